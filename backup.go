@@ -0,0 +1,709 @@
+package pinkis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// A backup is a stream of records, framed the same as records of write-ahead log with length and
+// checksum. Payload of a record starts with its type:
+//
+//	header   1, magic, version uvarint, engine uvarint, incremental byte, base uvarint, sequence uvarint
+//	entries  2, batch of entries put with raw values or deleted, in key order
+//	keys     3, count uvarint, [key length uvarint, key, hash uint64 little endian] * count
+//	trailer  4, entries uvarint, keys uvarint, checksum uint32 little endian
+//
+// Keys records are the manifest of backup, hashes of values of all keys at sequence of backup in
+// key order. An incremental backup is made by comparing database with manifest of its base.
+// Checksum of trailer is CRC32C of all records before trailer.
+const (
+	backupMagic   = "pinkis-backup"
+	backupVersion = 1
+	// Bytes of entries or keys in a record.
+	backupChunkSize = 64 << 10
+
+	backupRecordHeader  byte = 1
+	backupRecordEntries byte = 2
+	backupRecordKeys    byte = 3
+	backupRecordTrailer byte = 4
+)
+
+// BackupManifest describes a backup. It is returned by Backup, or read from a backup by
+// ValidateBackup, and is the base of the next incremental backup.
+type BackupManifest struct {
+	// Engine of database backed up.
+	Engine EngineType
+	// Whether backup has only changes after its base.
+	Incremental bool
+	// Sequence number of base of an incremental backup.
+	Base uint64
+	// Sequence number of database in backup, all batches <= it are in backup.
+	Sequence uint64
+	// Entries put or deleted in backup.
+	Entries int
+	// Keys of database at Sequence.
+	Keys int
+	// CRC32C of all records of backup before trailer.
+	Checksum uint32
+	// Hashes of values of all keys at Sequence, in key order.
+	hashes []backupKey
+}
+
+type backupKey struct {
+	key  []byte
+	hash uint64
+}
+
+// Hash of a raw value of kind, expiry is a part of it.
+func backupHash(kind entryKind, value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{byte(kind)})
+	h.Write(value)
+	return h.Sum64()
+}
+
+func encodeBackupHeader(m *BackupManifest) []byte {
+	buffer := make([]byte, 0, 1+len(backupMagic)+1+4*binary.MaxVarintLen64)
+	buffer = append(buffer, backupRecordHeader)
+	buffer = append(buffer, backupMagic...)
+	buffer = appendUvarint(buffer, backupVersion)
+	buffer = appendUvarint(buffer, uint64(m.Engine))
+	if m.Incremental {
+		buffer = append(buffer, 1)
+
+	} else {
+		buffer = append(buffer, 0)
+	}
+
+	buffer = appendUvarint(buffer, m.Base)
+	buffer = appendUvarint(buffer, m.Sequence)
+	return buffer
+}
+
+func decodeBackupHeader(payload []byte) (*BackupManifest, error) {
+	if len(payload) < 1+len(backupMagic) || payload[0] != backupRecordHeader ||
+		string(payload[1:1+len(backupMagic)]) != backupMagic {
+		return nil, WrapError(ErrCorrupted, "not a backup")
+	}
+
+	values := make([]uint64, 0, 4)
+	rest := payload[1+len(backupMagic):]
+	for i := 0; i < 5; i++ {
+		if i == 2 {
+			if len(rest) <= 0 || rest[0] > 1 {
+				return nil, WrapError(ErrCorrupted, "invalid header of backup")
+			}
+
+			values = append(values, uint64(rest[0]))
+			rest = rest[1:]
+			continue
+		}
+
+		value, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, WrapError(ErrCorrupted, "invalid header of backup")
+		}
+
+		values = append(values, value)
+		rest = rest[n:]
+	}
+
+	if values[0] != backupVersion {
+		return nil, WrapError(ErrCorrupted, "unsupported backup version %d", values[0])
+	}
+
+	m := &BackupManifest{
+		Engine:      EngineType(values[1]),
+		Incremental: values[2] == 1,
+		Base:        values[3],
+		Sequence:    values[4],
+	}
+
+	if m.Base > m.Sequence || (!m.Incremental && m.Base != 0) {
+		return nil, WrapError(ErrCorrupted, "invalid sequence numbers of backup, %d to %d", m.Base, m.Sequence)
+	}
+
+	return m, nil
+}
+
+// Write records of a backup, and checksum all records written.
+type backupWriter struct {
+	w        *bufio.Writer
+	checksum uint32
+	err      error
+}
+
+func (b *backupWriter) write(payload []byte) {
+	if b.err != nil {
+		return
+	}
+
+	record := encodeWALRecord(payload)
+	b.checksum = crc32.Update(b.checksum, crc32cTable, record)
+	_, b.err = b.w.Write(record)
+}
+
+// Write batch as an entries record and reset it.
+func (b *backupWriter) writeEntries(batch *writeBatch) {
+	if batch.Len() <= 0 {
+		return
+	}
+
+	b.write(append([]byte{backupRecordEntries}, batch.Encode()...))
+	batch.entries = batch.entries[:0]
+}
+
+func (b *backupWriter) writeKeys(keys []backupKey) {
+	for len(keys) > 0 {
+		buffer := []byte{backupRecordKeys}
+		n := 0
+		size := 0
+		for n < len(keys) && size < backupChunkSize {
+			size += len(keys[n].key) + 8
+			n++
+		}
+
+		buffer = appendUvarint(buffer, uint64(n))
+		for _, k := range keys[:n] {
+			buffer = appendLengthPrefixed(buffer, k.key)
+			var hash [8]byte
+			binary.LittleEndian.PutUint64(hash[:], k.hash)
+			buffer = append(buffer, hash[:]...)
+		}
+
+		b.write(buffer)
+		keys = keys[n:]
+	}
+}
+
+// Backup writes a full backup of a consistent snapshot of database into w, writes are not blocked
+// while it is written. Keys of all namespaces are backed up with their expiry, keys expired are
+// not. Manifest returned is the base of the next incremental backup.
+func (db *DB) Backup(w io.Writer) (*BackupManifest, error) {
+	return db.backup(w, nil)
+}
+
+// BackupSince writes an incremental backup into w, with keys put and deleted after sequence number
+// of base, found by comparing a consistent snapshot of database with manifest of base. Base is the
+// manifest of a backup of this database, returned by Backup or BackupSince, or read by
+// ValidateBackup.
+func (db *DB) BackupSince(w io.Writer, base *BackupManifest) (*BackupManifest, error) {
+	if base == nil {
+		return nil, WrapError(ErrInvalidOptions, "base of incremental backup required")
+	}
+
+	return db.backup(w, base)
+}
+
+func (db *DB) backup(w io.Writer, base *BackupManifest) (*BackupManifest, error) {
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+
+	snapshot, err := db.engine.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	defer snapshot.Release()
+
+	m := &BackupManifest{
+		Engine:   db.options.Engine,
+		Sequence: snapshot.Sequence(),
+	}
+
+	var previous []backupKey
+	if base != nil {
+		if base.Sequence > m.Sequence {
+			return nil, WrapError(ErrBackupMismatch, "base backup at %d is after database at %d",
+				base.Sequence, m.Sequence)
+		}
+
+		m.Incremental = true
+		m.Base = base.Sequence
+		previous = base.hashes
+	}
+
+	b := &backupWriter{w: bufio.NewWriter(w)}
+	b.write(encodeBackupHeader(m))
+	batch := &writeBatch{}
+	size := 0
+	add := func(e batchEntry) {
+		batch.entries = append(batch.entries, e)
+		m.Entries++
+		if size += len(e.key) + len(e.value); size >= backupChunkSize {
+			b.writeEntries(batch)
+			size = 0
+		}
+	}
+
+	iter := snapshot.Iterator()
+	expiring, _ := iter.(expiringIterator)
+	for iter.SeekToFirst(); iter.Valid() && b.err == nil; iter.Next() {
+		// Backup restored last is a mark of this database, not of databases restored from it.
+		if bytes.Equal(iter.Key(), restoredKey) {
+			continue
+		}
+
+		key := append([]byte{}, iter.Key()...)
+		e := batchEntry{kind: kindPut, key: key, value: append([]byte{}, iter.Value()...)}
+		if expiring != nil {
+			if expires := expiring.Expires(); expires != 0 {
+				e.kind = kindPutExpiring
+				e.value = expiringValue(e.value, expires)
+			}
+		}
+
+		for len(previous) > 0 && bytes.Compare(previous[0].key, key) < 0 {
+			add(batchEntry{kind: kindDelete, key: previous[0].key})
+			previous = previous[1:]
+		}
+
+		hash := backupHash(e.kind, e.value)
+		m.hashes = append(m.hashes, backupKey{key: key, hash: hash})
+		if len(previous) > 0 && bytes.Equal(previous[0].key, key) {
+			unchanged := previous[0].hash == hash
+			previous = previous[1:]
+			if unchanged {
+				continue
+			}
+		}
+
+		add(e)
+	}
+
+	errIter := iter.Close()
+	for _, k := range previous {
+		add(batchEntry{kind: kindDelete, key: k.key})
+	}
+
+	b.writeEntries(batch)
+	b.writeKeys(m.hashes)
+	m.Keys = len(m.hashes)
+	m.Checksum = b.checksum
+
+	trailer := []byte{backupRecordTrailer}
+	trailer = appendUvarint(trailer, uint64(m.Entries))
+	trailer = appendUvarint(trailer, uint64(m.Keys))
+	var checksum [4]byte
+	binary.LittleEndian.PutUint32(checksum[:], m.Checksum)
+	b.write(append(trailer, checksum[:]...))
+
+	if errIter != nil {
+		return nil, errIter
+	}
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if err := b.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Read records of a backup, and checksum all records read.
+type backupReader struct {
+	r        *bufio.Reader
+	records  int
+	checksum uint32
+}
+
+// Read payload of the next record, io.EOF if backup ends before it.
+func (b *backupReader) next() ([]byte, error) {
+	var header [walRecordHeaderSize]byte
+	if _, err := io.ReadFull(b.r, header[:]); err == io.EOF {
+		return nil, io.EOF
+
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, WrapError(ErrCorrupted, "backup truncated in record %d", b.records)
+
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Payload is read without allocating its length up front, which may be corrupted.
+	length := int64(binary.LittleEndian.Uint32(header[4:]))
+	var payload bytes.Buffer
+	if n, err := io.CopyN(&payload, b.r, length); n < length {
+		if err == io.EOF {
+			return nil, WrapError(ErrCorrupted, "backup truncated in record %d", b.records)
+		}
+
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(header[:]) != walChecksum(header[:], payload.Bytes()) || length <= 0 {
+		return nil, WrapError(ErrCorrupted, "checksum mismatch of record %d of backup", b.records)
+	}
+
+	b.records++
+	b.checksum = crc32.Update(b.checksum, crc32cTable, header[:])
+	b.checksum = crc32.Update(b.checksum, crc32cTable, payload.Bytes())
+	return payload.Bytes(), nil
+}
+
+// Read and validate a backup, apply batches of entries if apply is not nil. Backup is validated as
+// a whole only when it is read to the end, apply must be nil if backup is not validated yet.
+func readBackup(r io.Reader, apply func(batch *writeBatch) error) (*BackupManifest, error) {
+	b := &backupReader{r: bufio.NewReader(r)}
+	payload, err := b.next()
+	if err == io.EOF {
+		return nil, WrapError(ErrCorrupted, "empty backup")
+
+	} else if err != nil {
+		return nil, err
+	}
+
+	m, err := decodeBackupHeader(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys written in entries, with hashes of their values, or deleted.
+	var changes []backupKey
+	var deleted []bool
+	for {
+		checksum := b.checksum
+		payload, err := b.next()
+		if err == io.EOF {
+			return nil, WrapError(ErrCorrupted, "backup truncated, trailer not found")
+
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch payload[0] {
+		case backupRecordEntries:
+			if len(m.hashes) > 0 {
+				return nil, WrapError(ErrCorrupted, "entries after keys in record %d of backup", b.records)
+			}
+
+			batch, err := decodeBatch(payload[1:])
+			if err != nil {
+				return nil, err
+			}
+
+			for _, e := range batch.entries {
+				if e.kind == kindDeleteRange || e.kind == kindMerge {
+					return nil, WrapError(ErrCorrupted, "%s entry in record %d of backup", e.kind, b.records)
+				}
+
+				n := len(changes)
+				if n > 0 && bytes.Compare(changes[n-1].key, e.key) >= 0 {
+					return nil, WrapError(ErrCorrupted, "entries out of order in record %d of backup", b.records)
+				}
+
+				changes = append(changes, backupKey{key: e.key, hash: backupHash(e.kind, e.value)})
+				deleted = append(deleted, e.kind == kindDelete)
+			}
+
+			if apply != nil {
+				if err := apply(batch); err != nil {
+					return nil, err
+				}
+			}
+
+		case backupRecordKeys:
+			if err := decodeBackupKeys(m, payload[1:]); err != nil {
+				return nil, WrapError(err, "record %d of backup", b.records)
+			}
+
+		case backupRecordTrailer:
+			if err := checkBackupTrailer(m, payload[1:], len(changes), checksum); err != nil {
+				return nil, err
+			}
+
+			if _, err := b.r.ReadByte(); err != io.EOF {
+				return nil, WrapError(ErrCorrupted, "data after trailer of backup")
+			}
+
+			return m, checkBackupChanges(m, changes, deleted)
+
+		default:
+			return nil, WrapError(ErrCorrupted, "invalid type %d of record %d of backup", payload[0], b.records)
+		}
+	}
+}
+
+func decodeBackupKeys(m *BackupManifest, data []byte) error {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return WrapError(ErrCorrupted, "invalid count of keys")
+	}
+
+	rest := data[n:]
+	for i := uint64(0); i < count; i++ {
+		key, next, ok := readLengthPrefixed(rest)
+		if !ok || len(next) < 8 {
+			return WrapError(ErrCorrupted, "invalid key %d", i)
+		}
+
+		if n := len(m.hashes); n > 0 && bytes.Compare(m.hashes[n-1].key, key) >= 0 {
+			return WrapError(ErrCorrupted, "keys out of order")
+		}
+
+		m.hashes = append(m.hashes, backupKey{key: key, hash: binary.LittleEndian.Uint64(next)})
+		rest = next[8:]
+	}
+
+	if len(rest) > 0 {
+		return WrapError(ErrCorrupted, "%d bytes after keys", len(rest))
+	}
+
+	return nil
+}
+
+func checkBackupTrailer(m *BackupManifest, data []byte, entries int, checksum uint32) error {
+	values := make([]uint64, 0, 2)
+	for i := 0; i < 2; i++ {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			return WrapError(ErrCorrupted, "invalid trailer of backup")
+		}
+
+		values = append(values, value)
+		data = data[n:]
+	}
+
+	if len(data) != 4 {
+		return WrapError(ErrCorrupted, "invalid trailer of backup")
+	}
+
+	m.Entries = int(values[0])
+	m.Keys = int(values[1])
+	m.Checksum = binary.LittleEndian.Uint32(data)
+	switch {
+	case m.Checksum != checksum:
+		return WrapError(ErrCorrupted, "checksum mismatch of backup, %08x in trailer, but %08x", m.Checksum, checksum)
+
+	case m.Entries != entries || m.Keys != len(m.hashes):
+		return WrapError(ErrCorrupted, "backup has %d entries and %d keys, but %d and %d in trailer",
+			entries, len(m.hashes), m.Entries, m.Keys)
+
+	default:
+		return nil
+	}
+}
+
+// Check entries of backup against its manifest. Values put must match their hashes, and keys deleted
+// must not be in manifest. A full backup has all keys in manifest.
+func checkBackupChanges(m *BackupManifest, changes []backupKey, deleted []bool) error {
+	if !m.Incremental && len(changes) != len(m.hashes) {
+		return WrapError(ErrCorrupted, "%d entries in full backup of %d keys", len(changes), len(m.hashes))
+	}
+
+	// Every key put is written by a distinct sequence number after base, but keys deleted may be
+	// removed together by a range deletion, or by expiry without sequence numbers.
+	puts := uint64(0)
+	for _, d := range deleted {
+		if !d {
+			puts++
+		}
+	}
+
+	if puts > m.Sequence-m.Base {
+		return WrapError(ErrCorrupted, "%d keys put in backup from %d to %d", puts, m.Base, m.Sequence)
+	}
+
+	hashes := m.hashes
+	for i, change := range changes {
+		for len(hashes) > 0 && bytes.Compare(hashes[0].key, change.key) < 0 {
+			hashes = hashes[1:]
+		}
+
+		found := len(hashes) > 0 && bytes.Equal(hashes[0].key, change.key)
+		if deleted[i] == found || (found && hashes[0].hash != change.hash) {
+			return WrapError(ErrCorrupted, "entry %d of backup mismatches manifest", i)
+		}
+	}
+
+	return nil
+}
+
+// ValidateBackup reads a backup from r to the end, and validates checksums of all records, and all
+// entries against manifest, without restoring it. A broken backup is reported as an error wraps
+// ErrCorrupted.
+func ValidateBackup(r io.Reader) (*BackupManifest, error) {
+	return readBackup(r, nil)
+}
+
+// Restore restores a backup from r into database in dir, of the same engine as database backed
+// up. See RestoreWithOptions.
+func Restore(r io.Reader, dir string) error {
+	return restore(r, Options{Dir: dir}, true)
+}
+
+// RestoreWithOptions restores a backup from r into database of options. A full backup is restored
+// into a new database, options.Dir must not exist or be empty. An incremental backup is restored
+// into the database restored up to its base, which must not be written since then, or an error
+// wraps ErrBackupMismatch is returned. Backup is spooled into a temporary file and validated as a
+// whole before anything is written.
+func RestoreWithOptions(r io.Reader, options Options) error {
+	return restore(r, options, false)
+}
+
+func restore(r io.Reader, options Options, sameEngine bool) error {
+	if len(options.Dir) <= 0 {
+		return WrapError(ErrInvalidOptions, "directory of database required")
+	}
+
+	spool, err := os.CreateTemp("", "pinkis-restore-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	m, err := readBackup(io.TeeReader(r, spool), nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(options.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if !m.Incremental && len(entries) > 0 {
+		return WrapError(ErrInvalidOptions, "full backup is restored into an empty directory, but %s is not",
+			options.Dir)
+
+	} else if m.Incremental && len(entries) <= 0 {
+		return WrapError(ErrBackupMismatch, "no database in %s to restore incremental backup", options.Dir)
+	}
+
+	if sameEngine {
+		options.Engine = m.Engine
+	}
+
+	// Nothing but restore writes database.
+	options.ReapPeriod = -1
+	db, err := Open(options)
+	if err != nil {
+		return err
+	}
+
+	err = db.restore(spool, m)
+	if errClose := db.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// Meta key of sequence number of the last backup restored, and sequence number of database after
+// restoring it. It is written only if database is ahead of backup, since entries of a backup may
+// outnumber its sequence numbers, when many keys are removed by a range deletion or expiry. Like
+// other meta keys, it is neither iterated nor logged as a change, and it is left out of backups
+// and salvage, as it is a mark of this database only.
+var restoredKey = []byte("\x00restored")
+
+// Sequence number of backup database is restored up to, it is the sequence number of database
+// unless database is ahead of the last backup restored, and not written since then.
+func (db *DB) restoredSequence() (uint64, error) {
+	sequence := db.Sequence()
+	data, err := db.get(restoredKey)
+	if errors.Is(err, ErrNotFound) {
+		return sequence, nil
+
+	} else if err != nil {
+		return 0, err
+	}
+
+	restored, n := binary.Uvarint(data)
+	at, m := binary.Uvarint(data[n:])
+	if n <= 0 || m <= 0 || n+m != len(data) {
+		return 0, WrapError(ErrCorrupted, "invalid sequence number of backup restored")
+	}
+
+	if at != sequence {
+		return sequence, nil
+	}
+
+	return restored, nil
+}
+
+// Apply entries of backup of m read from r. Entries are written at the last sequence numbers up to
+// backup, so that sequence number of database is the same as backup after that. If there are not
+// enough sequence numbers, entries are written after database, and sequence number of backup is
+// recorded.
+func (db *DB) restore(r io.Reader, m *BackupManifest) error {
+	sequence, err := db.restoredSequence()
+	if err != nil {
+		return err
+	}
+
+	if sequence != m.Base {
+		return WrapError(ErrBackupMismatch, "backup follows database at %d, but database is at %d",
+			m.Base, sequence)
+	}
+
+	seq := db.Sequence() + 1
+	if last := db.Sequence() + uint64(m.Entries); last < m.Sequence {
+		seq = m.Sequence - uint64(m.Entries) + 1
+	}
+
+	apply := func(batch *writeBatch) error {
+		batch.seq = seq
+		seq += uint64(batch.Len())
+		return db.applyAt(batch)
+	}
+
+	if _, err := readBackup(r, apply); err != nil {
+		return err
+	}
+
+	if sequence := db.Sequence(); sequence > m.Sequence {
+		batch := &writeBatch{seq: sequence + 1}
+		batch.Put(restoredKey, appendUvarint(appendUvarint(nil, m.Sequence), batch.seq))
+		return db.applyAt(batch)
+
+	} else if sequence < m.Sequence {
+		return db.applyAt(&writeBatch{seq: m.Sequence})
+	}
+
+	return nil
+}
+
+// Apply batch whose sequence number is assigned by caller, it must be after the last batch.
+func (db *DB) applyAt(batch *writeBatch) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if batch.seq <= db.sequence {
+		return WrapError(ErrBackupMismatch, "batch at %d is not after database at %d", batch.seq, db.sequence)
+	}
+
+	if err := db.apply(batch); err != nil {
+		// Records of batch may be applied partly.
+		db.buckets = nil
+		return err
+	}
+
+	db.updateBucketIndex(batch)
+	db.sequence = batch.LastSequence()
+	db.conflicts.record(batch)
+	return nil
+}
@@ -0,0 +1,555 @@
+package pinkis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func newBackupStudent(i int, year int) testStudent {
+	houses := []string{"Gryffindor", "Hufflepuff", "Ravenclaw", "Slytherin"}
+	student := testStudent{
+		Name:  fmt.Sprintf("student-%03d", i),
+		Email: fmt.Sprintf("student-%03d@hogwarts.edu", i),
+		House: houses[i%4],
+		Year:  year,
+	}
+
+	return student
+}
+
+// Compare all students of restored database in options with expected, by meta.Equal.
+func checkRestored(t *testing.T, options Options, expected map[string]testStudent, sequence uint64) {
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open restored database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if db.Sequence() != sequence {
+		t.Errorf("unexpected sequence of restored database: %d, expected %d", db.Sequence(), sequence)
+	}
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	for i := 0; i < 120; i++ {
+		name := fmt.Sprintf("student-%03d", i)
+		var student testStudent
+		err := students.Get([]byte(name), &student)
+		if original, found := expected[name]; found {
+			if err != nil || !meta.Equal(student, original) {
+				t.Errorf("unexpected %s: %+v, %v", name, student, err)
+			}
+
+		} else if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s should be deleted: %+v, %v", name, student, err)
+		}
+	}
+
+	if keys := indexedKeys(t, db, students, "house_year"); len(keys) != len(expected) {
+		t.Errorf("unexpected keys in index: %d, expected %d", len(keys), len(expected))
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			options := Options{
+				Dir:          t.TempDir(),
+				Engine:       engine,
+				SyncPolicy:   SyncNever,
+				MemtableSize: 4 << 10,
+				PageSize:     512,
+			}
+
+			db, err := Open(options)
+			if err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			defer db.Close()
+
+			students, err := db.Collection("students", testStudent{})
+			if err != nil {
+				t.Fatalf("get collection failed: %v", err)
+			}
+
+			expected := make(map[string]testStudent)
+			for i := 0; i < 100; i++ {
+				student := newBackupStudent(i, 1991+i%7)
+				if err := students.Put([]byte(student.Name), student); err != nil {
+					t.Fatalf("put failed: %v", err)
+				}
+
+				expected[student.Name] = student
+			}
+
+			var full bytes.Buffer
+			base, err := db.Backup(&full)
+			if err != nil || base.Incremental || base.Sequence != db.Sequence() || base.Keys <= 100 {
+				t.Fatalf("unexpected backup: %+v, %v", base, err)
+			}
+
+			restored := Options{Dir: filepath.Join(t.TempDir(), "restored"), Engine: engine}
+			if err := Restore(bytes.NewReader(full.Bytes()), restored.Dir); err != nil {
+				t.Fatalf("restore failed: %v", err)
+			}
+
+			checkRestored(t, restored, expected, base.Sequence)
+
+			// Restored database is identical to backup, nothing changes since it.
+			restoredDB, err := Open(restored)
+			if err != nil {
+				t.Fatalf("open restored database failed: %v", err)
+			}
+
+			var empty bytes.Buffer
+			m, err := restoredDB.BackupSince(&empty, base)
+			if restoredDB.Close(); err != nil || m.Entries != 0 || m.Keys != base.Keys {
+				t.Errorf("unexpected backup of restored database: %+v, %v", m, err)
+			}
+
+			for i := 0; i < 10; i++ {
+				student := newBackupStudent(i, 1998)
+				if err := students.Put([]byte(student.Name), student); err != nil {
+					t.Fatalf("put failed: %v", err)
+				}
+
+				expected[student.Name] = student
+				name := fmt.Sprintf("student-%03d", 50+i)
+				if err := students.Delete([]byte(name)); err != nil {
+					t.Fatalf("delete failed: %v", err)
+				}
+
+				delete(expected, name)
+				student = newBackupStudent(100+i, 1991)
+				if err := students.Put([]byte(student.Name), student); err != nil {
+					t.Fatalf("put failed: %v", err)
+				}
+
+				expected[student.Name] = student
+			}
+
+			var incremental bytes.Buffer
+			next, err := db.BackupSince(&incremental, base)
+			if err != nil || !next.Incremental || next.Base != base.Sequence || next.Entries <= 30 ||
+				next.Entries >= base.Entries {
+				t.Fatalf("unexpected incremental backup: %+v, %v", next, err)
+			}
+
+			validated, err := ValidateBackup(bytes.NewReader(incremental.Bytes()))
+			if err != nil || validated.Sequence != next.Sequence || validated.Checksum != next.Checksum ||
+				validated.Keys != next.Keys {
+				t.Errorf("unexpected manifest: %+v, %v", validated, err)
+			}
+
+			if err := Restore(bytes.NewReader(incremental.Bytes()), restored.Dir); err != nil {
+				t.Fatalf("restore incremental backup failed: %v", err)
+			}
+
+			checkRestored(t, restored, expected, next.Sequence)
+
+			// Backups are restored in order of sequence numbers.
+			err = Restore(bytes.NewReader(incremental.Bytes()), restored.Dir)
+			if !errors.Is(err, ErrBackupMismatch) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			err = Restore(bytes.NewReader(incremental.Bytes()), t.TempDir())
+			if !errors.Is(err, ErrBackupMismatch) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			err = Restore(bytes.NewReader(full.Bytes()), restored.Dir)
+			if !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			// The next incremental backup is based on a manifest validated.
+			var last bytes.Buffer
+			if m, err = db.BackupSince(&last, validated); err != nil || m.Entries != 0 {
+				t.Fatalf("unexpected incremental backup: %+v, %v", m, err)
+			}
+
+			if err := Restore(&last, restored.Dir); err != nil {
+				t.Fatalf("restore incremental backup failed: %v", err)
+			}
+
+			checkRestored(t, restored, expected, m.Sequence)
+		})
+	}
+}
+
+func TestBackupWhileWriting(t *testing.T) {
+	db, err := Open(Options{Dir: t.TempDir(), Engine: EngineLSM, SyncPolicy: SyncNever, MemtableSize: 4 << 10})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	houses := []string{"gryffindor", "slytherin"}
+	for _, house := range houses {
+		if err := db.Put([]byte(house), []byte("500")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	// Points are moved between houses in transactions, the sum never changes.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+
+			default:
+			}
+
+			err := db.Update(func(tx *Tx) error {
+				from, to := []byte(houses[i%2]), []byte(houses[1-i%2])
+				a, _ := tx.Get(from)
+				b, _ := tx.Get(to)
+				x, _ := strconv.Atoi(string(a))
+				y, _ := strconv.Atoi(string(b))
+				if err := tx.Put(from, []byte(strconv.Itoa(x-10))); err != nil {
+					return err
+				}
+
+				return tx.Put(to, []byte(strconv.Itoa(y+10)))
+			})
+
+			if err != nil {
+				t.Errorf("update failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		var buffer bytes.Buffer
+		if _, err := db.Backup(&buffer); err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+
+		dir := t.TempDir()
+		if err := Restore(&buffer, dir); err != nil {
+			t.Fatalf("restore failed: %v", err)
+		}
+
+		restored, err := Open(Options{Dir: dir, Engine: EngineLSM})
+		if err != nil {
+			t.Fatalf("open restored database failed: %v", err)
+		}
+
+		sum := 0
+		for _, house := range houses {
+			value, err := restored.Get([]byte(house))
+			points, _ := strconv.Atoi(string(value))
+			if err != nil {
+				t.Errorf("get failed: %v", err)
+			}
+
+			sum += points
+		}
+
+		if restored.Close(); sum != 1000 {
+			t.Errorf("backup is not consistent, sum of points %d", sum)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestBackupTTL(t *testing.T) {
+	clock := newTestClock()
+	db, _ := openTestTTL(t, EngineLSM, clock)
+	defer db.Close()
+
+	if err := db.PutWithTTL([]byte("portkey"), []byte("boot"), time.Hour); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.PutWithTTL([]byte("polyjuice"), []byte("potion"), time.Minute); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.Put([]byte("cloak"), []byte("invisibility")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	// Expired keys are not backed up.
+	clock.Advance(2 * time.Minute)
+	var buffer bytes.Buffer
+	if _, err := db.Backup(&buffer); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	// A backup may be restored into another engine.
+	options := Options{Dir: t.TempDir(), Engine: EngineBTree, Clock: clock, ReapPeriod: -1}
+	if err := RestoreWithOptions(&buffer, options); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+
+	restored, err := Open(options)
+	if err != nil {
+		t.Fatalf("open restored database failed: %v", err)
+	}
+
+	defer restored.Close()
+
+	if keys := scanKeys(t, restored, false); len(keys) != 2 || keys[0] != "cloak=invisibility" || keys[1] != "portkey=boot" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	if countExpiryEntries(t, restored) != 2 {
+		t.Errorf("expiry entries should be restored")
+	}
+
+	clock.Advance(time.Hour)
+	if _, err := restored.Get([]byte("portkey")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("portkey should expire: %v", err)
+	}
+
+	if value, err := restored.Get([]byte("cloak")); err != nil || string(value) != "invisibility" {
+		t.Errorf("unexpected value: %q, %v", value, err)
+	}
+}
+
+// Back up keys removed all at once by remove, which take fewer sequence numbers than keys, then
+// restore all backups in order.
+func testBackupRemoved(t *testing.T, engine EngineType, remove func(db *DB, clock *testClock) error) {
+	clock := newTestClock()
+	db, _ := openTestTTL(t, engine, clock)
+	defer db.Close()
+
+	names := []string{"bill", "charlie", "percy", "fred", "george", "ron", "ginny"}
+	for _, name := range names {
+		if err := db.PutWithTTL([]byte(name), []byte("weasley"), time.Hour); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	var full, removed, last bytes.Buffer
+	base, err := db.Backup(&full)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	if err := remove(db, clock); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+
+	m, err := db.BackupSince(&removed, base)
+	if err != nil || m.Entries != len(names) || m.Sequence-m.Base >= uint64(len(names)) {
+		t.Fatalf("unexpected backup: %+v, %v", m, err)
+	}
+
+	if _, err := ValidateBackup(bytes.NewReader(removed.Bytes())); err != nil {
+		t.Errorf("validate backup failed: %v", err)
+	}
+
+	if err := db.Put([]byte("ron"), []byte("prefect")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	next, err := db.BackupSince(&last, m)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	options := Options{Dir: filepath.Join(t.TempDir(), "restored"), Engine: engine, Clock: clock}
+	for i, backup := range []*bytes.Buffer{&full, &removed, &last} {
+		if err := RestoreWithOptions(bytes.NewReader(backup.Bytes()), options); err != nil {
+			t.Fatalf("restore backup %d failed: %v", i, err)
+		}
+	}
+
+	// The database is ahead of backups restored, and still follows the last one.
+	err = RestoreWithOptions(bytes.NewReader(last.Bytes()), options)
+	if !errors.Is(err, ErrBackupMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	options.ReapPeriod = -1
+	restored, err := Open(options)
+	if err != nil {
+		t.Fatalf("open restored database failed: %v", err)
+	}
+
+	defer restored.Close()
+
+	if sequence, err := restored.restoredSequence(); sequence != next.Sequence || err != nil {
+		t.Errorf("unexpected sequence of restored database: %d, %v", sequence, err)
+	}
+
+	if keys := scanKeys(t, restored, false); len(keys) != 1 || keys[0] != "ron=prefect" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	// Backup restored last is not carried to databases restored from backups of this one.
+	var copied bytes.Buffer
+	m, err = restored.Backup(&copied)
+	if err != nil {
+		t.Fatalf("backup restored database failed: %v", err)
+	}
+
+	for _, k := range m.hashes {
+		if bytes.Equal(k.key, restoredKey) {
+			t.Errorf("backup restored should not be backed up")
+		}
+	}
+
+	copyOptions := Options{Dir: filepath.Join(t.TempDir(), "copied"), Engine: engine, Clock: clock}
+	if err := RestoreWithOptions(bytes.NewReader(copied.Bytes()), copyOptions); err != nil {
+		t.Fatalf("restore copied backup failed: %v", err)
+	}
+
+	copyOptions.ReapPeriod = -1
+	copy, err := Open(copyOptions)
+	if err != nil {
+		t.Fatalf("open copied database failed: %v", err)
+	}
+
+	defer copy.Close()
+
+	if sequence, err := copy.restoredSequence(); sequence != m.Sequence || err != nil {
+		t.Errorf("unexpected sequence of copied database: %d, %v", sequence, err)
+	}
+}
+
+func TestBackupRemoved(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			t.Run("DeleteRange", func(t *testing.T) {
+				testBackupRemoved(t, engine, func(db *DB, clock *testClock) error {
+					return db.DeleteRange(nil, nil)
+				})
+			})
+
+			t.Run("Expiry", func(t *testing.T) {
+				testBackupRemoved(t, engine, func(db *DB, clock *testClock) error {
+					clock.Advance(2 * time.Hour)
+					return nil
+				})
+			})
+		})
+	}
+}
+
+func TestValidateBackup(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("wizard-%04d", i))
+		if err := db.Put(key, bytes.Repeat([]byte("Ravenclaw "), 10)); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	var buffer bytes.Buffer
+	m, err := db.Backup(&buffer)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	validated, err := ValidateBackup(bytes.NewReader(buffer.Bytes()))
+	if err != nil || validated.Entries != m.Entries || validated.Keys != 1000 || validated.Checksum != m.Checksum {
+		t.Fatalf("unexpected manifest: %+v, %v", validated, err)
+	}
+
+	data := buffer.Bytes()
+	broken := map[string][]byte{
+		"empty":     {},
+		"truncated": data[:len(data)-3],
+		"appended":  append(append([]byte{}, data...), 0),
+		"flipped":   append([]byte{}, data...),
+		"trailer":   data[:bytes.LastIndex(data, []byte("wizard-0999"))],
+	}
+
+	broken["flipped"][len(data)/2] ^= 0xff
+	for name, data := range broken {
+		if _, err := ValidateBackup(bytes.NewReader(data)); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("unexpected error of %s backup: %v", name, err)
+		}
+
+		// Nothing is restored from a broken backup.
+		dir := filepath.Join(t.TempDir(), "restored")
+		if err := Restore(bytes.NewReader(data), dir); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("unexpected error of restoring %s backup: %v", name, err)
+		}
+
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("database should not be restored from %s backup: %v", name, err)
+		}
+	}
+}
+
+// Write a backup of m, with keys put.
+func writeTestBackup(m *BackupManifest, keys []string) []byte {
+	var buffer bytes.Buffer
+	b := &backupWriter{w: bufio.NewWriter(&buffer)}
+	b.write(encodeBackupHeader(m))
+	batch := &writeBatch{}
+	value := []byte("gryffindor")
+	for _, key := range keys {
+		batch.Put([]byte(key), value)
+		m.hashes = append(m.hashes, backupKey{key: []byte(key), hash: backupHash(kindPut, value)})
+	}
+
+	b.writeEntries(batch)
+	b.writeKeys(m.hashes)
+	trailer := []byte{backupRecordTrailer}
+	trailer = appendUvarint(trailer, uint64(len(keys)))
+	trailer = appendUvarint(trailer, uint64(len(keys)))
+	var checksum [4]byte
+	binary.LittleEndian.PutUint32(checksum[:], b.checksum)
+	b.write(append(trailer, checksum[:]...))
+	_ = b.w.Flush()
+	return buffer.Bytes()
+}
+
+// Entries of a backup may outnumber its sequence numbers only by keys deleted.
+func TestBackupPutsOutOfRange(t *testing.T) {
+	keys := []string{"dean", "neville", "seamus"}
+	for _, c := range []struct {
+		sequence uint64
+		valid    bool
+	}{{3, true}, {2, false}} {
+		data := writeTestBackup(&BackupManifest{Engine: EngineLSM, Sequence: c.sequence}, keys)
+		_, err := ValidateBackup(bytes.NewReader(data))
+		if c.valid && err != nil {
+			t.Errorf("validate backup to %d failed: %v", c.sequence, err)
+
+		} else if !c.valid && !errors.Is(err, ErrCorrupted) {
+			t.Errorf("unexpected error of backup to %d: %v", c.sequence, err)
+		}
+
+		if !c.valid {
+			dir := filepath.Join(t.TempDir(), "restored")
+			if err := Restore(bytes.NewReader(data), dir); !errors.Is(err, ErrCorrupted) {
+				t.Errorf("unexpected error of restoring backup to %d: %v", c.sequence, err)
+			}
+		}
+	}
+}
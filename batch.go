@@ -0,0 +1,199 @@
+package pinkis
+
+import "encoding/binary"
+
+type entryKind byte
+
+const (
+	kindDelete entryKind = 0
+	kindPut    entryKind = 1
+	// A put expires at a time, value is prefixed by expiry, see expiringValue.
+	kindPutExpiring entryKind = 2
+	// Keys in [key, value) are deleted, see rangeTombstone.
+	kindDeleteRange entryKind = 3
+	// An operand folded onto older versions of key, value is prefixed by name of operator, see
+	// mergeOperand.
+	kindMerge entryKind = 4
+)
+
+func (k entryKind) String() string {
+	switch k {
+	case kindDelete:
+		return "delete"
+
+	case kindPut:
+		return "put"
+
+	case kindPutExpiring:
+		return "put-expiring"
+
+	case kindDeleteRange:
+		return "delete-range"
+
+	case kindMerge:
+		return "merge"
+
+	default:
+		return "unknown"
+	}
+}
+
+type batchEntry struct {
+	kind  entryKind
+	key   []byte
+	value []byte
+	// Typed value encoded in value, it is kept in memory only and never logged.
+	object interface{}
+}
+
+// A group of mutations applied atomically. The i-th entry is assigned sequence number seq + i.
+type writeBatch struct {
+	seq     uint64
+	entries []batchEntry
+}
+
+const batchHeaderSize = 8
+
+func (b *writeBatch) Put(key []byte, value []byte) {
+	b.entries = append(b.entries, batchEntry{kind: kindPut, key: key, value: value})
+}
+
+// Put an encoded typed value, object is decoded from value by Collection.encode and never mutated.
+func (b *writeBatch) PutObject(key []byte, value []byte, object interface{}) {
+	b.entries = append(b.entries, batchEntry{kind: kindPut, key: key, value: value, object: object})
+}
+
+// Put a value expires at unix nanoseconds expires, object is nil for raw values.
+func (b *writeBatch) PutExpiring(key []byte, value []byte, object interface{}, expires int64) {
+	b.entries = append(b.entries, batchEntry{
+		kind:   kindPutExpiring,
+		key:    key,
+		value:  expiringValue(value, expires),
+		object: object,
+	})
+}
+
+func (b *writeBatch) Delete(key []byte) {
+	b.entries = append(b.entries, batchEntry{kind: kindDelete, key: key})
+}
+
+// Delete all keys in [start, end), end must be greater than start.
+func (b *writeBatch) DeleteRange(start []byte, end []byte) {
+	b.entries = append(b.entries, batchEntry{kind: kindDeleteRange, key: start, value: end})
+}
+
+// Merge an operand prefixed by name of operator into key.
+func (b *writeBatch) Merge(key []byte, operand []byte) {
+	b.entries = append(b.entries, batchEntry{kind: kindMerge, key: key, value: operand})
+}
+
+// Number of entries in batch.
+func (b *writeBatch) Len() int {
+	return len(b.entries)
+}
+
+// Last sequence number used by batch.
+func (b *writeBatch) LastSequence() uint64 {
+	if len(b.entries) <= 0 {
+		return b.seq
+	}
+
+	return b.seq + uint64(len(b.entries)) - 1
+}
+
+// Encode batch as:
+//
+//	seq     uint64, little endian
+//	count   uvarint
+//	entries [kind byte, key length uvarint, key, value length uvarint, value] * count
+//
+// value length and value are omitted in deletion, value is the end of range in range deletion.
+func (b *writeBatch) Encode() []byte {
+	size := batchHeaderSize + binary.MaxVarintLen64
+	for _, e := range b.entries {
+		size += 1 + 2*binary.MaxVarintLen64 + len(e.key) + len(e.value)
+	}
+
+	buffer := make([]byte, size)
+	binary.LittleEndian.PutUint64(buffer, b.seq)
+	n := batchHeaderSize
+	n += binary.PutUvarint(buffer[n:], uint64(len(b.entries)))
+	for _, e := range b.entries {
+		buffer[n] = byte(e.kind)
+		n++
+		n += binary.PutUvarint(buffer[n:], uint64(len(e.key)))
+		n += copy(buffer[n:], e.key)
+		if e.kind != kindDelete {
+			n += binary.PutUvarint(buffer[n:], uint64(len(e.value)))
+			n += copy(buffer[n:], e.value)
+		}
+	}
+
+	return buffer[:n]
+}
+
+func readLengthPrefixed(data []byte) ([]byte, []byte, bool) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return nil, nil, false
+	}
+
+	end := n + int(length)
+	return data[n:end:end], data[end:], true
+}
+
+// Decode batch encoded by writeBatch.Encode, keys and values refer to data.
+func decodeBatch(data []byte) (*writeBatch, error) {
+	if len(data) < batchHeaderSize {
+		return nil, WrapError(ErrCorrupted, "batch too short, %d bytes", len(data))
+	}
+
+	b := &writeBatch{
+		seq: binary.LittleEndian.Uint64(data),
+	}
+
+	rest := data[batchHeaderSize:]
+	count, n := binary.Uvarint(rest)
+	if n <= 0 || count > uint64(len(rest)) {
+		return nil, WrapError(ErrCorrupted, "invalid batch entry count")
+	}
+
+	rest = rest[n:]
+	b.entries = make([]batchEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(rest) <= 0 {
+			return nil, WrapError(ErrCorrupted, "batch entry %d missing", i)
+		}
+
+		var ok bool
+		e := batchEntry{
+			kind: entryKind(rest[0]),
+		}
+
+		e.key, rest, ok = readLengthPrefixed(rest[1:])
+		if !ok {
+			return nil, WrapError(ErrCorrupted, "invalid key of batch entry %d", i)
+		}
+
+		switch e.kind {
+		case kindDelete:
+
+		case kindPut, kindPutExpiring, kindDeleteRange, kindMerge:
+			e.value, rest, ok = readLengthPrefixed(rest)
+			if !ok {
+				return nil, WrapError(ErrCorrupted, "invalid value of batch entry %d", i)
+			}
+
+		default:
+			return nil, WrapError(ErrCorrupted, "invalid kind %d of batch entry %d", e.kind, i)
+		}
+
+		b.entries = append(b.entries, e)
+	}
+
+	if len(rest) > 0 {
+		return nil, WrapError(ErrCorrupted, "%d trailing bytes after batch", len(rest))
+	}
+
+	return b, nil
+}
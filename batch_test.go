@@ -0,0 +1,70 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBatchEncodeAndDecode(t *testing.T) {
+	batch := &writeBatch{seq: 42}
+	batch.Put([]byte("hermione"), []byte("granger"))
+	batch.Delete([]byte("voldemort"))
+	batch.Put([]byte("empty"), []byte{})
+
+	if batch.Len() != 3 || batch.LastSequence() != 44 {
+		t.Errorf("unexpected batch: len=%d, last=%d", batch.Len(), batch.LastSequence())
+	}
+
+	got, err := decodeBatch(batch.Encode())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got.seq != batch.seq || got.Len() != batch.Len() {
+		t.Fatalf("unexpected batch: %+v", got)
+	}
+
+	for i, e := range got.entries {
+		expected := batch.entries[i]
+		if e.kind != expected.kind || !bytes.Equal(e.key, expected.key) ||
+			!bytes.Equal(e.value, expected.value) {
+			t.Errorf("entries[%d] = %+v <=> %+v", i, e, expected)
+		}
+	}
+}
+
+func TestEmptyBatch(t *testing.T) {
+	batch := &writeBatch{seq: 7}
+	if batch.LastSequence() != 7 {
+		t.Errorf("unexpected last sequence: %d", batch.LastSequence())
+	}
+
+	got, err := decodeBatch(batch.Encode())
+	if err != nil || got.Len() != 0 || got.seq != 7 {
+		t.Errorf("unexpected result: %+v, %v", got, err)
+	}
+}
+
+func TestDecodeCorruptedBatch(t *testing.T) {
+	batch := &writeBatch{seq: 1}
+	batch.Put([]byte("neville"), []byte("longbottom"))
+	data := batch.Encode()
+
+	for i := 0; i < len(data); i++ {
+		if _, err := decodeBatch(data[:i]); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("decode data[:%d] got error %v", i, err)
+		}
+	}
+
+	invalidKind := append([]byte{}, data...)
+	invalidKind[batchHeaderSize+1] = 0x7f
+	if _, err := decodeBatch(invalidKind); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	trailing := append(append([]byte{}, data...), 0)
+	if _, err := decodeBatch(trailing); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const blockRestartInterval = 16
+
+// Build a block of sorted entries. Keys are prefix compressed against the previous key, and a
+// restart point storing a full key is made every blockRestartInterval entries:
+//
+//	entries  [shared uvarint, unshared uvarint, value length uvarint, key delta, value] * n
+//	restarts [offset uint32] * count, little endian
+//	count    uint32, little endian
+type blockBuilder struct {
+	buffer   []byte
+	restarts []uint32
+	counter  int
+	entries  int
+	lastKey  []byte
+}
+
+func newBlockBuilder() *blockBuilder {
+	b := &blockBuilder{}
+	b.Reset()
+	return b
+}
+
+func (b *blockBuilder) Reset() {
+	b.buffer = b.buffer[:0]
+	b.restarts = append(b.restarts[:0], 0)
+	b.counter = 0
+	b.entries = 0
+	b.lastKey = b.lastKey[:0]
+}
+
+func sharedPrefixLength(a []byte, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+// Add an entry, key must be greater than all keys added.
+func (b *blockBuilder) Add(key []byte, value []byte) {
+	shared := 0
+	if b.counter < blockRestartInterval {
+		shared = sharedPrefixLength(b.lastKey, key)
+
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buffer)))
+		b.counter = 0
+	}
+
+	var header [3 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(shared))
+	n += binary.PutUvarint(header[n:], uint64(len(key)-shared))
+	n += binary.PutUvarint(header[n:], uint64(len(value)))
+	b.buffer = append(b.buffer, header[:n]...)
+	b.buffer = append(b.buffer, key[shared:]...)
+	b.buffer = append(b.buffer, value...)
+
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.counter++
+	b.entries++
+}
+
+func (b *blockBuilder) Empty() bool {
+	return b.entries <= 0
+}
+
+// Size of block if it is finished now.
+func (b *blockBuilder) EstimatedSize() int {
+	return len(b.buffer) + 4*len(b.restarts) + 4
+}
+
+// Append restart points, return content of block, which is valid until next Reset.
+func (b *blockBuilder) Finish() []byte {
+	var u32 [4]byte
+	for _, restart := range b.restarts {
+		binary.LittleEndian.PutUint32(u32[:], restart)
+		b.buffer = append(b.buffer, u32[:]...)
+	}
+
+	binary.LittleEndian.PutUint32(u32[:], uint32(len(b.restarts)))
+	b.buffer = append(b.buffer, u32[:]...)
+	return b.buffer
+}
+
+// A parsed block, ready to iterate.
+type block struct {
+	data        []byte
+	restarts    int
+	numRestarts int
+}
+
+func newBlock(data []byte) (*block, error) {
+	if len(data) < 4 {
+		return nil, WrapError(ErrCorrupted, "block too short, %d bytes", len(data))
+	}
+
+	numRestarts := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	maxRestarts := (len(data) - 4) / 4
+	if numRestarts <= 0 || numRestarts > maxRestarts {
+		return nil, WrapError(ErrCorrupted, "invalid block restart count %d", numRestarts)
+	}
+
+	b := &block{
+		data:        data,
+		restarts:    len(data) - 4 - 4*numRestarts,
+		numRestarts: numRestarts,
+	}
+
+	return b, nil
+}
+
+func (b *block) restartPoint(i int) int {
+	return int(binary.LittleEndian.Uint32(b.data[b.restarts+4*i:]))
+}
+
+func (b *block) Iterator(compare compareFunc) *blockIterator {
+	return &blockIterator{
+		block:   b,
+		compare: compare,
+		offset:  b.restarts,
+		next:    b.restarts,
+	}
+}
+
+type blockIterator struct {
+	block   *block
+	compare compareFunc
+	key     []byte
+	value   []byte
+	offset  int
+	next    int
+	err     error
+}
+
+func (i *blockIterator) Valid() bool {
+	return i.err == nil && i.offset < i.block.restarts
+}
+
+// Decode entry at offset next, key is built on current key.
+func (i *blockIterator) parseNext() bool {
+	i.offset = i.next
+	if i.offset >= i.block.restarts {
+		return false
+	}
+
+	data := i.block.data[i.offset:i.block.restarts]
+	shared, n1 := binary.Uvarint(data)
+	unshared, n2 := uvarintAt(data, n1)
+	valueLength, n3 := uvarintAt(data, n1+n2)
+	if n1 <= 0 || n2 <= 0 || n3 <= 0 || shared > uint64(len(i.key)) {
+		i.corrupted()
+		return false
+	}
+
+	start := n1 + n2 + n3
+	if unshared+valueLength > uint64(len(data)-start) {
+		i.corrupted()
+		return false
+	}
+
+	keyEnd := start + int(unshared)
+	i.key = append(i.key[:shared], data[start:keyEnd]...)
+	valueEnd := keyEnd + int(valueLength)
+	i.value = data[keyEnd:valueEnd:valueEnd]
+	i.next = i.offset + valueEnd
+	return true
+}
+
+func uvarintAt(data []byte, offset int) (uint64, int) {
+	if offset <= 0 || offset > len(data) {
+		return 0, 0
+	}
+
+	return binary.Uvarint(data[offset:])
+}
+
+func (i *blockIterator) corrupted() {
+	i.err = WrapError(ErrCorrupted, "corrupted block entry at offset %d", i.offset)
+	i.key = nil
+	i.value = nil
+	i.offset = i.block.restarts
+}
+
+func (i *blockIterator) seekToRestart(index int) {
+	i.key = i.key[:0]
+	i.next = i.block.restartPoint(index)
+}
+
+func (i *blockIterator) SeekToFirst() {
+	i.seekToRestart(0)
+	i.parseNext()
+}
+
+// Seek to first entry whose key >= key, binary search in restart points, then linear search.
+func (i *blockIterator) Seek(key []byte) {
+	index := sort.Search(i.block.numRestarts, func(n int) bool {
+		i.seekToRestart(n)
+		if !i.parseNext() {
+			return true
+		}
+
+		return i.compare(i.key, key) > 0
+	})
+
+	if i.err != nil {
+		return
+	}
+
+	if index > 0 {
+		index--
+	}
+
+	i.seekToRestart(index)
+	for i.parseNext() {
+		if i.compare(i.key, key) >= 0 {
+			return
+		}
+	}
+}
+
+func (i *blockIterator) Next() {
+	i.parseNext()
+}
+
+func (i *blockIterator) invalidate() {
+	i.key = i.key[:0]
+	i.value = nil
+	i.offset = i.block.restarts
+	i.next = i.block.restarts
+}
+
+// Scan from restart point index to the last entry starting before end.
+func (i *blockIterator) scanBefore(index int, end int) {
+	i.seekToRestart(index)
+	for i.parseNext() && i.next < end {
+	}
+}
+
+func (i *blockIterator) SeekToLast() {
+	i.scanBefore(i.block.numRestarts-1, i.block.restarts)
+}
+
+// Move to the previous entry, by scanning from the last restart point before current entry.
+func (i *blockIterator) Prev() {
+	current := i.offset
+	index := sort.Search(i.block.numRestarts, func(n int) bool {
+		return i.block.restartPoint(n) >= current
+	}) - 1
+
+	if index < 0 {
+		i.invalidate()
+		return
+	}
+
+	i.scanBefore(index, current)
+}
+
+func (i *blockIterator) Key() []byte {
+	return i.key
+}
+
+func (i *blockIterator) Value() []byte {
+	return i.value
+}
+
+func (i *blockIterator) Error() error {
+	return i.err
+}
+
+func (i *blockIterator) Close() error {
+	return i.err
+}
@@ -0,0 +1,125 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func buildTestBlock(count int) []byte {
+	b := newBlockBuilder()
+	for i := 0; i < count; i++ {
+		b.Add([]byte(fmt.Sprintf("key-%04d", i*2)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+
+	return append([]byte{}, b.Finish()...)
+}
+
+func TestBlockIterate(t *testing.T) {
+	for _, count := range []int{1, 15, 16, 17, 100} {
+		b, err := newBlock(buildTestBlock(count))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		iter := b.Iterator(bytewiseCompare)
+		i := 0
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			key, value := fmt.Sprintf("key-%04d", i*2), fmt.Sprintf("value-%d", i)
+			if string(iter.Key()) != key || string(iter.Value()) != value {
+				t.Errorf("entry %d: %s=%s, expected %s=%s", i, iter.Key(), iter.Value(), key, value)
+			}
+
+			i++
+		}
+
+		if i != count || iter.Error() != nil {
+			t.Errorf("unexpected count %d <=> %d: %v", i, count, iter.Error())
+		}
+	}
+}
+
+func TestBlockIterateBackward(t *testing.T) {
+	for _, count := range []int{1, 15, 16, 17, 100} {
+		b, _ := newBlock(buildTestBlock(count))
+		iter := b.Iterator(bytewiseCompare)
+		i := count - 1
+		for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+			if key := fmt.Sprintf("key-%04d", i*2); string(iter.Key()) != key {
+				t.Errorf("entry %d: %s, expected %s", i, iter.Key(), key)
+			}
+
+			i--
+		}
+
+		if i != -1 || iter.Error() != nil {
+			t.Errorf("unexpected count %d <=> %d: %v", count-1-i, count, iter.Error())
+		}
+	}
+}
+
+func TestBlockSeek(t *testing.T) {
+	b, _ := newBlock(buildTestBlock(100))
+	iter := b.Iterator(bytewiseCompare)
+
+	for i := 0; i < 200; i++ {
+		iter.Seek([]byte(fmt.Sprintf("key-%04d", i)))
+		expected := i + i%2
+		if expected >= 200 {
+			if iter.Valid() {
+				t.Errorf("seek %d should be invalid, got %s", i, iter.Key())
+			}
+
+			continue
+		}
+
+		if !iter.Valid() || string(iter.Key()) != fmt.Sprintf("key-%04d", expected) {
+			t.Errorf("seek %d got %s, expected %d", i, iter.Key(), expected)
+		}
+	}
+
+	iter.Seek([]byte("a"))
+	if !iter.Valid() || string(iter.Key()) != "key-0000" {
+		t.Errorf("unexpected seek result: %s", iter.Key())
+	}
+
+	iter.Seek([]byte("z"))
+	if iter.Valid() {
+		t.Errorf("unexpected seek result: %s", iter.Key())
+	}
+}
+
+func TestBlockPrefixCompression(t *testing.T) {
+	b := newBlockBuilder()
+	for i := 0; i < 32; i++ {
+		b.Add([]byte(fmt.Sprintf("the-boy-who-lived-%02d", i)), nil)
+	}
+
+	size := len(b.Finish())
+	if size >= 32*len("the-boy-who-lived-00") {
+		t.Errorf("keys are not prefix compressed, size %d", size)
+	}
+}
+
+func TestCorruptedBlock(t *testing.T) {
+	if _, err := newBlock([]byte{1, 2}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := newBlock([]byte{0, 0, 0, 0}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	data := buildTestBlock(4)
+	data[0] = 0x7f
+	b, err := newBlock(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	iter := b.Iterator(bytewiseCompare)
+	iter.SeekToFirst()
+	if iter.Valid() || !errors.Is(iter.Error(), ErrCorrupted) {
+		t.Errorf("unexpected iterator state: %v", iter.Error())
+	}
+}
@@ -0,0 +1,180 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// PrefixExtractor extracts prefixes of keys for prefix bloom filters, so that a table is skipped
+// when no key in it has the prefix of key looked up. Name identifies the extraction, filters
+// written by a different extractor are ignored.
+type PrefixExtractor interface {
+	Name() string
+	// Prefix of key, ok is false if key is out of domain of extractor.
+	Prefix(key []byte) (prefix []byte, ok bool)
+}
+
+type fixedPrefix int
+
+// FixedPrefix extracts the first n bytes of keys, keys shorter than n are out of its domain.
+func FixedPrefix(n int) PrefixExtractor {
+	return fixedPrefix(n)
+}
+
+func (p fixedPrefix) Name() string {
+	return "fixed:" + strconv.Itoa(int(p))
+}
+
+func (p fixedPrefix) Prefix(key []byte) ([]byte, bool) {
+	if len(key) < int(p) {
+		return nil, false
+	}
+
+	return key[:p], true
+}
+
+// How keys of tables are filtered. A table has one filter of all its user keys, stored in a meta
+// block named by policy. Keys of default namespace are filtered by their prefixes if an extractor
+// is given, other keys, and keys out of domain of extractor, are filtered by themselves.
+type filterPolicy struct {
+	bitsPerKey int
+	prefix     PrefixExtractor
+}
+
+// Policy of options, nil if filters are disabled.
+func newFilterPolicy(options Options) *filterPolicy {
+	bits := options.bloomBitsPerKey()
+	if bits <= 0 {
+		return nil
+	}
+
+	return &filterPolicy{bitsPerKey: bits, prefix: options.BloomPrefix}
+}
+
+func (p *filterPolicy) name() string {
+	if p.prefix == nil {
+		return "filter.bloom"
+	}
+
+	return "filter.bloom.prefix." + p.prefix.Name()
+}
+
+// Key added to or probed in filter for user key.
+func (p *filterPolicy) filterKey(key []byte) []byte {
+	if p.prefix == nil || len(key) <= 0 || key[0] != namespaceDefault {
+		return key
+	}
+
+	prefix, ok := p.prefix.Prefix(key[1:])
+	if !ok {
+		return key
+	}
+
+	return key[:1+len(prefix)]
+}
+
+// Hash of bloom filters, the same as LevelDB.
+func bloomHash(data []byte) uint32 {
+	const (
+		seed = 0xbc9f1d34
+		m    = 0xc6a4a793
+	)
+
+	h := uint32(seed) ^ uint32(len(data))*m
+	for ; len(data) >= 4; data = data[4:] {
+		h += binary.LittleEndian.Uint32(data)
+		h *= m
+		h ^= h >> 16
+	}
+
+	switch len(data) {
+	case 3:
+		h += uint32(data[2]) << 16
+		fallthrough
+
+	case 2:
+		h += uint32(data[1]) << 8
+		fallthrough
+
+	case 1:
+		h += uint32(data[0])
+		h *= m
+		h ^= h >> 24
+	}
+
+	return h
+}
+
+// Builder of a bloom filter, keys are added as hashes.
+type bloomBuilder struct {
+	bitsPerKey int
+	hashes     []uint32
+}
+
+func (b *bloomBuilder) Add(key []byte) {
+	b.hashes = append(b.hashes, bloomHash(key))
+}
+
+func (b *bloomBuilder) Reset() {
+	b.hashes = b.hashes[:0]
+}
+
+// Encode filter as bits followed by a byte of number of probes.
+func (b *bloomBuilder) Finish() []byte {
+	// ln(2) * bits per key minimizes false positive rate.
+	k := b.bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+
+	} else if k > 30 {
+		k = 30
+	}
+
+	bits := len(b.hashes) * b.bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+
+	n := (bits + 7) / 8
+	bits = n * 8
+	filter := make([]byte, n+1)
+	filter[n] = byte(k)
+	for _, h := range b.hashes {
+		delta := h>>17 | h<<15
+		for j := 0; j < k; j++ {
+			position := h % uint32(bits)
+			filter[position/8] |= 1 << (position % 8)
+			h += delta
+		}
+	}
+
+	return filter
+}
+
+// Whether key may be added to filter, false positives are possible but false negatives are not.
+func bloomMayContain(filter []byte, key []byte) bool {
+	if len(filter) < 2 {
+		return true
+	}
+
+	n := len(filter) - 1
+	bits := uint32(n * 8)
+	k := int(filter[n])
+	// Reserved for other encodings.
+	if k > 30 {
+		return true
+	}
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for j := 0; j < k; j++ {
+		position := h % bits
+		if filter[position/8]&(1<<(position%8)) == 0 {
+			return false
+		}
+
+		h += delta
+	}
+
+	return true
+}
@@ -0,0 +1,144 @@
+package pinkis
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	for _, n := range []int{1, 10, 1000, 10000} {
+		b := &bloomBuilder{bitsPerKey: 10}
+		for i := 0; i < n; i++ {
+			b.Add([]byte(fmt.Sprintf("student-%d", i)))
+		}
+
+		filter := b.Finish()
+		for i := 0; i < n; i++ {
+			if key := []byte(fmt.Sprintf("student-%d", i)); !bloomMayContain(filter, key) {
+				t.Fatalf("%s should be in filter of %d keys", key, n)
+			}
+		}
+
+		positives := 0
+		for i := 0; i < 10000; i++ {
+			if bloomMayContain(filter, []byte(fmt.Sprintf("muggle-%d", i))) {
+				positives++
+			}
+		}
+
+		// About 1% false positive rate with 10 bits per key.
+		if positives > 200 {
+			t.Errorf("too many false positives of filter of %d keys: %d", n, positives)
+		}
+	}
+
+	if !bloomMayContain(nil, []byte("harry")) {
+		t.Errorf("empty filter should not exclude any key")
+	}
+}
+
+func TestFilterPolicyKey(t *testing.T) {
+	policy := &filterPolicy{bitsPerKey: 10, prefix: FixedPrefix(4)}
+	if policy.name() != "filter.bloom.prefix.fixed:4" {
+		t.Errorf("unexpected name: %s", policy.name())
+	}
+
+	cases := []struct {
+		key      []byte
+		expected string
+	}{
+		{defaultKey([]byte("user-harry")), "\x01user"},
+		{defaultKey([]byte("ron")), "\x01ron"},
+		{bucketPrefix(7), string(bucketPrefix(7))},
+	}
+
+	for i, c := range cases {
+		if got := string(policy.filterKey(c.key)); got != c.expected {
+			t.Errorf("case %d: unexpected filter key: %q <=> %q", i, got, c.expected)
+		}
+	}
+
+	whole := &filterPolicy{bitsPerKey: 10}
+	if whole.name() != "filter.bloom" || string(whole.filterKey([]byte("\x01harry"))) != "\x01harry" {
+		t.Errorf("unexpected whole key policy: %s", whole.name())
+	}
+}
+
+func TestTableFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), tableFileName(1))
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create table failed: %v", err)
+	}
+
+	policy := &filterPolicy{bitsPerKey: 10, prefix: FixedPrefix(5)}
+	w, err := newTableWriter(file, internalCompare(bytewiseCompare), tableOptions{filter: policy})
+	if err != nil {
+		t.Fatalf("make table writer failed: %v", err)
+	}
+
+	for i, house := range []string{"gryff", "huffl", "raven"} {
+		for j := 0; j < 100; j++ {
+			key := defaultKey([]byte(fmt.Sprintf("%s-%03d", house, j)))
+			if err := w.Add(makeInternalKey(key, uint64(i*100+j+1), kindPut), []byte("hogwarts")); err != nil {
+				t.Fatalf("add entry failed: %v", err)
+			}
+		}
+	}
+
+	if _, err := w.Finish(); err != nil {
+		t.Fatalf("finish table failed: %v", err)
+	}
+
+	file.Close()
+
+	cache := newBlockCache(1 << 20)
+	table, err := openTable(path, 1, bytewiseCompare, tableOptions{filter: policy, cache: cache})
+	if err != nil {
+		t.Fatalf("open table failed: %v", err)
+	}
+
+	if stats := cache.Stats(); stats.Entries != 2 || stats.PinnedSize <= 0 {
+		t.Errorf("index and filter should be pinned: %+v", stats)
+	}
+
+	if !table.MayContain(defaultKey([]byte("raven-999"))) {
+		t.Errorf("keys of a prefix in table may be in table")
+	}
+
+	if table.MayContain(defaultKey([]byte("slyth-001"))) {
+		t.Errorf("keys of a prefix not in table should be excluded")
+	}
+
+	if _, found, err := table.Get(defaultKey([]byte("slyth-001")), maxSequence); found || err != nil {
+		t.Errorf("unexpected result: %v, %v", found, err)
+	}
+
+	if stats := cache.Stats(); stats.Misses != 0 {
+		t.Errorf("no data block should be read: %+v", stats)
+	}
+
+	if _, found, err := table.Get(defaultKey([]byte("huffl-042")), maxSequence); !found || err != nil {
+		t.Errorf("unexpected result: %v, %v", found, err)
+	}
+
+	table.Close()
+	if stats := cache.Stats(); stats.PinnedSize != 0 {
+		t.Errorf("pinned blocks should be erased when table is closed: %+v", stats)
+	}
+
+	// Filter of another extractor is ignored.
+	other := &filterPolicy{bitsPerKey: 10, prefix: FixedPrefix(3)}
+	table, err = openTable(path, 1, bytewiseCompare, tableOptions{filter: other})
+	if err != nil {
+		t.Fatalf("open table failed: %v", err)
+	}
+
+	defer table.Close()
+
+	if !table.MayContain(defaultKey([]byte("slyth-001"))) {
+		t.Errorf("filter of another extractor should be ignored")
+	}
+}
@@ -0,0 +1,1239 @@
+package pinkis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const btreeFileName = "pinkis.btree"
+
+// A copy-on-write B+tree engine in a single file of fixed-size pages. Page 0 and 1 are meta pages
+// written alternately, a commit writes all modified nodes into free pages first, and then the meta
+// page pointing to the new root, so a crash never exposes a partial commit. There is a single
+// writer at a time, while readers see the tree of the last commit without blocking.
+//
+// Pages of an encrypted file are sealed by data key of file, whose envelope is kept in meta pages.
+// Data key is never changed, it is wrapped again by the current master key on commit.
+type btreeEngine struct {
+	options  Options
+	path     string
+	file     *os.File
+	pageSize int
+	recovery RecoveryInfo
+	// Cipher of pages, nil if file is not encrypted.
+	cipher *fileCipher
+	// Whether pages end with checksums, always true for new files.
+	checksums bool
+
+	// writeLock serializes write transactions, freelist is used by the writer only.
+	writeLock sync.Mutex
+	freelist  *btreeFreelist
+
+	// metaLock protects meta, readers and region. readers counts running read transactions by
+	// txid, region is the memory mapped file, nil if pages are read from file.
+	metaLock sync.Mutex
+	meta     *btreeMeta
+	readers  map[uint64]int
+	region   *mmapRegion
+
+	// lock is held by readers and writer while they use file, and by Close exclusively.
+	lock   sync.RWMutex
+	closed bool
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func openBTreeEngine(options Options) (*btreeEngine, error) {
+	if len(options.Dir) <= 0 {
+		return nil, WrapError(ErrInvalidOptions, "btree engine requires a directory")
+	}
+
+	if err := makeEngineDir(options); err != nil {
+		return nil, err
+	}
+
+	e := &btreeEngine{
+		options:  options,
+		path:     filepath.Join(options.Dir, btreeFileName),
+		freelist: newBTreeFreelist(),
+		readers:  make(map[uint64]int),
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if options.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(e.path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	e.file = file
+	if err := e.load(); err != nil {
+		e.region.unref()
+		file.Close()
+		return nil, err
+	}
+
+	e.recovery.LastSequence = e.meta.sequence
+	if options.SyncPolicy == SyncPeriodically && !options.ReadOnly {
+		e.closing = make(chan struct{})
+		e.done = make(chan struct{})
+		go e.syncPeriodically()
+	}
+
+	return e, nil
+}
+
+func (e *btreeEngine) syncPeriodically() {
+	defer close(e.done)
+
+	period := e.options.SyncPeriod
+	if period <= 0 {
+		period = walDefaultSyncPeriod
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Error is reported again by following Flush or Close.
+			_ = e.Flush()
+
+		case <-e.closing:
+			return
+		}
+	}
+}
+
+func (e *btreeEngine) load() error {
+	stat, err := e.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() <= 0 {
+		if e.options.ReadOnly {
+			return WrapError(ErrCorrupted, "%s is empty", btreeFileName)
+		}
+
+		if err := e.initialize(); err != nil {
+			return err
+		}
+	}
+
+	meta, err := e.readMeta()
+	if err != nil {
+		return err
+	}
+
+	if err := e.loadCipher(meta); err != nil {
+		return err
+	}
+
+	e.meta = meta
+	e.checksums = meta.checksums
+	e.pageSize = int(meta.pageSize)
+	if err := e.mmap(); err != nil {
+		return err
+	}
+
+	p, err := e.readPage(meta.freelist)
+	if err != nil {
+		return err
+	}
+
+	return e.freelist.read(p)
+}
+
+// Unwrap data key in meta of an encrypted file. A file not encrypted is never encrypted later,
+// since pages are never rewritten all at once.
+func (e *btreeEngine) loadCipher(meta *btreeMeta) error {
+	if meta.envelope == nil {
+		if e.options.KeyProvider != nil {
+			return WrapError(ErrInvalidOptions, "%s is not encrypted", btreeFileName)
+		}
+
+		return nil
+	}
+
+	if e.cipher != nil {
+		return nil
+	}
+
+	c, err := openEnvelope(meta.envelope, e.options.KeyProvider, btreeFileName)
+	if err != nil {
+		return err
+	}
+
+	e.cipher = c
+	return nil
+}
+
+// Envelope of data key wrapped by the current master key, nil if file is not encrypted. Caller
+// must hold writeLock.
+func (e *btreeEngine) envelope() ([]byte, error) {
+	if e.cipher == nil {
+		return nil, nil
+	}
+
+	if e.cipher.keyID != e.options.KeyProvider.CurrentKeyID() {
+		if err := e.cipher.wrap(e.options.KeyProvider); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.cipher.envelope, nil
+}
+
+// Bytes reserved in the end of each run of pages, for checksum, and tag and nonce of encrypted
+// pages.
+func (e *btreeEngine) reserved() int {
+	if e == nil {
+		return 0
+	}
+
+	size := 0
+	if e.checksums {
+		size += pageChecksumSize
+	}
+
+	if e.cipher != nil {
+		size += pageCipherOverhead
+	}
+
+	return size
+}
+
+// Make page p to write, sealed if file is encrypted, and ending with checksum of all bytes before
+// it. Bytes reserved in a plaintext page are written in place.
+func (e *btreeEngine) encodePage(p page) (page, error) {
+	if e.cipher != nil {
+		if !e.checksums {
+			return e.cipher.sealPage(p)
+		}
+
+		sealed, err := e.cipher.sealPage(p[:len(p)-pageChecksumSize])
+		if err != nil {
+			return nil, err
+		}
+
+		p = append(sealed, make([]byte, pageChecksumSize)...)
+	}
+
+	if e.checksums {
+		end := len(p) - pageChecksumSize
+		binary.LittleEndian.PutUint32(p[end:], crc32.Checksum(p[:end], crc32cTable))
+	}
+
+	return p, nil
+}
+
+// Verify checksum of page p read from file, and open it in place if file is encrypted. Checksum
+// is skipped if it is disabled by options, unless verify is set.
+func (e *btreeEngine) decodePage(p page, verify bool) error {
+	if e.checksums {
+		end := len(p) - pageChecksumSize
+		if end < pageHeaderSize {
+			return WrapError(ErrCorrupted, "page %d too short", p.id())
+		}
+
+		if verify && binary.LittleEndian.Uint32(p[end:]) != crc32.Checksum(p[:end], crc32cTable) {
+			return WrapError(ErrCorrupted, "checksum mismatch of page %d", p.id())
+		}
+
+		p = p[:end]
+	}
+
+	if e.cipher != nil {
+		return e.cipher.openPage(p)
+	}
+
+	return nil
+}
+
+// Map file large enough for all pages in use, unless mmap is disabled or unsupported. Pages of
+// encrypted files are decrypted when read, they are never mapped. Readers of the previous region
+// keep it until they are done.
+func (e *btreeEngine) mmap() error {
+	if !mmapSupported || e.options.DisableMmap || e.cipher != nil {
+		return nil
+	}
+
+	e.metaLock.Lock()
+	defer e.metaLock.Unlock()
+
+	used := int64(e.meta.pgid) * int64(e.pageSize)
+	if e.region != nil && int64(len(e.region.data)) >= used {
+		return nil
+	}
+
+	size, err := mmapSize(used)
+	if err != nil {
+		return err
+	}
+
+	region, err := newMmapRegion(e.file, size)
+	if err != nil {
+		return err
+	}
+
+	e.region.unref()
+	e.region = region
+	return nil
+}
+
+func (e *btreeEngine) optionPageSize() int {
+	size := e.options.PageSize
+	if size <= 0 {
+		return defaultPageSize()
+	}
+
+	return size
+}
+
+// Write meta pages, an empty freelist and an empty root leaf into a new file.
+func (e *btreeEngine) initialize() error {
+	size := e.optionPageSize()
+	if size < btreeMinPageSize || size > btreeMaxPageSize || size&(size-1) != 0 {
+		return WrapError(ErrInvalidOptions, "page size %d is not a power of 2 in [%d, %d]",
+			size, btreeMinPageSize, btreeMaxPageSize)
+	}
+
+	var envelope []byte
+	if e.options.KeyProvider != nil {
+		c, err := newFileCipher(e.options.KeyProvider)
+		if err != nil {
+			return err
+		}
+
+		e.cipher = c
+		envelope = c.envelope
+	}
+
+	e.checksums = true
+	buffer := make([]byte, 4*size)
+	for i := 0; i < 2; i++ {
+		meta := &btreeMeta{
+			pageSize:  uint32(size),
+			root:      3,
+			freelist:  2,
+			pgid:      4,
+			txid:      uint64(i),
+			envelope:  envelope,
+			checksums: true,
+		}
+
+		meta.write(page(buffer[i*size : (i+1)*size]))
+	}
+
+	freelist := page(make([]byte, size))
+	freelist.setHeader(2, pageFlagFreelist, 0, 0)
+	newBTreeFreelist().write(freelist)
+	root := page(make([]byte, size))
+	root.setHeader(3, pageFlagLeaf, 0, 0)
+	for i, p := range []page{freelist, root} {
+		encoded, err := e.encodePage(p)
+		if err != nil {
+			return err
+		}
+
+		copy(buffer[(i+2)*size:], encoded)
+	}
+
+	if _, err := e.file.WriteAt(buffer, 0); err != nil {
+		return err
+	}
+
+	if err := e.file.Sync(); err != nil {
+		return err
+	}
+
+	return syncDir(e.options.Dir)
+}
+
+// Read both meta pages, and use the valid one with larger txid. If meta page 0 is broken, page
+// size is unknown, and meta page 1 is looked up at all valid page sizes.
+func (e *btreeEngine) readMeta() (*btreeMeta, error) {
+	buffer := make([]byte, btreeMinPageSize)
+	meta0, err := e.readMetaAt(buffer, 0)
+	var meta1 *btreeMeta
+	for size := btreeMinPageSize; size <= btreeMaxPageSize && meta1 == nil; size *= 2 {
+		if meta0 != nil {
+			size = int(meta0.pageSize)
+		}
+
+		meta1, _ = e.readMetaAt(buffer, int64(size))
+		if meta0 != nil {
+			break
+		}
+	}
+
+	switch {
+	case meta0 == nil && meta1 == nil:
+		return nil, err
+
+	case meta0 == nil:
+		return meta1, nil
+
+	case meta1 == nil || meta0.txid > meta1.txid:
+		return meta0, nil
+
+	default:
+		return meta1, nil
+	}
+}
+
+func (e *btreeEngine) readMetaAt(buffer []byte, offset int64) (*btreeMeta, error) {
+	if _, err := e.file.ReadAt(buffer, offset); err != nil {
+		return nil, WrapError(ErrCorrupted, "read meta page failed: %s", err)
+	}
+
+	meta, err := readBTreeMeta(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := meta.validate(); err != nil {
+		return nil, err
+	}
+
+	if offset != 0 && offset != int64(meta.pageSize) {
+		return nil, WrapError(ErrCorrupted, "meta page at wrong offset %d", offset)
+	}
+
+	return meta, nil
+}
+
+// Read a page with its overflow pages from file.
+func (e *btreeEngine) readPage(id pgid) (page, error) {
+	return e.readPageOf(id, !e.options.DisableChecksums)
+}
+
+// Read a page with its overflow pages from file, verify its checksum if verify is set.
+func (e *btreeEngine) readPageOf(id pgid, verify bool) (page, error) {
+	offset := int64(id) * int64(e.pageSize)
+	p := page(make([]byte, e.pageSize))
+	if _, err := e.file.ReadAt(p, offset); err != nil {
+		return nil, WrapError(ErrCorrupted, "read page %d failed: %s", id, err)
+	}
+
+	if p.id() != id {
+		return nil, WrapError(ErrCorrupted, "page %d has wrong id %d", id, p.id())
+	}
+
+	if overflow := p.overflow(); overflow > 0 {
+		full := page(make([]byte, (int(overflow)+1)*e.pageSize))
+		copy(full, p)
+		if _, err := e.file.ReadAt(full[e.pageSize:], offset+int64(e.pageSize)); err != nil {
+			return nil, WrapError(ErrCorrupted, "read overflow of page %d failed: %s", id, err)
+		}
+
+		p = full
+	}
+
+	if err := e.decodePage(p, verify); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Start a read transaction on the last commit, it must be closed by endRead.
+func (e *btreeEngine) beginRead() *btreeTx {
+	e.metaLock.Lock()
+	defer e.metaLock.Unlock()
+
+	meta := *e.meta
+	e.readers[meta.txid]++
+	e.region.ref()
+	return &btreeTx{
+		engine:   e,
+		meta:     &meta,
+		pageSize: e.pageSize,
+		region:   e.region,
+		now:      nowOf(e.options.clock()),
+	}
+}
+
+func (e *btreeEngine) endRead(tx *btreeTx) {
+	e.metaLock.Lock()
+	defer e.metaLock.Unlock()
+
+	e.readers[tx.meta.txid]--
+	if e.readers[tx.meta.txid] <= 0 {
+		delete(e.readers, tx.meta.txid)
+	}
+
+	tx.close()
+}
+
+// Start a write transaction, caller must hold writeLock. Pages freed by transactions no reader
+// depends on are released for reuse.
+func (e *btreeEngine) beginWrite() *btreeTx {
+	e.metaLock.Lock()
+	meta := *e.meta
+	oldest := meta.txid
+	for txid := range e.readers {
+		if txid < oldest {
+			oldest = txid
+		}
+	}
+
+	region := e.region
+	region.ref()
+	e.metaLock.Unlock()
+
+	e.freelist.release(oldest, meta.txid)
+	meta.txid++
+	tx := &btreeTx{
+		engine:   e,
+		meta:     &meta,
+		pageSize: e.pageSize,
+		region:   region,
+		writable: true,
+		nodes:    make(map[pgid]*btreeNode),
+		pages:    make(map[pgid]page),
+	}
+
+	return tx
+}
+
+// Get a copy of value, since value in a mapped page is invalid after transaction.
+func (e *btreeEngine) Get(key []byte) ([]byte, interface{}, error) {
+	var value []byte
+	err := e.View(key, func(view []byte, object interface{}) error {
+		var err error
+		value, err = duplicateBytes(view)
+		return err
+	})
+
+	return value, nil, err
+}
+
+// Call fn with value of key in a read transaction, value may be in a mapped page.
+func (e *btreeEngine) View(key []byte, fn func(value []byte, object interface{}) error) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	tx := e.beginRead()
+	defer e.endRead(tx)
+
+	value, found, err := tx.get(key)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+
+	return fn(value, nil)
+}
+
+// A snapshot of B+tree is a read transaction, pages of its tree are not reused until it ends.
+type btreeSnapshot struct {
+	engine *btreeEngine
+	tx     *btreeTx
+}
+
+func (e *btreeEngine) Snapshot() (engineSnapshot, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return nil, ErrClosed
+	}
+
+	s := &btreeSnapshot{
+		engine: e,
+		tx:     e.beginRead(),
+	}
+
+	return s, nil
+}
+
+func (s *btreeSnapshot) Sequence() uint64 {
+	return s.tx.meta.sequence
+}
+
+func (s *btreeSnapshot) View(key []byte, fn func(value []byte, object interface{}) error) error {
+	if s.tx == nil {
+		return ErrTxClosed
+	}
+
+	s.engine.lock.RLock()
+	defer s.engine.lock.RUnlock()
+
+	if s.engine.closed {
+		return ErrClosed
+	}
+
+	value, found, err := s.tx.get(key)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+
+	return fn(value, nil)
+}
+
+func (s *btreeSnapshot) Iterator() engineIterator {
+	if s.tx == nil {
+		return &emptyIterator{err: ErrTxClosed}
+	}
+
+	return newBTreeCursor(s.tx)
+}
+
+func (s *btreeSnapshot) Release() {
+	if s.tx != nil {
+		s.engine.endRead(s.tx)
+		s.tx = nil
+	}
+}
+
+// Apply batch in a write transaction. Typed values are not kept, they are decoded from encoded
+// values when read. Merge operands are folded onto values when applied.
+func (e *btreeEngine) Apply(batch *writeBatch) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	tx := e.beginWrite()
+	now := nowOf(e.options.clock())
+	var written [][]byte
+	for _, entry := range batch.entries {
+		var err error
+		switch entry.kind {
+		case kindPut, kindPutExpiring:
+			err = tx.put(entry.key, entry.value, entry.kind)
+			written = append(written, entry.key)
+
+		case kindDelete:
+			err = tx.delete(entry.key)
+
+		case kindDeleteRange:
+			err = tx.deleteRange(entry.key, entry.value, written)
+
+		case kindMerge:
+			err = tx.merge(entry.key, entry.value, now)
+			written = append(written, entry.key)
+		}
+
+		if err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+
+	tx.meta.sequence = batch.LastSequence()
+	return tx.commit()
+}
+
+// Sync file, commits are synced already unless sync policy is SyncNever or SyncPeriodically.
+func (e *btreeEngine) Flush() error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	return e.file.Sync()
+}
+
+// Pages are reused in place, nothing to compact.
+func (e *btreeEngine) CompactRange(start []byte, end []byte) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+func (e *btreeEngine) LastSequence() uint64 {
+	e.metaLock.Lock()
+	defer e.metaLock.Unlock()
+
+	return e.meta.sequence
+}
+
+func (e *btreeEngine) Recovery() RecoveryInfo {
+	return e.recovery
+}
+
+// Verify meta pages, and all pages of the last commit. Writers are blocked only while meta pages
+// are read.
+func (e *btreeEngine) Verify(report *VerifyReport) error {
+	e.writeLock.Lock()
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		e.writeLock.Unlock()
+		return ErrClosed
+	}
+
+	report.Files++
+	e.verifyMeta(report)
+	tx := e.beginRead()
+	e.writeLock.Unlock()
+	defer e.endRead(tx)
+
+	e.verifyTree(tx.meta, report, nil)
+	return nil
+}
+
+// Copy file with pages of the last commit, and write meta of it into both meta pages of copy.
+// Pages of the commit are kept by a read transaction while they are copied, pages written by later
+// commits are free in the copy. Writers are not blocked.
+func (e *btreeEngine) Checkpoint(dir string) (uint64, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return 0, ErrClosed
+	}
+
+	tx := e.beginRead()
+	defer e.endRead(tx)
+
+	size := int64(tx.meta.pgid) * int64(e.pageSize)
+	path := filepath.Join(dir, btreeFileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	err = copyRange(file, e.file, size)
+	buffer := page(make([]byte, 2*e.pageSize))
+	for i := 0; i < 2; i++ {
+		tx.meta.write(buffer[i*e.pageSize : (i+1)*e.pageSize])
+	}
+
+	if err == nil {
+		_, err = file.WriteAt(buffer, 0)
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	return tx.meta.sequence, err
+}
+
+// Statistics of pages, for tests and diagnosis.
+func (e *btreeEngine) pageCount() (int, int) {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	e.metaLock.Lock()
+	defer e.metaLock.Unlock()
+
+	return int(e.meta.pgid), e.freelist.Len()
+}
+
+func (e *btreeEngine) Close() error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	if e.closing != nil {
+		close(e.closing)
+		<-e.done
+		e.closing = nil
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	e.closed = true
+	e.region.unref()
+	e.region = nil
+	var err error
+	if !e.options.ReadOnly {
+		err = e.file.Sync()
+	}
+
+	if errClose := e.file.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// A transaction on a snapshot of B+tree. A read transaction reads pages only, a write transaction
+// loads modified pages as nodes, and writes them into new pages on commit.
+type btreeTx struct {
+	engine   *btreeEngine
+	meta     *btreeMeta
+	pageSize int
+	writable bool
+	// Mapped region of file when transaction starts, referenced until transaction is closed.
+	region *mmapRegion
+	nodes  map[pgid]*btreeNode
+	// Pages allocated and written by commit.
+	pages map[pgid]page
+	// Pages allocated from freelist, they are returned on rollback.
+	reused []pgid
+	// Time transaction starts, values expired then are invisible to it.
+	now int64
+}
+
+func (tx *btreeTx) page(id pgid) (page, error) {
+	if p, ok := tx.pages[id]; ok {
+		return p, nil
+	}
+
+	if id >= tx.meta.pgid {
+		return nil, WrapError(ErrCorrupted, "page %d out of file of %d pages", id, tx.meta.pgid)
+	}
+
+	offset := int64(id) * int64(tx.pageSize)
+	data, ok := tx.region.slice(offset, tx.pageSize)
+	if !ok {
+		return tx.engine.readPage(id)
+	}
+
+	p := page(data)
+	if p.id() != id {
+		return nil, WrapError(ErrCorrupted, "page %d has wrong id %d", id, p.id())
+	}
+
+	if overflow := p.overflow(); overflow > 0 {
+		if id+pgid(overflow) >= tx.meta.pgid {
+			return nil, WrapError(ErrCorrupted, "overflow of page %d out of file", id)
+		}
+
+		data, ok = tx.region.slice(offset, (int(overflow)+1)*tx.pageSize)
+		if !ok {
+			return tx.engine.readPage(id)
+		}
+
+		p = page(data)
+	}
+
+	// Pages mapped are never encrypted, only checksum is verified.
+	if err := tx.engine.decodePage(p, !tx.engine.options.DisableChecksums); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Materialize node of page id, child of parent.
+func (tx *btreeTx) node(id pgid, parent *btreeNode) (*btreeNode, error) {
+	if n, ok := tx.nodes[id]; ok {
+		return n, nil
+	}
+
+	p, err := tx.page(id)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &btreeNode{
+		tx:     tx,
+		parent: parent,
+	}
+
+	if err := n.read(p); err != nil {
+		return nil, err
+	}
+
+	if parent != nil {
+		parent.children = append(parent.children, n)
+	}
+
+	tx.nodes[id] = n
+	return n, nil
+}
+
+func (tx *btreeTx) forget(n *btreeNode) {
+	delete(tx.nodes, n.pgid)
+}
+
+func (tx *btreeTx) free(id pgid, overflow uint32) {
+	tx.engine.freelist.free(tx.meta.txid, id, overflow)
+}
+
+// Allocate count contiguous pages, from freelist or end of file.
+func (tx *btreeTx) allocate(count int) (page, error) {
+	id := tx.engine.freelist.allocate(count)
+	if id == 0 {
+		id = tx.meta.pgid
+		tx.meta.pgid += pgid(count)
+
+	} else {
+		for i := 0; i < count; i++ {
+			tx.reused = append(tx.reused, id+pgid(i))
+		}
+	}
+
+	p := page(make([]byte, count*tx.pageSize))
+	p.setHeader(id, 0, 0, uint32(count-1))
+	tx.pages[id] = p
+	return p, nil
+}
+
+// Find value of key visible when transaction starts, materialized nodes are used in a write
+// transaction.
+func (tx *btreeTx) get(key []byte) ([]byte, bool, error) {
+	kind, value, found, err := tx.lookup(key)
+	if !found {
+		return nil, false, err
+	}
+
+	value, visible := visibleValue(kind, value, tx.now)
+	return value, visible, nil
+}
+
+// Find the element of key, return its kind and value as they are stored.
+func (tx *btreeTx) lookup(key []byte) (entryKind, []byte, bool, error) {
+	id := tx.meta.root
+	for {
+		if n, ok := tx.nodes[id]; ok {
+			if n.leaf {
+				i, exact := n.search(key)
+				if !exact {
+					return 0, nil, false, nil
+				}
+
+				return n.inodes[i].kind, n.inodes[i].value, true, nil
+			}
+
+			id = n.inodes[n.childIndex(key)].child
+			continue
+		}
+
+		p, err := tx.page(id)
+		if err != nil {
+			return 0, nil, false, err
+		}
+
+		if err := p.validate(); err != nil {
+			return 0, nil, false, err
+		}
+
+		if p.isLeaf() {
+			i, found, err := searchLeafPage(p, key)
+			if !found {
+				return 0, nil, false, err
+			}
+
+			_, value, err := p.leafElement(i)
+			if err != nil {
+				return 0, nil, false, err
+			}
+
+			return p.leafKind(i), value, true, nil
+		}
+
+		id, err = searchBranchPage(p, key)
+		if err != nil {
+			return 0, nil, false, err
+		}
+	}
+}
+
+// Index of element of key in leaf page, and whether it is found.
+func searchLeafPage(p page, key []byte) (int, bool, error) {
+	var err error
+	i := sort.Search(p.count(), func(i int) bool {
+		k, _, errElement := p.leafElement(i)
+		if errElement != nil {
+			err = errElement
+			return true
+		}
+
+		return bytes.Compare(k, key) >= 0
+	})
+
+	if err != nil || i >= p.count() {
+		return 0, false, err
+	}
+
+	k, _, err := p.leafElement(i)
+	if err != nil || !bytes.Equal(k, key) {
+		return 0, false, err
+	}
+
+	return i, true, nil
+}
+
+// Child of branch page may hold key.
+func searchBranchPage(p page, key []byte) (pgid, error) {
+	if p.count() <= 0 {
+		return 0, WrapError(ErrCorrupted, "empty branch page %d", p.id())
+	}
+
+	var err error
+	i := sort.Search(p.count(), func(i int) bool {
+		k, _, errElement := p.branchElement(i)
+		if errElement != nil {
+			err = errElement
+			return true
+		}
+
+		return bytes.Compare(k, key) > 0
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if i > 0 {
+		i--
+	}
+
+	_, child, err := p.branchElement(i)
+	return child, err
+}
+
+// Materialize nodes from root to the leaf may hold key.
+func (tx *btreeTx) leafNode(key []byte) (*btreeNode, error) {
+	n, err := tx.node(tx.meta.root, nil)
+	for err == nil && !n.leaf {
+		if len(n.inodes) <= 0 {
+			return nil, WrapError(ErrCorrupted, "empty branch page %d", n.pgid)
+		}
+
+		n, err = n.childAt(n.childIndex(key))
+	}
+
+	return n, err
+}
+
+func (tx *btreeTx) put(key []byte, value []byte, kind entryKind) error {
+	n, err := tx.leafNode(key)
+	if err != nil {
+		return err
+	}
+
+	n.put(key, key, value, 0)
+	i, _ := n.search(key)
+	n.inodes[i].kind = kind
+	return nil
+}
+
+func (tx *btreeTx) delete(key []byte) error {
+	n, err := tx.leafNode(key)
+	if err != nil {
+		return err
+	}
+
+	n.del(key)
+	return nil
+}
+
+// Fold operand onto value of key visible at now, an expired value absorbs operand.
+func (tx *btreeTx) merge(key []byte, operand []byte, now int64) error {
+	kind, value, found, err := tx.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		kind = kindDelete
+	}
+
+	kind, value, ok, err := mergeEntry(kind, value, [][]byte{operand}, now)
+	if err != nil || !ok {
+		return err
+	}
+
+	return tx.put(key, value, kind)
+}
+
+// Delete keys in [start, end) of the tree, and keys in written which are put earlier in the same
+// transaction, since cursor reads the tree as it is before transaction.
+func (tx *btreeTx) deleteRange(start []byte, end []byte, written [][]byte) error {
+	var keys [][]byte
+	c := newBTreeCursor(tx)
+	for c.Seek(start); c.Valid() && bytes.Compare(c.Key(), end) < 0; c.Next() {
+		keys = append(keys, append([]byte{}, c.Key()...))
+	}
+
+	if err := c.Close(); err != nil {
+		return err
+	}
+
+	for _, key := range written {
+		if bytes.Compare(start, key) <= 0 && bytes.Compare(key, end) < 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		if err := tx.delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write modified nodes and freelist into new pages, then meta. Pages are synced before meta, so
+// that meta never points to pages not written, unless sync policy is SyncNever.
+func (tx *btreeTx) commit() error {
+	e := tx.engine
+	if err := tx.spill(); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	old, err := tx.page(tx.meta.freelist)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	e.freelist.freeUnread(tx.meta.txid, tx.meta.freelist, old.overflow())
+	count := (e.freelist.size() + e.reserved() + tx.pageSize - 1) / tx.pageSize
+	p, err := tx.allocate(count)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	p.setHeader(p.id(), pageFlagFreelist, 0, uint32(count-1))
+	e.freelist.write(p)
+	tx.meta.freelist = p.id()
+
+	if err := tx.writePages(); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	if tx.meta.envelope, err = e.envelope(); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	buffer := page(make([]byte, tx.pageSize))
+	tx.meta.write(buffer)
+	offset := int64(tx.meta.txid%2) * int64(tx.pageSize)
+	if _, err := e.file.WriteAt(buffer, offset); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	if e.options.SyncPolicy == SyncAlways {
+		if err := e.file.Sync(); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+
+	e.metaLock.Lock()
+	e.meta = tx.meta
+	e.metaLock.Unlock()
+	tx.close()
+
+	// Pages out of mapped region are read from file, so it is fine if remapping fails.
+	_ = e.mmap()
+	return nil
+}
+
+// Rebalance and write all modified nodes, and update root.
+func (tx *btreeTx) spill() error {
+	for _, n := range tx.nodes {
+		if err := n.rebalance(); err != nil {
+			return err
+		}
+	}
+
+	root, ok := tx.nodes[tx.meta.root]
+	if !ok {
+		return nil
+	}
+
+	if err := root.spill(); err != nil {
+		return err
+	}
+
+	root = root.root()
+	if root.pgid == 0 {
+		return NewError("root of B+tree is not spilled")
+	}
+
+	tx.meta.root = root.pgid
+	return nil
+}
+
+func (tx *btreeTx) writePages() error {
+	ids := make([]pgid, 0, len(tx.pages))
+	for id := range tx.pages {
+		ids = append(ids, id)
+	}
+
+	sortPgids(ids)
+	for _, id := range ids {
+		p, err := tx.engine.encodePage(tx.pages[id])
+		if err != nil {
+			return err
+		}
+
+		offset := int64(id) * int64(tx.pageSize)
+		if _, err := tx.engine.file.WriteAt(p, offset); err != nil {
+			return err
+		}
+	}
+
+	if tx.engine.options.SyncPolicy == SyncAlways {
+		return tx.engine.file.Sync()
+	}
+
+	return nil
+}
+
+// Discard all changes, pages freed by transaction are returned.
+func (tx *btreeTx) rollback() {
+	if tx.writable {
+		tx.engine.freelist.rollback(tx.meta.txid)
+		tx.engine.freelist.restore(tx.reused)
+	}
+
+	tx.close()
+}
+
+func (tx *btreeTx) close() {
+	tx.nodes = nil
+	tx.pages = nil
+	tx.region.unref()
+	tx.region = nil
+}
@@ -0,0 +1,256 @@
+package pinkis
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Position in a page of cursor.
+type btreeCursorFrame struct {
+	page  page
+	index int
+}
+
+// A cursor iterates leaf elements of the tree of a read transaction, with a stack of pages from
+// root to the current leaf. Keys and values are slices of pages, valid until the transaction ends.
+type btreeCursor struct {
+	tx      *btreeTx
+	stack   []btreeCursorFrame
+	key     []byte
+	value   []byte
+	expires int64
+	err     error
+}
+
+func newBTreeCursor(tx *btreeTx) *btreeCursor {
+	return &btreeCursor{tx: tx}
+}
+
+func (c *btreeCursor) fail(err error) {
+	c.err = err
+	c.stack = c.stack[:0]
+}
+
+func (c *btreeCursor) push(id pgid) (page, bool) {
+	p, err := c.tx.page(id)
+	if err == nil {
+		err = p.validate()
+	}
+
+	if err != nil {
+		c.fail(err)
+		return nil, false
+	}
+
+	c.stack = append(c.stack, btreeCursorFrame{page: p})
+	return p, true
+}
+
+// Descend from the top of stack to a leaf, through the first or last child of each branch.
+func (c *btreeCursor) descend(last bool) {
+	for {
+		top := &c.stack[len(c.stack)-1]
+		if top.page.isLeaf() {
+			if last {
+				top.index = top.page.count() - 1
+			}
+
+			return
+		}
+
+		if top.page.count() <= 0 {
+			c.fail(WrapError(ErrCorrupted, "empty branch page %d", top.page.id()))
+			return
+		}
+
+		if last {
+			top.index = top.page.count() - 1
+		}
+
+		_, child, err := top.page.branchElement(top.index)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		if _, ok := c.push(child); !ok {
+			return
+		}
+	}
+}
+
+// Load element at current position, or move on if it is out of leaf or expired.
+func (c *btreeCursor) load(forward bool) {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		if top.index >= 0 && top.index < top.page.count() {
+			key, value, err := top.page.leafElement(top.index)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+
+			kind := top.page.leafKind(top.index)
+			if visible, ok := visibleValue(kind, value, c.tx.now); ok {
+				c.key, c.value, c.expires = key, visible, expiryOf(kind, value)
+				return
+			}
+
+			if forward {
+				top.index++
+
+			} else {
+				top.index--
+			}
+
+			continue
+		}
+
+		// Move to the next or previous leaf via the nearest ancestor having more children.
+		c.stack = c.stack[:len(c.stack)-1]
+		for len(c.stack) > 0 {
+			parent := &c.stack[len(c.stack)-1]
+			if forward {
+				parent.index++
+
+			} else {
+				parent.index--
+			}
+
+			if parent.index >= 0 && parent.index < parent.page.count() {
+				break
+			}
+
+			c.stack = c.stack[:len(c.stack)-1]
+		}
+
+		if len(c.stack) <= 0 {
+			return
+		}
+
+		parent := c.stack[len(c.stack)-1]
+		_, child, err := parent.page.branchElement(parent.index)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		if _, ok := c.push(child); !ok {
+			return
+		}
+
+		c.descend(!forward)
+	}
+}
+
+func (c *btreeCursor) seekEnd(last bool) {
+	c.err = nil
+	c.stack = c.stack[:0]
+	if _, ok := c.push(c.tx.meta.root); !ok {
+		return
+	}
+
+	c.descend(last)
+	c.load(!last)
+}
+
+func (c *btreeCursor) Valid() bool {
+	return c.err == nil && len(c.stack) > 0
+}
+
+func (c *btreeCursor) SeekToFirst() {
+	c.seekEnd(false)
+}
+
+func (c *btreeCursor) SeekToLast() {
+	c.seekEnd(true)
+}
+
+func (c *btreeCursor) Seek(key []byte) {
+	c.err = nil
+	c.stack = c.stack[:0]
+	p, ok := c.push(c.tx.meta.root)
+	for ok && !p.isLeaf() {
+		var err error
+		top := &c.stack[len(c.stack)-1]
+		top.index = sort.Search(p.count(), func(i int) bool {
+			k, _, errElement := p.branchElement(i)
+			if errElement != nil {
+				err = errElement
+				return true
+			}
+
+			return bytes.Compare(k, key) > 0
+		})
+
+		if top.index > 0 {
+			top.index--
+		}
+
+		var child pgid
+		if err == nil {
+			_, child, err = p.branchElement(top.index)
+		}
+
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		p, ok = c.push(child)
+	}
+
+	if !ok {
+		return
+	}
+
+	var err error
+	top := &c.stack[len(c.stack)-1]
+	top.index = sort.Search(p.count(), func(i int) bool {
+		k, _, errElement := p.leafElement(i)
+		if errElement != nil {
+			err = errElement
+			return true
+		}
+
+		return bytes.Compare(k, key) >= 0
+	})
+
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	c.load(true)
+}
+
+func (c *btreeCursor) Next() {
+	c.stack[len(c.stack)-1].index++
+	c.load(true)
+}
+
+func (c *btreeCursor) Prev() {
+	c.stack[len(c.stack)-1].index--
+	c.load(false)
+}
+
+func (c *btreeCursor) Key() []byte {
+	return c.key
+}
+
+func (c *btreeCursor) Value() []byte {
+	return c.value
+}
+
+func (c *btreeCursor) Expires() int64 {
+	return c.expires
+}
+
+func (c *btreeCursor) Error() error {
+	return c.err
+}
+
+func (c *btreeCursor) Close() error {
+	c.stack = nil
+	return c.err
+}
@@ -0,0 +1,165 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Free pages of a B+tree file. Pages freed by a write transaction are pending until no reader may
+// still use them, that is, all readers started after the transaction committed.
+//
+// Freelist pages are read by writers only, so pages of an old freelist are free as soon as the
+// transaction freeing them commits, even if readers are running.
+type btreeFreelist struct {
+	ids     []pgid
+	pending map[uint64][]pgid
+	unread  map[uint64][]pgid
+}
+
+func newBTreeFreelist() *btreeFreelist {
+	f := &btreeFreelist{
+		pending: make(map[uint64][]pgid),
+		unread:  make(map[uint64][]pgid),
+	}
+
+	return f
+}
+
+func sortPgids(ids []pgid) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+// Number of free and pending pages.
+func (f *btreeFreelist) Len() int {
+	n := len(f.ids)
+	for _, ids := range f.pending {
+		n += len(ids)
+	}
+
+	for _, ids := range f.unread {
+		n += len(ids)
+	}
+
+	return n
+}
+
+// Allocate n contiguous free pages, return id of the first page, or 0 if there are not.
+func (f *btreeFreelist) allocate(n int) pgid {
+	start := 0
+	for i := range f.ids {
+		if i > 0 && f.ids[i] != f.ids[i-1]+1 {
+			start = i
+		}
+
+		if i-start+1 >= n {
+			id := f.ids[start]
+			f.ids = append(f.ids[:start], f.ids[i+1:]...)
+			return id
+		}
+	}
+
+	return 0
+}
+
+// Free page id with its overflow pages by transaction txid.
+func (f *btreeFreelist) free(txid uint64, id pgid, overflow uint32) {
+	for i := pgid(0); i <= pgid(overflow); i++ {
+		f.pending[txid] = append(f.pending[txid], id+i)
+	}
+}
+
+// Free page id with its overflow pages, which are never read by readers, by transaction txid.
+func (f *btreeFreelist) freeUnread(txid uint64, id pgid, overflow uint32) {
+	for i := pgid(0); i <= pgid(overflow); i++ {
+		f.unread[txid] = append(f.unread[txid], id+i)
+	}
+}
+
+// Release pages freed by transactions up to reader, and unread pages freed by transactions up to
+// committed.
+func (f *btreeFreelist) release(reader uint64, committed uint64) {
+	released := false
+	for _, pending := range []struct {
+		ids  map[uint64][]pgid
+		txid uint64
+	}{{f.pending, reader}, {f.unread, committed}} {
+		for tx, ids := range pending.ids {
+			if tx <= pending.txid {
+				f.ids = append(f.ids, ids...)
+				delete(pending.ids, tx)
+				released = true
+			}
+		}
+	}
+
+	if released {
+		sortPgids(f.ids)
+	}
+}
+
+// Drop pages freed by transaction txid, which is rolled back.
+func (f *btreeFreelist) rollback(txid uint64) {
+	delete(f.pending, txid)
+	delete(f.unread, txid)
+}
+
+// Return pages allocated by a transaction rolled back.
+func (f *btreeFreelist) restore(ids []pgid) {
+	if len(ids) > 0 {
+		f.ids = append(f.ids, ids...)
+		sortPgids(f.ids)
+	}
+}
+
+// All free and pending pages in order. Pending pages are free when file is opened again.
+func (f *btreeFreelist) all() []pgid {
+	ids := make([]pgid, 0, f.Len())
+	ids = append(ids, f.ids...)
+	for _, pending := range f.pending {
+		ids = append(ids, pending...)
+	}
+
+	for _, unread := range f.unread {
+		ids = append(ids, unread...)
+	}
+
+	sortPgids(ids)
+	return ids
+}
+
+// Size of page to store freelist, with header.
+func (f *btreeFreelist) size() int {
+	return pageHeaderSize + 8 + 8*f.Len()
+}
+
+// Write freelist into page as a count uint64 and ids uint64 * count, little endian.
+func (f *btreeFreelist) write(p page) {
+	ids := f.all()
+	data := p[pageHeaderSize:]
+	binary.LittleEndian.PutUint64(data, uint64(len(ids)))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(data[8+8*i:], uint64(id))
+	}
+}
+
+func (f *btreeFreelist) read(p page) error {
+	if p.flags() != pageFlagFreelist || len(p) < pageHeaderSize+8 {
+		return WrapError(ErrCorrupted, "invalid freelist page %d", p.id())
+	}
+
+	data := p[pageHeaderSize:]
+	count := binary.LittleEndian.Uint64(data)
+	if count > uint64(len(data)-8)/8 {
+		return WrapError(ErrCorrupted, "too many ids in freelist page %d", p.id())
+	}
+
+	f.ids = make([]pgid, count)
+	for i := range f.ids {
+		f.ids[i] = pgid(binary.LittleEndian.Uint64(data[8+8*i:]))
+	}
+
+	sortPgids(f.ids)
+	f.pending = make(map[uint64][]pgid)
+	f.unread = make(map[uint64][]pgid)
+	return nil
+}
@@ -0,0 +1,81 @@
+package pinkis
+
+import (
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func TestBTreeFreelistAllocate(t *testing.T) {
+	f := newBTreeFreelist()
+	f.ids = []pgid{3, 5, 6, 7, 9, 10}
+
+	if id := f.allocate(3); id != 5 {
+		t.Errorf("unexpected first page of 3 contiguous pages: %d", id)
+	}
+
+	if id := f.allocate(3); id != 0 {
+		t.Errorf("no 3 contiguous pages should be left, got %d", id)
+	}
+
+	if id := f.allocate(1); id != 3 {
+		t.Errorf("unexpected allocated page: %d", id)
+	}
+
+	if ok, err := meta.ArrayEqualInfo([]pgid{9, 10}, f.ids); !ok {
+		t.Errorf("unexpected free pages: %v", err)
+	}
+}
+
+func TestBTreeFreelistPending(t *testing.T) {
+	f := newBTreeFreelist()
+	f.free(5, 12, 1)
+	f.free(6, 20, 0)
+	f.free(7, 4, 0)
+
+	if id := f.allocate(1); id != 0 {
+		t.Errorf("pending pages should not be allocated, got %d", id)
+	}
+
+	f.release(6, 6)
+	if ok, err := meta.ArrayEqualInfo([]pgid{12, 13, 20}, f.ids); !ok {
+		t.Errorf("unexpected free pages: %v", err)
+	}
+
+	f.rollback(7)
+	if n := f.Len(); n != 3 {
+		t.Errorf("pages freed by rolled back transaction should be dropped, got %d", n)
+	}
+
+	f.free(8, 2, 0)
+	p := page(make([]byte, f.size()))
+	p.setHeader(1, pageFlagFreelist, 0, 0)
+	f.write(p)
+
+	loaded := newBTreeFreelist()
+	if err := loaded.read(p); err != nil {
+		t.Fatalf("read freelist failed: %v", err)
+	}
+
+	if ok, err := meta.ArrayEqualInfo([]pgid{2, 12, 13, 20}, loaded.ids); !ok {
+		t.Errorf("pending pages should be free when loaded: %v", err)
+	}
+}
+
+// Pages of old freelist are free once transaction commits, even if readers are running.
+func TestBTreeFreelistUnread(t *testing.T) {
+	f := newBTreeFreelist()
+	f.free(5, 12, 0)
+	f.freeUnread(5, 30, 1)
+	f.freeUnread(6, 40, 0)
+
+	f.release(3, 5)
+	if ok, err := meta.ArrayEqualInfo([]pgid{30, 31}, f.ids); !ok {
+		t.Errorf("unexpected free pages: %v", err)
+	}
+
+	f.rollback(6)
+	if n := f.Len(); n != 3 {
+		t.Errorf("unexpected number of pages: %d", n)
+	}
+}
@@ -0,0 +1,384 @@
+package pinkis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// An element of node. For leaf nodes, key, value and its kind are stored, for branch nodes, key is
+// the smallest key in child subtree.
+type btreeInode struct {
+	key   []byte
+	value []byte
+	kind  entryKind
+	child pgid
+}
+
+// An in-memory node of a page modified by a write transaction. Nodes are written into newly
+// allocated pages when transaction commits, pages of the original nodes are freed.
+type btreeNode struct {
+	tx       *btreeTx
+	leaf     bool
+	pgid     pgid
+	overflow uint32
+	parent   *btreeNode
+	// Materialized child nodes.
+	children []*btreeNode
+	inodes   []btreeInode
+	// Key of node in parent, it may be stale until node is spilled.
+	key        []byte
+	unbalanced bool
+	spilled    bool
+}
+
+// Load node from page.
+func (n *btreeNode) read(p page) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	n.leaf = p.isLeaf()
+	n.pgid = p.id()
+	n.overflow = p.overflow()
+	n.inodes = make([]btreeInode, p.count())
+	for i := range n.inodes {
+		inode := &n.inodes[i]
+		var err error
+		if n.leaf {
+			inode.key, inode.value, err = p.leafElement(i)
+			inode.kind = p.leafKind(i)
+
+		} else {
+			inode.key, inode.child, err = p.branchElement(i)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(n.inodes) > 0 {
+		n.key = n.inodes[0].key
+	}
+
+	return nil
+}
+
+func (n *btreeNode) elementSize() int {
+	if n.leaf {
+		return leafElementSize
+	}
+
+	return branchElementSize
+}
+
+// Size of node written in a page.
+func (n *btreeNode) size() int {
+	size := pageHeaderSize
+	for _, inode := range n.inodes {
+		size += n.elementSize() + len(inode.key) + len(inode.value)
+	}
+
+	return size
+}
+
+// Write node into p, p must be large enough.
+func (n *btreeNode) write(p page) {
+	flags := uint16(pageFlagBranch)
+	if n.leaf {
+		flags = pageFlagLeaf
+	}
+
+	p.setHeader(n.pgid, flags, len(n.inodes), uint32(len(p)/n.tx.pageSize-1))
+	offset := pageHeaderSize + len(n.inodes)*n.elementSize()
+	for i, inode := range n.inodes {
+		element := p[pageHeaderSize+i*n.elementSize():]
+		binary.LittleEndian.PutUint32(element, uint32(offset))
+		binary.LittleEndian.PutUint32(element[4:], uint32(len(inode.key)))
+		if n.leaf {
+			size := uint32(len(inode.value))
+			if inode.kind == kindPutExpiring {
+				size |= leafFlagExpiring
+			}
+
+			binary.LittleEndian.PutUint32(element[8:], size)
+
+		} else {
+			binary.LittleEndian.PutUint64(element[8:], uint64(inode.child))
+		}
+
+		offset += copy(p[offset:], inode.key)
+		offset += copy(p[offset:], inode.value)
+	}
+}
+
+// Index of the first inode whose key >= key, and whether it equals key.
+func (n *btreeNode) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.inodes), func(i int) bool {
+		return bytes.Compare(n.inodes[i].key, key) >= 0
+	})
+
+	return i, i < len(n.inodes) && bytes.Equal(n.inodes[i].key, key)
+}
+
+// Index of child subtree may hold key in a branch node.
+func (n *btreeNode) childIndex(key []byte) int {
+	i, exact := n.search(key)
+	if !exact && i > 0 {
+		i--
+	}
+
+	return i
+}
+
+// Materialize the i-th child.
+func (n *btreeNode) childAt(i int) (*btreeNode, error) {
+	return n.tx.node(n.inodes[i].child, n)
+}
+
+func (n *btreeNode) indexOf(child *btreeNode) int {
+	i, _ := n.search(child.key)
+	return i
+}
+
+// Put an inode, replacing the one of oldKey if it exists.
+func (n *btreeNode) put(oldKey []byte, newKey []byte, value []byte, child pgid) {
+	i, exact := n.search(oldKey)
+	if !exact {
+		n.inodes = append(n.inodes, btreeInode{})
+		copy(n.inodes[i+1:], n.inodes[i:])
+	}
+
+	n.inodes[i] = btreeInode{
+		key:   newKey,
+		value: value,
+		child: child,
+	}
+}
+
+// Delete inode of key, return whether it exists.
+func (n *btreeNode) del(key []byte) bool {
+	i, exact := n.search(key)
+	if !exact {
+		return false
+	}
+
+	n.inodes = append(n.inodes[:i], n.inodes[i+1:]...)
+	n.unbalanced = true
+	return true
+}
+
+func (n *btreeNode) removeChild(target *btreeNode) {
+	for i, child := range n.children {
+		if child == target {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			return
+		}
+	}
+}
+
+// Free page of node, if it is loaded from a page.
+func (n *btreeNode) free() {
+	if n.pgid != 0 {
+		n.tx.free(n.pgid, n.overflow)
+		n.pgid = 0
+	}
+}
+
+func (n *btreeNode) minKeys() int {
+	if n.leaf {
+		return 1
+	}
+
+	return 2
+}
+
+// Merge node with a sibling if it is too small after deletions, and collapse root with only one
+// child. Parent is rebalanced after merge, since it loses a child.
+func (n *btreeNode) rebalance() error {
+	if !n.unbalanced {
+		return nil
+	}
+
+	n.unbalanced = false
+	threshold := int(float64(n.tx.pageSize) * btreeMinFillPercent)
+	if n.size() > threshold && len(n.inodes) > n.minKeys() {
+		return nil
+	}
+
+	if n.parent == nil {
+		if n.leaf || len(n.inodes) != 1 {
+			return nil
+		}
+
+		child, err := n.childAt(0)
+		if err != nil {
+			return err
+		}
+
+		n.leaf = child.leaf
+		n.inodes = child.inodes
+		n.children = child.children
+		for _, grandchild := range n.children {
+			grandchild.parent = n
+		}
+
+		n.tx.forget(child)
+		child.free()
+		return nil
+	}
+
+	if len(n.inodes) <= 0 {
+		n.parent.del(n.key)
+		n.parent.removeChild(n)
+		n.tx.forget(n)
+		n.free()
+		return n.parent.rebalance()
+	}
+
+	// Merge the first child with its next sibling, and others with their previous ones.
+	index := n.parent.indexOf(n)
+	left, right := n, n
+	var err error
+	if index == 0 {
+		if len(n.parent.inodes) < 2 {
+			return nil
+		}
+
+		right, err = n.parent.childAt(1)
+
+	} else {
+		left, err = n.parent.childAt(index - 1)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, child := range right.children {
+		child.parent = left
+		left.children = append(left.children, child)
+	}
+
+	left.inodes = append(left.inodes, right.inodes...)
+	n.parent.del(right.key)
+	n.parent.removeChild(right)
+	n.tx.forget(right)
+	right.free()
+	return n.parent.rebalance()
+}
+
+// Split node into nodes fitting in pages. The first one is node itself, others are new siblings.
+// A new root is made if node is root.
+func (n *btreeNode) split() []*btreeNode {
+	nodes := []*btreeNode{n}
+	for node := n; ; {
+		next := node.splitTwo()
+		if next == nil {
+			return nodes
+		}
+
+		nodes = append(nodes, next)
+		node = next
+	}
+}
+
+func (n *btreeNode) splitTwo() *btreeNode {
+	pageSize := n.tx.pageSize - n.tx.engine.reserved()
+	if len(n.inodes) <= 2*n.minKeys() || n.size() <= pageSize {
+		return nil
+	}
+
+	threshold := int(float64(pageSize) * btreeFillPercent)
+	size := pageHeaderSize
+	index := 0
+	for i, inode := range n.inodes {
+		elementSize := n.elementSize() + len(inode.key) + len(inode.value)
+		if i >= n.minKeys() && i <= len(n.inodes)-n.minKeys() && size+elementSize > threshold {
+			index = i
+			break
+		}
+
+		size += elementSize
+	}
+
+	if index <= 0 {
+		return nil
+	}
+
+	if n.parent == nil {
+		n.parent = &btreeNode{
+			tx:       n.tx,
+			children: []*btreeNode{n},
+		}
+	}
+
+	next := &btreeNode{
+		tx:     n.tx,
+		leaf:   n.leaf,
+		parent: n.parent,
+	}
+
+	n.parent.children = append(n.parent.children, next)
+	next.inodes = n.inodes[index:]
+	n.inodes = n.inodes[:index:index]
+	return next
+}
+
+// Write node and all its materialized descendants into new pages, bottom up. Parent is updated
+// with new pages of children, and spilled as well if it is a new root.
+func (n *btreeNode) spill() error {
+	if n.spilled {
+		return nil
+	}
+
+	children := append([]*btreeNode{}, n.children...)
+	sort.Slice(children, func(i, j int) bool {
+		return bytes.Compare(children[i].inodes[0].key, children[j].inodes[0].key) < 0
+	})
+
+	for _, child := range children {
+		if err := child.spill(); err != nil {
+			return err
+		}
+	}
+
+	n.children = nil
+	for _, node := range n.split() {
+		node.free()
+		count := (node.size() + n.tx.engine.reserved() + n.tx.pageSize - 1) / n.tx.pageSize
+		p, err := n.tx.allocate(count)
+		if err != nil {
+			return err
+		}
+
+		node.pgid = p.id()
+		node.overflow = uint32(count - 1)
+		node.write(p)
+		node.spilled = true
+		if node.parent != nil {
+			key := node.key
+			if key == nil {
+				key = node.inodes[0].key
+			}
+
+			node.parent.put(key, node.inodes[0].key, nil, node.pgid)
+			node.key = node.inodes[0].key
+		}
+	}
+
+	if n.parent != nil && n.parent.pgid == 0 && !n.parent.spilled {
+		return n.parent.spill()
+	}
+
+	return nil
+}
+
+func (n *btreeNode) root() *btreeNode {
+	for n.parent != nil {
+		n = n.parent
+	}
+
+	return n
+}
@@ -0,0 +1,284 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+type pgid uint64
+
+const (
+	btreeMagic          = 0x70696e6b
+	btreeVersion        = 1
+	btreeMinPageSize    = 512
+	btreeMaxPageSize    = 1 << 16
+	pageHeaderSize      = 16
+	leafElementSize     = 12
+	branchElementSize   = 16
+	metaSize            = 64
+	btreeMinFillPercent = 0.25
+	btreeFillPercent    = 0.5
+	// Flag in value size of leaf elements, set if value is of kindPutExpiring.
+	leafFlagExpiring = 1 << 31
+	// Flags in meta, set if pages are encrypted, and if pages end with checksums.
+	metaFlagEncrypted = 1
+	metaFlagChecksums = 2
+	// Size of CRC32C in the end of each run of pages, of all bytes before it as written to file.
+	pageChecksumSize = 4
+)
+
+const (
+	pageFlagBranch   = 0x01
+	pageFlagLeaf     = 0x02
+	pageFlagMeta     = 0x04
+	pageFlagFreelist = 0x08
+)
+
+func defaultPageSize() int {
+	size := os.Getpagesize()
+	if size < btreeMinPageSize || size > btreeMaxPageSize {
+		return 4096
+	}
+
+	return size
+}
+
+// A page, possibly followed by overflow pages. Layout of header:
+//
+//	id       uint64
+//	flags    uint16
+//	count    uint16, number of elements
+//	overflow uint32, number of pages following this one
+//
+// Elements of leaf pages are [offset uint32, key size uint32, value size uint32], the highest bit
+// of value size is set if value expires, see expiringValue. Elements of branch pages are
+// [offset uint32, key size uint32, child pgid uint64]. Offsets are relative to start of page, keys
+// and values are stored after all elements. All integers are little endian. A page with its
+// overflow pages ends with a checksum as written to file, if metaFlagChecksums is set in meta.
+type page []byte
+
+func (p page) id() pgid {
+	return pgid(binary.LittleEndian.Uint64(p))
+}
+
+func (p page) flags() uint16 {
+	return binary.LittleEndian.Uint16(p[8:])
+}
+
+func (p page) count() int {
+	return int(binary.LittleEndian.Uint16(p[10:]))
+}
+
+func (p page) overflow() uint32 {
+	return binary.LittleEndian.Uint32(p[12:])
+}
+
+func (p page) setHeader(id pgid, flags uint16, count int, overflow uint32) {
+	binary.LittleEndian.PutUint64(p, uint64(id))
+	binary.LittleEndian.PutUint16(p[8:], flags)
+	binary.LittleEndian.PutUint16(p[10:], uint16(count))
+	binary.LittleEndian.PutUint32(p[12:], overflow)
+}
+
+func (p page) isLeaf() bool {
+	return p.flags()&pageFlagLeaf != 0
+}
+
+func (p page) typeName() string {
+	switch {
+	case p.flags()&pageFlagBranch != 0:
+		return "branch"
+
+	case p.flags()&pageFlagLeaf != 0:
+		return "leaf"
+
+	case p.flags()&pageFlagMeta != 0:
+		return "meta"
+
+	case p.flags()&pageFlagFreelist != 0:
+		return "freelist"
+
+	default:
+		return fmt.Sprintf("unknown<%02x>", p.flags())
+	}
+}
+
+// Slice data of page in [offset, offset+size), ok is false if it is out of page.
+func (p page) slice(offset uint32, size uint32) ([]byte, bool) {
+	end := uint64(offset) + uint64(size)
+	if end > uint64(len(p)) {
+		return nil, false
+	}
+
+	return p[offset:end:end], true
+}
+
+// Key and value of the i-th element of a leaf page.
+func (p page) leafElement(i int) ([]byte, []byte, error) {
+	element := p[pageHeaderSize+i*leafElementSize:]
+	offset := binary.LittleEndian.Uint32(element)
+	keySize := binary.LittleEndian.Uint32(element[4:])
+	valueSize := binary.LittleEndian.Uint32(element[8:]) &^ leafFlagExpiring
+	key, ok1 := p.slice(offset, keySize)
+	value, ok2 := p.slice(offset+keySize, valueSize)
+	if !ok1 || !ok2 {
+		return nil, nil, p.corrupted(i)
+	}
+
+	return key, value, nil
+}
+
+// Kind of value of the i-th element of a leaf page.
+func (p page) leafKind(i int) entryKind {
+	element := p[pageHeaderSize+i*leafElementSize:]
+	if binary.LittleEndian.Uint32(element[8:])&leafFlagExpiring != 0 {
+		return kindPutExpiring
+	}
+
+	return kindPut
+}
+
+// Key and child of the i-th element of a branch page.
+func (p page) branchElement(i int) ([]byte, pgid, error) {
+	element := p[pageHeaderSize+i*branchElementSize:]
+	offset := binary.LittleEndian.Uint32(element)
+	keySize := binary.LittleEndian.Uint32(element[4:])
+	child := pgid(binary.LittleEndian.Uint64(element[8:]))
+	key, ok := p.slice(offset, keySize)
+	if !ok {
+		return nil, 0, p.corrupted(i)
+	}
+
+	return key, child, nil
+}
+
+func (p page) corrupted(i int) error {
+	return WrapError(ErrCorrupted, "corrupted element %d of %s page %d", i, p.typeName(), p.id())
+}
+
+// Check whether elements of page fit in page.
+func (p page) validate() error {
+	elementSize := leafElementSize
+	if !p.isLeaf() {
+		elementSize = branchElementSize
+	}
+
+	if pageHeaderSize+p.count()*elementSize > len(p) {
+		return WrapError(ErrCorrupted, "too many elements in %s page %d", p.typeName(), p.id())
+	}
+
+	return nil
+}
+
+// Metadata of a B+tree file, two copies are kept in page 0 and 1 alternately. The one with
+// larger txid and valid checksum is used, so a torn write of meta never loses the previous commit.
+type btreeMeta struct {
+	pageSize uint32
+	root     pgid
+	freelist pgid
+	// Number of pages in use, the next page to allocate from end of file.
+	pgid     pgid
+	txid     uint64
+	sequence uint64
+	// Key envelope of an encrypted file, following meta in meta pages.
+	envelope []byte
+	// Whether pages end with checksums, files made before page checksums have none.
+	checksums bool
+}
+
+// Encode meta as:
+//
+//	magic     uint32
+//	version   uint32
+//	page size uint32
+//	flags     uint32, metaFlagEncrypted if pages are encrypted, and key envelope follows checksum,
+//	          metaFlagChecksums if pages end with checksums
+//	root      uint64
+//	freelist  uint64
+//	pgid      uint64
+//	txid      uint64
+//	sequence  uint64
+//	checksum  uint32, CRC32C of all fields above
+func (m *btreeMeta) write(p page) {
+	p.setHeader(pgid(m.txid%2), pageFlagMeta, 0, 0)
+	data := p[pageHeaderSize:]
+	binary.LittleEndian.PutUint32(data[0:], btreeMagic)
+	binary.LittleEndian.PutUint32(data[4:], btreeVersion)
+	binary.LittleEndian.PutUint32(data[8:], m.pageSize)
+	flags := uint32(0)
+	if m.checksums {
+		flags |= metaFlagChecksums
+	}
+
+	if m.envelope != nil {
+		flags |= metaFlagEncrypted
+		copy(data[metaSize:], m.envelope)
+	}
+
+	binary.LittleEndian.PutUint32(data[12:], flags)
+	binary.LittleEndian.PutUint64(data[16:], uint64(m.root))
+	binary.LittleEndian.PutUint64(data[24:], uint64(m.freelist))
+	binary.LittleEndian.PutUint64(data[32:], uint64(m.pgid))
+	binary.LittleEndian.PutUint64(data[40:], m.txid)
+	binary.LittleEndian.PutUint64(data[48:], m.sequence)
+	binary.LittleEndian.PutUint32(data[56:], crc32.Checksum(data[:56], crc32cTable))
+}
+
+func readBTreeMeta(p page) (*btreeMeta, error) {
+	if len(p) < pageHeaderSize+metaSize || p.flags() != pageFlagMeta {
+		return nil, WrapError(ErrCorrupted, "invalid meta page")
+	}
+
+	data := p[pageHeaderSize:]
+	if binary.LittleEndian.Uint32(data[0:]) != btreeMagic {
+		return nil, WrapError(ErrCorrupted, "invalid magic of meta page")
+	}
+
+	if binary.LittleEndian.Uint32(data[56:]) != crc32.Checksum(data[:56], crc32cTable) {
+		return nil, WrapError(ErrCorrupted, "checksum mismatch of meta page")
+	}
+
+	if version := binary.LittleEndian.Uint32(data[4:]); version != btreeVersion {
+		return nil, WrapError(ErrCorrupted, "unsupported B+tree version %d", version)
+	}
+
+	m := &btreeMeta{
+		pageSize: binary.LittleEndian.Uint32(data[8:]),
+		root:     pgid(binary.LittleEndian.Uint64(data[16:])),
+		freelist: pgid(binary.LittleEndian.Uint64(data[24:])),
+		pgid:     pgid(binary.LittleEndian.Uint64(data[32:])),
+		txid:     binary.LittleEndian.Uint64(data[40:]),
+		sequence: binary.LittleEndian.Uint64(data[48:]),
+	}
+
+	flags := binary.LittleEndian.Uint32(data[12:])
+	m.checksums = flags&metaFlagChecksums != 0
+	if flags&metaFlagEncrypted != 0 {
+		size, ok := envelopeSize(data[metaSize:])
+		if !ok || metaSize+size > len(data) {
+			return nil, WrapError(ErrCorrupted, "invalid key envelope in meta page")
+		}
+
+		m.envelope = append([]byte{}, data[metaSize:metaSize+size]...)
+	}
+
+	return m, nil
+}
+
+func (m *btreeMeta) validate() error {
+	size := m.pageSize
+	if size < btreeMinPageSize || size > btreeMaxPageSize || size&(size-1) != 0 {
+		return WrapError(ErrCorrupted, "invalid page size %d", size)
+	}
+
+	if m.root < 2 || m.freelist < 2 || m.root == m.freelist ||
+		m.root >= m.pgid || m.freelist >= m.pgid {
+
+		return WrapError(ErrCorrupted, "invalid pages in meta, root %d, freelist %d, pgid %d",
+			m.root, m.freelist, m.pgid)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testMetaEqual(a *btreeMeta, b *btreeMeta) bool {
+	return a.pageSize == b.pageSize && a.root == b.root && a.freelist == b.freelist &&
+		a.pgid == b.pgid && a.txid == b.txid && a.sequence == b.sequence &&
+		a.checksums == b.checksums && bytes.Equal(a.envelope, b.envelope)
+}
+
+func TestBTreeMeta(t *testing.T) {
+	m := &btreeMeta{
+		pageSize:  4096,
+		root:      7,
+		freelist:  5,
+		pgid:      10,
+		txid:      42,
+		sequence:  1997,
+		checksums: true,
+	}
+
+	p := page(make([]byte, 4096))
+	m.write(p)
+	if p.id() != 0 || p.typeName() != "meta" {
+		t.Errorf("unexpected meta page header: %d %s", p.id(), p.typeName())
+	}
+
+	loaded, err := readBTreeMeta(p)
+	if err != nil || !testMetaEqual(loaded, m) {
+		t.Fatalf("unexpected meta: %+v, %v", loaded, err)
+	}
+
+	if err := loaded.validate(); err != nil {
+		t.Errorf("validate meta failed: %v", err)
+	}
+
+	p[pageHeaderSize+20]++
+	if _, err := readBTreeMeta(p); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	c, err := newFileCipher(testKeyProvider("hogwarts"))
+	if err != nil {
+		t.Fatalf("make cipher failed: %v", err)
+	}
+
+	m.envelope = c.envelope
+	m.write(p)
+	if loaded, err = readBTreeMeta(p); err != nil || !testMetaEqual(loaded, m) {
+		t.Fatalf("unexpected meta with envelope: %+v, %v", loaded, err)
+	}
+
+	invalid := *m
+	invalid.pageSize = 1000
+	if err := invalid.validate(); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	invalid = *m
+	invalid.root = 12
+	if err := invalid.validate(); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBTreeLeafPage(t *testing.T) {
+	tx := &btreeTx{pageSize: 512}
+	n := &btreeNode{
+		tx:   tx,
+		leaf: true,
+		pgid: 9,
+		inodes: []btreeInode{
+			{key: []byte("harry"), value: []byte("potter")},
+			{key: []byte("hermione"), value: []byte("granger")},
+			{key: []byte("ron"), value: []byte("weasley")},
+		},
+	}
+
+	p := page(make([]byte, 512))
+	n.write(p)
+	if p.id() != 9 || !p.isLeaf() || p.count() != 3 {
+		t.Fatalf("unexpected page header: %d %s %d", p.id(), p.typeName(), p.count())
+	}
+
+	for _, key := range []string{"harry", "hermione", "ron"} {
+		i, found, err := searchLeafPage(p, []byte(key))
+		_, value, _ := p.leafElement(i)
+		if err != nil || !found || string(value) != string(n.inodes[n.childIndex([]byte(key))].value) {
+			t.Errorf("unexpected value of %s: %s, %v, %v", key, value, found, err)
+		}
+	}
+
+	if _, found, _ := searchLeafPage(p, []byte("draco")); found {
+		t.Errorf("draco should not be found")
+	}
+
+	// Break offset of the last element.
+	p[pageHeaderSize+2*leafElementSize] = 0xff
+	p[pageHeaderSize+2*leafElementSize+1] = 0xff
+	if _, _, err := p.leafElement(2); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func openTestBTree(t *testing.T, dir string) *DB {
+	options := Options{
+		Dir:        dir,
+		Engine:     EngineBTree,
+		SyncPolicy: SyncNever,
+		PageSize:   512,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open btree database failed: %v", err)
+	}
+
+	return db
+}
+
+func btreeEngineOf(db *DB) *btreeEngine {
+	return db.engine.(*btreeEngine)
+}
+
+// All keys and values in tree as "key=value", by walking pages from root.
+func scanBTree(t *testing.T, e *btreeEngine) []string {
+	tx := e.beginRead()
+	defer e.endRead(tx)
+
+	var result []string
+	var walk func(id pgid, depth int)
+	walk = func(id pgid, depth int) {
+		p, err := tx.page(id)
+		if err != nil {
+			t.Fatalf("read page %d failed: %v", id, err)
+		}
+
+		for i := 0; i < p.count(); i++ {
+			if p.isLeaf() {
+				key, value, err := p.leafElement(i)
+				if err != nil {
+					t.Fatalf("read leaf element failed: %v", err)
+				}
+
+				result = append(result, fmt.Sprintf("%s=%s", key, value))
+				continue
+			}
+
+			_, child, err := p.branchElement(i)
+			if err != nil {
+				t.Fatalf("read branch element failed: %v", err)
+			}
+
+			walk(child, depth+1)
+		}
+	}
+
+	walk(tx.meta.root, 0)
+	return result
+}
+
+// Entries of keys in default namespace, as returned by scanBTree.
+func expectedEntries(data map[string]string) []string {
+	result := make([]string, 0, len(data))
+	for key, value := range data {
+		result = append(result, fmt.Sprintf("%s=%s", defaultKey([]byte(key)), value))
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+func TestBTreeRequiresDir(t *testing.T) {
+	if _, err := Open(Options{Engine: EngineBTree}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	options := Options{
+		Dir:      t.TempDir(),
+		Engine:   EngineBTree,
+		PageSize: 1000,
+	}
+
+	if _, err := Open(options); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBTreeRandomOperations(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestBTree(t, dir)
+	e := btreeEngineOf(db)
+
+	r := rand.New(rand.NewSource(7))
+	data := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("wizard-%04d", r.Intn(1500))
+		if r.Intn(3) == 0 {
+			delete(data, key)
+			if err := db.Delete([]byte(key)); err != nil {
+				t.Fatalf("delete failed: %v", err)
+			}
+
+			continue
+		}
+
+		value := fmt.Sprintf("wand-%d-%s", i, strings.Repeat("x", r.Intn(40)))
+		data[key] = value
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if ok, err := meta.ArrayEqualInfo(expectedEntries(data), scanBTree(t, e)); !ok {
+		t.Errorf("unexpected entries in tree: %v", err)
+	}
+
+	for key, value := range data {
+		got, err := db.Get([]byte(key))
+		if err != nil || string(got) != value {
+			t.Errorf("unexpected value of %s: %q, %v", key, got, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	db = openTestBTree(t, dir)
+	defer db.Close()
+
+	if ok, err := meta.ArrayEqualInfo(expectedEntries(data), scanBTree(t, btreeEngineOf(db))); !ok {
+		t.Errorf("unexpected entries after reopen: %v", err)
+	}
+
+	if db.Sequence() != 5000 {
+		t.Errorf("unexpected sequence after reopen: %d", db.Sequence())
+	}
+}
+
+func TestBTreeDeleteAll(t *testing.T) {
+	db := openTestBTree(t, t.TempDir())
+	defer db.Close()
+
+	e := btreeEngineOf(db)
+	for i := 0; i < 2000; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte("hogwarts"))
+	}
+
+	grown, _ := e.pageCount()
+	for i := 0; i < 2000; i++ {
+		if err := db.Delete([]byte(fmt.Sprintf("key-%05d", i))); err != nil {
+			t.Fatalf("delete failed: %v", err)
+		}
+	}
+
+	if entries := scanBTree(t, e); len(entries) != 0 {
+		t.Errorf("tree should be empty, got %d entries", len(entries))
+	}
+
+	// Freed pages are reused, file does not grow.
+	for i := 0; i < 2000; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte("hogwarts"))
+	}
+
+	if pages, free := e.pageCount(); pages > grown+grown/2 {
+		t.Errorf("freed pages should be reused, %d pages, %d free, %d before", pages, free, grown)
+	}
+}
+
+func TestBTreeLargeValues(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestBTree(t, dir)
+
+	values := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		value := make([]byte, 300*i)
+		for j := range value {
+			value[j] = byte(i + j)
+		}
+
+		key := fmt.Sprintf("spell-%02d", i)
+		values[key] = value
+		if err := db.Put([]byte(key), value); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	db.Close()
+	db = openTestBTree(t, dir)
+	defer db.Close()
+
+	for key, value := range values {
+		got, err := db.Get([]byte(key))
+		if err != nil || !meta.Equal(got, value) {
+			t.Errorf("unexpected value of %s, %d bytes, %v", key, len(got), err)
+		}
+	}
+}
+
+func TestBTreeConcurrentReaders(t *testing.T) {
+	db := openTestBTree(t, t.TempDir())
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("0"))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for round := 1; round <= 20; round++ {
+			for i := 0; i < 200; i++ {
+				db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprint(round)))
+			}
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 2000; i++ {
+				key := []byte(fmt.Sprintf("key-%03d", i%200))
+				if _, err := db.Get(key); err != nil {
+					t.Errorf("get %s failed: %v", key, err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// A torn write of the latest meta page falls back to the previous commit.
+func TestBTreeBrokenMeta(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestBTree(t, dir)
+	db.Put([]byte("harry"), []byte("potter"))
+	db.Put([]byte("ron"), []byte("weasley"))
+	txid := btreeEngineOf(db).meta.txid
+	db.Close()
+
+	path := filepath.Join(dir, btreeFileName)
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open file failed: %v", err)
+	}
+
+	file.WriteAt([]byte("broken"), int64(txid%2)*512+pageHeaderSize+20)
+	file.Close()
+
+	db = openTestBTree(t, dir)
+	defer db.Close()
+
+	if value, err := db.Get([]byte("harry")); err != nil || string(value) != "potter" {
+		t.Errorf("unexpected value of harry: %s, %v", value, err)
+	}
+
+	if _, err := db.Get([]byte("ron")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ron should be lost with the broken commit: %v", err)
+	}
+
+	if db.Sequence() != 1 {
+		t.Errorf("unexpected sequence: %d", db.Sequence())
+	}
+}
+
+func TestBTreeCorruptedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, btreeFileName)
+	if err := os.WriteFile(path, make([]byte, 4096), 0644); err != nil {
+		t.Fatalf("write file failed: %v", err)
+	}
+
+	if _, err := Open(Options{Dir: dir, Engine: EngineBTree}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBTreeCollection(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestBTree(t, dir)
+
+	wizards, err := db.Collection("wizards", testWizard{})
+	if err != nil {
+		t.Fatalf("create collection failed: %v", err)
+	}
+
+	harry := testWizard{Name: "Harry", House: "Gryffindor", Born: 1980, Courses: []string{"Potions"}}
+	if err := wizards.Put([]byte("harry"), &harry); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	db.Close()
+	db = openTestBTree(t, dir)
+	defer db.Close()
+
+	wizards, _ = db.Collection("wizards", testWizard{})
+	var got testWizard
+	if err := wizards.Get([]byte("harry"), &got); err != nil || !meta.Equal(got, harry) {
+		t.Errorf("unexpected wizard: %+v, %v", got, err)
+	}
+}
+
+func TestBTreeClosed(t *testing.T) {
+	db := openTestBTree(t, t.TempDir())
+	e := btreeEngineOf(db)
+	db.Close()
+
+	if _, _, err := e.Get([]byte("harry")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := e.Apply(putBatch("harry", "potter")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := e.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
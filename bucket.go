@@ -0,0 +1,968 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Buckets are named keyspaces made in transactions, and may be nested. A bucket is described by a
+// record in meta namespace, keyed by id of its parent bucket and its name:
+//
+//	key    0x00 "bucket/" parent id uint64 big endian, name
+//	value  id uvarint, codec, comparator, type, each as length uvarint and string, TTL uvarint,
+//	       compressor as length uvarint and string
+//
+// TTL is absent in records written before buckets may expire keys, taken as 0. Compressor is
+// absent in records written before buckets may be compressed differently, taken as default.
+//
+// Keys in a bucket are prefixed by its id, see bucketPrefix. Root buckets have parent id 0, and ids
+// are allocated from a counter stored in meta namespace, never reused.
+var (
+	bucketRecordPrefix = []byte("\x00bucket/")
+	bucketSequenceKey  = []byte("\x00bucket-sequence")
+)
+
+// Comparator orders keys of a bucket. Name identifies the order, and is stored with bucket.
+type Comparator interface {
+	Name() string
+	Compare(a []byte, b []byte) int
+}
+
+// Settings of a bucket, stored when bucket is created, and checked every time it is opened.
+type BucketOptions struct {
+	// Codec of typed values, Options.Codec is used if nil.
+	Codec Codec
+	// Order of keys in iterators, bytewise order if nil.
+	Comparator Comparator
+	// Prototype of typed values, a struct or a pointer to a struct. Bucket is untyped if nil.
+	Type interface{}
+	// Default TTL of keys put in bucket, keys never expire by default if 0.
+	TTL time.Duration
+	// Compression of keys in bucket, Options.Compression is used if nil. Unlike other settings,
+	// it may be changed by SetCompression.
+	Compression Compressor
+}
+
+type bucketRecord struct {
+	id         uint64
+	codec      string
+	comparator string
+	valueType  string
+	ttl        time.Duration
+	// Name of compressor, the default compressor if empty.
+	compression string
+}
+
+func (r bucketRecord) encode() []byte {
+	data := make([]byte, 0, 6*binary.MaxVarintLen64+len(r.codec)+len(r.comparator)+len(r.valueType)+
+		len(r.compression))
+	data = appendUvarint(data, r.id)
+	for _, s := range []string{r.codec, r.comparator, r.valueType} {
+		data = appendLengthPrefixed(data, []byte(s))
+	}
+
+	data = appendUvarint(data, uint64(r.ttl))
+	return appendLengthPrefixed(data, []byte(r.compression))
+}
+
+func decodeBucketRecord(data []byte) (bucketRecord, error) {
+	r := bucketRecord{}
+	id, n := binary.Uvarint(data)
+	if n <= 0 {
+		return r, WrapError(ErrCorrupted, "invalid bucket id")
+	}
+
+	r.id = id
+	data = data[n:]
+	fields := []*string{&r.codec, &r.comparator, &r.valueType}
+	for _, field := range fields {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return r, WrapError(ErrCorrupted, "invalid bucket record of id %d", r.id)
+		}
+
+		*field = string(data[n : n+int(length)])
+		data = data[n+int(length):]
+	}
+
+	if len(data) > 0 {
+		ttl, n := binary.Uvarint(data)
+		if n <= 0 {
+			return r, WrapError(ErrCorrupted, "invalid TTL of bucket of id %d", r.id)
+		}
+
+		r.ttl = time.Duration(ttl)
+		data = data[n:]
+	}
+
+	if len(data) > 0 {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length != uint64(len(data)-n) {
+			return r, WrapError(ErrCorrupted, "invalid compressor of bucket of id %d", r.id)
+		}
+
+		r.compression = string(data[n:])
+	}
+
+	return r, nil
+}
+
+// Name of codec stored with bucket, type of codec unless it has a Name method.
+func codecName(codec Codec) string {
+	if named, ok := codec.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+
+	return reflect.TypeOf(codec).String()
+}
+
+// Name of type stored with bucket, qualified by full package path.
+func typeName(t reflect.Type) string {
+	if t.Name() == "" {
+		return t.String()
+	}
+
+	return t.PkgPath() + "." + t.Name()
+}
+
+// Bucket is a keyspace in a transaction. Keys and sub-buckets of a bucket are separated, a key
+// and a sub-bucket may have the same name. A bucket is valid until transaction ends, and must not
+// be used after it is deleted.
+type Bucket struct {
+	tx *Tx
+	// Full name, names of all ancestors joined by '/'.
+	path       string
+	name       string
+	id         uint64
+	parent     uint64
+	prefix     []byte
+	comparator Comparator
+	ttl        time.Duration
+	// Typed values, nil if bucket is untyped, or type of it is unknown.
+	collection *Collection
+}
+
+// Root of all buckets, it is not a bucket and stores no keys.
+func (tx *Tx) root() *Bucket {
+	return &Bucket{tx: tx}
+}
+
+// Create a bucket of name, fails with ErrBucketExists if it exists. At most one options is used.
+func (tx *Tx) CreateBucket(name string, options ...*BucketOptions) (*Bucket, error) {
+	return tx.root().CreateBucket(name, options...)
+}
+
+// Open a bucket of name, or create it if it does not exist.
+func (tx *Tx) CreateBucketIfNotExists(name string, options ...*BucketOptions) (*Bucket, error) {
+	return tx.root().CreateBucketIfNotExists(name, options...)
+}
+
+// Open a bucket of name, fails with ErrBucketNotFound if it does not exist. Settings in options
+// must match settings bucket created with.
+func (tx *Tx) Bucket(name string, options ...*BucketOptions) (*Bucket, error) {
+	return tx.root().Bucket(name, options...)
+}
+
+// Delete a bucket of name with all its keys and sub-buckets, atomically when transaction commits.
+func (tx *Tx) DeleteBucket(name string) error {
+	return tx.root().DeleteBucket(name)
+}
+
+// Call fn with name of each root bucket in order.
+func (tx *Tx) ForEachBucket(fn func(name string) error) error {
+	return tx.root().ForEachBucket(fn)
+}
+
+// Name of bucket.
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Full name of bucket, with names of its ancestors.
+func (b *Bucket) Path() string {
+	return b.path
+}
+
+func (b *Bucket) childPath(name string) string {
+	if b.id == 0 {
+		return name
+	}
+
+	return b.path + "/" + name
+}
+
+func (b *Bucket) recordKey(name string) []byte {
+	key := make([]byte, len(bucketRecordPrefix)+8+len(name))
+	n := copy(key, bucketRecordPrefix)
+	binary.BigEndian.PutUint64(key[n:], b.id)
+	copy(key[n+8:], name)
+	return key
+}
+
+func (b *Bucket) record(name string) (bucketRecord, error) {
+	var record bucketRecord
+	err := b.tx.view(b.recordKey(name), func(value []byte, object interface{}) error {
+		var err error
+		record, err = decodeBucketRecord(value)
+		return err
+	})
+
+	return record, err
+}
+
+func bucketOptions(options []*BucketOptions) (*BucketOptions, error) {
+	switch len(options) {
+	case 0:
+		return &BucketOptions{}, nil
+
+	case 1:
+		if options[0] == nil {
+			return &BucketOptions{}, nil
+		}
+
+		return options[0], nil
+
+	default:
+		return nil, WrapError(ErrInvalidOptions, "at most one bucket options, but %d", len(options))
+	}
+}
+
+// Struct type of bucket values in options, nil if bucket is untyped.
+func (o *BucketOptions) valueType() (reflect.Type, error) {
+	if o.Type == nil {
+		return nil, nil
+	}
+
+	if !meta.IsStruct(o.Type) {
+		return nil, WrapError(ErrTypeMismatch, "typed bucket requires a struct type, but %T", o.Type)
+	}
+
+	return meta.InstanceOf(o.Type).Type(), nil
+}
+
+func (b *Bucket) checkName(name string) error {
+	if b.tx.closed {
+		return ErrTxClosed
+	}
+
+	if len(name) <= 0 {
+		return WrapError(ErrInvalidName, "bucket name required")
+	}
+
+	return nil
+}
+
+// Create a sub-bucket of name, fails with ErrBucketExists if it exists.
+func (b *Bucket) CreateBucket(name string, options ...*BucketOptions) (*Bucket, error) {
+	if err := b.checkName(name); err != nil {
+		return nil, err
+	}
+
+	o, err := bucketOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.create(name, o)
+}
+
+func (b *Bucket) create(name string, options *BucketOptions) (*Bucket, error) {
+	if err := b.tx.check(true); err != nil {
+		return nil, err
+	}
+
+	valueType, err := options.valueType()
+	if err != nil {
+		return nil, err
+	}
+
+	key := b.recordKey(name)
+	if exists, err := b.tx.has(key); err != nil {
+		return nil, err
+
+	} else if exists {
+		return nil, WrapError(ErrBucketExists, "bucket '%s' exists", b.childPath(name))
+	}
+
+	id, err := b.tx.nextBucketID()
+	if err != nil {
+		return nil, err
+	}
+
+	codec := options.Codec
+	if codec == nil {
+		codec = b.tx.db.options.codec()
+	}
+
+	if options.TTL < 0 {
+		return nil, WrapError(ErrInvalidOptions, "TTL of bucket '%s' must not be negative, but %v",
+			b.childPath(name), options.TTL)
+	}
+
+	if err := checkCompressor(options.Compression); err != nil {
+		return nil, err
+	}
+
+	record := bucketRecord{
+		id:    id,
+		codec: codecName(codec),
+		ttl:   options.TTL,
+	}
+
+	if options.Compression != nil {
+		record.compression = options.Compression.Name()
+		compression := b.tx.db.compression
+		b.tx.committed = append(b.tx.committed, func() { compression.set(id, options.Compression) })
+	}
+
+	if options.Comparator != nil {
+		record.comparator = options.Comparator.Name()
+	}
+
+	if valueType != nil {
+		record.valueType = typeName(valueType)
+	}
+
+	value := record.encode()
+	if err := b.tx.write(key, func(batch *writeBatch) { batch.Put(key, value) }); err != nil {
+		return nil, err
+	}
+
+	return b.open(name, record, options)
+}
+
+func (tx *Tx) nextBucketID() (uint64, error) {
+	var last uint64
+	err := tx.view(bucketSequenceKey, func(value []byte, object interface{}) error {
+		if len(value) != 8 {
+			return WrapError(ErrCorrupted, "invalid bucket sequence of %d bytes", len(value))
+		}
+
+		last = binary.BigEndian.Uint64(value)
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, last+1)
+	err = tx.write(bucketSequenceKey, func(batch *writeBatch) { batch.Put(bucketSequenceKey, value) })
+	return last + 1, err
+}
+
+// Open a sub-bucket of name, or create it if it does not exist.
+func (b *Bucket) CreateBucketIfNotExists(name string, options ...*BucketOptions) (*Bucket, error) {
+	if err := b.checkName(name); err != nil {
+		return nil, err
+	}
+
+	o, err := bucketOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := b.record(name)
+	if errors.Is(err, ErrNotFound) {
+		return b.create(name, o)
+
+	} else if err != nil {
+		return nil, err
+	}
+
+	return b.open(name, record, o)
+}
+
+// Open a sub-bucket of name, fails with ErrBucketNotFound if it does not exist.
+func (b *Bucket) Bucket(name string, options ...*BucketOptions) (*Bucket, error) {
+	if err := b.checkName(name); err != nil {
+		return nil, err
+	}
+
+	o, err := bucketOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := b.record(name)
+	if errors.Is(err, ErrNotFound) {
+		return nil, WrapError(ErrBucketNotFound, "bucket '%s' not found", b.childPath(name))
+
+	} else if err != nil {
+		return nil, err
+	}
+
+	return b.open(name, record, o)
+}
+
+// Open a bucket of record, check options against settings in record.
+func (b *Bucket) open(name string, record bucketRecord, options *BucketOptions) (*Bucket, error) {
+	path := b.childPath(name)
+	child := &Bucket{
+		tx:     b.tx,
+		path:   path,
+		name:   name,
+		id:     record.id,
+		parent: b.id,
+		prefix: bucketPrefix(record.id),
+		ttl:    record.ttl,
+	}
+
+	if options.TTL != 0 && options.TTL != record.ttl {
+		return nil, WrapError(ErrInvalidOptions, "bucket '%s' has TTL %v, but %v",
+			path, record.ttl, options.TTL)
+	}
+
+	if options.Compression != nil && options.Compression.Name() != record.compression {
+		compression := record.compression
+		if compression == "" {
+			compression = "default"
+		}
+
+		return nil, WrapError(ErrInvalidOptions, "bucket '%s' is compressed by '%s', but '%s'",
+			path, compression, options.Compression.Name())
+	}
+
+	if options.Comparator != nil {
+		if options.Comparator.Name() != record.comparator {
+			return nil, WrapError(ErrInvalidOptions, "bucket '%s' is ordered by '%s', but '%s'",
+				path, record.comparator, options.Comparator.Name())
+		}
+
+		child.comparator = options.Comparator
+
+	} else if record.comparator != "" {
+		return nil, WrapError(ErrInvalidOptions, "bucket '%s' requires comparator '%s'",
+			path, record.comparator)
+	}
+
+	valueType, err := b.tx.db.bucketType(path, record, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Codec matters to typed buckets only, but it is checked whenever given.
+	if valueType == nil && options.Codec == nil {
+		return child, nil
+	}
+
+	codec := options.Codec
+	if codec == nil {
+		codec = b.tx.db.options.codec()
+	}
+
+	if name := codecName(codec); name != record.codec {
+		return nil, WrapError(ErrInvalidOptions, "bucket '%s' is encoded by '%s', but '%s'",
+			path, record.codec, name)
+	}
+
+	if valueType == nil {
+		return child, nil
+	}
+
+	expires, err := parseExpiresTag(valueType)
+	if err != nil {
+		return nil, err
+	}
+
+	child.collection = &Collection{
+		db:        b.tx.db,
+		name:      path,
+		prefix:    child.prefix,
+		valueType: valueType,
+		codec:     codec,
+		expires:   expires,
+		ttl:       record.ttl,
+	}
+
+	return child, nil
+}
+
+// Check type of a typed bucket, by stored type name and identity of type registered in process.
+// Return the struct type of bucket, or nil if bucket is untyped or its type is unknown.
+func (db *DB) bucketType(path string, record bucketRecord, options *BucketOptions) (reflect.Type, error) {
+	valueType, err := options.valueType()
+	if err != nil {
+		return nil, err
+	}
+
+	db.collectionLock.Lock()
+	defer db.collectionLock.Unlock()
+
+	registered := db.bucketTypes[record.id]
+	if valueType == nil {
+		return registered, nil
+	}
+
+	if record.valueType == "" {
+		return nil, WrapError(ErrTypeMismatch, "bucket '%s' is untyped, but %s", path, valueType)
+	}
+
+	if registered != nil && registered != valueType {
+		return nil, WrapError(ErrTypeMismatch, "bucket '%s' is type %s, but %s",
+			path, registered, valueType)
+	}
+
+	if name := typeName(valueType); name != record.valueType {
+		return nil, WrapError(ErrTypeMismatch, "bucket '%s' is type %s, but %s",
+			path, record.valueType, name)
+	}
+
+	db.bucketTypes[record.id] = valueType
+	return valueType, nil
+}
+
+// Delete a sub-bucket of name with all its keys and sub-buckets, atomically when transaction
+// commits.
+func (b *Bucket) DeleteBucket(name string) error {
+	if err := b.checkName(name); err != nil {
+		return err
+	}
+
+	if err := b.tx.check(true); err != nil {
+		return err
+	}
+
+	record, err := b.record(name)
+	if errors.Is(err, ErrNotFound) {
+		return WrapError(ErrBucketNotFound, "bucket '%s' not found", b.childPath(name))
+
+	} else if err != nil {
+		return err
+	}
+
+	child := &Bucket{tx: b.tx, id: record.id, prefix: bucketPrefix(record.id)}
+	if err := child.clear(); err != nil {
+		return err
+	}
+
+	key := b.recordKey(name)
+	return b.tx.write(key, func(batch *writeBatch) { batch.Delete(key) })
+}
+
+// Delete all keys and sub-buckets.
+func (b *Bucket) clear() error {
+	keys, err := b.keys(b.prefix)
+	if err != nil {
+		return err
+	}
+
+	children, err := b.children()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := child.clear(); err != nil {
+			return err
+		}
+
+		keys = append(keys, b.recordKey(child.name))
+	}
+
+	for _, key := range keys {
+		k := key
+		if err := b.tx.write(k, func(batch *writeBatch) { batch.Delete(k) }); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Full keys in namespace, in bytewise order.
+func (b *Bucket) keys(namespace []byte) ([][]byte, error) {
+	iter, err := b.tx.iterator(namespace, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for ok := iter.First(); ok; ok = iter.Next() {
+		keys = append(keys, prefixedKey(namespace, iter.Key()))
+	}
+
+	err = iter.Error()
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	return keys, err
+}
+
+// Sub-buckets in order of names, opened without settings, for internal use only.
+func (b *Bucket) children() ([]*Bucket, error) {
+	namespace := b.recordKey("")
+	iter, err := b.tx.iterator(namespace, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []*Bucket
+	for ok := iter.First(); ok && err == nil; ok = iter.Next() {
+		var record bucketRecord
+		record, err = decodeBucketRecord(iter.Value())
+		if err == nil {
+			name := string(iter.Key())
+			children = append(children, &Bucket{
+				tx:     b.tx,
+				path:   b.childPath(name),
+				name:   name,
+				id:     record.id,
+				parent: b.id,
+				prefix: bucketPrefix(record.id),
+			})
+		}
+	}
+
+	if err == nil {
+		err = iter.Error()
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	return children, err
+}
+
+// Call fn with name of each sub-bucket in order.
+func (b *Bucket) ForEachBucket(fn func(name string) error) error {
+	children, err := b.children()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := fn(child.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Bucket) key(key []byte) ([]byte, error) {
+	if b.id == 0 {
+		return nil, WrapError(ErrBucketNotFound, "root is not a bucket")
+	}
+
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	return prefixedKey(b.prefix, key), nil
+}
+
+// Get value of key in bucket, the returned value is a copy owned by caller.
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	k, err := b.key(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	err = b.tx.view(k, func(view []byte, object interface{}) error {
+		var err error
+		value, err = duplicateBytes(view)
+		return err
+	})
+
+	return value, err
+}
+
+// Check whether key exists in bucket.
+func (b *Bucket) Has(key []byte) (bool, error) {
+	k, err := b.key(key)
+	if err != nil {
+		return false, err
+	}
+
+	return b.tx.has(k)
+}
+
+// Set value of key in bucket, both key and value are copied. Key expires after default TTL of
+// bucket if it is set.
+func (b *Bucket) Put(key []byte, value []byte) error {
+	k, err := b.key(key)
+	if err != nil {
+		return err
+	}
+
+	if b.ttl > 0 {
+		return b.tx.putExpiring(k, value, nil, b.tx.db.now()+int64(b.ttl))
+	}
+
+	valueCopy, err := duplicateBytes(value)
+	if err != nil {
+		return err
+	}
+
+	if valueCopy == nil {
+		valueCopy = []byte{}
+	}
+
+	return b.tx.write(k, func(batch *writeBatch) { batch.Put(k, valueCopy) })
+}
+
+// Set value of key in bucket, which expires after ttl instead of default TTL of bucket.
+func (b *Bucket) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	k, err := b.key(key)
+	if err != nil {
+		return err
+	}
+
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+
+	return b.tx.putExpiring(k, value, nil, b.tx.db.now()+int64(ttl))
+}
+
+// Default TTL of keys in bucket, 0 if keys never expire by default.
+func (b *Bucket) TTL() time.Duration {
+	return b.ttl
+}
+
+// Set compression of keys in bucket, Options.Compression is used if c is nil. It takes effect
+// when transaction commits, blocks written before are compressed as they are until compacted.
+func (b *Bucket) SetCompression(c Compressor) error {
+	if err := b.tx.check(true); err != nil {
+		return err
+	}
+
+	if b.id == 0 {
+		return WrapError(ErrBucketNotFound, "root is not a bucket")
+	}
+
+	if err := checkCompressor(c); err != nil {
+		return err
+	}
+
+	parent := &Bucket{tx: b.tx, id: b.parent}
+	record, err := parent.record(b.name)
+	if err != nil {
+		return err
+	}
+
+	record.compression = ""
+	if c != nil {
+		record.compression = c.Name()
+	}
+
+	key := parent.recordKey(b.name)
+	value := record.encode()
+	if err := b.tx.write(key, func(batch *writeBatch) { batch.Put(key, value) }); err != nil {
+		return err
+	}
+
+	id, compression := b.id, b.tx.db.compression
+	b.tx.committed = append(b.tx.committed, func() { compression.set(id, c) })
+	return nil
+}
+
+// Load compressors of all buckets, buckets of unknown compressors use the default compressor.
+func (db *DB) loadBucketCompressions() error {
+	return db.View(func(tx *Tx) error {
+		iter, err := tx.iterator(bucketRecordPrefix, nil)
+		if err != nil {
+			return err
+		}
+
+		for ok := iter.First(); ok && err == nil; ok = iter.Next() {
+			var record bucketRecord
+			if record, err = decodeBucketRecord(iter.Value()); err == nil && record.compression != "" {
+				if c, found := compressorOfName(record.compression); found {
+					db.compression.set(record.id, c)
+				}
+			}
+		}
+
+		if err == nil {
+			err = iter.Error()
+		}
+
+		if errClose := iter.Close(); err == nil {
+			err = errClose
+		}
+
+		return err
+	})
+}
+
+// Delete key in bucket.
+func (b *Bucket) Delete(key []byte) error {
+	k, err := b.key(key)
+	if err != nil {
+		return err
+	}
+
+	return b.tx.write(k, func(batch *writeBatch) { batch.Delete(k) })
+}
+
+func (b *Bucket) typed() (*TxCollection, error) {
+	if b.collection == nil {
+		return nil, WrapError(ErrTypeMismatch, "bucket '%s' is untyped, or opened without type", b.path)
+	}
+
+	return b.tx.Collection(b.collection), nil
+}
+
+// Put a typed value of key, value must be the struct type of bucket or a pointer to it.
+func (b *Bucket) PutValue(key []byte, value interface{}) error {
+	c, err := b.typed()
+	if err != nil {
+		return err
+	}
+
+	return c.Put(key, value)
+}
+
+// Get a typed value of key into out, a pointer to the struct type of bucket.
+func (b *Bucket) GetValue(key []byte, out interface{}) error {
+	c, err := b.typed()
+	if err != nil {
+		return err
+	}
+
+	return c.Get(key, out)
+}
+
+// Struct type of typed values in bucket, nil if bucket is untyped or opened without type.
+func (b *Bucket) Type() reflect.Type {
+	if b.collection == nil {
+		return nil
+	}
+
+	return b.collection.valueType
+}
+
+// Make an iterator over keys in bucket, ordered by comparator of bucket, including writes of
+// transaction itself when iterator is made. Prefix is not supported by buckets with comparator.
+func (b *Bucket) Iterator(options *IteratorOptions) (*Iterator, error) {
+	if b.comparator == nil {
+		return b.tx.iterator(b.prefix, options)
+	}
+
+	if options != nil && options.Prefix != nil {
+		return nil, WrapError(ErrInvalidOptions, "prefix is not supported by bucket '%s' with comparator",
+			b.path)
+	}
+
+	iter, err := b.tx.iterator(b.prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []overlayEntry
+	for ok := iter.First(); ok; ok = iter.Next() {
+		entries = append(entries, overlayEntry{
+			key:   prefixedKey(b.prefix, iter.Key()),
+			value: append([]byte{}, iter.Value()...),
+		})
+	}
+
+	err = iter.Error()
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(b.prefix)
+	compare := func(x []byte, y []byte) int { return b.comparator.Compare(x[n:], y[n:]) }
+	return newOrderedIterator(newSliceIterator(entries, compare), b.prefix, compare, options)
+}
+
+// Call fn with each key and value in bucket in order. Key and value are valid during fn only.
+func (b *Bucket) ForEach(fn func(key []byte, value []byte) error) error {
+	iter, err := b.Iterator(nil)
+	if err != nil {
+		return err
+	}
+
+	for ok := iter.First(); ok && err == nil; ok = iter.Next() {
+		err = fn(iter.Key(), iter.Value())
+	}
+
+	if err == nil {
+		err = iter.Error()
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// Statistics of a bucket, including all its sub-buckets.
+type BucketStats struct {
+	// Number of keys.
+	KeyN int
+	// Total size of keys and values.
+	KeySize   int64
+	ValueSize int64
+	// Number of sub-buckets, nested ones included.
+	BucketN int
+	// Levels of buckets, 1 for a bucket without sub-buckets.
+	Depth int
+}
+
+func (s *BucketStats) add(other BucketStats) {
+	s.KeyN += other.KeyN
+	s.KeySize += other.KeySize
+	s.ValueSize += other.ValueSize
+	s.BucketN += other.BucketN
+}
+
+// Statistics of bucket in transaction, including writes of transaction itself.
+func (b *Bucket) Stats() (BucketStats, error) {
+	stats := BucketStats{Depth: 1}
+	iter, err := b.tx.iterator(b.prefix, nil)
+	if err != nil {
+		return stats, err
+	}
+
+	for ok := iter.First(); ok; ok = iter.Next() {
+		stats.KeyN++
+		stats.KeySize += int64(len(iter.Key()))
+		stats.ValueSize += int64(len(iter.Value()))
+	}
+
+	err = iter.Error()
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return stats, err
+	}
+
+	children, err := b.children()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, child := range children {
+		childStats, err := child.Stats()
+		if err != nil {
+			return stats, err
+		}
+
+		stats.add(childStats)
+		stats.BucketN++
+		if childStats.Depth+1 > stats.Depth {
+			stats.Depth = childStats.Depth + 1
+		}
+	}
+
+	return stats, nil
+}
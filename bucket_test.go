@@ -0,0 +1,595 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func TestBucketNested(t *testing.T) {
+	db, err := Open(Options{Dir: t.TempDir(), Engine: EngineBTree})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		tenant, err := tx.CreateBucketIfNotExists("tenant-a")
+		if err != nil {
+			return err
+		}
+
+		wizards, err := tenant.CreateBucket("wizards")
+		if err != nil {
+			return err
+		}
+
+		if wizards.Path() != "tenant-a/wizards" {
+			t.Errorf("unexpected path: %s", wizards.Path())
+		}
+
+		if err := wizards.Put([]byte("harry"), []byte("potter")); err != nil {
+			return err
+		}
+
+		// A key and a sub-bucket may have the same name.
+		if err := tenant.Put([]byte("wizards"), []byte("hogwarts")); err != nil {
+			return err
+		}
+
+		other, err := tx.CreateBucket("tenant-b")
+		if err != nil {
+			return err
+		}
+
+		return other.Put([]byte("harry"), []byte("dresden"))
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	db, err = Open(db.options)
+	if err != nil {
+		t.Fatalf("reopen database failed: %v", err)
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *Tx) error {
+		var names []string
+		tx.ForEachBucket(func(name string) error {
+			names = append(names, name)
+			return nil
+		})
+
+		if fmt.Sprint(names) != "[tenant-a tenant-b]" {
+			t.Errorf("unexpected buckets: %v", names)
+		}
+
+		tenant, err := tx.Bucket("tenant-a")
+		if err != nil {
+			return err
+		}
+
+		wizards, err := tenant.Bucket("wizards")
+		if err != nil {
+			return err
+		}
+
+		if value, err := wizards.Get([]byte("harry")); err != nil || string(value) != "potter" {
+			t.Errorf("unexpected value: %s, %v", value, err)
+		}
+
+		if value, err := tenant.Get([]byte("wizards")); err != nil || string(value) != "hogwarts" {
+			t.Errorf("unexpected value: %s, %v", value, err)
+		}
+
+		if _, err := tenant.Get([]byte("harry")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("keys of buckets should be isolated: %v", err)
+		}
+
+		if _, err := tx.Get([]byte("harry")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("keys of buckets should be isolated: %v", err)
+		}
+
+		if _, err := tx.Bucket("wizards"); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		if _, err := tx.CreateBucketIfNotExists("tenant-c"); !errors.Is(err, ErrTxNotWritable) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("view failed: %v", err)
+	}
+}
+
+func TestBucketCreate(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	err := db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket(""); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		b, err := tx.CreateBucket("gryffindor")
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucket("gryffindor"); !errors.Is(err, ErrBucketExists) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		again, err := tx.CreateBucketIfNotExists("gryffindor")
+		if err != nil || again.id != b.id {
+			t.Errorf("unexpected bucket: %v, %v", again, err)
+		}
+
+		if _, err := tx.CreateBucket("slytherin", nil, nil); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	// Concurrent creations conflict on bucket sequence.
+	tx1, _ := db.Begin(true)
+	tx2, _ := db.Begin(true)
+	if _, err := tx1.CreateBucket("ravenclaw"); err != nil {
+		t.Fatalf("create bucket failed: %v", err)
+	}
+
+	if _, err := tx2.CreateBucket("hufflepuff"); err != nil {
+		t.Fatalf("create bucket failed: %v", err)
+	}
+
+	if err := tx1.Commit(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := tx2.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Number of keys stored for buckets, including metadata.
+func countBucketKeys(t *testing.T, db *DB) int {
+	snapshot, err := db.engine.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	defer snapshot.Release()
+
+	iter := snapshot.Iterator()
+	defer iter.Close()
+
+	n := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if key[0] == namespaceBucket || bytes.HasPrefix(key, bucketRecordPrefix) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestBucketDelete(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	err := db.Update(func(tx *Tx) error {
+		hogwarts, err := tx.CreateBucket("hogwarts")
+		if err != nil {
+			return err
+		}
+
+		for _, house := range []string{"gryffindor", "slytherin"} {
+			b, err := hogwarts.CreateBucket(house)
+			if err != nil {
+				return err
+			}
+
+			students, err := b.CreateBucket("students")
+			if err != nil {
+				return err
+			}
+
+			for i := 0; i < 10; i++ {
+				if err := students.Put([]byte(fmt.Sprintf("student-%d", i)), []byte(house)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := hogwarts.Put([]byte("headmaster"), []byte("dumbledore")); err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucket("azkaban")
+		return err
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	before := countBucketKeys(t, db)
+
+	// Rollback of a deletion keeps everything.
+	tx, _ := db.Begin(true)
+	if err := tx.DeleteBucket("hogwarts"); err != nil {
+		t.Fatalf("delete bucket failed: %v", err)
+	}
+
+	if _, err := tx.Bucket("hogwarts"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("deleted bucket should not be found in transaction: %v", err)
+	}
+
+	tx.Rollback()
+	if n := countBucketKeys(t, db); n != before {
+		t.Errorf("rollback should keep all keys: %d <=> %d", n, before)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.DeleteBucket("dementors"); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		return tx.DeleteBucket("hogwarts")
+	})
+
+	if err != nil {
+		t.Fatalf("delete bucket failed: %v", err)
+	}
+
+	// Record of azkaban only.
+	if n := countBucketKeys(t, db); n != 1 {
+		t.Errorf("keys of deleted buckets should be deleted, %d left", n)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket("hogwarts")
+		if err != nil {
+			return err
+		}
+
+		if _, err := b.Bucket("gryffindor"); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("sub-buckets should be deleted: %v", err)
+		}
+
+		if _, err := b.Get([]byte("headmaster")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("keys should be deleted: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+}
+
+func TestBucketStats(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	err := db.Update(func(tx *Tx) error {
+		weasley, err := tx.CreateBucket("weasley")
+		if err != nil {
+			return err
+		}
+
+		weasley.Put([]byte("ron"), []byte("keeper"))
+		weasley.Put([]byte("ginny"), []byte("chaser"))
+		twins, err := weasley.CreateBucket("twins")
+		if err != nil {
+			return err
+		}
+
+		twins.Put([]byte("fred"), []byte("beater"))
+		if _, err := twins.CreateBucket("shop"); err != nil {
+			return err
+		}
+
+		stats, err := weasley.Stats()
+		if err != nil {
+			return err
+		}
+
+		expected := BucketStats{
+			KeyN:      3,
+			KeySize:   12,
+			ValueSize: 18,
+			BucketN:   2,
+			Depth:     3,
+		}
+
+		if stats != expected {
+			t.Errorf("unexpected stats: %+v <=> %+v", stats, expected)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+}
+
+type testReverseComparator struct{}
+
+func (testReverseComparator) Name() string {
+	return "test.reverse"
+}
+
+func (testReverseComparator) Compare(a []byte, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+type testNamedCodec struct {
+	JSONCodec
+}
+
+func (testNamedCodec) Name() string {
+	return "test.json"
+}
+
+func TestBucketComparator(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	options := &BucketOptions{Comparator: testReverseComparator{}}
+	err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket("years", options)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range []string{"first", "second", "third", "fourth"} {
+			if err := b.Put([]byte(name), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		if _, err := tx.Bucket("years"); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("comparator should be required: %v", err)
+		}
+
+		b, err := tx.Bucket("years", options)
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		b.ForEach(func(key []byte, value []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+
+		if fmt.Sprint(keys) != "[third second fourth first]" {
+			t.Errorf("unexpected order: %v", keys)
+		}
+
+		iter, err := b.Iterator(&IteratorOptions{LowerBound: []byte("second")})
+		if err != nil {
+			return err
+		}
+		defer iter.Close()
+
+		keys = keys[:0]
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			keys = append(keys, string(iter.Key()))
+		}
+
+		if fmt.Sprint(keys) != "[first fourth second]" {
+			t.Errorf("unexpected order: %v", keys)
+		}
+
+		if _, err := b.Iterator(&IteratorOptions{Prefix: []byte("f")}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("view failed: %v", err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket("potions", &BucketOptions{Codec: testNamedCodec{}})
+		if err != nil {
+			return err
+		}
+
+		if b.Type() != nil {
+			t.Errorf("bucket should be untyped: %v", b.Type())
+		}
+
+		if _, err := tx.Bucket("potions", &BucketOptions{Codec: JSONCodec{}}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		if _, err := tx.Bucket("potions", options); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+}
+
+func TestBucketTyped(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	options := &BucketOptions{Type: &testWizard{}}
+	err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket("wizards", options)
+		if err != nil {
+			return err
+		}
+
+		harry := testWizard{Name: "Harry Potter", House: "Gryffindor", Born: 1980}
+		if err := b.PutValue([]byte("harry"), &harry); err != nil {
+			return err
+		}
+
+		harry.House = "Slytherin"
+		var got testWizard
+		if err := b.GetValue([]byte("harry"), &got); err != nil {
+			return err
+		}
+
+		if got.House != "Gryffindor" {
+			t.Errorf("value should be copied when put: %+v", got)
+		}
+
+		err = b.PutValue([]byte("hedwig"), &testCreature{Name: "Hedwig"})
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		_, err = tx.CreateBucket("owls", &BucketOptions{Type: "hedwig"})
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		plain, err := tx.CreateBucket("plain")
+		if err != nil {
+			return err
+		}
+
+		if err := plain.PutValue([]byte("harry"), &harry); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		// Type is known once the bucket is opened with it.
+		b, err := tx.Bucket("wizards")
+		if err != nil {
+			return err
+		}
+
+		var harry testWizard
+		if err := b.GetValue([]byte("harry"), &harry); err != nil || harry.Name != "Harry Potter" {
+			t.Errorf("unexpected value: %+v, %v", harry, err)
+		}
+
+		_, err = tx.Bucket("wizards", &BucketOptions{Type: testCreature{}})
+		var metaErr *meta.MetaError
+		if !errors.As(err, &metaErr) || !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		_, err = tx.Bucket("plain", options)
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("view failed: %v", err)
+	}
+}
+
+func TestBucketTypeIdentity(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket("wizards", &BucketOptions{Type: testWizard{}})
+		return err
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	// A different type of the same name, as if it is declared in another scope.
+	type testWizard struct {
+		Name string
+	}
+
+	err = db.View(func(tx *Tx) error {
+		_, err := tx.Bucket("wizards", &BucketOptions{Type: testWizard{}})
+		return err
+	})
+
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBucketRecord(t *testing.T) {
+	record := bucketRecord{
+		id:          42,
+		codec:       "pinkis.JSONCodec",
+		comparator:  "test.reverse",
+		valueType:   "github.com/flily/pinkis.testWizard",
+		ttl:         time.Hour,
+		compression: "zstd",
+	}
+
+	got, err := decodeBucketRecord(record.encode())
+	if err != nil || got != record {
+		t.Errorf("unexpected record: %+v, %v", got, err)
+	}
+
+	data := record.encode()
+	if _, err := decodeBucketRecord(data[:len(data)-1]); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Records without compressor are written before buckets may be compressed differently.
+	record.compression = ""
+	data = record.encode()
+	if got, err := decodeBucketRecord(data[:len(data)-1]); err != nil || got != record {
+		t.Errorf("unexpected record: %+v, %v", got, err)
+	}
+
+	// Records without TTL are written before buckets may expire keys.
+	record.ttl = 0
+	data = record.encode()
+	if got, err := decodeBucketRecord(data[:len(data)-2]); err != nil || got != record {
+		t.Errorf("unexpected record: %+v, %v", got, err)
+	}
+}
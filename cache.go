@@ -0,0 +1,256 @@
+package pinkis
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"reflect"
+	"sync"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Number of shards of block cache, each shard has its own lock and LRU list.
+const cacheShards = 16
+
+// CacheStats are statistics of block cache of a database.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Number of entries and their total charge, including pinned ones.
+	Entries int
+	Size    int64
+	// Charge of pinned entries, which are never evicted.
+	PinnedSize int64
+	Capacity   int64
+}
+
+// A sharded LRU cache of blocks of tables and decoded typed values, with a budget of bytes.
+// Entries are charged by their sizes, the least recently used unpinned entries are evicted when
+// a shard is over budget. It is safe for concurrent use, a nil cache caches nothing.
+type blockCache struct {
+	shards [cacheShards]cacheShard
+}
+
+type cacheShard struct {
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	pinned   int64
+	hits     uint64
+	misses   uint64
+	entries  map[string]*list.Element
+	// Unpinned entries, the most recently used first.
+	lru *list.List
+}
+
+type cacheEntry struct {
+	key    string
+	value  interface{}
+	charge int64
+	pinned bool
+}
+
+// Make a cache of capacity bytes, nil if capacity is not positive.
+func newBlockCache(capacity int64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	c := &blockCache{}
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.capacity = (capacity + cacheShards - 1) / cacheShards
+		shard.entries = make(map[string]*list.Element)
+		shard.lru = list.New()
+	}
+
+	return c
+}
+
+func (c *blockCache) shard(key string) *cacheShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &c.shards[h.Sum32()%cacheShards]
+}
+
+// Get value of key, and mark it as the most recently used.
+func (c *blockCache) Get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, found := s.entries[key]
+	if !found {
+		s.misses++
+		return nil, false
+	}
+
+	s.hits++
+	entry := element.Value.(*cacheEntry)
+	if !entry.pinned {
+		s.lru.MoveToFront(element)
+	}
+
+	return entry.value, true
+}
+
+// Put value of key charged by charge bytes, replacing the existing one. A pinned entry stays until
+// it is erased.
+func (c *blockCache) Put(key string, value interface{}, charge int64, pinned bool) {
+	if c == nil {
+		return
+	}
+
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.erase(key)
+	entry := &cacheEntry{key: key, value: value, charge: charge, pinned: pinned}
+	element := &list.Element{Value: entry}
+	if pinned {
+		s.pinned += charge
+
+	} else {
+		element = s.lru.PushFront(entry)
+	}
+
+	s.entries[key] = element
+	s.size += charge
+	s.evict()
+}
+
+// Erase entry of key, pinned or not.
+func (c *blockCache) Erase(key string) {
+	if c == nil {
+		return
+	}
+
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.erase(key)
+}
+
+func (s *cacheShard) erase(key string) {
+	element, found := s.entries[key]
+	if !found {
+		return
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if entry.pinned {
+		s.pinned -= entry.charge
+
+	} else {
+		s.lru.Remove(element)
+	}
+
+	delete(s.entries, key)
+	s.size -= entry.charge
+}
+
+// Evict the least recently used entries until shard is in budget, or only pinned entries left.
+func (s *cacheShard) evict() {
+	for s.size > s.capacity && s.lru.Len() > 0 {
+		s.erase(s.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+func (c *blockCache) Stats() CacheStats {
+	stats := CacheStats{}
+	if c == nil {
+		return stats
+	}
+
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		stats.Hits += s.hits
+		stats.Misses += s.misses
+		stats.Entries += len(s.entries)
+		stats.Size += s.size
+		stats.PinnedSize += s.pinned
+		stats.Capacity += s.capacity
+		s.lock.Unlock()
+	}
+
+	return stats
+}
+
+// Key of block at offset of table.
+func blockCacheKey(table uint64, offset uint64) string {
+	var key [17]byte
+	key[0] = 'b'
+	binary.BigEndian.PutUint64(key[1:], table)
+	binary.BigEndian.PutUint64(key[9:], offset)
+	return string(key[:])
+}
+
+// A typed value decoded from data, cached by hash of data.
+type cachedValue struct {
+	valueType reflect.Type
+	data      []byte
+	value     reflect.Value
+}
+
+func valueCacheKey(prefix []byte, data []byte) string {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	key := make([]byte, 1+len(prefix)+8)
+	key[0] = 'v'
+	copy(key[1:], prefix)
+	binary.BigEndian.PutUint64(key[1+len(prefix):], h.Sum64())
+	return string(key)
+}
+
+// Decode a typed value of collection from data, or copy it from cache. Values in cache are never
+// handed out, callers own the copies returned.
+func (c *Collection) decodeCached(data []byte) (reflect.Value, error) {
+	cache := c.db.cache
+	if cache == nil {
+		return c.decode(data)
+	}
+
+	key := valueCacheKey(c.prefix, data)
+	if v, found := cache.Get(key); found {
+		cached := v.(*cachedValue)
+		if cached.valueType == c.valueType && bytes.Equal(cached.data, data) {
+			return duplicateValue(cached.value)
+		}
+	}
+
+	value, err := c.decode(data)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	cached := &cachedValue{
+		valueType: c.valueType,
+		data:      append([]byte{}, data...),
+	}
+
+	if cached.value, err = duplicateValue(value); err != nil {
+		return reflect.Value{}, err
+	}
+
+	// Decoded values take about as much memory as encoded data.
+	cache.Put(key, cached, int64(2*len(data)+len(key)), false)
+	return value, nil
+}
+
+func duplicateValue(value reflect.Value) (reflect.Value, error) {
+	copy, err := meta.Duplicate(value.Interface())
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	return reflect.ValueOf(copy), nil
+}
@@ -0,0 +1,131 @@
+package pinkis
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBlockCacheEviction(t *testing.T) {
+	// 10 bytes per shard.
+	cache := newBlockCache(10 * cacheShards)
+	s := &cache.shards[0]
+	var keys []string
+	for i := 0; len(keys) < 4; i++ {
+		key := fmt.Sprintf("block-%d", i)
+		if cache.shard(key) == s {
+			keys = append(keys, key)
+		}
+	}
+
+	cache.Put(keys[0], "harry", 4, false)
+	cache.Put(keys[1], "hermione", 4, false)
+	if value, found := cache.Get(keys[0]); !found || value != "harry" {
+		t.Errorf("unexpected value: %v, %v", value, found)
+	}
+
+	// keys[1] is the least recently used.
+	cache.Put(keys[2], "ron", 4, false)
+	if _, found := cache.Get(keys[1]); found {
+		t.Errorf("%s should be evicted", keys[1])
+	}
+
+	cache.Put(keys[3], "index", 8, true)
+	if _, found := cache.Get(keys[0]); found {
+		t.Errorf("%s should be evicted by pinned entry", keys[0])
+	}
+
+	if _, found := cache.Get(keys[2]); found {
+		t.Errorf("%s should be evicted by pinned entry", keys[2])
+	}
+
+	cache.Put(keys[0], "harry", 4, false)
+	if value, found := cache.Get(keys[3]); !found || value != "index" {
+		t.Errorf("pinned entry should never be evicted: %v, %v", value, found)
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 3 || stats.Entries != 1 || stats.Size != 8 || stats.PinnedSize != 8 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	cache.Erase(keys[3])
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Size != 0 || stats.PinnedSize != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBlockCacheDisabled(t *testing.T) {
+	cache := newBlockCache(-1)
+	if cache != nil {
+		t.Fatalf("cache should be disabled")
+	}
+
+	cache.Put("harry", "potter", 1, true)
+	if _, found := cache.Get("harry"); found {
+		t.Errorf("nothing should be cached")
+	}
+
+	cache.Erase("harry")
+	if stats := cache.Stats(); stats != (CacheStats{}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestBlockCacheLSM(t *testing.T) {
+	options := Options{
+		Dir:          t.TempDir(),
+		Engine:       EngineLSM,
+		SyncPolicy:   SyncNever,
+		MemtableSize: 4 << 10,
+		BlockSize:    512,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open lsm database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	c, err := db.Collection("wizards", testWizard{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		w := testWizard{Name: fmt.Sprintf("wizard-%d", i), Born: 1900 + i}
+		if err := c.Put([]byte(w.Name), w); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	before := db.CacheStats()
+	for i := 0; i < 100; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("muggle-%d", i))); err == nil {
+			t.Fatalf("muggle should not be found")
+		}
+	}
+
+	// Almost all missing keys are excluded by filters without reading any block.
+	if stats := db.CacheStats(); stats.Misses-before.Misses > 10 {
+		t.Errorf("too many blocks read for missing keys: %+v", stats)
+	}
+
+	var w testWizard
+	for i := 0; i < 2; i++ {
+		if err := c.Get([]byte("wizard-42"), &w); err != nil || w.Born != 1942 {
+			t.Fatalf("unexpected value: %+v, %v", w, err)
+		}
+
+		// Values owned by caller never change values cached.
+		w.Born = 1000
+	}
+
+	if stats := db.CacheStats(); stats.Hits <= before.Hits || stats.PinnedSize <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,1006 @@
+package pinkis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Changes of keys are logged in change namespace when Options.ChangeLog is set, in the same batch
+// as writes, so that change log is exactly as durable as data. A record is keyed by its position,
+// the sequence number of the record itself, which is after all writes of its batch:
+//
+//	key    0x06 position uint64 big endian
+//	value  sequence uvarint, time varint, type byte, flags byte, collection, key, old value and
+//	       value, each as length uvarint and bytes, expires varint, bucket as length uvarint and
+//	       bytes
+//
+// Bucket is absent for keys out of buckets. Flags tell whether old value and value exist. Records
+// before the start position stored in meta namespace are trimmed, and positions of the next
+// changes to read by consumers are stored there.
+var (
+	changeStartKey     = []byte("\x00change-start")
+	changeOffsetPrefix = []byte("\x00change-offset/")
+)
+
+const (
+	changeFlagOld   byte = 1 << 0
+	changeFlagValue byte = 1 << 1
+)
+
+// ChangeRecord is a change of a key read from change log. All writes of a key in a batch make a
+// single change, and keys deleted by a range deletion share its sequence number. Keys expiring
+// make no change, consumers tell it by Expires.
+type ChangeRecord struct {
+	// Position of record in change log, it is after Sequence.
+	Position uint64
+	// Sequence number of the last write of key in the batch.
+	Sequence uint64
+	// When the batch is written, by Options.Clock.
+	Time time.Time
+	Type ChangeType
+	// Name of collection of key, empty for keys out of collections.
+	Collection string
+	// Path of bucket of key as Bucket.Path, empty for keys out of buckets.
+	Bucket string
+	Key    []byte
+	// Values before and after change, nil if key does not exist.
+	OldValue []byte
+	Value    []byte
+	// Expiry of value put with a TTL, zero if it never expires.
+	Expires time.Time
+}
+
+func changeKey(position uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = namespaceChange
+	binary.BigEndian.PutUint64(key[1:], position)
+	return key
+}
+
+func (r ChangeRecord) encode() []byte {
+	data := make([]byte, 0, 2+7*binary.MaxVarintLen64+len(r.Collection)+len(r.Bucket)+len(r.Key)+
+		len(r.OldValue)+len(r.Value))
+	data = appendUvarint(data, r.Sequence)
+	data = appendVarint(data, r.Time.UnixNano())
+	flags := byte(0)
+	if r.OldValue != nil {
+		flags |= changeFlagOld
+	}
+
+	if r.Value != nil {
+		flags |= changeFlagValue
+	}
+
+	data = append(data, byte(r.Type), flags)
+	for _, field := range [][]byte{[]byte(r.Collection), r.Key, r.OldValue, r.Value} {
+		data = appendLengthPrefixed(data, field)
+	}
+
+	expires := int64(0)
+	if !r.Expires.IsZero() {
+		expires = r.Expires.UnixNano()
+	}
+
+	data = appendVarint(data, expires)
+	if len(r.Bucket) > 0 {
+		data = appendLengthPrefixed(data, []byte(r.Bucket))
+	}
+
+	return data
+}
+
+func decodeChangeRecord(position uint64, data []byte) (ChangeRecord, error) {
+	r := ChangeRecord{Position: position}
+	invalid := WrapError(ErrCorrupted, "invalid change record at %d", position)
+	seq, n := binary.Uvarint(data)
+	if n <= 0 {
+		return r, invalid
+	}
+
+	nanos, m := binary.Varint(data[n:])
+	if m <= 0 || len(data) < n+m+2 {
+		return r, invalid
+	}
+
+	r.Sequence = seq
+	r.Time = time.Unix(0, nanos)
+	r.Type = ChangeType(data[n+m])
+	flags := data[n+m+1]
+	rest := data[n+m+2:]
+	var fields [4][]byte
+	for i := range fields {
+		field, next, ok := readLengthPrefixed(rest)
+		if !ok {
+			return r, invalid
+		}
+
+		fields[i] = append([]byte{}, field...)
+		rest = next
+	}
+
+	expires, k := binary.Varint(rest)
+	if k <= 0 {
+		return r, invalid
+	}
+
+	if rest = rest[k:]; len(rest) > 0 {
+		bucket, next, ok := readLengthPrefixed(rest)
+		if !ok || len(next) > 0 {
+			return r, invalid
+		}
+
+		r.Bucket = string(bucket)
+	}
+
+	r.Collection, r.Key = string(fields[0]), fields[1]
+	if flags&changeFlagOld != 0 {
+		r.OldValue = fields[2]
+	}
+
+	if flags&changeFlagValue != 0 {
+		r.Value = fields[3]
+	}
+
+	if expires != 0 {
+		r.Expires = time.Unix(0, expires)
+	}
+
+	return r, nil
+}
+
+// Keys out of collections, keys in collections and keys in buckets are logged.
+func loggable(key []byte) bool {
+	if len(key) <= 0 {
+		return false
+	}
+
+	switch key[0] {
+	case namespaceDefault, namespaceCollection, namespaceBucket:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Record of change of a logged key, false if key is malformed, or its bucket is not in paths.
+func changeRecordOf(key []byte, paths map[uint64]string) (ChangeRecord, bool) {
+	switch key[0] {
+	case namespaceDefault:
+		return ChangeRecord{Key: key[1:]}, true
+
+	case namespaceBucket:
+		if len(key) < 9 {
+			return ChangeRecord{}, false
+		}
+
+		path, found := paths[binary.BigEndian.Uint64(key[1:9])]
+		return ChangeRecord{Bucket: path, Key: key[9:]}, found
+
+	default:
+		name, rest, ok := splitNamespacePrefix(key)
+		return ChangeRecord{Collection: name, Key: rest}, ok
+	}
+}
+
+// Parent and name of a bucket, of which paths of buckets are made.
+type bucketNode struct {
+	parent uint64
+	name   string
+}
+
+// Decode a bucket record of key, with bucketRecordPrefix stripped, and value.
+func decodeBucketNode(key []byte, value []byte) (uint64, bucketNode, error) {
+	record, err := decodeBucketRecord(value)
+	if err != nil {
+		return 0, bucketNode{}, err
+
+	} else if len(key) < 8 {
+		return 0, bucketNode{}, WrapError(ErrCorrupted, "invalid key of bucket record of id %d",
+			record.id)
+	}
+
+	return record.id, bucketNode{parent: binary.BigEndian.Uint64(key), name: string(key[8:])}, nil
+}
+
+// Index of all buckets by ids, so that paths of buckets are found without reading bucket records
+// on each write. It is loaded when it is used first, and kept up to date by batches applied. It is
+// used with writeLock held.
+type bucketIndex struct {
+	nodes map[uint64]bucketNode
+	// Ids of buckets by keys of records, with bucketRecordPrefix stripped.
+	ids map[string]uint64
+}
+
+func (x *bucketIndex) add(key []byte, value []byte) error {
+	id, node, err := decodeBucketNode(key, value)
+	if err != nil {
+		return err
+	}
+
+	x.nodes[id] = node
+	x.ids[string(key)] = id
+	return nil
+}
+
+// Load bucket index from engine. Called with writeLock held, engine is read without checking
+// whether database is closed.
+func (db *DB) loadBucketIndex() (*bucketIndex, error) {
+	snapshot, err := db.engine.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	index := &bucketIndex{nodes: make(map[uint64]bucketNode), ids: make(map[string]uint64)}
+	iter := newIterator(snapshot.Iterator(), bucketRecordPrefix, nil)
+	iter.snapshot = snapshot
+	for ok := iter.First(); ok && err == nil; ok = iter.Next() {
+		err = index.add(iter.Key(), iter.Value())
+	}
+
+	if err == nil {
+		err = iter.Error()
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// Update bucket index loaded with records written by batch applied. Index is dropped to be loaded
+// again if records of batch can not be followed.
+func (db *DB) updateBucketIndex(batch *writeBatch) {
+	index := db.buckets
+	if index == nil {
+		return
+	}
+
+	end := prefixSuccessor(bucketRecordPrefix)
+	for _, e := range batch.entries {
+		if e.kind == kindDeleteRange {
+			if bytes.Compare(e.key, end) < 0 && bytes.Compare(e.value, bucketRecordPrefix) > 0 {
+				db.buckets = nil
+				return
+			}
+
+			continue
+
+		} else if !bytes.HasPrefix(e.key, bucketRecordPrefix) {
+			continue
+		}
+
+		key := e.key[len(bucketRecordPrefix):]
+		switch e.kind {
+		case kindPut:
+			if err := index.add(key, e.value); err != nil {
+				db.buckets = nil
+				return
+			}
+
+		case kindDelete:
+			delete(index.nodes, index.ids[string(key)])
+			delete(index.ids, string(key))
+
+		default:
+			db.buckets = nil
+			return
+		}
+	}
+}
+
+// Paths of buckets of ids, of buckets in index and buckets created by batch. Buckets deleted by
+// batch are still in index, so that keys deleted along with them are logged with their paths.
+func (db *DB) bucketPaths(batch *writeBatch, ids []uint64) (map[uint64]string, error) {
+	if db.buckets == nil {
+		index, err := db.loadBucketIndex()
+		if err != nil {
+			return nil, err
+		}
+
+		db.buckets = index
+	}
+
+	created := make(map[uint64]bucketNode)
+	for _, e := range batch.entries {
+		if e.kind == kindPut && bytes.HasPrefix(e.key, bucketRecordPrefix) {
+			id, node, err := decodeBucketNode(e.key[len(bucketRecordPrefix):], e.value)
+			if err != nil {
+				return nil, err
+			}
+
+			created[id] = node
+		}
+	}
+
+	nodeOf := func(id uint64) (bucketNode, bool) {
+		if n, found := created[id]; found {
+			return n, true
+		}
+
+		n, found := db.buckets.nodes[id]
+		return n, found
+	}
+
+	paths := make(map[uint64]string, len(ids))
+	var pathOf func(id uint64) string
+	pathOf = func(id uint64) string {
+		if path, found := paths[id]; found {
+			return path
+		}
+
+		n, _ := nodeOf(id)
+		paths[id] = n.name
+		if _, found := nodeOf(n.parent); found {
+			paths[id] = pathOf(n.parent) + "/" + n.name
+		}
+
+		return paths[id]
+	}
+
+	for _, id := range ids {
+		if _, found := nodeOf(id); found {
+			pathOf(id)
+		}
+	}
+
+	return paths, nil
+}
+
+// State of a key changed by a batch.
+type changeState struct {
+	key     []byte
+	seq     uint64
+	old     []byte
+	existed bool
+	value   []byte
+	exists  bool
+	expires int64
+}
+
+// Make a new batch of writes of batch followed by records of changes made by them, over values in
+// engine. It is called with writeLock held, after sequence number of batch is assigned.
+func (db *DB) logChanges(batch *writeBatch) (*writeBatch, error) {
+	now := db.now()
+	states := make(map[string]*changeState)
+	load := func(key []byte) (*changeState, error) {
+		if s, found := states[string(key)]; found {
+			return s, nil
+		}
+
+		value, exists, err := viewCopy(db.engine.View, key)
+		if err != nil {
+			return nil, err
+		}
+
+		s := &changeState{key: key, old: value, existed: exists, value: value, exists: exists}
+		states[string(key)] = s
+		return s, nil
+	}
+
+	for i, e := range batch.entries {
+		seq := batch.seq + uint64(i)
+		if !loggable(e.key) {
+			continue
+		}
+
+		if e.kind == kindDeleteRange {
+			if err := db.loadRange(e.key, e.value, load); err != nil {
+				return nil, err
+			}
+
+			for _, s := range states {
+				if bytes.Compare(e.key, s.key) <= 0 && bytes.Compare(s.key, e.value) < 0 {
+					s.value, s.exists, s.expires, s.seq = nil, false, 0, seq
+				}
+			}
+
+			continue
+		}
+
+		s, err := load(e.key)
+		if err != nil {
+			return nil, err
+		}
+
+		kind, value := e.kind, e.value
+		if kind == kindMerge {
+			base := kindDelete
+			if s.exists {
+				base = kindPut
+			}
+
+			// Values read from engine are without expiry, an expired base is taken as absent.
+			var ok bool
+			if kind, value, ok, err = mergeEntry(base, s.value, [][]byte{value}, now); err != nil {
+				return nil, err
+
+			} else if !ok {
+				kind, value = kindDelete, nil
+			}
+		}
+
+		s.value, s.exists = visibleValue(kind, value, now)
+		s.expires = expiryOf(kind, value)
+		s.seq = seq
+	}
+
+	changed := make([]*changeState, 0, len(states))
+	for _, s := range states {
+		if s.existed || s.exists {
+			changed = append(changed, s)
+		}
+	}
+
+	sort.Slice(changed, func(i, j int) bool {
+		if changed[i].seq != changed[j].seq {
+			return changed[i].seq < changed[j].seq
+		}
+
+		return bytes.Compare(changed[i].key, changed[j].key) < 0
+	})
+
+	var ids []uint64
+	for _, s := range changed {
+		if s.key[0] == namespaceBucket && len(s.key) >= 9 {
+			ids = append(ids, binary.BigEndian.Uint64(s.key[1:9]))
+		}
+	}
+
+	var paths map[uint64]string
+	if len(ids) > 0 {
+		var err error
+		if paths, err = db.bucketPaths(batch, ids); err != nil {
+			return nil, err
+		}
+	}
+
+	n := len(batch.entries)
+	logged := &writeBatch{seq: batch.seq, entries: batch.entries[:n:n]}
+	for _, s := range changed {
+		r, ok := changeRecordOf(s.key, paths)
+		if !ok {
+			continue
+		}
+
+		r.Sequence, r.Time, r.Type = s.seq, time.Unix(0, now), ChangePut
+		if s.existed {
+			r.OldValue = append([]byte{}, s.old...)
+		}
+
+		if s.exists {
+			r.Value = append([]byte{}, s.value...)
+
+		} else {
+			r.Type = ChangeDelete
+		}
+
+		if s.expires != 0 {
+			r.Expires = time.Unix(0, s.expires)
+		}
+
+		logged.Put(changeKey(batch.seq+uint64(logged.Len())), r.encode())
+	}
+
+	return logged, nil
+}
+
+// Load states of keys existing in engine in [start, end).
+func (db *DB) loadRange(start []byte, end []byte,
+	load func(key []byte) (*changeState, error)) error {
+	snapshot, err := db.engine.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	defer snapshot.Release()
+
+	iter := snapshot.Iterator()
+	for iter.Seek(start); iter.Valid() && bytes.Compare(iter.Key(), end) < 0; iter.Next() {
+		if _, err = load(append([]byte{}, iter.Key()...)); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = iter.Error()
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// Number of records in change log, they are counted only if change log is limited by number.
+func (db *DB) countChanges() (int, error) {
+	iter, err := db.newIterator([]byte{namespaceChange}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for ok := iter.First(); ok; ok = iter.Next() {
+		count++
+	}
+
+	err = iter.Error()
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	return count, err
+}
+
+// Start position of change log of tx, records before it are trimmed.
+func (tx *Tx) changeStart() (uint64, error) {
+	data, err := tx.get(changeStartKey)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+
+	} else if err != nil {
+		return 0, err
+	}
+
+	start, n := binary.Uvarint(data)
+	if n <= 0 || n != len(data) {
+		return 0, WrapError(ErrCorrupted, "invalid start of change log")
+	}
+
+	return start, nil
+}
+
+// Read records of change log in order, whose positions >= from, at most limit ones, unlimited if
+// limit is not positive. Reading from a sequence number never misses changes after it. It fails
+// with ErrHistoryTruncated if records after from are trimmed, 0 means from the oldest one.
+func (db *DB) ReadChanges(from uint64, limit int) ([]ChangeRecord, error) {
+	var records []ChangeRecord
+	err := db.View(func(tx *Tx) error {
+		start, err := tx.changeStart()
+		if err != nil {
+			return err
+		}
+
+		if from != 0 && from < start {
+			return WrapError(ErrHistoryTruncated, "changes before %d are trimmed, but from %d",
+				start, from)
+		}
+
+		options := &IteratorOptions{LowerBound: changeKey(from)[1:]}
+		iter, err := tx.iterator([]byte{namespaceChange}, options)
+		if err != nil {
+			return err
+		}
+
+		for ok := iter.First(); ok && (limit <= 0 || len(records) < limit); ok = iter.Next() {
+			if len(iter.Key()) != 8 {
+				err = WrapError(ErrCorrupted, "invalid change key %x", iter.Key())
+				break
+			}
+
+			var r ChangeRecord
+			r, err = decodeChangeRecord(binary.BigEndian.Uint64(iter.Key()), iter.Value())
+			if err != nil {
+				break
+			}
+
+			records = append(records, r)
+		}
+
+		if err == nil {
+			err = iter.Error()
+		}
+
+		if errClose := iter.Close(); err == nil {
+			err = errClose
+		}
+
+		return err
+	})
+
+	return records, err
+}
+
+// Trim records of change log beyond Options.ChangeLogLimit and Options.ChangeLogRetention, return
+// number of records trimmed. It is called by reaper periodically.
+func (db *DB) TrimChanges() (int, error) {
+	limit, retention := db.options.ChangeLogLimit, db.options.ChangeLogRetention
+	if limit <= 0 && retention <= 0 {
+		return 0, nil
+	}
+
+	db.changeTrimLock.Lock()
+	defer db.changeTrimLock.Unlock()
+
+	db.writeLock.Lock()
+	count := db.changeCount
+	db.writeLock.Unlock()
+
+	deadline := db.now() - int64(retention)
+	trimmed := 0
+	end := uint64(0)
+	err := db.View(func(tx *Tx) error {
+		iter, err := tx.iterator([]byte{namespaceChange}, nil)
+		if err != nil {
+			return err
+		}
+
+		for ok := iter.First(); ok; ok = iter.Next() {
+			if limit <= 0 || count-trimmed <= limit {
+				nanos, n := int64(0), 0
+				if _, m := binary.Uvarint(iter.Value()); m > 0 {
+					nanos, n = binary.Varint(iter.Value()[m:])
+				}
+
+				if retention <= 0 || n <= 0 || nanos >= deadline {
+					break
+				}
+			}
+
+			trimmed++
+			end = binary.BigEndian.Uint64(iter.Key()) + 1
+		}
+
+		err = iter.Error()
+		if errClose := iter.Close(); err == nil {
+			err = errClose
+		}
+
+		return err
+	})
+
+	if err != nil || trimmed <= 0 {
+		return 0, err
+	}
+
+	batch := &writeBatch{}
+	batch.DeleteRange([]byte{namespaceChange}, changeKey(end))
+	batch.Put(changeStartKey, appendUvarint(nil, end))
+	if err := db.write(batch); err != nil {
+		return 0, err
+	}
+
+	db.writeLock.Lock()
+	db.changeCount -= trimmed
+	db.writeLock.Unlock()
+	return trimmed, nil
+}
+
+func changeOffsetKey(consumer string) []byte {
+	return prefixedKey(changeOffsetPrefix, []byte(consumer))
+}
+
+// Position of the next change to read by consumer, as committed by CommitChangeOffset, 0 if it
+// never commits.
+func (db *DB) ChangeOffset(consumer string) (uint64, error) {
+	if len(consumer) <= 0 {
+		return 0, WrapError(ErrInvalidName, "consumer name required")
+	}
+
+	data, err := db.get(changeOffsetKey(consumer))
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+
+	} else if err != nil {
+		return 0, err
+	}
+
+	offset, n := binary.Uvarint(data)
+	if n <= 0 || n != len(data) {
+		return 0, WrapError(ErrCorrupted, "invalid change offset of consumer '%s'", consumer)
+	}
+
+	return offset, nil
+}
+
+// Commit position of the next change to read by consumer, it is stored in database.
+func (db *DB) CommitChangeOffset(consumer string, next uint64) error {
+	if len(consumer) <= 0 {
+		return WrapError(ErrInvalidName, "consumer name required")
+	}
+
+	return db.put(changeOffsetKey(consumer), appendUvarint(nil, next))
+}
+
+// Options of exporting changes as JSON lines.
+type ExportOptions struct {
+	// Render unexported fields of typed values, they are omitted by default.
+	Unexported bool
+	// Maximum number of changes in a file, 10000 by default.
+	FileRecords int
+}
+
+func (o *ExportOptions) unexported() bool {
+	return o != nil && o.Unexported
+}
+
+func (o *ExportOptions) fileRecords() int {
+	if o == nil || o.FileRecords <= 0 {
+		return 10000
+	}
+
+	return o.FileRecords
+}
+
+// A change rendered in a JSON line. Values of opened collections are rendered as objects of their
+// fields, other values are raw bytes.
+type exportedChange struct {
+	Position   uint64      `json:"position"`
+	Sequence   uint64      `json:"sequence"`
+	Time       time.Time   `json:"time"`
+	Type       string      `json:"type"`
+	Collection string      `json:"collection,omitempty"`
+	Bucket     string      `json:"bucket,omitempty"`
+	Key        []byte      `json:"key"`
+	OldValue   interface{} `json:"old,omitempty"`
+	Value      interface{} `json:"value,omitempty"`
+	Expires    *time.Time  `json:"expires,omitempty"`
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Render v as a JSON value, structs are rendered as objects of fields got by meta.GetField.
+func renderValue(v reflect.Value, unexported bool) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+
+	t := v.Type()
+	if v.CanInterface() && (t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)) {
+		return v.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+
+		return renderValue(v.Elem(), unexported)
+
+	case reflect.Struct:
+		fields := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			name := t.Field(i).Name
+			exported := meta.IsExportedName(name)
+			if !exported && !unexported {
+				continue
+			}
+
+			field := v.Field(i)
+			if exported && v.CanInterface() {
+				value, err := meta.GetField(v.Interface(), name)
+				if err != nil {
+					continue
+				}
+
+				field = reflect.ValueOf(value)
+			}
+
+			fields[name] = renderValue(field, unexported)
+		}
+
+		return fields
+
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && v.CanInterface() && v.Kind() == reflect.Slice {
+			return v.Bytes()
+		}
+
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = renderValue(v.Index(i), unexported)
+		}
+
+		return items
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+
+		items := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := fmt.Sprint(renderValue(iter.Key(), unexported))
+			items[key] = renderValue(iter.Value(), unexported)
+		}
+
+		return items
+
+	case reflect.Bool:
+		return v.Bool()
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint()
+
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+
+	case reflect.String:
+		return v.String()
+
+	default:
+		return nil
+	}
+}
+
+// Render value of record, typed values are decoded by collection if it is opened.
+func (db *DB) renderChangeValue(r ChangeRecord, value []byte,
+	unexported bool) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	if len(r.Collection) <= 0 {
+		return value, nil
+	}
+
+	db.collectionLock.Lock()
+	c, found := db.collections[r.Collection]
+	db.collectionLock.Unlock()
+	if !found {
+		return value, nil
+	}
+
+	decoded, err := c.decode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderValue(decoded, unexported), nil
+}
+
+// Write records as JSON lines into w.
+func (db *DB) writeChanges(w io.Writer, records []ChangeRecord, options *ExportOptions) error {
+	encoder := json.NewEncoder(w)
+	for _, r := range records {
+		change := exportedChange{
+			Position:   r.Position,
+			Sequence:   r.Sequence,
+			Time:       r.Time.UTC(),
+			Type:       r.Type.String(),
+			Collection: r.Collection,
+			Bucket:     r.Bucket,
+			Key:        r.Key,
+		}
+
+		var err error
+		unexported := options.unexported()
+		if change.OldValue, err = db.renderChangeValue(r, r.OldValue, unexported); err != nil {
+			return err
+		}
+
+		if change.Value, err = db.renderChangeValue(r, r.Value, unexported); err != nil {
+			return err
+		}
+
+		if !r.Expires.IsZero() {
+			expires := r.Expires.UTC()
+			change.Expires = &expires
+		}
+
+		if err := encoder.Encode(change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Export changes whose positions >= from into w as JSON lines, at most limit ones, unlimited if
+// limit is not positive. Return position of the next change to export.
+func (db *DB) ExportChanges(w io.Writer, from uint64, limit int,
+	options *ExportOptions) (uint64, error) {
+	records, err := db.ReadChanges(from, limit)
+	if err != nil || len(records) <= 0 {
+		return from, err
+	}
+
+	if err := db.writeChanges(w, records, options); err != nil {
+		return from, err
+	}
+
+	return records[len(records)-1].Position + 1, nil
+}
+
+// Export changes after offset of consumer into new JSON lines files in dir, named by position of
+// their first changes. Offset of consumer is committed after each file is synced, so that no
+// change is lost or exported twice. Return number of changes exported.
+func (db *DB) ExportChangeFiles(consumer string, dir string, options *ExportOptions) (int, error) {
+	next, err := db.ChangeOffset(consumer)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for {
+		records, err := db.ReadChanges(next, options.fileRecords())
+		if err != nil || len(records) <= 0 {
+			return total, err
+		}
+
+		name := fmt.Sprintf("changes-%020d.jsonl", records[0].Position)
+		if err := db.writeChangeFile(filepath.Join(dir, name), records, options); err != nil {
+			return total, err
+		}
+
+		if err := syncDir(dir); err != nil {
+			return total, err
+		}
+
+		next = records[len(records)-1].Position + 1
+		if err := db.CommitChangeOffset(consumer, next); err != nil {
+			return total, err
+		}
+
+		total += len(records)
+	}
+}
+
+// Write records into a new file of path, file is renamed into path after it is synced, so that
+// a file half written is never observed.
+func (db *DB) writeChangeFile(path string, records []ChangeRecord, options *ExportOptions) error {
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	err = db.writeChanges(w, records, options)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err == nil {
+		err = os.Rename(temp, path)
+	}
+
+	if err != nil {
+		os.Remove(temp)
+	}
+
+	return err
+}
@@ -0,0 +1,530 @@
+package pinkis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func describeRecord(r ChangeRecord) string {
+	key := string(r.Key)
+	if len(r.Collection) > 0 {
+		key = r.Collection + ":" + key
+	}
+
+	if len(r.Bucket) > 0 {
+		key = r.Bucket + ":" + key
+	}
+
+	return fmt.Sprintf("%d %s %s %q->%q", r.Sequence, r.Type, key, r.OldValue, r.Value)
+}
+
+func readRecords(t *testing.T, db *DB, from uint64) []string {
+	records, err := db.ReadChanges(from, 0)
+	if err != nil {
+		t.Fatalf("read changes failed: %v", err)
+	}
+
+	var result []string
+	last := uint64(0)
+	for _, r := range records {
+		if r.Position <= last || r.Position <= r.Sequence {
+			t.Errorf("unexpected position of %s: %d after %d", describeRecord(r), r.Position, last)
+		}
+
+		last = r.Position
+		result = append(result, describeRecord(r))
+	}
+
+	return result
+}
+
+func testChangeLog(t *testing.T, engine EngineType) {
+	clock := newTestClock()
+	options := Options{
+		Engine:        engine,
+		SyncPolicy:    SyncNever,
+		Clock:         clock,
+		ReapPeriod:    -1,
+		MergeOperator: Int64Add,
+		ChangeLog:     true,
+	}
+
+	if engine != EngineMemory {
+		options.Dir = t.TempDir()
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer func() { db.Close() }()
+
+	wizards, err := db.Collection("wizards", testWizard{})
+	if err != nil {
+		t.Fatalf("open collection failed: %v", err)
+	}
+
+	steps := []func() error{
+		func() error { return db.Put([]byte("harry"), []byte("potter")) },
+		func() error { return db.Put([]byte("harry"), []byte("the chosen one")) },
+		func() error {
+			return db.Update(func(tx *Tx) error {
+				if err := tx.Put([]byte("ron"), []byte("weasley")); err != nil {
+					return err
+				}
+
+				if err := tx.Delete([]byte("harry")); err != nil {
+					return err
+				}
+
+				return tx.Put([]byte("ron"), []byte("king"))
+			})
+		},
+		func() error { return db.Delete([]byte("dudley")) },
+		func() error { return db.Merge([]byte("points"), EncodeInt64(10)) },
+		func() error { return db.Merge([]byte("points"), EncodeInt64(5)) },
+		func() error { return wizards.Put([]byte("luna"), testWizard{Name: "Luna", House: "Ravenclaw"}) },
+		func() error { return db.DeleteRange([]byte("p"), []byte("s")) },
+		func() error { return db.PutWithTTL([]byte("portkey"), []byte("boot"), time.Hour) },
+	}
+
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d failed: %v", i, err)
+		}
+	}
+
+	luna, _ := DefaultCodec.Marshal(testWizard{Name: "Luna", House: "Ravenclaw"})
+	expected := []string{
+		`1 put harry ""->"potter"`,
+		`3 put harry "potter"->"the chosen one"`,
+		`6 delete harry "the chosen one"->""`,
+		`7 put ron ""->"king"`,
+		fmt.Sprintf(`11 put points ""->%q`, EncodeInt64(10)),
+		fmt.Sprintf(`13 put points %q->%q`, EncodeInt64(10), EncodeInt64(15)),
+		fmt.Sprintf(`15 put wizards:luna ""->%q`, luna),
+		fmt.Sprintf(`17 delete points %q->""`, EncodeInt64(15)),
+		`17 delete ron "king"->""`,
+		`20 put portkey ""->"boot"`,
+	}
+
+	if records := readRecords(t, db, 0); !meta.Equal(records, expected) {
+		t.Errorf("unexpected records:\n%q\n<=>\n%q", records, expected)
+	}
+
+	if records := readRecords(t, db, 10); !meta.Equal(records, expected[4:]) {
+		t.Errorf("unexpected records from 10: %q", records)
+	}
+
+	records, err := db.ReadChanges(0, 2)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("unexpected records: %v, %v", records, err)
+	}
+
+	if !records[0].Time.Equal(clock.Now()) || !records[0].Expires.IsZero() {
+		t.Errorf("unexpected time of record: %v, %v", records[0].Time, records[0].Expires)
+	}
+
+	last, err := db.ReadChanges(records[1].Position+1, 0)
+	if err != nil || len(last) != len(expected)-2 {
+		t.Fatalf("unexpected records: %v, %v", last, err)
+	}
+
+	if portkey := last[len(last)-1]; !portkey.Expires.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("unexpected expiry: %v", portkey.Expires)
+	}
+
+	if engine == EngineMemory {
+		return
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if db, err = Open(options); err != nil {
+		t.Fatalf("reopen database failed: %v", err)
+	}
+
+	if records := readRecords(t, db, 0); !meta.Equal(records, expected) {
+		t.Errorf("unexpected records after reopen: %q", records)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			testChangeLog(t, engine)
+		})
+	}
+
+	db := openTestDB(t)
+	defer db.Close()
+
+	if err := db.Put([]byte("harry"), []byte("potter")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if records := readRecords(t, db, 0); len(records) != 0 {
+		t.Errorf("unexpected records: %q", records)
+	}
+}
+
+func TestChangeLogBuckets(t *testing.T) {
+	db, err := Open(Options{Dir: t.TempDir(), SyncPolicy: SyncNever, ChangeLog: true})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer func() { db.Close() }()
+
+	err = db.Update(func(tx *Tx) error {
+		gringotts, err := tx.CreateBucket("gringotts")
+		if err != nil {
+			return err
+		}
+
+		vaults, err := gringotts.CreateBucket("vaults")
+		if err != nil {
+			return err
+		}
+
+		if err := gringotts.Put([]byte("goblin"), []byte("griphook")); err != nil {
+			return err
+		}
+
+		return vaults.Put([]byte("687"), []byte("potter"))
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		gringotts, err := tx.Bucket("gringotts")
+		if err != nil {
+			return err
+		}
+
+		if err := gringotts.Put([]byte("goblin"), []byte("bogrod")); err != nil {
+			return err
+		}
+
+		return gringotts.DeleteBucket("vaults")
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	// Buckets created and deleted are followed by index, rather than read on each write.
+	err = db.Update(func(tx *Tx) error {
+		gringotts, err := tx.Bucket("gringotts")
+		if err != nil {
+			return err
+		}
+
+		vaults, err := gringotts.CreateBucket("vaults")
+		if err != nil {
+			return err
+		}
+
+		return vaults.Put([]byte("713"), []byte("stone"))
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if db.buckets == nil || len(db.buckets.nodes) != 2 || len(db.buckets.ids) != 2 {
+		t.Errorf("unexpected index of buckets: %+v", db.buckets)
+	}
+
+	records := readRecords(t, db, 0)
+	if len(records) != 5 {
+		t.Fatalf("unexpected records: %q", records)
+	}
+
+	expected := []string{
+		`put gringotts:goblin ""->"griphook"`,
+		`put gringotts/vaults:687 ""->"potter"`,
+		`put gringotts:goblin "griphook"->"bogrod"`,
+		`delete gringotts/vaults:687 "potter"->""`,
+		`put gringotts/vaults:713 ""->"stone"`,
+	}
+
+	for i, record := range records {
+		if !strings.HasSuffix(record, " "+expected[i]) {
+			t.Errorf("unexpected record %d: %s <=> %s", i, record, expected[i])
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if db, err = Open(Options{Dir: db.options.Dir, SyncPolicy: SyncNever, ChangeLog: true}); err != nil {
+		t.Fatalf("reopen database failed: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	if _, err := db.ExportChanges(&buffer, 0, 1, nil); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &line); err != nil || line["bucket"] != "gringotts" {
+		t.Errorf("unexpected line %s: %v", buffer.Bytes(), err)
+	}
+}
+
+func TestChangeLogRetention(t *testing.T) {
+	clock := newTestClock()
+	options := Options{
+		Dir:                t.TempDir(),
+		Engine:             EngineLSM,
+		SyncPolicy:         SyncNever,
+		Clock:              clock,
+		ReapPeriod:         -1,
+		ChangeLog:          true,
+		ChangeLogLimit:     4,
+		ChangeLogRetention: time.Hour,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer func() { db.Close() }()
+
+	names := []string{"fred", "george", "percy", "ginny", "bill", "charlie"}
+	for _, name := range names {
+		if err := db.Put([]byte(name), []byte("weasley")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+
+		clock.Advance(time.Minute)
+	}
+
+	if n, err := db.TrimChanges(); n != 2 || err != nil {
+		t.Errorf("unexpected trimmed: %d, %v", n, err)
+	}
+
+	if _, err := db.ReadChanges(1, 0); !errors.Is(err, ErrHistoryTruncated) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	records, err := db.ReadChanges(0, 0)
+	if err != nil || len(records) != 4 || string(records[0].Key) != "percy" {
+		t.Fatalf("unexpected records: %v, %v", records, err)
+	}
+
+	if _, err := db.ReadChanges(records[0].Position, 0); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if db, err = Open(options); err != nil {
+		t.Fatalf("reopen database failed: %v", err)
+	}
+
+	if n, err := db.TrimChanges(); n != 0 || err != nil {
+		t.Errorf("unexpected trimmed: %d, %v", n, err)
+	}
+
+	clock.Advance(time.Hour - 2*time.Minute + time.Second)
+	if n, err := db.TrimChanges(); n != 3 || err != nil {
+		t.Errorf("unexpected trimmed: %d, %v", n, err)
+	}
+
+	if records := readRecords(t, db, 0); len(records) != 1 || records[0] != `11 put charlie ""->"weasley"` {
+		t.Errorf("unexpected records: %q", records)
+	}
+}
+
+func TestChangeOffset(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: dir, SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	if offset, err := db.ChangeOffset("hedwig"); offset != 0 || err != nil {
+		t.Errorf("unexpected offset: %d, %v", offset, err)
+	}
+
+	if err := db.CommitChangeOffset("hedwig", 42); err != nil {
+		t.Fatalf("commit offset failed: %v", err)
+	}
+
+	if err := db.CommitChangeOffset("", 42); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if db, err = Open(Options{Dir: dir, SyncPolicy: SyncNever}); err != nil {
+		t.Fatalf("reopen database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if offset, err := db.ChangeOffset("hedwig"); offset != 42 || err != nil {
+		t.Errorf("unexpected offset: %d, %v", offset, err)
+	}
+
+	if _, err := db.ChangeOffset(""); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExportChanges(t *testing.T) {
+	db, err := Open(Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	scores, err := db.Collection("scores", testScore{})
+	if err != nil {
+		t.Fatalf("open collection failed: %v", err)
+	}
+
+	if err := scores.Put([]byte("gryffindor"), testScore{House: "Gryffindor", Points: 482, secret: 1}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.Put([]byte("snitch"), []byte("golden")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	next, err := db.ExportChanges(&buffer, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&buffer)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("unexpected line %s: %v", scanner.Bytes(), err)
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 2 || uint64(lines[1]["position"].(float64))+1 != next {
+		t.Fatalf("unexpected lines: %v, %d", lines, next)
+	}
+
+	value := map[string]interface{}{"House": "Gryffindor", "Points": 482.0, "Best": 0.0, "Note": ""}
+	if lines[0]["collection"] != "scores" || lines[0]["type"] != "put" || !meta.Equal(lines[0]["value"], value) {
+		t.Errorf("unexpected line: %v", lines[0])
+	}
+
+	if _, found := lines[0]["old"]; found {
+		t.Errorf("unexpected old value: %v", lines[0])
+	}
+
+	if lines[1]["key"] != "c25pdGNo" || lines[1]["value"] != "Z29sZGVu" {
+		t.Errorf("unexpected line: %v", lines[1])
+	}
+
+	buffer.Reset()
+	if _, err := db.ExportChanges(&buffer, 0, 1, &ExportOptions{Unexported: true}); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+
+	if !bytes.Contains(buffer.Bytes(), []byte(`"secret":0`)) {
+		t.Errorf("unexpected export: %s", buffer.Bytes())
+	}
+
+	if n, err := db.ExportChanges(&buffer, next, 0, nil); n != next || err != nil {
+		t.Errorf("unexpected export: %d, %v", n, err)
+	}
+}
+
+func TestExportChangeFiles(t *testing.T) {
+	db, err := Open(Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	put := func(names ...string) {
+		for _, name := range names {
+			if err := db.Put([]byte(name), []byte("hufflepuff")); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "changes")
+	options := &ExportOptions{FileRecords: 2}
+	put("hannah", "ernie", "justin")
+	if n, err := db.ExportChangeFiles("archive", dir, options); n != 3 || err != nil {
+		t.Fatalf("unexpected export: %d, %v", n, err)
+	}
+
+	put("susan", "zacharias")
+	if n, err := db.ExportChangeFiles("archive", dir, options); n != 2 || err != nil {
+		t.Fatalf("unexpected export: %d, %v", n, err)
+	}
+
+	if n, err := db.ExportChangeFiles("archive", dir, options); n != 0 || err != nil {
+		t.Fatalf("unexpected export: %d, %v", n, err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(files) != 3 {
+		t.Fatalf("unexpected files: %v, %v", files, err)
+	}
+
+	var keys []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read file failed: %v", err)
+		}
+
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+			var change struct{ Key []byte }
+			if err := json.Unmarshal(line, &change); err != nil {
+				t.Fatalf("unexpected line %s: %v", line, err)
+			}
+
+			keys = append(keys, string(change.Key))
+		}
+	}
+
+	expected := []string{"hannah", "ernie", "justin", "susan", "zacharias"}
+	if !meta.Equal(keys, expected) {
+		t.Errorf("unexpected keys: %q <=> %q", keys, expected)
+	}
+
+	records, _ := db.ReadChanges(0, 0)
+	if offset, err := db.ChangeOffset("archive"); offset != records[len(records)-1].Position+1 || err != nil {
+		t.Errorf("unexpected offset: %d, %v", offset, err)
+	}
+}
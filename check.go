@@ -0,0 +1,488 @@
+package pinkis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Number of records written in a batch by Salvage.
+const salvageBatchSize = 1000
+
+// Check scans all files of a closed database in options.Dir with checksums verified, and reports
+// corrupted ranges. Files of any engine found in directory are scanned, and nothing is modified.
+// KeyProvider of options is required if files are encrypted. A corrupted database is reported as
+// an error wraps ErrCorrupted, along with the report.
+func Check(options Options) (VerifyReport, error) {
+	var report VerifyReport
+	if err := scanFiles(options, &report, nil); err != nil {
+		return report, err
+	}
+
+	return report, report.Err()
+}
+
+// Scan files of B+tree, tables and write-ahead log in options.Dir, visit entries of them.
+func scanFiles(options Options, report *VerifyReport, visit entryVisitor) error {
+	if len(options.Dir) <= 0 {
+		return WrapError(ErrInvalidOptions, "directory of database required")
+	}
+
+	if _, err := os.Stat(options.Dir); err != nil {
+		return err
+	}
+
+	if err := checkBTree(options, report, visit); err != nil {
+		return err
+	}
+
+	flushed, err := checkTables(options, report, visit)
+	if err != nil {
+		return err
+	}
+
+	// Entries flushed into tables are skipped, they may be deleted by compactions later.
+	walVisit := visit
+	if visit != nil && flushed > 0 {
+		walVisit = func(seq uint64, kind entryKind, key []byte, value []byte) {
+			if seq > flushed {
+				visit(seq, kind, key, value)
+			}
+		}
+	}
+
+	return verifyWAL(filepath.Join(options.Dir, walDirName), options.KeyProvider, report, walVisit)
+}
+
+// Check B+tree file if it exists. A file whose meta pages are both broken is corrupted as a whole.
+func checkBTree(options Options, report *VerifyReport, visit entryVisitor) error {
+	path := filepath.Join(options.Dir, btreeFileName)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+
+	} else if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	report.Files++
+	e := &btreeEngine{
+		options: options,
+		path:    path,
+		file:    file,
+	}
+
+	m, err := e.readMeta()
+	if err != nil {
+		report.corrupt(btreeFileName, 0, stat.Size(), err)
+		return nil
+	}
+
+	e.pageSize = int(m.pageSize)
+	e.checksums = m.checksums
+	if m.envelope != nil {
+		if e.cipher, err = openEnvelope(m.envelope, options.KeyProvider, btreeFileName); err != nil {
+			report.corrupt(btreeFileName, 0, stat.Size(), err)
+			return nil
+		}
+	}
+
+	e.verifyMeta(report)
+	e.verifyTree(m, report, visit)
+	return nil
+}
+
+// Check tables in manifest, or all tables in directory if manifest is missing or corrupted. Return
+// the last sequence number flushed into tables, 0 if it is unknown.
+func checkTables(options Options, report *VerifyReport, visit entryVisitor) (uint64, error) {
+	if err := verifyManifest(options.Dir, options.KeyProvider, report); err != nil {
+		return 0, err
+	}
+
+	flushed := uint64(0)
+	var numbers []uint64
+	m, err := loadManifest(options.Dir, options.KeyProvider)
+	if err == nil && m != nil {
+		flushed = m.lastSequence
+		for _, t := range m.tables {
+			numbers = append(numbers, t.number)
+		}
+
+		for _, t := range m.tombstones {
+			if visit != nil {
+				visit(t.seq, kindDeleteRange, t.start, t.end)
+			}
+		}
+
+	} else {
+		entries, err := os.ReadDir(options.Dir)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.HasSuffix(name, tableSuffix) {
+				continue
+			}
+
+			number, err := strconv.ParseUint(strings.TrimSuffix(name, tableSuffix), 10, 64)
+			if err == nil {
+				numbers = append(numbers, number)
+			}
+		}
+	}
+
+	for _, number := range numbers {
+		name := tableFileName(number)
+		path := filepath.Join(options.Dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			report.corrupt(name, 0, 0, WrapError(ErrCorrupted, "table %s in manifest not found", name))
+			continue
+		}
+
+		if err := verifyTableFile(path, name, number, options.KeyProvider, report, visit); err != nil {
+			return 0, err
+		}
+	}
+
+	return flushed, nil
+}
+
+// SalvageOptions tells Salvage types of typed values, so that they are validated before they are
+// salvaged.
+type SalvageOptions struct {
+	// Prototypes of values of collections by name, the same as passed to DB.Collection.
+	Collections map[string]interface{}
+	// Prototypes of values of typed buckets, matched by type names stored with buckets.
+	Types []interface{}
+}
+
+// SalvageReport reports files scanned and records salvaged by Salvage.
+type SalvageReport struct {
+	VerifyReport
+	// Records written into the new database.
+	Salvaged int
+	// Typed values dropped, since they cannot be decoded into their types.
+	Invalid int
+	// Typed values salvaged without validation, since their types are not given.
+	Unchecked int
+}
+
+// The newest version of a key found by Salvage, along with operands merged after it.
+type salvagedEntry struct {
+	seq      uint64
+	kind     entryKind
+	value    []byte
+	operands []salvagedOperand
+}
+
+type salvagedOperand struct {
+	seq   uint64
+	value []byte
+}
+
+// Keep operands merged after the newest version and not deleted by tombstones, in order of
+// sequence numbers. Operands found in both tables and write-ahead log are kept once.
+func (e *salvagedEntry) settle(key []byte, tombstones rangeTombstones) {
+	if tombstones.covers(bytewiseCompare, key, e.seq, maxSequence) {
+		e.kind, e.value = kindDelete, nil
+	}
+
+	sort.Slice(e.operands, func(i, j int) bool { return e.operands[i].seq < e.operands[j].seq })
+	operands := e.operands[:0]
+	for _, op := range e.operands {
+		n := len(operands)
+		if op.seq <= e.seq || n > 0 && operands[n-1].seq == op.seq ||
+			tombstones.covers(bytewiseCompare, key, op.seq, maxSequence) {
+			continue
+		}
+
+		operands = append(operands, op)
+	}
+
+	e.operands = operands
+}
+
+// Salvage scans all files of a closed database in options.Dir the same as Check, and writes the
+// newest readable version of each key into a new database of target, along with operands merged
+// after it. Deleted and expired keys, and keys whose operands can not be folded, are dropped. Typed
+// values of collections and buckets whose types are given in salvage are decoded and checked field
+// by field, values which cannot be decoded are dropped. Indexes are not copied, indexes declared by
+// tags of types in salvage.Collections are built again in the new database.
+func Salvage(options Options, target Options, salvage SalvageOptions) (SalvageReport, error) {
+	var report SalvageReport
+	source, err1 := filepath.Abs(options.Dir)
+	dest, err2 := filepath.Abs(target.Dir)
+	if err1 != nil || err2 != nil || len(target.Dir) <= 0 || source == dest {
+		return report, WrapError(ErrInvalidOptions, "salvage requires a directory other than %s", options.Dir)
+	}
+
+	entries := make(map[string]*salvagedEntry)
+	var tombstones rangeTombstones
+	visit := func(seq uint64, kind entryKind, key []byte, value []byte) {
+		if kind == kindDeleteRange {
+			start, end := copyOp(key, value)
+			tombstones = append(tombstones, rangeTombstone{start: start, end: end, seq: seq})
+			return
+		}
+
+		found, ok := entries[string(key)]
+		if !ok {
+			found = &salvagedEntry{kind: kindDelete}
+			entries[string(key)] = found
+		}
+
+		if kind == kindMerge {
+			found.operands = append(found.operands, salvagedOperand{seq: seq, value: append([]byte{}, value...)})
+
+		} else if !ok || found.seq < seq {
+			found.seq, found.kind, found.value = seq, kind, append([]byte{}, value...)
+		}
+	}
+
+	if err := scanFiles(options, &report.VerifyReport, visit); err != nil {
+		return report, err
+	}
+
+	for key, e := range entries {
+		if e.settle([]byte(key), tombstones); e.kind == kindDelete && len(e.operands) <= 0 {
+			delete(entries, key)
+		}
+	}
+
+	db, err := Open(target)
+	if err != nil {
+		return report, err
+	}
+
+	s := &salvager{
+		codec:   options.codec(),
+		now:     nowOf(options.clock()),
+		entries: entries,
+		types:   make(map[uint64]reflect.Type),
+		report:  &report,
+	}
+
+	err = s.run(db, salvage)
+	if errClose := db.Close(); err == nil {
+		err = errClose
+	}
+
+	return report, err
+}
+
+type salvager struct {
+	codec   Codec
+	now     int64
+	entries map[string]*salvagedEntry
+	// Types of typed buckets by id, nil if type is unknown.
+	types  map[uint64]reflect.Type
+	report *SalvageReport
+}
+
+// Find types of typed buckets from bucket records salvaged.
+func (s *salvager) loadBucketTypes(prototypes []interface{}) {
+	known := make(map[string]reflect.Type)
+	for _, prototype := range prototypes {
+		if meta.IsStruct(prototype) {
+			t := meta.InstanceOf(prototype).Type()
+			known[typeName(t)] = t
+		}
+	}
+
+	for key, e := range s.entries {
+		if !strings.HasPrefix(key, string(bucketRecordPrefix)) {
+			continue
+		}
+
+		value, ok := visibleValue(e.kind, e.value, s.now)
+		if !ok {
+			continue
+		}
+
+		record, err := decodeBucketRecord(value)
+		if err != nil || record.valueType == "" {
+			continue
+		}
+
+		// Values of a bucket of unknown type, or of another codec, are not validated.
+		s.types[record.id] = nil
+		if record.codec == codecName(s.codec) {
+			s.types[record.id] = known[record.valueType]
+		}
+	}
+}
+
+// Type of typed value of key, typed is false if key is untyped.
+func (s *salvager) typeOf(key []byte, collections map[string]reflect.Type) (reflect.Type, bool) {
+	switch {
+	case len(key) <= 0:
+		return nil, false
+
+	case key[0] == namespaceCollection:
+		name, _, ok := splitNamespacePrefix(key)
+		if !ok {
+			return nil, true
+		}
+
+		return collections[name], true
+
+	case key[0] == namespaceBucket && len(key) >= 9:
+		id := binary.BigEndian.Uint64(key[1:])
+		t, found := s.types[id]
+		return t, found
+
+	default:
+		return nil, false
+	}
+}
+
+// Whether an entry of key is salvaged, index and expiry entries are derived from others, and the
+// backup restored last is a mark of the database salvaged.
+func salvageable(key []byte) bool {
+	if len(key) <= 0 {
+		return false
+	}
+
+	switch key[0] {
+	case namespaceIndex, namespaceExpiry:
+		return false
+
+	case namespaceMeta:
+		return !bytes.HasPrefix(key, indexDefinitionPrefix) && !bytes.Equal(key, restoredKey)
+
+	default:
+		return true
+	}
+}
+
+func (s *salvager) run(db *DB, salvage SalvageOptions) error {
+	collections := make(map[string]reflect.Type)
+	for name, prototype := range salvage.Collections {
+		if !meta.IsStruct(prototype) {
+			return WrapError(ErrTypeMismatch, "collection '%s' requires a struct type, but %T",
+				name, prototype)
+		}
+
+		collections[name] = meta.InstanceOf(prototype).Type()
+	}
+
+	s.loadBucketTypes(salvage.Types)
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	batch := &writeBatch{}
+	for _, key := range keys {
+		e := s.entries[key]
+		value, ok := visibleValue(e.kind, e.value, s.now)
+		// An expired value absorbs operands merged onto it.
+		if !ok && (len(e.operands) <= 0 || e.kind == kindPutExpiring) || !salvageable([]byte(key)) {
+			continue
+		}
+
+		// Operands are checked by folding them, and merged again into the new database.
+		merged := value
+		operands := make([][]byte, len(e.operands))
+		for i, op := range e.operands {
+			operands[i] = op.value
+		}
+
+		if len(operands) > 0 {
+			var err error
+			if merged, err = foldOperands(value, operands); err != nil {
+				s.report.Invalid++
+				continue
+			}
+		}
+
+		if t, typed := s.typeOf([]byte(key), collections); typed {
+			if t == nil {
+				s.report.Unchecked++
+
+			} else if err := validateTyped(s.codec, merged, t); err != nil {
+				s.report.Invalid++
+				continue
+			}
+		}
+
+		if ok && e.kind == kindPutExpiring {
+			expires := int64(binary.BigEndian.Uint64(e.value))
+			putExpiring(batch, []byte(key), value, nil, expires)
+
+		} else if ok {
+			batch.Put([]byte(key), value)
+		}
+
+		for _, operand := range operands {
+			batch.Merge([]byte(key), operand)
+		}
+
+		s.report.Salvaged++
+		if batch.Len() >= salvageBatchSize {
+			if err := db.write(batch); err != nil {
+				return err
+			}
+
+			batch = &writeBatch{}
+		}
+	}
+
+	if batch.Len() > 0 {
+		if err := db.write(batch); err != nil {
+			return err
+		}
+	}
+
+	for name, prototype := range salvage.Collections {
+		if _, err := db.Collection(name, prototype); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Decode data into a new value of struct type t, and check that all exported fields of it are
+// accessible.
+func validateTyped(codec Codec, data []byte, t reflect.Type) error {
+	pointer := meta.NewPointerOf(t)
+	if err := codec.Unmarshal(data, pointer.Interface()); err != nil {
+		return err
+	}
+
+	value := pointer.Interface()
+	if !meta.IsStruct(value) {
+		return WrapError(ErrTypeMismatch, "%s is not a struct", t)
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if !meta.IsExportedName(name) {
+			continue
+		}
+
+		if _, err := meta.GetField(value, name); err != nil {
+			return WrapError(ErrTypeMismatch, "field %s of %s: %s", name, t, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,288 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Put wizard-000 to wizard-<count> into a new database of options, and close it.
+func writeCheckData(t *testing.T, options Options, count int) {
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("wizard-%03d", i))
+		if err := db.Put(key, []byte(fmt.Sprintf("Slytherin %03d", i))); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+}
+
+// Salvage database of options into a new database, and count keys readable in it.
+func salvageCount(t *testing.T, options Options, count int) (SalvageReport, int) {
+	target := Options{Dir: t.TempDir(), SyncPolicy: SyncNever}
+	report, err := Salvage(options, target, SalvageOptions{})
+	if err != nil {
+		t.Fatalf("salvage failed: %v", err)
+	}
+
+	db, err := Open(target)
+	if err != nil {
+		t.Fatalf("open salvaged database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	found := 0
+	for i := 0; i < count; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("wizard-%03d", i)))
+		if err == nil && string(value) == fmt.Sprintf("Slytherin %03d", i) {
+			found++
+
+		} else if !errors.Is(err, ErrNotFound) {
+			t.Errorf("unexpected value of %d: %q, %v", i, value, err)
+		}
+	}
+
+	return report, found
+}
+
+func TestCheckWAL(t *testing.T) {
+	options := Options{Dir: t.TempDir(), SyncPolicy: SyncNever}
+	writeCheckData(t, options, 10)
+
+	name := filepath.Join(walDirName, walSegmentName(1))
+	path := filepath.Join(options.Dir, name)
+	corruptFile(t, path, offsetInFile(t, path, "Slytherin 005"))
+
+	// A torn tail of the last segment is not corruption.
+	stat, _ := os.Stat(path)
+	os.Truncate(path, stat.Size()-3)
+
+	report, err := Check(options)
+	if !errors.Is(err, ErrCorrupted) || report.Records != 8 || len(report.Corrupted) != 1 {
+		t.Fatalf("unexpected report: %+v, %v", report, err)
+	}
+
+	if r := report.Corrupted[0]; r.File != name || r.Size <= 0 {
+		t.Errorf("unexpected range: %s", r)
+	}
+
+	if _, found := salvageCount(t, options, 10); found != 8 {
+		t.Errorf("unexpected salvaged: %d", found)
+	}
+
+	// Records following a broken one are not truncated as a torn write.
+	if _, err := Open(options); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckBTree(t *testing.T) {
+	options := Options{Dir: t.TempDir(), Engine: EngineBTree, SyncPolicy: SyncNever, PageSize: 512}
+	writeCheckData(t, options, 300)
+	path := filepath.Join(options.Dir, btreeFileName)
+
+	report, err := Check(options)
+	if err != nil || report.Pages <= 4 {
+		t.Fatalf("unexpected report: %+v, %v", report, err)
+	}
+
+	// Broken meta page is reported, the other one is still used.
+	corruptFile(t, path, 20)
+	corruptFile(t, path, offsetInFile(t, path, "Slytherin 150"))
+	report, err = Check(options)
+	if !errors.Is(err, ErrCorrupted) || len(report.Corrupted) != 2 {
+		t.Fatalf("unexpected report: %+v, %v", report, err)
+	}
+
+	if r := report.Corrupted[0]; r.File != btreeFileName || r.Offset != 0 || r.Size != 512 {
+		t.Errorf("unexpected range: %s", r)
+	}
+
+	if r := report.Corrupted[1]; r.Offset%512 != 0 || r.Offset <= 512 {
+		t.Errorf("unexpected range: %s", r)
+	}
+
+	if _, found := salvageCount(t, options, 300); found <= 0 || found >= 300 {
+		t.Errorf("unexpected salvaged: %d", found)
+	}
+}
+
+func TestSalvageOrphanLeaves(t *testing.T) {
+	options := Options{Dir: t.TempDir(), Engine: EngineBTree, SyncPolicy: SyncNever, PageSize: 512}
+	writeCheckData(t, options, 300)
+
+	// All leaves are salvaged if root is corrupted.
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	root := btreeEngineOf(db).meta.root
+	db.Close()
+	corruptFile(t, filepath.Join(options.Dir, btreeFileName), int64(root)*512+pageHeaderSize)
+
+	report, found := salvageCount(t, options, 300)
+	if found != 300 || len(report.Corrupted) != 1 {
+		t.Errorf("unexpected salvaged: %d, %+v", found, report)
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	options := Options{
+		Dir:          t.TempDir(),
+		Engine:       EngineLSM,
+		SyncPolicy:   SyncNever,
+		MemtableSize: 4 << 10,
+		BlockSize:    512,
+		Compression:  NoCompression,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	houses := []string{"Gryffindor", "Hufflepuff", "Ravenclaw", "Slytherin"}
+	for i := 0; i < 200; i++ {
+		student := testStudent{
+			Name:  fmt.Sprintf("student-%03d", i),
+			Email: fmt.Sprintf("student-%03d@hogwarts.edu", i),
+			House: houses[i%4],
+			Year:  1991 + i%7,
+		}
+
+		if err := students.Put([]byte(student.Name), student); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if err := students.Delete([]byte("student-042")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	// A typed value which cannot be decoded is dropped.
+	if err := db.put(students.key([]byte("peeves")), []byte("{poltergeist")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		owls, err := tx.CreateBucket("owls", &BucketOptions{Type: testCreature{}})
+		if err != nil {
+			return err
+		}
+
+		return owls.PutValue([]byte("hedwig"), testCreature{Name: "Hedwig"})
+	})
+
+	if err != nil {
+		t.Fatalf("put owl failed: %v", err)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	v := lsmEngineOf(db).currentVersion()
+	for _, table := range v.tables() {
+		data, _ := os.ReadFile(table.path)
+		if offset := bytes.Index(data, []byte("student-100@hogwarts.edu")); offset >= 0 {
+			corruptFile(t, table.path, int64(offset))
+		}
+	}
+
+	v.unref()
+	db.Close()
+
+	target := Options{Dir: t.TempDir(), SyncPolicy: SyncNever}
+	salvage := SalvageOptions{
+		Collections: map[string]interface{}{"students": testStudent{}},
+		Types:       []interface{}{&testCreature{}},
+	}
+
+	if _, err := Salvage(options, Options{Dir: options.Dir}, salvage); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	report, err := Salvage(options, target, salvage)
+	if err != nil {
+		t.Fatalf("salvage failed: %v", err)
+	}
+
+	if len(report.Corrupted) != 1 || report.Invalid != 1 || report.Unchecked != 0 || report.Salvaged <= 0 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	if db, err = Open(target); err != nil {
+		t.Fatalf("open salvaged database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if students, err = db.Collection("students", testStudent{}); err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	found := 0
+	for i := 0; i < 200; i++ {
+		expected := testStudent{
+			Name:  fmt.Sprintf("student-%03d", i),
+			Email: fmt.Sprintf("student-%03d@hogwarts.edu", i),
+			House: houses[i%4],
+			Year:  1991 + i%7,
+		}
+
+		var student testStudent
+		err := students.Get([]byte(expected.Name), &student)
+		if err == nil && meta.Equal(student, expected) && i != 42 {
+			found++
+
+		} else if !errors.Is(err, ErrNotFound) {
+			t.Errorf("unexpected student %d: %+v, %v", i, student, err)
+		}
+	}
+
+	if found <= 100 || found >= 199 {
+		t.Errorf("unexpected salvaged students: %d", found)
+	}
+
+	if keys := indexedKeys(t, db, students, "house_year"); len(keys) != found {
+		t.Errorf("index should be built again, %d keys in index", len(keys))
+	}
+
+	err = db.View(func(tx *Tx) error {
+		owls, err := tx.Bucket("owls", &BucketOptions{Type: testCreature{}})
+		if err != nil {
+			return err
+		}
+
+		var owl testCreature
+		if err := owls.GetValue([]byte("hedwig"), &owl); err != nil || owl.Name != "Hedwig" {
+			t.Errorf("unexpected owl: %+v, %v", owl, err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Errorf("view failed: %v", err)
+	}
+}
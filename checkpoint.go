@@ -0,0 +1,184 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A checkpoint is marked by a file of a record, framed the same as records of write-ahead log:
+//
+//	magic     "pinkis-checkpoint"
+//	engine    uvarint
+//	sequence  uvarint
+const (
+	checkpointFileName = "CHECKPOINT"
+	checkpointMagic    = "pinkis-checkpoint"
+)
+
+// Checkpoint makes a copy of database in dir at a consistent sequence number, which is returned.
+// Immutable files are hard linked, or copied if they cannot be linked, and mutable files are
+// copied. Dir must not exist, it should be on the same file system as database so that files are
+// linked. A checkpoint is opened by Open as a database of the same engine, or read-only by
+// OpenSnapshot. Writes are blocked while memtable of LSM engine is flushed, or while write-ahead
+// log of memory engine is copied.
+func (db *DB) Checkpoint(dir string) (uint64, error) {
+	if db.isClosed() {
+		return 0, ErrClosed
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return 0, WrapError(ErrInvalidOptions, "checkpoint directory %s already exists", dir)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	seq, err := db.engine.Checkpoint(dir)
+	if err == nil {
+		err = writeCheckpointFile(dir, db.options.Engine, seq)
+	}
+
+	if err == nil {
+		err = syncDir(dir)
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+func writeCheckpointFile(dir string, engine EngineType, seq uint64) error {
+	payload := []byte(checkpointMagic)
+	payload = appendUvarint(payload, uint64(engine))
+	payload = appendUvarint(payload, seq)
+	path := filepath.Join(dir, checkpointFileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(encodeWALRecord(payload))
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// Read engine and sequence number of checkpoint in dir.
+func readCheckpointFile(dir string) (EngineType, uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, checkpointFileName))
+	if os.IsNotExist(err) {
+		return 0, 0, WrapError(ErrInvalidOptions, "%s is not a checkpoint", dir)
+
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	payload, size, ok := decodeWALRecord(data)
+	if !ok || size != len(data) || len(payload) < len(checkpointMagic) ||
+		string(payload[:len(checkpointMagic)]) != checkpointMagic {
+		return 0, 0, WrapError(ErrCorrupted, "invalid %s in %s", checkpointFileName, dir)
+	}
+
+	rest := payload[len(checkpointMagic):]
+	engine, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return 0, 0, WrapError(ErrCorrupted, "invalid %s in %s", checkpointFileName, dir)
+	}
+
+	seq, m := binary.Uvarint(rest[n:])
+	if m <= 0 || n+m != len(rest) {
+		return 0, 0, WrapError(ErrCorrupted, "invalid %s in %s", checkpointFileName, dir)
+	}
+
+	return EngineType(engine), seq, nil
+}
+
+// OpenSnapshot opens a checkpoint in options.Dir made by Checkpoint, read-only. Engine of options
+// is ignored, checkpoint is opened by the engine it is made of. Files of checkpoint are never
+// written, all writes fail with ErrReadOnly.
+func OpenSnapshot(options Options) (*DB, error) {
+	engine, seq, err := readCheckpointFile(options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	options.Engine = engine
+	options.ReadOnly = true
+	db, err := Open(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if sequence := db.Sequence(); sequence != seq {
+		db.Close()
+		return nil, WrapError(ErrCorrupted, "checkpoint at %d, but %d is recovered", seq, sequence)
+	}
+
+	return db, nil
+}
+
+// Hard link file of src to dst, or copy it if it cannot be linked.
+func linkFile(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	return copyFile(src, dst, -1)
+}
+
+// Copy the first size bytes of src to a new file of dst, the whole file if size is negative.
+func copyFile(src string, dst string, size int64) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	if size < 0 {
+		stat, err := source.Stat()
+		if err != nil {
+			return err
+		}
+
+		size = stat.Size()
+	}
+
+	file, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = copyRange(file, source, size)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// Copy the first size bytes of src into w.
+func copyRange(w io.Writer, src io.ReaderAt, size int64) error {
+	n, err := io.Copy(w, io.NewSectionReader(src, 0, size))
+	if err == nil && n < size {
+		err = WrapError(ErrCorrupted, "%d bytes copied, but %d expected", n, size)
+	}
+
+	return err
+}
@@ -0,0 +1,312 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Names of all files under dir, relative to it.
+func listFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			name, _ := filepath.Rel(dir, path)
+			files = append(files, fmt.Sprintf("%s:%d", name, info.Size()))
+		}
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatalf("list files of %s failed: %v", dir, err)
+	}
+
+	sort.Strings(files)
+	return files
+}
+
+func TestCheckpoint(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			options := Options{
+				Dir:          t.TempDir(),
+				Engine:       engine,
+				SyncPolicy:   SyncNever,
+				MemtableSize: 4 << 10,
+				PageSize:     512,
+			}
+
+			db, err := Open(options)
+			if err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			defer db.Close()
+
+			students, err := db.Collection("students", testStudent{})
+			if err != nil {
+				t.Fatalf("get collection failed: %v", err)
+			}
+
+			expected := make(map[string]testStudent)
+			for i := 0; i < 100; i++ {
+				student := newBackupStudent(i, 1991+i%7)
+				if err := students.Put([]byte(student.Name), student); err != nil {
+					t.Fatalf("put failed: %v", err)
+				}
+
+				expected[student.Name] = student
+			}
+
+			dir := filepath.Join(t.TempDir(), "checkpoint")
+			seq, err := db.Checkpoint(dir)
+			if err != nil || seq != db.Sequence() {
+				t.Fatalf("checkpoint failed: %d, %v", seq, err)
+			}
+
+			if _, err := db.Checkpoint(dir); !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			// Changes after checkpoint are not in it.
+			for i := 0; i < 10; i++ {
+				student := newBackupStudent(i, 1998)
+				if err := students.Put([]byte(student.Name), student); err != nil {
+					t.Fatalf("put failed: %v", err)
+				}
+
+				if err := students.Delete([]byte(fmt.Sprintf("student-%03d", 50+i))); err != nil {
+					t.Fatalf("delete failed: %v", err)
+				}
+			}
+
+			files := listFiles(t, dir)
+			snapshot, err := OpenSnapshot(Options{Dir: dir})
+			if err != nil {
+				t.Fatalf("open snapshot failed: %v", err)
+			}
+
+			checkSnapshot(t, snapshot, expected, seq)
+			if err := snapshot.Close(); err != nil {
+				t.Errorf("close snapshot failed: %v", err)
+			}
+
+			if after := listFiles(t, dir); !meta.Equal(after, files) {
+				t.Errorf("files of snapshot are changed: %v, %v", files, after)
+			}
+
+			// A checkpoint is a database of the same engine.
+			copied, err := Open(Options{Dir: dir, Engine: engine})
+			if err != nil {
+				t.Fatalf("open checkpoint failed: %v", err)
+			}
+
+			if err := copied.Put([]byte("harry"), []byte("Gryffindor")); err != nil {
+				t.Errorf("put failed: %v", err)
+			}
+
+			copied.Close()
+			if _, err := db.Get([]byte("harry")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("database should not be changed by its checkpoint: %v", err)
+			}
+		})
+	}
+}
+
+// Compare all students of a read-only snapshot with expected by meta.Equal, and check that it
+// cannot be written.
+func checkSnapshot(t *testing.T, db *DB, expected map[string]testStudent, seq uint64) {
+	if db.Sequence() != seq {
+		t.Errorf("unexpected sequence: %d, expected %d", db.Sequence(), seq)
+	}
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	for name, original := range expected {
+		var student testStudent
+		if err := students.Get([]byte(name), &student); err != nil || !meta.Equal(student, original) {
+			t.Errorf("unexpected %s: %+v, %v", name, student, err)
+		}
+	}
+
+	if keys := indexedKeys(t, db, students, "house_year"); len(keys) != len(expected) {
+		t.Errorf("unexpected keys in index: %d, expected %d", len(keys), len(expected))
+	}
+
+	if err := db.Put([]byte("harry"), []byte("Gryffindor")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := students.Delete([]byte("student-000")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = db.Update(func(tx *Tx) error { return tx.Put([]byte("harry"), []byte("Gryffindor")) })
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.CompactRange(nil, nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckpointLinksTables(t *testing.T) {
+	options := Options{Dir: t.TempDir(), Engine: EngineLSM, SyncPolicy: SyncNever, MemtableSize: 4 << 10}
+	writeCheckData(t, options, 300)
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if err := db.Put([]byte("wizard-300"), []byte("unflushed")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	if _, err := db.Checkpoint(dir); err != nil {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+
+	v := lsmEngineOf(db).currentVersion()
+	defer v.unref()
+
+	if len(v.tables()) <= 0 {
+		t.Fatalf("no tables")
+	}
+
+	for _, table := range v.tables() {
+		source, err1 := os.Stat(table.path)
+		linked, err2 := os.Stat(filepath.Join(dir, filepath.Base(table.path)))
+		if err1 != nil || err2 != nil || !os.SameFile(source, linked) {
+			t.Errorf("table %s should be linked: %v, %v", table.path, err1, err2)
+		}
+	}
+
+	snapshot, err := OpenSnapshot(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("open snapshot failed: %v", err)
+	}
+
+	defer snapshot.Close()
+
+	if value, err := snapshot.Get([]byte("wizard-300")); err != nil || string(value) != "unflushed" {
+		t.Errorf("unexpected value: %q, %v", value, err)
+	}
+}
+
+func TestCheckpointWhileWriting(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			options := Options{Dir: t.TempDir(), Engine: engine, SyncPolicy: SyncNever, MemtableSize: 4 << 10}
+			db, err := Open(options)
+			if err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			defer db.Close()
+
+			houses := []string{"gryffindor", "slytherin"}
+			for _, house := range houses {
+				if err := db.Put([]byte(house), []byte("500")); err != nil {
+					t.Fatalf("put failed: %v", err)
+				}
+			}
+
+			// Points are moved between houses in batches, the sum never changes.
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+
+					default:
+					}
+
+					batch := &writeBatch{}
+					batch.Put(defaultKey([]byte(houses[i%2])), []byte(strconv.Itoa(500-i%2*10)))
+					batch.Put(defaultKey([]byte(houses[1-i%2])), []byte(strconv.Itoa(500+i%2*10)))
+					if err := db.write(batch); err != nil {
+						t.Errorf("write failed: %v", err)
+						return
+					}
+				}
+			}()
+
+			for i := 0; i < 5; i++ {
+				dir := filepath.Join(t.TempDir(), "checkpoint")
+				seq, err := db.Checkpoint(dir)
+				if err != nil {
+					t.Fatalf("checkpoint failed: %v", err)
+				}
+
+				snapshot, err := OpenSnapshot(Options{Dir: dir})
+				if err != nil {
+					t.Fatalf("open snapshot failed: %v", err)
+				}
+
+				sum := 0
+				for _, house := range houses {
+					value, err := snapshot.Get([]byte(house))
+					points, _ := strconv.Atoi(string(value))
+					if err != nil {
+						t.Errorf("get failed: %v", err)
+					}
+
+					sum += points
+				}
+
+				if snapshot.Sequence() != seq || sum != 1000 {
+					t.Errorf("checkpoint is not consistent at %d, sum of points %d", snapshot.Sequence(), sum)
+				}
+
+				snapshot.Close()
+			}
+
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestOpenSnapshotRequiresCheckpoint(t *testing.T) {
+	options := Options{Dir: t.TempDir(), SyncPolicy: SyncNever}
+	writeCheckData(t, options, 10)
+	if _, err := OpenSnapshot(options); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	db, err := Open(Options{})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	// A database in memory only has no checkpoint, nothing is left.
+	if _, err := db.Checkpoint(filepath.Join(options.Dir, "checkpoint")); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(options.Dir, "checkpoint")); !os.IsNotExist(err) {
+		t.Errorf("checkpoint directory should be removed: %v", err)
+	}
+}
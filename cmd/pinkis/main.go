@@ -0,0 +1,113 @@
+// Command pinkis maintains pinkis databases.
+//
+//	pinkis check [-salvage dir] [-engine lsm] [-key-id id -key-file path] dir
+//
+// check scans all files of a closed database in dir with checksums verified, and reports corrupted
+// ranges. With -salvage, readable records are written into a new database in the salvage directory,
+// of engine given by -engine. Encrypted files are read with the master key in key file. Exit status
+// is 1 if database is corrupted, and 2 on other errors.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/flily/pinkis"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func usage(stderr io.Writer) int {
+	fmt.Fprintln(stderr, "usage: pinkis check [-salvage dir] [-engine lsm] [-key-id id -key-file path] dir")
+	return 2
+}
+
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) <= 0 || args[0] != "check" {
+		return usage(stderr)
+	}
+
+	return check(args[1:], stdout, stderr)
+}
+
+func parseEngine(name string) (pinkis.EngineType, bool) {
+	for _, engine := range []pinkis.EngineType{pinkis.EngineMemory, pinkis.EngineLSM, pinkis.EngineBTree} {
+		if engine.String() == name {
+			return engine, true
+		}
+	}
+
+	return 0, false
+}
+
+func check(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	salvage := flags.String("salvage", "", "salvage readable records into a new database in `dir`")
+	engineName := flags.String("engine", "lsm", "engine of salvaged database, memory, lsm or btree")
+	keyID := flags.String("key-id", "", "`id` of master key of encrypted files")
+	keyFile := flags.String("key-file", "", "`path` of file of master key")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usage(stderr)
+	}
+
+	engine, ok := parseEngine(*engineName)
+	if !ok {
+		fmt.Fprintf(stderr, "unknown engine '%s'\n", *engineName)
+		return 2
+	}
+
+	options := pinkis.Options{Dir: flags.Arg(0)}
+	if len(*keyFile) > 0 {
+		key, err := os.ReadFile(*keyFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "read key failed: %v\n", err)
+			return 2
+		}
+
+		options.KeyProvider = &pinkis.StaticKeyProvider{
+			Current: *keyID,
+			Keys:    map[string][]byte{*keyID: key},
+		}
+	}
+
+	// Salvaged database is encrypted by the same master key.
+	var report pinkis.SalvageReport
+	var err error
+	if len(*salvage) > 0 {
+		target := options
+		target.Dir = *salvage
+		target.Engine = engine
+		report, err = pinkis.Salvage(options, target, pinkis.SalvageOptions{})
+
+	} else {
+		report.VerifyReport, err = pinkis.Check(options)
+	}
+
+	if err != nil && !errors.Is(err, pinkis.ErrCorrupted) {
+		fmt.Fprintf(stderr, "check failed: %v\n", err)
+		return 2
+	}
+
+	for _, r := range report.Corrupted {
+		fmt.Fprintf(stdout, "corrupted %s\n", r)
+	}
+
+	fmt.Fprintf(stdout, "checked %d files, %d blocks, %d pages, %d records, %d corrupted ranges\n",
+		report.Files, report.Blocks, report.Pages, report.Records, len(report.Corrupted))
+	if len(*salvage) > 0 {
+		fmt.Fprintf(stdout, "salvaged %d records into %s, %d typed values unchecked\n",
+			report.Salvaged, *salvage, report.Unchecked)
+	}
+
+	if len(report.Corrupted) > 0 {
+		return 1
+	}
+
+	return 0
+}
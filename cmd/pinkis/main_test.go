@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flily/pinkis"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	db, err := pinkis.Open(pinkis.Options{Dir: dir, SyncPolicy: pinkis.SyncNever})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("wizard-%d", i)), []byte("Dumbledore")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	db.Close()
+
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"check", dir}, &stdout, &stderr); code != 0 {
+		t.Errorf("unexpected exit code %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	// Corrupt the first record.
+	path := filepath.Join(dir, "wal", "000001.wal")
+	data, _ := os.ReadFile(path)
+	data[10] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	stdout.Reset()
+	salvage := filepath.Join(t.TempDir(), "salvaged")
+	if code := run([]string{"check", "-salvage", salvage, dir}, &stdout, &stderr); code != 1 {
+		t.Errorf("unexpected exit code %d: %s%s", code, stdout.String(), stderr.String())
+	}
+
+	if !strings.Contains(stdout.String(), "corrupted wal/000001.wal:0+") ||
+		!strings.Contains(stdout.String(), "salvaged 9 records") {
+		t.Errorf("unexpected output: %s", stdout.String())
+	}
+
+	if db, err = pinkis.Open(pinkis.Options{Dir: salvage, Engine: pinkis.EngineLSM}); err != nil {
+		t.Fatalf("open salvaged database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if value, err := db.Get([]byte("wizard-9")); err != nil || string(value) != "Dumbledore" {
+		t.Errorf("unexpected value: %q, %v", value, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	for _, args := range [][]string{nil, {"repair"}, {"check"}, {"check", "-engine", "hashmap", "dir"}} {
+		if code := run(args, &stdout, &stderr); code != 2 {
+			t.Errorf("unexpected exit code %d of %v", code, args)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package pinkis
+
+import (
+	"encoding/json"
+)
+
+// Codec converts typed values to and from bytes stored in database. Unmarshal must not keep data,
+// which may be a view of a memory mapped page.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codec in JSON, unexported fields are NOT stored.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+var DefaultCodec Codec = JSONCodec{}
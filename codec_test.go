@@ -0,0 +1,36 @@
+package pinkis
+
+import (
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func TestJSONCodec(t *testing.T) {
+	type testStruct struct {
+		Name  string
+		House string
+		age   int
+	}
+
+	data := testStruct{
+		Name:  "Luna Lovegood",
+		House: "Ravenclaw",
+		age:   14,
+	}
+
+	encoded, err := DefaultCodec.Marshal(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got testStruct
+	if err := DefaultCodec.Unmarshal(encoded, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data.age = 0
+	if !meta.Equal(data, got) {
+		t.Errorf("unexpected result: %#v <=> %#v", got, data)
+	}
+}
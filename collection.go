@@ -0,0 +1,330 @@
+package pinkis
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Collection stores Go structs of a registered type directly.
+type Collection struct {
+	db        *DB
+	name      string
+	prefix    []byte
+	valueType reflect.Type
+	codec     Codec
+	// Field of values tagged `pinkis:"expires"`, and default TTL of values.
+	expires string
+	ttl     time.Duration
+
+	indexLock sync.RWMutex
+	indexes   []*collectionIndex
+
+	mergeLock sync.RWMutex
+	merger    MergeOperator
+}
+
+// Get collection of name, values in collection must be the same struct type as prototype.
+// prototype can be a struct, or a pointer to a struct. Getting a collection with the same name
+// but a different type returns an error wraps ErrTypeMismatch. Values expire at a time.Time field
+// tagged `pinkis:"expires"` if it is not zero.
+func (db *DB) Collection(name string, prototype interface{}) (*Collection, error) {
+	if len(name) <= 0 {
+		return nil, WrapError(ErrInvalidName, "collection name required")
+	}
+
+	if !meta.IsStruct(prototype) {
+		return nil, WrapError(ErrTypeMismatch, "collection '%s' requires a struct type, but %T",
+			name, prototype)
+	}
+
+	valueType := meta.InstanceOf(prototype).Type()
+
+	db.collectionLock.Lock()
+	defer db.collectionLock.Unlock()
+
+	if c, found := db.collections[name]; found {
+		if c.valueType != valueType {
+			return nil, WrapError(ErrTypeMismatch, "collection '%s' is type %s, but %s",
+				name, c.valueType, valueType)
+		}
+
+		return c, nil
+	}
+
+	expires, err := parseExpiresTag(valueType)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Collection{
+		db:        db,
+		name:      name,
+		prefix:    namespacePrefix(namespaceCollection, name),
+		valueType: valueType,
+		codec:     db.options.codec(),
+		expires:   expires,
+	}
+
+	if err := c.setupIndexes(); err != nil {
+		return nil, err
+	}
+
+	db.collections[name] = c
+	return c, nil
+}
+
+// Name of collection.
+func (c *Collection) Name() string {
+	return c.name
+}
+
+// Registered struct type of collection.
+func (c *Collection) Type() reflect.Type {
+	return c.valueType
+}
+
+func (c *Collection) key(key []byte) []byte {
+	return prefixedKey(c.prefix, key)
+}
+
+func (c *Collection) checkValue(value interface{}) error {
+	if !meta.IsStruct(value) {
+		return WrapError(ErrTypeMismatch, "collection '%s' requires %s, but %T",
+			c.name, c.valueType, value)
+	}
+
+	valueType := meta.InstanceOf(value).Type()
+	if valueType != c.valueType {
+		return WrapError(ErrTypeMismatch, "collection '%s' requires %s, but %s",
+			c.name, c.valueType, valueType)
+	}
+
+	return nil
+}
+
+func (c *Collection) checkOutput(out interface{}) (reflect.Value, error) {
+	outValue := reflect.ValueOf(out)
+	if outValue.Kind() != reflect.Ptr || outValue.IsNil() {
+		return reflect.Value{}, WrapError(ErrTypeMismatch,
+			"collection '%s' requires non-nil *%s to get value, but %T", c.name, c.valueType, out)
+	}
+
+	elem := outValue.Elem()
+	if elem.Type() != c.valueType {
+		return reflect.Value{}, WrapError(ErrTypeMismatch,
+			"collection '%s' requires *%s to get value, but %T", c.name, c.valueType, out)
+	}
+
+	return elem, nil
+}
+
+// Encode a typed value, return encoded data and a new struct instance decoded from it, so that
+// objects kept in memory are the same as values decoded from data later. The instance is the only
+// copy of value kept, callers get duplicates of it by load.
+func (c *Collection) encode(value interface{}) ([]byte, interface{}, error) {
+	if err := c.checkValue(value); err != nil {
+		return nil, nil, err
+	}
+
+	data, err := c.codec.Marshal(meta.InstanceOf(value).Interface())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	instance, err := c.decode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, instance.Interface(), nil
+}
+
+func (c *Collection) decode(data []byte) (reflect.Value, error) {
+	pointer := meta.NewPointerOf(c.valueType)
+	if err := c.codec.Unmarshal(data, pointer.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	return pointer.Elem(), nil
+}
+
+// Load a typed value owned by caller, from a frozen object if it is in memory, or decode it from
+// data otherwise.
+func (c *Collection) load(data []byte, object interface{}) (reflect.Value, error) {
+	if object == nil {
+		return c.decodeCached(data)
+	}
+
+	copy, err := meta.Duplicate(object)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	value := reflect.ValueOf(copy)
+	if value.Type() != c.valueType {
+		return c.decode(data)
+	}
+
+	return value, nil
+}
+
+// Put value of key, value must be the registered struct or a pointer to it.
+func (c *Collection) Put(key []byte, value interface{}) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if len(c.indexList()) > 0 {
+		return c.db.updateRetry(func(tx *Tx) error {
+			return tx.Collection(c).Put(key, value)
+		})
+	}
+
+	data, instance, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+
+	expires, err := c.expiry(instance)
+	if err != nil {
+		return err
+	}
+
+	if expires > 0 {
+		batch := &writeBatch{}
+		putExpiring(batch, c.key(key), data, instance, expires)
+		return c.db.write(batch)
+	}
+
+	return c.db.putObject(c.key(key), data, instance)
+}
+
+// Get value of key into out, out must be a pointer to the registered struct.
+func (c *Collection) Get(key []byte, out interface{}) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	elem, err := c.checkOutput(out)
+	if err != nil {
+		return err
+	}
+
+	return c.db.view(c.key(key), func(data []byte, object interface{}) error {
+		value, err := c.load(data, object)
+		if err != nil {
+			return err
+		}
+
+		elem.Set(value)
+		return nil
+	})
+}
+
+// Check whether key exists in collection.
+func (c *Collection) Has(key []byte) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+
+	return c.db.has(c.key(key))
+}
+
+// Delete key from collection.
+func (c *Collection) Delete(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if len(c.indexList()) > 0 {
+		return c.db.updateRetry(func(tx *Tx) error {
+			return tx.Collection(c).Delete(key)
+		})
+	}
+
+	return c.db.delete(c.key(key))
+}
+
+// Delete all keys of collection in [start, end), empty start or end means unbounded. Keys are
+// deleted by a single range deletion, or one by one if collection is indexed, so that indexes are
+// updated.
+func (c *Collection) DeleteRange(start []byte, end []byte) error {
+	if len(c.indexList()) > 0 {
+		return c.db.updateRetry(func(tx *Tx) error {
+			return tx.Collection(c).DeleteRange(start, end)
+		})
+	}
+
+	return c.db.deleteRange(c.prefix, start, end)
+}
+
+// Delete values whose field is in [lo, hi) atomically, nil lo or hi means unbounded. Return number
+// of values deleted.
+func (c *Collection) DeleteWhere(field string, lo interface{}, hi interface{}) (int, error) {
+	var n int
+	err := c.db.updateRetry(func(tx *Tx) error {
+		var err error
+		n, err = tx.Collection(c).DeleteWhere(field, lo, hi)
+		return err
+	})
+
+	return n, err
+}
+
+// Make an iterator over a new snapshot of collection.
+func (c *Collection) Iterator(options *IteratorOptions) (*CollectionIterator, error) {
+	iter, err := c.db.newIterator(c.prefix, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CollectionIterator{Iterator: iter, c: c}, nil
+}
+
+// CollectionIterator iterates keys of a collection, and decodes values into structs.
+type CollectionIterator struct {
+	*Iterator
+	c *Collection
+}
+
+// Decode value at current position into out, a pointer to a struct. out can be the registered
+// struct, or any struct whose fields are set from fields of the same names in value, converted if
+// types differ. Fields of out not in value are left unchanged.
+func (i *CollectionIterator) Decode(out interface{}) error {
+	value, err := i.c.decode(i.Value())
+	if err != nil {
+		return err
+	}
+
+	return assignFields(out, value)
+}
+
+func assignFields(out interface{}, value reflect.Value) error {
+	outValue := reflect.ValueOf(out)
+	if outValue.Kind() != reflect.Ptr || outValue.IsNil() || outValue.Elem().Kind() != reflect.Struct {
+		return WrapError(ErrTypeMismatch, "non-nil pointer to struct required, but %T", out)
+	}
+
+	outType := outValue.Elem().Type()
+	if outType == value.Type() {
+		outValue.Elem().Set(value)
+		return nil
+	}
+
+	for n := 0; n < outType.NumField(); n++ {
+		name := outType.Field(n).Name
+		field := value.FieldByName(name)
+		if !meta.IsExportedName(name) || !field.IsValid() {
+			continue
+		}
+
+		if _, err := meta.SetField(out, name, field.Interface()); err != nil {
+			return WrapError(ErrTypeMismatch, "can not decode %s into %s: %v", value.Type(), outType, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package pinkis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+type testWizard struct {
+	Name    string
+	House   string
+	Born    int
+	Courses []string
+}
+
+type testCreature struct {
+	Name string
+}
+
+type testFamiliar struct {
+	Name   string
+	Owner  string
+	Form   string `json:"-"`
+	secret string
+}
+
+func TestCollectionPutAndGet(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	wizards, err := db.Collection("wizards", testWizard{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	harry := testWizard{
+		Name:    "Harry Potter",
+		House:   "Gryffindor",
+		Born:    1980,
+		Courses: []string{"Potions", "Charms"},
+	}
+
+	if err := wizards.Put([]byte("harry"), &harry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	harry.Courses[0] = "Divination"
+	harry.House = "Slytherin"
+
+	var got testWizard
+	if err := wizards.Get([]byte("harry"), &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := testWizard{
+		Name:    "Harry Potter",
+		House:   "Gryffindor",
+		Born:    1980,
+		Courses: []string{"Potions", "Charms"},
+	}
+
+	if !meta.Equal(got, expected) {
+		t.Errorf("unexpected result: %#v <=> %#v", got, expected)
+	}
+
+	got.Courses[1] = "Herbology"
+	var again testWizard
+	if err := wizards.Get([]byte("harry"), &again); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !meta.Equal(again, expected) {
+		t.Errorf("unexpected result: %#v <=> %#v", again, expected)
+	}
+
+	if err := wizards.Put([]byte("ron"), testWizard{Name: "Ron Weasley"}); err != nil {
+		t.Errorf("put struct value failed: %v", err)
+	}
+
+	if has, err := wizards.Has([]byte("ron")); !has || err != nil {
+		t.Errorf("unexpected result: %v, %v", has, err)
+	}
+
+	if err := wizards.Delete([]byte("ron")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := wizards.Get([]byte("ron"), &got); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// Values read from memtable are the same as values decoded from tables, fields ignored by codec
+// are dropped either way.
+func TestCollectionGetFlushed(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	defer db.Close()
+
+	familiars, err := db.Collection("familiars", testFamiliar{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	hedwig := testFamiliar{Name: "Hedwig", Owner: "Harry", Form: "owl", secret: "snowy"}
+	if err := familiars.Put([]byte("hedwig"), hedwig); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	scabbers := testFamiliar{Name: "Scabbers", Form: "rat", secret: "Peter Pettigrew"}
+	err = db.Update(func(tx *Tx) error {
+		return tx.Collection(familiars).Put([]byte("scabbers"), scabbers)
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	batch := db.NewBatch()
+	crookshanks := testFamiliar{Name: "Crookshanks", Owner: "Hermione", Form: "cat", secret: "kneazle"}
+	if err := batch.Collection(familiars).Put([]byte("crookshanks"), crookshanks); err != nil {
+		t.Fatalf("batch put failed: %v", err)
+	}
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	keys := []string{"hedwig", "scabbers", "crookshanks"}
+	get := func(when string) []testFamiliar {
+		result := make([]testFamiliar, len(keys))
+		for i, key := range keys {
+			if err := familiars.Get([]byte(key), &result[i]); err != nil {
+				t.Fatalf("get %s %s failed: %v", key, when, err)
+			}
+		}
+
+		return result
+	}
+
+	cached := get("in memtable")
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	flushed := get("flushed")
+	expected := []testFamiliar{
+		{Name: "Hedwig", Owner: "Harry"},
+		{Name: "Scabbers"},
+		{Name: "Crookshanks", Owner: "Hermione"},
+	}
+
+	for i, key := range keys {
+		if cached[i] != flushed[i] || flushed[i] != expected[i] {
+			t.Errorf("unexpected %s: %+v <=> %+v <=> %+v", key, cached[i], flushed[i], expected[i])
+		}
+	}
+}
+
+func TestCollectionTypeMismatch(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	if _, err := db.Collection("numbers", 42); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := db.Collection("", testWizard{}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	wizards, err := db.Collection("wizards", &testWizard{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if same, err := db.Collection("wizards", testWizard{}); same != wizards || err != nil {
+		t.Errorf("unexpected result: %v, %v", same, err)
+	}
+
+	_, err = db.Collection("wizards", testCreature{})
+	var metaError *meta.MetaError
+	if !errors.Is(err, ErrTypeMismatch) || !errors.As(err, &metaError) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := wizards.Put([]byte("buckbeak"), testCreature{Name: "Buckbeak"}); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var nilWizard *testWizard
+	if err := wizards.Put([]byte("nobody"), nilWizard); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := wizards.Put([]byte("harry"), testWizard{Name: "Harry Potter"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var creature testCreature
+	if err := wizards.Get([]byte("harry"), &creature); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var wizard testWizard
+	if err := wizards.Get([]byte("harry"), wizard); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := wizards.Get([]byte("harry"), nilWizard); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCollectionNamespaces(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	wizards, _ := db.Collection("wizards", testWizard{})
+	creatures, _ := db.Collection("creatures", testCreature{})
+
+	if err := wizards.Put([]byte("hagrid"), testWizard{Name: "Rubeus Hagrid"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if has, _ := creatures.Has([]byte("hagrid")); has {
+		t.Errorf("key should not exist in another collection")
+	}
+
+	if has, _ := db.Has([]byte("hagrid")); has {
+		t.Errorf("key should not exist in default keyspace")
+	}
+}
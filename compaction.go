@@ -0,0 +1,986 @@
+package pinkis
+
+import (
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// CompactionStrategy selects how tables of an LSM engine are merged.
+type CompactionStrategy int
+
+const (
+	// Keep tables in levels of growing size, tables in a level are disjoint except level 0. A level
+	// outgrowing its size is merged into the next level.
+	CompactionLeveled CompactionStrategy = iota
+	// Merge tables of similar size into a bigger one, all tables stay in level 0. Fewer bytes are
+	// rewritten than leveled, at the cost of more tables to read and more space.
+	CompactionSizeTiered
+)
+
+func (s CompactionStrategy) String() string {
+	switch s {
+	case CompactionLeveled:
+		return "leveled"
+
+	case CompactionSizeTiered:
+		return "size-tiered"
+
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	compactionDefaultConcurrency   = 1
+	compactionDefaultL0Trigger     = 4
+	compactionDefaultLevelBase     = 10 << 20
+	compactionDefaultMultiplier    = 10
+	compactionDefaultTableSize     = 2 << 20
+	compactionDefaultTierMin       = 4
+	compactionDefaultTierMax       = 32
+	compactionTierLowerBucketRatio = 0.5
+	compactionTierUpperBucketRatio = 1.5
+)
+
+func positiveOr(value int, fallback int) int {
+	if value <= 0 {
+		return fallback
+	}
+
+	return value
+}
+
+func positiveOr64(value int64, fallback int64) int64 {
+	if value <= 0 {
+		return fallback
+	}
+
+	return value
+}
+
+// Maximum size of a level in leveled compaction, level 0 is limited by number of tables.
+func (o Options) levelMaxSize(level int) uint64 {
+	size := uint64(positiveOr64(o.LevelBaseSize, compactionDefaultLevelBase))
+	multiplier := uint64(positiveOr(o.LevelSizeMultiplier, compactionDefaultMultiplier))
+	for i := 1; i < level; i++ {
+		size *= multiplier
+	}
+
+	return size
+}
+
+// A compaction merges input tables into tables in output level.
+type compaction struct {
+	level       int
+	outputLevel int
+	inputs      []*liveTable
+	version     *lsmVersion
+	// Range of user keys in inputs.
+	smallest []byte
+	largest  []byte
+}
+
+func newCompaction(version *lsmVersion, level int, outputLevel int, inputs []*liveTable) *compaction {
+	c := &compaction{
+		level:       level,
+		outputLevel: outputLevel,
+		inputs:      inputs,
+		version:     version,
+	}
+
+	c.smallest, c.largest = keyRange(version.compare, inputs)
+	return c
+}
+
+// Range of user keys in tables.
+func keyRange(compare compareFunc, tables []*liveTable) ([]byte, []byte) {
+	var smallest, largest []byte
+	for i, t := range tables {
+		if i == 0 || compare(t.smallestKey(), smallest) < 0 {
+			smallest = t.smallestKey()
+		}
+
+		if i == 0 || compare(t.largestKey(), largest) > 0 {
+			largest = t.largestKey()
+		}
+	}
+
+	return smallest, largest
+}
+
+func (c *compaction) overlaps(other *compaction) bool {
+	compare := c.version.compare
+	return compare(c.smallest, other.largest) <= 0 && compare(other.smallest, c.largest) <= 0
+}
+
+func (c *compaction) isInput(t *liveTable) bool {
+	for _, input := range c.inputs {
+		if input == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether tables not in compaction may hold key. If not, a tombstone of key can be dropped.
+func (c *compaction) keyMayExistElsewhere(key []byte) bool {
+	for _, tables := range c.version.levels {
+		for _, t := range tables {
+			if !c.isInput(t) && t.overlaps(c.version.compare, key, key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Whether a level 0 table not in compaction may hold entries of key between entries of inputs.
+// Level 0 tables picked by size-tiered compaction may skip tables in order of age, so that
+// operands are not folded across them.
+func (c *compaction) keyMayInterleave(key []byte) bool {
+	if c.level != 0 {
+		return false
+	}
+
+	for _, t := range c.version.levels[0] {
+		if !c.isInput(t) && t.overlaps(c.version.compare, key, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether table holds entries covered by range tombstone t. A table which can not be read is
+// taken as holding them.
+func holdsCovered(compare compareFunc, table *liveTable, t rangeTombstone) bool {
+	if !table.overlaps(compare, t.start, t.end) {
+		return false
+	}
+
+	iter := table.reader.Iterator()
+	defer iter.Close()
+
+	for iter.Seek(makeLookupKey(t.start, maxSequence)); iter.Valid(); iter.Next() {
+		parsed, err := parseInternalKey(iter.Key())
+		if err != nil || compare(parsed.key, t.end) >= 0 {
+			return err != nil
+		}
+
+		if parsed.seq < t.seq {
+			return true
+		}
+	}
+
+	return iter.Error() != nil
+}
+
+// Sequence numbers of range tombstones visible to all readers at smallestSnapshot, which cover
+// no entry of tables out of compaction. Entries covered by them in inputs are all dropped by
+// compaction.
+func (c *compaction) retiredTombstones(smallestSnapshot uint64) map[uint64]bool {
+	retired := make(map[uint64]bool)
+	for _, t := range c.version.tombstones {
+		if t.seq > smallestSnapshot {
+			continue
+		}
+
+		covered := false
+		for _, table := range c.version.tables() {
+			if !c.isInput(table) && holdsCovered(c.version.compare, table, t) {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			retired[t.seq] = true
+		}
+	}
+
+	return retired
+}
+
+// Compactions to rewrite tables in their levels, which hold entries covered by range tombstones
+// visible to all readers at smallestSnapshot. Tables in level 0 are rewritten with all tables
+// overlapping them.
+func (e *lsmEngine) coveredTables(v *lsmVersion, smallestSnapshot uint64) []*compaction {
+	var compactions []*compaction
+	picked := make(map[uint64]bool)
+	for _, t := range v.tombstones {
+		if t.seq > smallestSnapshot {
+			continue
+		}
+
+		for level := range v.levels {
+			for _, table := range v.overlappingTables(level, t.start, t.end) {
+				if picked[table.meta.number] || !holdsCovered(v.compare, table, t) {
+					continue
+				}
+
+				inputs := []*liveTable{table}
+				if level == 0 {
+					inputs = expandLevel0(v, table.smallestKey(), table.largestKey())
+				}
+
+				for _, input := range inputs {
+					picked[input.meta.number] = true
+				}
+
+				compactions = append(compactions, newCompaction(v, level, level, inputs))
+			}
+		}
+	}
+
+	return compactions
+}
+
+// Tables in level 0 overlapping [start, end], range is expanded until no more table overlaps it,
+// since tables in level 0 overlap with each other.
+func expandLevel0(v *lsmVersion, start []byte, end []byte) []*liveTable {
+	tables := v.overlappingTables(0, start, end)
+	for len(tables) > 0 {
+		start, end = keyRange(v.compare, tables)
+		expanded := v.overlappingTables(0, start, end)
+		if len(expanded) == len(tables) {
+			break
+		}
+
+		tables = expanded
+	}
+
+	return tables
+}
+
+// States of compactions, protected by lock of engine.
+type compactionState struct {
+	running int
+	paused  int
+	active  []*compaction
+	// Numbers of tables being compacted.
+	busy map[uint64]bool
+	// Largest key compacted in each level, the next leveled compaction of a level starts after it.
+	pointers [lsmNumLevels][]byte
+	// Set when engine is closing, compactions stop as soon as possible.
+	stopping int32
+}
+
+func (s *compactionState) anyBusy(tables []*liveTable) bool {
+	for _, t := range tables {
+		if s.busy[t.meta.number] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether c can run along with running compactions.
+func (s *compactionState) conflicts(c *compaction) bool {
+	if s.anyBusy(c.inputs) {
+		return true
+	}
+
+	for _, running := range s.active {
+		if running.level == 0 && c.level == 0 && running.outputLevel != 0 {
+			return true
+		}
+
+		if running.outputLevel == c.outputLevel && running.overlaps(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *compactionState) start(c *compaction) {
+	s.running++
+	s.active = append(s.active, c)
+	for _, t := range c.inputs {
+		s.busy[t.meta.number] = true
+	}
+}
+
+func (s *compactionState) finish(c *compaction) {
+	s.running--
+	for i, running := range s.active {
+		if running == c {
+			s.active = append(s.active[:i], s.active[i+1:]...)
+			break
+		}
+	}
+
+	for _, t := range c.inputs {
+		delete(s.busy, t.meta.number)
+	}
+}
+
+// Pick a compaction to run, or nil if nothing needs compaction. Tables of stale keys are rewritten
+// when nothing else needs compaction. Caller must hold lock.
+func (e *lsmEngine) pickCompaction() *compaction {
+	var c *compaction
+	if e.options.CompactionStrategy == CompactionSizeTiered {
+		c = e.pickSizeTiered(e.current)
+
+	} else {
+		c = e.pickLeveled(e.current)
+	}
+
+	if c != nil {
+		return c
+	}
+
+	for _, c := range e.staleTables(e.current, nil, nil) {
+		if !e.compactions.conflicts(c) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Compactions to rewrite tables overlapping [start, end] in their levels, whose data keys are not
+// wrapped by the current master key, so that old master keys may be retired after that.
+func (e *lsmEngine) staleTables(v *lsmVersion, start []byte, end []byte) []*compaction {
+	if e.options.KeyProvider == nil {
+		return nil
+	}
+
+	current := e.options.KeyProvider.CurrentKeyID()
+	var compactions []*compaction
+	for level := range v.levels {
+		for _, t := range v.overlappingTables(level, start, end) {
+			if t.reader.cipher == nil || t.reader.cipher.keyID != current {
+				compactions = append(compactions, newCompaction(v, level, level, []*liveTable{t}))
+			}
+		}
+	}
+
+	return compactions
+}
+
+// Compact the level with the highest score, a level scores 1 when it is full.
+func (e *lsmEngine) pickLeveled(v *lsmVersion) *compaction {
+	type levelScore struct {
+		level int
+		score float64
+	}
+
+	trigger := positiveOr(e.options.L0CompactionTrigger, compactionDefaultL0Trigger)
+	scores := make([]levelScore, 0, lsmNumLevels-1)
+	scores = append(scores, levelScore{0, float64(len(v.levels[0])) / float64(trigger)})
+	for level := 1; level < lsmNumLevels-1; level++ {
+		score := float64(v.levelSize(level)) / float64(e.options.levelMaxSize(level))
+		scores = append(scores, levelScore{level, score})
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].score > scores[j].score })
+	for _, s := range scores {
+		if s.score < 1 {
+			break
+		}
+
+		var inputs []*liveTable
+		if s.level == 0 {
+			inputs = append(inputs, v.levels[0]...)
+
+		} else {
+			inputs = e.pickLevelTable(v, s.level)
+		}
+
+		if len(inputs) <= 0 {
+			continue
+		}
+
+		c := e.expandToNextLevel(v, s.level, inputs)
+		if !e.compactions.conflicts(c) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Pick the first idle table after the compaction pointer of level, wrapping around.
+func (e *lsmEngine) pickLevelTable(v *lsmVersion, level int) []*liveTable {
+	tables := v.levels[level]
+	pointer := e.compactions.pointers[level]
+	start := 0
+	if pointer != nil {
+		start = sort.Search(len(tables), func(i int) bool {
+			return v.compare(tables[i].largestKey(), pointer) > 0
+		})
+	}
+
+	for i := 0; i < len(tables); i++ {
+		t := tables[(start+i)%len(tables)]
+		if !e.compactions.busy[t.meta.number] {
+			return []*liveTable{t}
+		}
+	}
+
+	return nil
+}
+
+// Make a compaction of inputs in level, with overlapping tables in the next level.
+func (e *lsmEngine) expandToNextLevel(v *lsmVersion, level int, inputs []*liveTable) *compaction {
+	smallest, largest := keyRange(v.compare, inputs)
+	all := append([]*liveTable{}, inputs...)
+	all = append(all, v.overlappingTables(level+1, smallest, largest)...)
+	return newCompaction(v, level, level+1, all)
+}
+
+// Bucket tables in level 0 by size, and merge the first bucket with enough idle tables.
+func (e *lsmEngine) pickSizeTiered(v *lsmVersion) *compaction {
+	minThreshold := positiveOr(e.options.SizeTieredMinThreshold, compactionDefaultTierMin)
+	maxThreshold := positiveOr(e.options.SizeTieredMaxThreshold, compactionDefaultTierMax)
+	if maxThreshold < minThreshold {
+		maxThreshold = minThreshold
+	}
+
+	tables := make([]*liveTable, 0, len(v.levels[0]))
+	for _, t := range v.levels[0] {
+		if !e.compactions.busy[t.meta.number] {
+			tables = append(tables, t)
+		}
+	}
+
+	sort.Slice(tables, func(i, j int) bool { return tables[i].meta.size < tables[j].meta.size })
+
+	var bucket []*liveTable
+	var total float64
+	for i := 0; i <= len(tables); i++ {
+		if i < len(tables) {
+			size := float64(tables[i].meta.size)
+			average := total / float64(len(bucket))
+			if len(bucket) <= 0 || (size >= average*compactionTierLowerBucketRatio &&
+				size <= average*compactionTierUpperBucketRatio) {
+				bucket = append(bucket, tables[i])
+				total += size
+				continue
+			}
+		}
+
+		if len(bucket) >= minThreshold {
+			if len(bucket) > maxThreshold {
+				bucket = bucket[:maxThreshold]
+			}
+
+			c := newCompaction(v, 0, 0, bucket)
+			if !e.compactions.conflicts(c) {
+				return c
+			}
+		}
+
+		if i < len(tables) {
+			bucket = []*liveTable{tables[i]}
+			total = float64(tables[i].meta.size)
+		}
+	}
+
+	return nil
+}
+
+// Start background compactions while there are compactions to run and idle workers.
+func (e *lsmEngine) maybeScheduleCompaction() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	concurrency := positiveOr(e.options.CompactionConcurrency, compactionDefaultConcurrency)
+	for e.compactions.running < concurrency && e.compactions.paused <= 0 && !e.closed &&
+		e.bgErr == nil && !e.options.DisableAutoCompaction && !e.options.ReadOnly {
+
+		c := e.pickCompaction()
+		if c == nil {
+			return
+		}
+
+		c.version.ref()
+		e.compactions.start(c)
+		if c.level > 0 {
+			e.compactions.pointers[c.level] = c.largest
+		}
+
+		go e.backgroundCompaction(c)
+	}
+}
+
+func (e *lsmEngine) backgroundCompaction(c *compaction) {
+	err := e.runCompaction(c)
+
+	e.lock.Lock()
+	e.compactions.finish(c)
+	if err != nil && err != errCompactionStopped && e.bgErr == nil {
+		e.bgErr = err
+	}
+
+	e.compactionCond.Broadcast()
+	e.lock.Unlock()
+	c.version.unref()
+
+	if err == nil {
+		e.maybeScheduleCompaction()
+	}
+}
+
+var errCompactionStopped = NewError("compaction stopped")
+
+func (e *lsmEngine) tableSize() uint64 {
+	return uint64(positiveOr64(e.options.TableSize, compactionDefaultTableSize))
+}
+
+// Merge inputs of compaction into new tables and install them. An entry is dropped if a newer
+// entry of the same user key is visible to all readers, and a tombstone is dropped if no table
+// out of compaction may hold the key. Expired entries are taken as tombstones, since they are
+// invisible to all readers, snapshots included. Entries covered by range tombstones visible to all
+// readers are dropped, and such range tombstones are retired if no table out of compaction may hold
+// keys in their ranges.
+func (e *lsmEngine) runCompaction(c *compaction) error {
+	smallestSnapshot := e.snapshots.oldest(e.LastSequence())
+	now := nowOf(e.options.clock())
+	iterators := make([]internalIterator, 0, len(c.inputs))
+	for _, t := range c.inputs {
+		iterators = append(iterators, t.reader.Iterator())
+	}
+
+	iter := newMergingIterator(internalCompare(e.compare), iterators)
+	var outputs []*liveTable
+	var output *outputTable
+	var outputKey []byte
+	var currentKey []byte
+	hasCurrentKey := false
+	lastSequence := uint64(0)
+	// Whether the newest entry of current key kept is an operand, which is absorbed by an expired
+	// value below it, so the expired value is kept.
+	underOperand := false
+	var chain *mergeChain
+	err := error(nil)
+
+	// Add an entry to output, a new table is started at a new key if output is full.
+	emit := func(key []byte, value []byte) error {
+		userKey := internalUserKey(key)
+		if output != nil && e.compare(userKey, outputKey) != 0 && output.EstimatedSize() >= e.tableSize() {
+			table, err := output.Finish()
+			output = nil
+			if err != nil {
+				return err
+			}
+
+			outputs = append(outputs, table)
+		}
+
+		if output == nil {
+			var err error
+			if output, err = e.newOutputTable(c.outputLevel); err != nil {
+				return err
+			}
+		}
+
+		outputKey = append(outputKey[:0], userKey...)
+		if err := output.Add(key, value); err != nil {
+			return err
+		}
+
+		e.limiter.Wait(len(key) + len(value))
+		return nil
+	}
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if atomic.LoadInt32(&e.compactions.stopping) != 0 {
+			err = errCompactionStopped
+			break
+		}
+
+		key, value := iter.Key(), iter.Value()
+		parsed, errParse := parseInternalKey(key)
+		if errParse != nil {
+			err = errParse
+			break
+		}
+
+		newKey := !hasCurrentKey || e.compare(parsed.key, currentKey) != 0
+		if newKey {
+			if chain != nil {
+				if err = chain.emit(c, now, emit); err != nil {
+					break
+				}
+
+				chain = nil
+			}
+
+			currentKey = append(currentKey[:0], parsed.key...)
+			hasCurrentKey = true
+			lastSequence = maxSequence + 1
+			underOperand = false
+		}
+
+		covered := c.version.tombstones.covers(e.compare, parsed.key, parsed.seq, smallestSnapshot)
+		if chain != nil {
+			chain.add(key, value, parsed, covered)
+			lastSequence = parsed.seq
+			continue
+		}
+
+		if parsed.kind == kindPutExpiring && expiredAt(value, now) && !underOperand {
+			key, value = makeInternalKey(parsed.key, parsed.seq, kindDelete), nil
+			parsed.kind = kindDelete
+		}
+
+		drop := false
+		if lastSequence <= smallestSnapshot {
+			drop = true
+
+		} else if covered {
+			drop = true
+
+		} else if parsed.kind == kindDelete && parsed.seq <= smallestSnapshot &&
+			!c.keyMayExistElsewhere(parsed.key) {
+			drop = true
+		}
+
+		lastSequence = parsed.seq
+		if drop {
+			continue
+		}
+
+		// Operands visible to all readers are folded with older entries of key.
+		if parsed.kind == kindMerge && parsed.seq <= smallestSnapshot {
+			chain = newMergeChain(key, value)
+			continue
+		}
+
+		underOperand = parsed.kind == kindMerge
+		if err = emit(key, value); err != nil {
+			break
+		}
+	}
+
+	if err == nil && chain != nil {
+		err = chain.emit(c, now, emit)
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	if output != nil {
+		if err == nil {
+			var table *liveTable
+			table, err = output.Finish()
+			if err == nil {
+				outputs = append(outputs, table)
+			}
+
+		} else {
+			output.Abandon()
+		}
+	}
+
+	if err == nil {
+		edit := &versionEdit{
+			added:   outputs,
+			deleted: make(map[uint64]bool),
+		}
+
+		for _, t := range c.inputs {
+			edit.deleted[t.meta.number] = true
+		}
+
+		edit.retired = c.retiredTombstones(smallestSnapshot)
+		return e.logAndApply(edit)
+	}
+
+	for _, t := range outputs {
+		t.discard()
+	}
+
+	return err
+}
+
+// Entries of a key taken by a compaction, from the newest operand visible to all readers, until
+// the value operands are folded onto is found.
+type mergeChain struct {
+	keys   [][]byte
+	values [][]byte
+	// Operands, newest first.
+	operands [][]byte
+	// Entry operands are folded onto, a delete if key is deleted or never put.
+	kind     entryKind
+	value    []byte
+	resolved bool
+}
+
+func newMergeChain(key []byte, value []byte) *mergeChain {
+	chain := &mergeChain{kind: kindDelete}
+	chain.add(key, value, parsedInternalKey{kind: kindMerge}, false)
+	return chain
+}
+
+// Take an older entry of key, covered if it is deleted by a range tombstone.
+func (m *mergeChain) add(key []byte, value []byte, parsed parsedInternalKey, covered bool) {
+	if m.resolved {
+		return
+	}
+
+	if covered {
+		m.resolved = true
+		return
+	}
+
+	k, v := copyOp(key, value)
+	m.keys = append(m.keys, k)
+	m.values = append(m.values, v)
+	if parsed.kind == kindMerge {
+		m.operands = append(m.operands, v)
+		return
+	}
+
+	m.kind, m.value, m.resolved = parsed.kind, v, true
+}
+
+// Emit operands folded as an entry at sequence number of the newest operand, if the value folded
+// onto is found or no older entry of key exists elsewhere, and no level 0 table out of compaction
+// may hold entries between them. Otherwise, or if operands fail to fold, entries are kept as they
+// are.
+func (m *mergeChain) emit(c *compaction, now int64, emit func(key []byte, value []byte) error) error {
+	parsed, _ := parseInternalKey(m.keys[0])
+	if (m.resolved || !c.keyMayExistElsewhere(parsed.key)) && !c.keyMayInterleave(parsed.key) {
+		operands := make([][]byte, len(m.operands))
+		for i, operand := range m.operands {
+			operands[len(operands)-1-i] = operand
+		}
+
+		kind, value, ok, err := mergeEntry(m.kind, m.value, operands, now)
+		if err == nil {
+			if !ok {
+				kind, value = kindDelete, nil
+			}
+
+			return emit(makeInternalKey(parsed.key, parsed.seq, kind), value)
+		}
+	}
+
+	for i, key := range m.keys {
+		if err := emit(key, m.values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A table being written by a flush or a compaction.
+type outputTable struct {
+	level  int
+	number uint64
+	path   string
+	file   *os.File
+	writer *tableWriter
+	engine *lsmEngine
+}
+
+func (e *lsmEngine) newOutputTable(level int) (*outputTable, error) {
+	number := e.newTableNumber()
+	path := e.tablePath(number)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := newTableWriter(file, internalCompare(e.compare), e.tableOptions())
+	if err != nil {
+		file.Close()
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	output := &outputTable{
+		level:  level,
+		number: number,
+		path:   path,
+		file:   file,
+		writer: writer,
+		engine: e,
+	}
+
+	return output, nil
+}
+
+func (o *outputTable) Add(key []byte, value []byte) error {
+	return o.writer.Add(key, value)
+}
+
+func (o *outputTable) EstimatedSize() uint64 {
+	return o.writer.EstimatedSize()
+}
+
+// Finish and open table, it is not recorded in manifest yet.
+func (o *outputTable) Finish() (*liveTable, error) {
+	meta, err := o.writer.Finish()
+	if errClose := o.file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		_ = os.Remove(o.path)
+		return nil, err
+	}
+
+	meta.level = o.level
+	meta.number = o.number
+	reader, err := openTable(o.path, o.number, o.engine.compare, o.engine.tableOptions())
+	if err != nil {
+		_ = os.Remove(o.path)
+		return nil, err
+	}
+
+	return newLiveTable(meta, reader, o.path), nil
+}
+
+// Close and remove an unfinished table.
+func (o *outputTable) Abandon() {
+	_ = o.file.Close()
+	_ = os.Remove(o.path)
+}
+
+// Close and remove a finished table, which is not in any version.
+func (t *liveTable) discard() {
+	t.markObsolete()
+	t.ref()
+	t.unref()
+}
+
+// Merge all tables overlapping user keys [start, end] down, nil means unbounded. With leveled
+// compaction, tables are merged level by level into the deepest level holding keys in range.
+// With size-tiered compaction, all overlapping tables are merged into one. Tables holding entries
+// covered by range tombstones, and tables in range left of stale keys are rewritten then.
+// Memtable is flushed first, and auto compactions are paused until it is done.
+func (e *lsmEngine) CompactRange(start []byte, end []byte) error {
+	if err := e.Flush(); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	e.compactions.paused++
+	for e.compactions.running > 0 {
+		e.compactionCond.Wait()
+	}
+
+	// Counted as running, so that Close waits for it.
+	e.compactions.running++
+	e.lock.Unlock()
+
+	err := e.compactRange(start, end)
+
+	e.lock.Lock()
+	e.compactions.running--
+	e.compactions.paused--
+	e.compactionCond.Broadcast()
+	if err != nil && err != errCompactionStopped && e.bgErr == nil {
+		e.bgErr = err
+	}
+
+	e.lock.Unlock()
+
+	e.maybeScheduleCompaction()
+	if err == errCompactionStopped {
+		return ErrClosed
+	}
+
+	return err
+}
+
+func (e *lsmEngine) compactRange(start []byte, end []byte) error {
+	if err := e.mergeRange(start, end); err != nil {
+		return err
+	}
+
+	for {
+		v := e.currentVersion()
+		compactions := e.coveredTables(v, e.snapshots.oldest(e.LastSequence()))
+		compactions = append(compactions, e.staleTables(v, start, end)...)
+		if len(compactions) <= 0 {
+			v.unref()
+			return e.retireTombstones()
+		}
+
+		err := e.runCompaction(compactions[0])
+		v.unref()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Retire range tombstones covering no entry of any table.
+func (e *lsmEngine) retireTombstones() error {
+	v := e.currentVersion()
+	defer v.unref()
+
+	c := newCompaction(v, 0, 0, nil)
+	retired := c.retiredTombstones(e.snapshots.oldest(e.LastSequence()))
+	if len(retired) <= 0 {
+		return nil
+	}
+
+	return e.logAndApply(&versionEdit{retired: retired})
+}
+
+func (e *lsmEngine) mergeRange(start []byte, end []byte) error {
+	if e.options.CompactionStrategy == CompactionSizeTiered {
+		v := e.currentVersion()
+		defer v.unref()
+
+		inputs := expandLevel0(v, start, end)
+		if len(inputs) <= 0 {
+			return nil
+		}
+
+		return e.runCompaction(newCompaction(v, 0, 0, inputs))
+	}
+
+	v := e.currentVersion()
+	maxLevel := 0
+	for level := 1; level < lsmNumLevels; level++ {
+		if len(v.overlappingTables(level, start, end)) > 0 {
+			maxLevel = level
+		}
+	}
+
+	v.unref()
+	if maxLevel <= 0 {
+		maxLevel = 1
+	}
+
+	for level := 0; level < maxLevel; level++ {
+		if err := e.compactLevel(level, start, end); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Merge tables overlapping [start, end] in level into the next level.
+func (e *lsmEngine) compactLevel(level int, start []byte, end []byte) error {
+	v := e.currentVersion()
+	defer v.unref()
+
+	var inputs []*liveTable
+	if level == 0 {
+		inputs = expandLevel0(v, start, end)
+
+	} else {
+		inputs = v.overlappingTables(level, start, end)
+	}
+
+	if len(inputs) <= 0 {
+		return nil
+	}
+
+	return e.runCompaction(e.expandToNextLevel(v, level, inputs))
+}
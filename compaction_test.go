@@ -0,0 +1,354 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func testCompactionOptions(dir string, strategy CompactionStrategy) Options {
+	return Options{
+		Dir:                    dir,
+		Engine:                 EngineLSM,
+		SyncPolicy:             SyncNever,
+		MemtableSize:           4 << 10,
+		BlockSize:              512,
+		CompactionStrategy:     strategy,
+		L0CompactionTrigger:    2,
+		LevelBaseSize:          16 << 10,
+		LevelSizeMultiplier:    4,
+		TableSize:              8 << 10,
+		SizeTieredMinThreshold: 2,
+	}
+}
+
+func openTestCompaction(t *testing.T, dir string, strategy CompactionStrategy) *DB {
+	db, err := Open(testCompactionOptions(dir, strategy))
+	if err != nil {
+		t.Fatalf("open lsm database failed: %v", err)
+	}
+
+	return db
+}
+
+// Visible entries of engine as "key=value", the newest entry of each key wins.
+func scanVisible(t *testing.T, e *lsmEngine) []string {
+	iter, _ := e.newInternalIterator()
+	defer iter.Close()
+
+	var result []string
+	var last []byte
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		parsed, err := parseInternalKey(iter.Key())
+		if err != nil {
+			t.Fatalf("parse key failed: %v", err)
+		}
+
+		if last != nil && string(parsed.key) == string(last) {
+			continue
+		}
+
+		last = append([]byte{}, parsed.key...)
+		if parsed.kind == kindPut {
+			result = append(result, fmt.Sprintf("%q=%s", parsed.key, iter.Value()))
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	return result
+}
+
+// Number of entries in all tables, including shadowed ones and tombstones.
+func countTableEntries(t *testing.T, e *lsmEngine) int {
+	v := e.currentVersion()
+	defer v.unref()
+
+	count := 0
+	for _, table := range v.tables() {
+		iter := table.reader.Iterator()
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			count++
+		}
+
+		if err := iter.Close(); err != nil {
+			t.Fatalf("scan table failed: %v", err)
+		}
+	}
+
+	return count
+}
+
+func writeOverlappingData(t *testing.T, db *DB, rounds int) {
+	houses := []string{"gryffindor", "hufflepuff", "ravenclaw", "slytherin"}
+	for round := 0; round < rounds; round++ {
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("student-%04d", i))
+			value := []byte(fmt.Sprintf("%s-%d", houses[(i+round)%len(houses)], round))
+			if err := db.Put(key, value); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+
+			if (i+round)%7 == 0 {
+				if err := db.Delete(key); err != nil {
+					t.Fatalf("delete failed: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func testCompactRange(t *testing.T, strategy CompactionStrategy) {
+	options := testCompactionOptions(t.TempDir(), strategy)
+	options.DisableAutoCompaction = true
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	e := lsmEngineOf(db)
+
+	writeOverlappingData(t, db, 8)
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	before := scanVisible(t, e)
+	entriesBefore := countTableEntries(t, e)
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact range failed: %v", err)
+	}
+
+	after := scanVisible(t, e)
+	if ok, err := meta.ArrayEqualInfo(before, after); !ok {
+		t.Errorf("visible data changed by compaction: %v", err)
+	}
+
+	entriesAfter := countTableEntries(t, e)
+	if entriesAfter != len(after) {
+		t.Errorf("shadowed entries and tombstones should be dropped, %d entries for %d keys",
+			entriesAfter, len(after))
+	}
+
+	if entriesAfter >= entriesBefore {
+		t.Errorf("compaction should reduce entries, %d -> %d", entriesBefore, entriesAfter)
+	}
+
+	for i := 0; i < 300; i += 11 {
+		key := []byte(fmt.Sprintf("student-%04d", i))
+		value, err := db.Get(key)
+		// Keys deleted in the last round.
+		if i%7 == 0 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s should be deleted, got %s, %v", key, value, err)
+			}
+
+			continue
+		}
+
+		if err != nil || !strings.HasSuffix(string(value), "-7") {
+			t.Errorf("unexpected value of %s: %s, %v", key, value, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	db, err = Open(options)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+
+	defer db.Close()
+
+	reopened := scanVisible(t, lsmEngineOf(db))
+	if ok, err := meta.ArrayEqualInfo(before, reopened); !ok {
+		t.Errorf("visible data changed after reopen: %v", err)
+	}
+}
+
+func TestCompactRangeLeveled(t *testing.T) {
+	testCompactRange(t, CompactionLeveled)
+}
+
+func TestCompactRangeSizeTiered(t *testing.T) {
+	testCompactRange(t, CompactionSizeTiered)
+}
+
+func TestCompactRangeLeveledTablesDisjoint(t *testing.T) {
+	db := openTestCompaction(t, t.TempDir(), CompactionLeveled)
+	defer db.Close()
+
+	e := lsmEngineOf(db)
+	writeOverlappingData(t, db, 6)
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact range failed: %v", err)
+	}
+
+	v := e.currentVersion()
+	defer v.unref()
+
+	if n := len(v.levels[0]); n != 0 {
+		t.Errorf("level 0 should be empty after compaction, got %d tables", n)
+	}
+
+	for level := 1; level < lsmNumLevels; level++ {
+		tables := v.levels[level]
+		for i := 1; i < len(tables); i++ {
+			if v.compare(tables[i-1].largestKey(), tables[i].smallestKey()) >= 0 {
+				t.Errorf("tables in level %d overlap: %q, %q", level,
+					tables[i-1].largestKey(), tables[i].smallestKey())
+			}
+		}
+	}
+}
+
+func TestCompactRangePartial(t *testing.T) {
+	options := testCompactionOptions(t.TempDir(), CompactionLeveled)
+	options.DisableAutoCompaction = true
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	defer db.Close()
+
+	e := lsmEngineOf(db)
+	writeOverlappingData(t, db, 4)
+	before := scanVisible(t, e)
+
+	if err := db.CompactRange([]byte("student-0100"), []byte("student-0199")); err != nil {
+		t.Fatalf("compact range failed: %v", err)
+	}
+
+	after := scanVisible(t, e)
+	if ok, err := meta.ArrayEqualInfo(before, after); !ok {
+		t.Errorf("visible data changed by compaction: %v", err)
+	}
+}
+
+func testAutoCompaction(t *testing.T, strategy CompactionStrategy) {
+	dir := t.TempDir()
+	options := Options{
+		Dir:                    dir,
+		Engine:                 EngineLSM,
+		SyncPolicy:             SyncNever,
+		MemtableSize:           2 << 10,
+		BlockSize:              512,
+		CompactionStrategy:     strategy,
+		CompactionConcurrency:  3,
+		L0CompactionTrigger:    2,
+		LevelBaseSize:          8 << 10,
+		LevelSizeMultiplier:    2,
+		TableSize:              4 << 10,
+		SizeTieredMinThreshold: 2,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	expected := make(map[string]string)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			r := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 1500; i++ {
+				key := fmt.Sprintf("wizard-%d-%03d", w, r.Intn(200))
+				value := fmt.Sprintf("wand-%d", i)
+				if err := db.Put([]byte(key), []byte(value)); err != nil {
+					t.Errorf("put failed: %v", err)
+					return
+				}
+
+				lock.Lock()
+				expected[key] = value
+				lock.Unlock()
+			}
+		}(w)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("wizard-%d-%03d", i%4, i%200)
+			if _, err := db.Get([]byte(key)); err != nil && !errors.Is(err, ErrNotFound) {
+				t.Errorf("get failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	check := func(db *DB) {
+		for key, value := range expected {
+			got, err := db.Get([]byte(key))
+			if err != nil || string(got) != value {
+				t.Errorf("unexpected value of %s: %s, %v", key, got, err)
+			}
+		}
+	}
+
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	db, err = Open(options)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+
+	defer db.Close()
+	check(db)
+}
+
+func TestAutoCompactionLeveled(t *testing.T) {
+	testAutoCompaction(t, CompactionLeveled)
+}
+
+func TestAutoCompactionSizeTiered(t *testing.T) {
+	testAutoCompaction(t, CompactionSizeTiered)
+}
+
+func TestCompactRangeMemoryEngine(t *testing.T) {
+	db := openTestDB(t)
+	db.Put([]byte("harry"), []byte("potter"))
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Errorf("compact range failed: %v", err)
+	}
+
+	db.Close()
+	if err := db.CompactRange(nil, nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCompactionStrategyString(t *testing.T) {
+	cases := map[CompactionStrategy]string{
+		CompactionLeveled:       "leveled",
+		CompactionSizeTiered:    "size-tiered",
+		CompactionStrategy(100): "unknown",
+	}
+
+	for strategy, expected := range cases {
+		if s := strategy.String(); s != expected {
+			t.Errorf("unexpected string of %d: %s", strategy, s)
+		}
+	}
+}
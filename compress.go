@@ -0,0 +1,263 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Compressor compresses blocks of sorted tables. Type of compressor is recorded in header of each
+// block, so that blocks stay readable after compression settings change, as long as compressor of
+// the type is registered.
+type Compressor interface {
+	// Type identifies algorithm in block headers, 0 is reserved for uncompressed blocks.
+	Type() byte
+	// Name identifies algorithm in bucket settings.
+	Name() string
+	// Append compressed src to dst.
+	Compress(dst []byte, src []byte) []byte
+	// Append decompressed src to dst, fails with ErrCorrupted if src is malformed.
+	Decompress(dst []byte, src []byte) ([]byte, error)
+}
+
+// Built-in compressors, registered by default.
+var (
+	// Store blocks as they are.
+	NoCompression Compressor = noCompressor{}
+	// Fast compression of snappy block format.
+	SnappyCompression Compressor = snappyCompressor{}
+	// Smaller blocks of zstd frame format, compressed slower than snappy.
+	ZstdCompression Compressor = zstdCompressor{}
+)
+
+var compressors = struct {
+	lock   sync.RWMutex
+	types  map[byte]Compressor
+	byName map[string]Compressor
+}{
+	types:  make(map[byte]Compressor),
+	byName: make(map[string]Compressor),
+}
+
+func init() {
+	for _, c := range []Compressor{NoCompression, SnappyCompression, ZstdCompression} {
+		compressors.types[c.Type()] = c
+		compressors.byName[c.Name()] = c
+	}
+}
+
+// RegisterCompressor makes compressor c available to read blocks of its type, and to be chosen by
+// name of it. Both type and name must be unique.
+func RegisterCompressor(c Compressor) error {
+	compressors.lock.Lock()
+	defer compressors.lock.Unlock()
+
+	if c.Type() == NoCompression.Type() {
+		return WrapError(ErrInvalidOptions, "compressor type %d is reserved", c.Type())
+	}
+
+	if registered, found := compressors.types[c.Type()]; found {
+		return WrapError(ErrInvalidOptions, "compressor type %d is registered by '%s'",
+			c.Type(), registered.Name())
+	}
+
+	if _, found := compressors.byName[c.Name()]; found {
+		return WrapError(ErrInvalidOptions, "compressor '%s' is registered", c.Name())
+	}
+
+	compressors.types[c.Type()] = c
+	compressors.byName[c.Name()] = c
+	return nil
+}
+
+// Check that c is registered, so that blocks compressed by it are readable.
+func checkCompressor(c Compressor) error {
+	if c == nil {
+		return nil
+	}
+
+	if registered, found := compressorOfType(c.Type()); !found || registered.Name() != c.Name() {
+		return WrapError(ErrInvalidOptions, "compressor '%s' of type %d is not registered",
+			c.Name(), c.Type())
+	}
+
+	return nil
+}
+
+func compressorOfType(t byte) (Compressor, bool) {
+	compressors.lock.RLock()
+	defer compressors.lock.RUnlock()
+
+	c, found := compressors.types[t]
+	return c, found
+}
+
+func compressorOfName(name string) (Compressor, bool) {
+	compressors.lock.RLock()
+	defer compressors.lock.RUnlock()
+
+	c, found := compressors.byName[name]
+	return c, found
+}
+
+type noCompressor struct{}
+
+func (noCompressor) Type() byte {
+	return 0
+}
+
+func (noCompressor) Name() string {
+	return "none"
+}
+
+func (noCompressor) Compress(dst []byte, src []byte) []byte {
+	return append(dst, src...)
+}
+
+func (noCompressor) Decompress(dst []byte, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// Compress block content by c, unless it saves less than 1/8 of content. Return type and content
+// of block to write, content may be buffer.
+func compressBlock(c Compressor, content []byte, buffer []byte) (byte, []byte) {
+	if c == nil || c.Type() == NoCompression.Type() {
+		return NoCompression.Type(), content
+	}
+
+	compressed := c.Compress(buffer[:0], content)
+	if len(compressed) >= len(content)-len(content)/8 {
+		return NoCompression.Type(), content
+	}
+
+	return c.Type(), compressed
+}
+
+// Compressors of blocks by keys. Keys of a bucket are compressed by compressor of bucket if it
+// has one, all other keys by the default compressor. It is safe for concurrent use.
+type compressionPolicy struct {
+	lock     sync.RWMutex
+	fallback Compressor
+	buckets  map[uint64]Compressor
+}
+
+func newCompressionPolicy(fallback Compressor) *compressionPolicy {
+	return &compressionPolicy{
+		fallback: fallback,
+		buckets:  make(map[uint64]Compressor),
+	}
+}
+
+// Set compressor of bucket of id, the default compressor is used if c is nil.
+func (p *compressionPolicy) set(id uint64, c Compressor) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if c == nil {
+		delete(p.buckets, id)
+
+	} else {
+		p.buckets[id] = c
+	}
+}
+
+// Compressor of blocks starting with key, nil policy compresses nothing.
+func (p *compressionPolicy) compressor(key []byte) Compressor {
+	if p == nil {
+		return NoCompression
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if len(key) >= 9 && key[0] == namespaceBucket {
+		if c, found := p.buckets[binary.BigEndian.Uint64(key[1:9])]; found {
+			return c
+		}
+	}
+
+	return p.fallback
+}
+
+// A match of LZ77 parsing, length bytes equal to those offset bytes before, after literals bytes
+// not matched.
+type lzSequence struct {
+	literals int
+	offset   int
+	length   int
+}
+
+const (
+	lzMinMatch = 4
+	lzHashBits = 14
+)
+
+func lzHash(data []byte, i int) uint32 {
+	return (binary.LittleEndian.Uint32(data[i:]) * 0x1e35a7bd) >> (32 - lzHashBits)
+}
+
+// Parse src into sequences of matches no farther than window bytes, bytes after the last match
+// are literals. At most depth candidates of each position are tried, a depth of 1 skips bytes
+// faster when nothing matches, trading ratio for speed.
+func lzParse(src []byte, window int, depth int, sequences []lzSequence) []lzSequence {
+	var head [1 << lzHashBits]int32
+	var chain []int32
+	if depth > 1 {
+		chain = make([]int32, len(src))
+	}
+
+	insert := func(i int) {
+		h := lzHash(src, i)
+		if chain != nil {
+			chain[i] = head[h]
+		}
+
+		head[h] = int32(i + 1)
+	}
+
+	anchor := 0
+	for i := 0; i+lzMinMatch <= len(src); {
+		best, offset := 0, 0
+		candidate := int(head[lzHash(src, i)]) - 1
+		for d := 0; d < depth && candidate >= 0 && i-candidate <= window; d++ {
+			n := 0
+			for i+n < len(src) && src[candidate+n] == src[i+n] {
+				n++
+			}
+
+			if n > best {
+				best, offset = n, i-candidate
+			}
+
+			if chain == nil {
+				break
+			}
+
+			candidate = int(chain[candidate]) - 1
+		}
+
+		insert(i)
+		if best < lzMinMatch {
+			if chain == nil {
+				i += 1 + (i-anchor)>>5
+
+			} else {
+				i++
+			}
+
+			continue
+		}
+
+		sequences = append(sequences, lzSequence{literals: i - anchor, offset: offset, length: best})
+		end := i + best
+		if chain != nil {
+			for i++; i < end && i+lzMinMatch <= len(src); i++ {
+				insert(i)
+			}
+		}
+
+		i = end
+		anchor = end
+	}
+
+	return sequences
+}
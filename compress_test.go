@@ -0,0 +1,354 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Compressor of tests, bytes are inverted.
+type testInvertCompressor struct{}
+
+func (testInvertCompressor) Type() byte {
+	return 0x7f
+}
+
+func (testInvertCompressor) Name() string {
+	return "test.invert"
+}
+
+func (testInvertCompressor) Compress(dst []byte, src []byte) []byte {
+	for _, b := range src {
+		dst = append(dst, ^b)
+	}
+
+	return dst
+}
+
+func (c testInvertCompressor) Decompress(dst []byte, src []byte) ([]byte, error) {
+	return c.Compress(dst, src), nil
+}
+
+func init() {
+	if err := RegisterCompressor(testInvertCompressor{}); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	if err := RegisterCompressor(testInvertCompressor{}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := RegisterCompressor(NoCompression); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, c := range []Compressor{NoCompression, SnappyCompression, ZstdCompression, testInvertCompressor{}} {
+		if got, found := compressorOfType(c.Type()); !found || got.Name() != c.Name() {
+			t.Errorf("compressor of type %d not found: %v", c.Type(), got)
+		}
+
+		if got, found := compressorOfName(c.Name()); !found || got.Type() != c.Type() {
+			t.Errorf("compressor '%s' not found: %v", c.Name(), got)
+		}
+	}
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	for _, c := range []Compressor{NoCompression, SnappyCompression, ZstdCompression} {
+		for name, data := range testCompressionSamples() {
+			compressed := c.Compress(nil, data)
+			decompressed, err := c.Decompress(nil, compressed)
+			if err != nil || !bytes.Equal(decompressed, data) {
+				t.Errorf("%s of %s: round trip failed: %v", c.Name(), name, err)
+			}
+		}
+	}
+}
+
+func TestCompressorTypedValues(t *testing.T) {
+	wizards := []testWizard{
+		{Name: "Harry Potter", House: "Gryffindor", Born: 1980, Courses: []string{"Potions", "Charms"}},
+		{Name: "Luna Lovegood", House: "Ravenclaw", Born: 1981},
+		{Name: "Cedric Diggory", House: "Hufflepuff", Born: 1977, Courses: []string{}},
+	}
+
+	for i := 0; i < 100; i++ {
+		wizards = append(wizards, testWizard{
+			Name:    fmt.Sprintf("Weasley %d", i),
+			House:   "Gryffindor",
+			Born:    1950 + i,
+			Courses: []string{"Defence Against the Dark Arts", "Transfiguration"},
+		})
+	}
+
+	var data []byte
+	var sizes []int
+	for _, w := range wizards {
+		encoded, err := DefaultCodec.Marshal(w)
+		if err != nil {
+			t.Fatalf("marshal failed: %v", err)
+		}
+
+		data = append(data, encoded...)
+		sizes = append(sizes, len(encoded))
+	}
+
+	for _, c := range []Compressor{NoCompression, SnappyCompression, ZstdCompression} {
+		decompressed, err := c.Decompress(nil, c.Compress(nil, data))
+		if err != nil {
+			t.Fatalf("%s: decompress failed: %v", c.Name(), err)
+		}
+
+		for i, w := range wizards {
+			var got testWizard
+			if err := DefaultCodec.Unmarshal(decompressed[:sizes[i]], &got); err != nil {
+				t.Fatalf("%s: unmarshal failed: %v", c.Name(), err)
+			}
+
+			if !meta.Equal(got, w) {
+				t.Errorf("%s: unexpected value: %+v <=> %+v", c.Name(), got, w)
+			}
+
+			decompressed = decompressed[sizes[i]:]
+		}
+	}
+}
+
+// Count types of data blocks of live tables whose first keys have prefix.
+func testBlockTypes(t *testing.T, db *DB, prefix []byte) map[byte]int {
+	v := lsmEngineOf(db).currentVersion()
+	defer v.unref()
+
+	types := make(map[byte]int)
+	for _, tables := range v.levels {
+		for _, table := range tables {
+			index := table.reader.index.Iterator(internalCompare(bytewiseCompare))
+			for index.SeekToFirst(); index.Valid(); index.Next() {
+				handle, _ := decodeBlockHandle(index.Value())
+				_, blockType, err := table.reader.readBlockContent(handle, true)
+				if err != nil {
+					t.Fatalf("read block failed: %v", err)
+				}
+
+				b, err := table.reader.readBlock(handle, true)
+				if err != nil {
+					t.Fatalf("read block failed: %v", err)
+				}
+
+				iter := b.Iterator(internalCompare(bytewiseCompare))
+				iter.SeekToFirst()
+				if bytes.HasPrefix(internalUserKey(iter.Key()), prefix) {
+					types[blockType]++
+				}
+			}
+		}
+	}
+
+	return types
+}
+
+func TestBucketCompression(t *testing.T) {
+	options := Options{
+		Dir:          t.TempDir(),
+		Engine:       EngineLSM,
+		SyncPolicy:   SyncNever,
+		MemtableSize: 64 << 10,
+		BlockSize:    512,
+		Compression:  NoCompression,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	var id uint64
+	wizards := make(map[string]testWizard)
+	err = db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket("wizards", &BucketOptions{Type: testWizard{}, Compression: ZstdCompression})
+		if err != nil {
+			return err
+		}
+
+		id = b.id
+		for i := 0; i < 200; i++ {
+			w := testWizard{Name: fmt.Sprintf("wizard-%03d", i), House: "Gryffindor", Born: 1900 + i}
+			wizards[w.Name] = w
+			if err := b.PutValue([]byte(w.Name), &w); err != nil {
+				return err
+			}
+
+			if err := tx.Put([]byte(w.Name), []byte(w.House)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if types := testBlockTypes(t, db, bucketPrefix(id)); types[ZstdCompression.Type()] <= 0 || len(types) != 1 {
+		t.Errorf("blocks of bucket should be compressed by zstd: %v", types)
+	}
+
+	if types := testBlockTypes(t, db, []byte{namespaceDefault}); types[blockTypeRaw] <= 0 || len(types) != 1 {
+		t.Errorf("blocks of default namespace should not be compressed: %v", types)
+	}
+
+	db.Close()
+
+	// Compressors of buckets are loaded when database is opened, other settings may change.
+	options.Compression = ZstdCompression
+	if db, err = Open(options); err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if c := db.compression.compressor(bucketPrefix(id)); c != ZstdCompression {
+		t.Errorf("unexpected compressor of bucket: %v", c)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		if _, err := tx.Bucket("wizards", &BucketOptions{Compression: SnappyCompression}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		b, err := tx.Bucket("wizards", &BucketOptions{Compression: ZstdCompression})
+		if err != nil {
+			return err
+		}
+
+		return b.SetCompression(SnappyCompression)
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	if types := testBlockTypes(t, db, bucketPrefix(id)); types[SnappyCompression.Type()] <= 0 || len(types) != 1 {
+		t.Errorf("blocks of bucket should be recompressed: %v", types)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		b, err := tx.Bucket("wizards", &BucketOptions{Type: testWizard{}, Compression: SnappyCompression})
+		if err != nil {
+			return err
+		}
+
+		for name, w := range wizards {
+			var got testWizard
+			if err := b.GetValue([]byte(name), &got); err != nil || !meta.Equal(got, w) {
+				t.Errorf("unexpected value of %s: %+v, %v", name, got, err)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("view failed: %v", err)
+	}
+}
+
+func TestBucketCompressionRollback(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket("owls", &BucketOptions{Compression: unregisteredCompressor{}})
+		if !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		b, err := tx.CreateBucket("wizards")
+		if err != nil {
+			return err
+		}
+
+		return b.SetCompression(ZstdCompression)
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatalf("begin failed: %v", err)
+	}
+
+	b, err := tx.Bucket("wizards")
+	if err != nil {
+		t.Fatalf("open bucket failed: %v", err)
+	}
+
+	if err := b.SetCompression(nil); err != nil {
+		t.Fatalf("set compression failed: %v", err)
+	}
+
+	tx.Rollback()
+	if c := db.compression.compressor(bucketPrefix(b.id)); c != ZstdCompression {
+		t.Errorf("compressor should not change by rolled back transaction: %v", c)
+	}
+}
+
+// Compressor never registered, it takes type of zstd.
+type unregisteredCompressor struct {
+	testInvertCompressor
+}
+
+func (unregisteredCompressor) Type() byte {
+	return ZstdCompression.Type()
+}
+
+func BenchmarkCompress(b *testing.B) {
+	samples := testCompressionSamples()
+	for _, c := range []Compressor{SnappyCompression, ZstdCompression} {
+		for _, name := range []string{"text", "records", "random"} {
+			data := samples[name]
+			b.Run(c.Name()+"/"+name, func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				var compressed []byte
+				for i := 0; i < b.N; i++ {
+					compressed = c.Compress(compressed[:0], data)
+				}
+
+				b.ReportMetric(float64(len(compressed))/float64(len(data)), "ratio")
+			})
+		}
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	samples := testCompressionSamples()
+	for _, c := range []Compressor{SnappyCompression, ZstdCompression} {
+		for _, name := range []string{"text", "records", "random"} {
+			data := samples[name]
+			compressed := c.Compress(nil, data)
+			b.Run(c.Name()+"/"+name, func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				var decompressed []byte
+				for i := 0; i < b.N; i++ {
+					decompressed, _ = c.Decompress(decompressed[:0], compressed)
+				}
+			})
+		}
+	}
+}
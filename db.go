@@ -0,0 +1,358 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// DB is an embedded ordered key-value database, safe for concurrent use.
+type DB struct {
+	options Options
+	engine  engine
+	cache   *blockCache
+	// Compressors of blocks, by buckets.
+	compression *compressionPolicy
+
+	// writeLock serializes writers, so that batches are applied in order of sequence numbers.
+	writeLock sync.Mutex
+	sequence  uint64
+	closed    bool
+	conflicts *conflictTracker
+
+	collectionLock sync.Mutex
+	collections    map[string]*Collection
+	// Struct types of typed buckets opened, by bucket id.
+	bucketTypes map[uint64]reflect.Type
+
+	watches *watchHub
+	// Index of buckets for change log, nil if it is not loaded.
+	buckets *bucketIndex
+	// Number of records in change log, and lock of trimming it.
+	changeCount    int
+	changeTrimLock sync.Mutex
+
+	// Background reaper of expired keys, nil if it is disabled.
+	reaperStop chan struct{}
+	reaperDone chan struct{}
+	reaperOnce sync.Once
+}
+
+// Open a database with options. If options.Dir is not empty, all mutations are logged in
+// write-ahead log, and recovered when the database is opened again.
+func Open(options Options) (*DB, error) {
+	if err := checkKeyProvider(options.KeyProvider); err != nil {
+		return nil, err
+	}
+
+	if err := checkMergeOperator(options.MergeOperator); err != nil {
+		return nil, err
+	}
+
+	cache := newBlockCache(options.blockCacheSize())
+	compression := newCompressionPolicy(options.compression())
+	engine, err := openEngine(options, cache, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		options:     options,
+		engine:      engine,
+		cache:       cache,
+		compression: compression,
+		sequence:    engine.LastSequence(),
+		conflicts:   newConflictTracker(),
+		collections: make(map[string]*Collection),
+		bucketTypes: make(map[uint64]reflect.Type),
+		watches:     newWatchHub(options.WatchHistory, engine.LastSequence()),
+	}
+
+	if err := db.loadBucketCompressions(); err != nil {
+		engine.Close()
+		return nil, err
+	}
+
+	if options.ChangeLogLimit > 0 {
+		if db.changeCount, err = db.countChanges(); err != nil {
+			engine.Close()
+			return nil, err
+		}
+	}
+
+	if period := options.reapPeriod(); period > 0 && !options.ReadOnly {
+		db.reaperStop = make(chan struct{})
+		db.reaperDone = make(chan struct{})
+		go db.runReaper(period)
+	}
+
+	return db, nil
+}
+
+// What is recovered from write-ahead log when database is opened.
+func (db *DB) Recovery() RecoveryInfo {
+	return db.engine.Recovery()
+}
+
+// Statistics of block cache, all zero if cache is disabled.
+func (db *DB) CacheStats() CacheStats {
+	return db.cache.Stats()
+}
+
+// Current sequence number, the sequence number of last write.
+func (db *DB) Sequence() uint64 {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	return db.sequence
+}
+
+func (db *DB) isClosed() bool {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	return db.closed
+}
+
+// Write batch out of transactions.
+func (db *DB) write(batch *writeBatch) error {
+	return db.commit(batch, nil)
+}
+
+// Write batch to write-ahead log and engine. If batch is written by transaction tx, it fails with
+// ErrConflict when any key of it is written by others after tx began.
+func (db *DB) commit(batch *writeBatch, tx *Tx) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if tx != nil {
+		if err := db.conflicts.check(tx.readSequence(), tx.writes, tx.ranges); err != nil {
+			return err
+		}
+	}
+
+	batch.seq = db.sequence + 1
+	writes := batch.Len()
+	if db.options.ChangeLog {
+		logged, err := db.logChanges(batch)
+		if err != nil {
+			return err
+		}
+
+		batch = logged
+	}
+
+	if err := db.apply(batch); err != nil {
+		// Records of batch may be applied partly.
+		db.buckets = nil
+		return err
+	}
+
+	db.updateBucketIndex(batch)
+	db.changeCount += batch.Len() - writes
+
+	db.sequence = batch.LastSequence()
+	db.conflicts.record(batch)
+	return nil
+}
+
+// Make an isolated copy of a byte slice, so that neither side can observe mutations of the other.
+func duplicateBytes(data []byte) ([]byte, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	copy, err := meta.Duplicate(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return copy.([]byte), nil
+}
+
+func checkKey(key []byte) error {
+	if len(key) <= 0 {
+		return ErrKeyRequired
+	}
+
+	return nil
+}
+
+// Call fn with value and object of key owned by engine, fn must not modify or keep them.
+func (db *DB) view(key []byte, fn func(value []byte, object interface{}) error) error {
+	return db.engine.View(key, fn)
+}
+
+func (db *DB) get(key []byte) ([]byte, error) {
+	var value []byte
+	err := db.view(key, func(view []byte, object interface{}) error {
+		var err error
+		value, err = duplicateBytes(view)
+		return err
+	})
+
+	return value, err
+}
+
+func (db *DB) has(key []byte) (bool, error) {
+	err := db.view(key, func(value []byte, object interface{}) error { return nil })
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (db *DB) put(key []byte, value []byte) error {
+	valueCopy, err := duplicateBytes(value)
+	if err != nil {
+		return err
+	}
+
+	if valueCopy == nil {
+		valueCopy = []byte{}
+	}
+
+	batch := &writeBatch{}
+	batch.Put(key, valueCopy)
+	return db.write(batch)
+}
+
+// Put encoded typed value, object is decoded from value and never mutated.
+func (db *DB) putObject(key []byte, value []byte, object interface{}) error {
+	batch := &writeBatch{}
+	batch.PutObject(key, value, object)
+	return db.write(batch)
+}
+
+func (db *DB) delete(key []byte) error {
+	batch := &writeBatch{}
+	batch.Delete(key)
+	return db.write(batch)
+}
+
+// Get value of key, return ErrNotFound if key does not exist.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	return db.get(defaultKey(key))
+}
+
+// Check whether key exists.
+func (db *DB) Has(key []byte) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+
+	return db.has(defaultKey(key))
+}
+
+// Set value of key. Both key and value are copied, caller is free to modify them after Put.
+func (db *DB) Put(key []byte, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return db.put(defaultKey(key), value)
+}
+
+// Delete key, it is not an error if key does not exist.
+func (db *DB) Delete(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return db.delete(defaultKey(key))
+}
+
+// Delete all keys in [start, end), empty start or end means unbounded. Keys are deleted by a
+// single range deletion, however many keys are in range.
+func (db *DB) DeleteRange(start []byte, end []byte) error {
+	return db.deleteRange(defaultKey(nil), start, end)
+}
+
+func (db *DB) deleteRange(namespace []byte, start []byte, end []byte) error {
+	if err := checkRange(start, end); err != nil {
+		return err
+	}
+
+	s, e := namespaceRange(namespace, start, end)
+	if bytes.Compare(s, e) >= 0 {
+		return nil
+	}
+
+	batch := &writeBatch{}
+	batch.DeleteRange(s, e)
+	return db.write(batch)
+}
+
+// Flush all written data to persistent storage.
+func (db *DB) Flush() error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	// Nothing is written into a read-only database.
+	if db.options.ReadOnly {
+		return nil
+	}
+
+	return db.engine.Flush()
+}
+
+// Compact data of keys in [start, end] to reclaim space of overwritten and deleted keys, nil
+// means unbounded. It blocks until compaction is done, writes are not blocked meanwhile.
+func (db *DB) CompactRange(start []byte, end []byte) error {
+	if db.isClosed() {
+		return ErrClosed
+	}
+
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if start != nil {
+		start = defaultKey(start)
+	}
+
+	if end != nil {
+		end = defaultKey(end)
+	}
+
+	return db.engine.CompactRange(start, end)
+}
+
+// Close database, all operations after Close return ErrClosed.
+func (db *DB) Close() error {
+	db.stopReaper()
+
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	db.closed = true
+	db.watches.close()
+	return db.engine.Close()
+}
@@ -0,0 +1,363 @@
+package pinkis
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+type batchOpKind byte
+
+const (
+	batchOpDelete      batchOpKind = 0
+	batchOpPut         batchOpKind = 1
+	batchOpDeleteRange batchOpKind = 2
+)
+
+// An operation of Batch. Collection is empty for keys of the default namespace.
+type batchOp struct {
+	kind       batchOpKind
+	collection string
+	key        []byte
+	// Value of put, or end of range deletion.
+	value []byte
+	// Typed value encoded in value, a copy owned by batch.
+	object interface{}
+}
+
+// Batch accumulates operations applied atomically by Commit in a single transaction, which is
+// logged as a single record. Keys and values are copied when they are added, typed values are
+// encoded and captured as instances decoded from the encoded data, so later mutation by caller is
+// never written. They are not captured by meta.Duplicate, which copies fields ignored by codec,
+// so objects kept in memory would differ from values read back from data. A batch is not safe
+// for concurrent use.
+type Batch struct {
+	db   *DB
+	ops  []batchOp
+	size int
+}
+
+// Make an empty batch of database.
+func (db *DB) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+func lengthPrefixedSize(data []byte) int {
+	var u [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(u[:], uint64(len(data))) + len(data)
+}
+
+func (b *Batch) add(op batchOp) {
+	b.size += 1 + lengthPrefixedSize([]byte(op.collection)) + lengthPrefixedSize(op.key)
+	if op.kind != batchOpDelete {
+		b.size += lengthPrefixedSize(op.value)
+	}
+
+	b.ops = append(b.ops, op)
+}
+
+// Copy key and value of an operation, a nil value is copied as empty.
+func copyOp(key []byte, value []byte) ([]byte, []byte) {
+	return append([]byte{}, key...), append([]byte{}, value...)
+}
+
+// Set value of key.
+func (b *Batch) Put(key []byte, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	k, v := copyOp(key, value)
+	b.add(batchOp{kind: batchOpPut, key: k, value: v})
+	return nil
+}
+
+// Delete key.
+func (b *Batch) Delete(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	k, _ := copyOp(key, nil)
+	b.add(batchOp{kind: batchOpDelete, key: k})
+	return nil
+}
+
+func checkRange(start []byte, end []byte) error {
+	if len(end) > 0 && bytes.Compare(start, end) > 0 {
+		return WrapError(ErrInvalidOptions, "range start %q is greater than end %q", start, end)
+	}
+
+	return nil
+}
+
+// Delete all keys in [start, end), including keys put earlier in batch. Empty start or end means
+// unbounded.
+func (b *Batch) DeleteRange(start []byte, end []byte) error {
+	if err := checkRange(start, end); err != nil {
+		return err
+	}
+
+	k, v := copyOp(start, end)
+	b.add(batchOp{kind: batchOpDeleteRange, key: k, value: v})
+	return nil
+}
+
+// Collection c in batch, c must be a collection of the same database.
+func (b *Batch) Collection(c *Collection) *BatchCollection {
+	return &BatchCollection{b: b, c: c}
+}
+
+// Number of operations in batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Size of batch in bytes, the same as length of encoded batch.
+func (b *Batch) Size() int {
+	var u [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(u[:], uint64(len(b.ops))) + b.size
+}
+
+// Remove all operations, so that batch can be reused.
+func (b *Batch) Reset() {
+	b.ops = nil
+	b.size = 0
+}
+
+// Append all operations of other after operations of b, other is not changed. Both batches must
+// be of the same database.
+func (b *Batch) Merge(other *Batch) error {
+	if other.db != b.db {
+		return WrapError(ErrInvalidOptions, "can not merge batches of different databases")
+	}
+
+	for _, op := range other.ops {
+		b.add(op)
+	}
+
+	return nil
+}
+
+// Encode batch to be replayed by DecodeBatch, as:
+//
+//	count uvarint
+//	ops   [kind byte, collection, key, value] * count
+//
+// collection, key and value are prefixed by uvarint lengths, value is omitted in deletion, and is
+// the end of range in range deletion.
+func (b *Batch) Encode() []byte {
+	buffer := make([]byte, 0, b.Size())
+	buffer = appendUvarint(buffer, uint64(len(b.ops)))
+	for _, op := range b.ops {
+		buffer = append(buffer, byte(op.kind))
+		buffer = appendLengthPrefixed(buffer, []byte(op.collection))
+		buffer = appendLengthPrefixed(buffer, op.key)
+		if op.kind != batchOpDelete {
+			buffer = appendLengthPrefixed(buffer, op.value)
+		}
+	}
+
+	return buffer
+}
+
+// Decode a batch encoded by Batch.Encode, data is copied. Collections of typed values are resolved
+// by names when batch is committed.
+func (db *DB) DecodeBatch(data []byte) (*Batch, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, WrapError(ErrCorrupted, "invalid batch operation count")
+	}
+
+	b := db.NewBatch()
+	rest := append([]byte{}, data[n:]...)
+	for i := uint64(0); i < count; i++ {
+		if len(rest) <= 0 {
+			return nil, WrapError(ErrCorrupted, "batch operation %d missing", i)
+		}
+
+		var name []byte
+		var ok bool
+		op := batchOp{
+			kind: batchOpKind(rest[0]),
+		}
+
+		name, rest, ok = readLengthPrefixed(rest[1:])
+		if ok {
+			op.collection = string(name)
+			op.key, rest, ok = readLengthPrefixed(rest)
+		}
+
+		if !ok {
+			return nil, WrapError(ErrCorrupted, "invalid key of batch operation %d", i)
+		}
+
+		switch op.kind {
+		case batchOpDelete:
+
+		case batchOpPut, batchOpDeleteRange:
+			op.value, rest, ok = readLengthPrefixed(rest)
+			if !ok {
+				return nil, WrapError(ErrCorrupted, "invalid value of batch operation %d", i)
+			}
+
+		default:
+			return nil, WrapError(ErrCorrupted, "invalid kind %d of batch operation %d", op.kind, i)
+		}
+
+		b.add(op)
+	}
+
+	if len(rest) > 0 {
+		return nil, WrapError(ErrCorrupted, "%d trailing bytes after batch", len(rest))
+	}
+
+	return b, nil
+}
+
+// Collections of typed operations by names, they must be registered in database.
+func (b *Batch) collections() (map[string]*Collection, error) {
+	b.db.collectionLock.Lock()
+	defer b.db.collectionLock.Unlock()
+
+	collections := make(map[string]*Collection)
+	for _, op := range b.ops {
+		if len(op.collection) <= 0 {
+			continue
+		}
+
+		c, found := b.db.collections[op.collection]
+		if !found {
+			return nil, WrapError(ErrInvalidName, "collection '%s' of batch is not registered",
+				op.collection)
+		}
+
+		collections[op.collection] = c
+	}
+
+	return collections, nil
+}
+
+// Apply all operations of batch atomically, in the order they are added. Batch is not changed, it
+// can be committed again or reset to be reused.
+func (b *Batch) Commit() error {
+	if b.db.isClosed() {
+		return ErrClosed
+	}
+
+	collections, err := b.collections()
+	if err != nil {
+		return err
+	}
+
+	return b.db.updateRetry(func(tx *Tx) error {
+		for _, op := range b.ops {
+			if err := b.apply(tx, collections[op.collection], op); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Apply an operation in transaction, c is nil for keys of the default namespace.
+func (b *Batch) apply(tx *Tx, c *Collection, op batchOp) error {
+	switch op.kind {
+	case batchOpPut:
+		if c == nil {
+			return tx.Put(op.key, op.value)
+		}
+
+		object := op.object
+		if object == nil {
+			value, err := c.decode(op.value)
+			if err != nil {
+				return err
+			}
+
+			object = value.Interface()
+		}
+
+		return tx.Collection(c).put(op.key, op.value, object)
+
+	case batchOpDelete:
+		if c == nil {
+			return tx.Delete(op.key)
+		}
+
+		return tx.Collection(c).Delete(op.key)
+
+	default:
+		if c == nil {
+			return tx.DeleteRange(op.key, op.value)
+		}
+
+		return tx.Collection(c).DeleteRange(op.key, op.value)
+	}
+}
+
+// BatchCollection adds operations of a collection to a batch.
+type BatchCollection struct {
+	b *Batch
+	c *Collection
+}
+
+func (t *BatchCollection) check() error {
+	if t.c.db != t.b.db {
+		return WrapError(ErrInvalidOptions, "collection '%s' is not of database of batch", t.c.name)
+	}
+
+	return nil
+}
+
+// Put value of key, value must be the registered struct or a pointer to it. Value is encoded and
+// captured by decoding the encoded data, mutation of value before commit is not written.
+func (t *BatchCollection) Put(key []byte, value interface{}) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	data, object, err := t.c.encode(value)
+	if err != nil {
+		return err
+	}
+
+	k, _ := copyOp(key, nil)
+	t.b.add(batchOp{kind: batchOpPut, collection: t.c.name, key: k, value: data, object: object})
+	return nil
+}
+
+// Delete key from collection.
+func (t *BatchCollection) Delete(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	k, _ := copyOp(key, nil)
+	t.b.add(batchOp{kind: batchOpDelete, collection: t.c.name, key: k})
+	return nil
+}
+
+// Delete all keys of collection in [start, end), empty start or end means unbounded. Indexes are
+// updated for each key deleted.
+func (t *BatchCollection) DeleteRange(start []byte, end []byte) error {
+	if err := checkRange(start, end); err != nil {
+		return err
+	}
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	k, v := copyOp(start, end)
+	t.b.add(batchOp{kind: batchOpDeleteRange, collection: t.c.name, key: k, value: v})
+	return nil
+}
@@ -0,0 +1,251 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func TestBatchCommit(t *testing.T) {
+	options := Options{Dir: t.TempDir(), SyncPolicy: SyncNever}
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	for _, name := range []string{"dudley", "petunia", "vernon"} {
+		if err := db.Put([]byte(name), []byte("dursley")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	batch := db.NewBatch()
+	value := []byte("potter")
+	if err := batch.Put([]byte("harry"), value); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	value[0] = 'P'
+	if err := batch.Put([]byte("ron"), []byte("weasley")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := batch.Put([]byte("petunias"), []byte("in batch")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := batch.DeleteRange([]byte("p"), []byte("vernon")); err != nil {
+		t.Fatalf("delete range failed: %v", err)
+	}
+
+	if err := batch.Delete([]byte("ron")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if batch.Len() != 5 || batch.Size() != len(batch.Encode()) {
+		t.Errorf("unexpected batch: len=%d, size=%d, encoded %d", batch.Len(), batch.Size(),
+			len(batch.Encode()))
+	}
+
+	if err := batch.Put(nil, []byte("nobody")); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := batch.DeleteRange([]byte("z"), []byte("a")); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	sequence := db.Sequence()
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	expected := []string{"dudley=dursley", "harry=potter", "vernon=dursley"}
+	if keys := scanKeys(t, db, false); !meta.Equal(keys, expected) {
+		t.Errorf("unexpected keys: %v, expected %v", keys, expected)
+	}
+
+	db.Close()
+
+	// All operations are logged as a single record, keys in range are deleted by a tombstone.
+	var records []string
+	w, _ := openTestWAL(t, filepath.Join(options.Dir, walDirName), &records)
+	w.Close()
+
+	last, err := decodeBatch([]byte(records[len(records)-1]))
+	if err != nil || len(records) != 4 || last.seq != sequence+1 || last.Len() != 5 ||
+		last.entries[3].kind != kindDeleteRange {
+		t.Errorf("unexpected records: %d, %+v, %v", len(records), last, err)
+	}
+}
+
+func TestBatchTypedValues(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	batch := db.NewBatch()
+	expected := make(map[string]testStudent)
+	for i := 0; i < 10; i++ {
+		student := newBackupStudent(i, 1991)
+		if err := batch.Collection(students).Put([]byte(student.Name), &student); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+
+		expected[student.Name] = student
+		student.House = "Azkaban"
+	}
+
+	if err := batch.Collection(students).DeleteRange([]byte("student-008"), nil); err != nil {
+		t.Fatalf("delete range failed: %v", err)
+	}
+
+	delete(expected, "student-008")
+	delete(expected, "student-009")
+	if err := batch.Collection(students).Put(nil, testStudent{}); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := batch.Collection(students).Put([]byte("hedwig"), "owl"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("student-%03d", i)
+		var student testStudent
+		err := students.Get([]byte(name), &student)
+		if original, found := expected[name]; found {
+			if err != nil || !meta.Equal(student, original) {
+				t.Errorf("unexpected %s: %+v, %v", name, student, err)
+			}
+
+		} else if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s should be deleted: %v", name, err)
+		}
+	}
+
+	if keys := indexedKeys(t, db, students, "house_year"); len(keys) != len(expected) {
+		t.Errorf("unexpected keys in index: %v", keys)
+	}
+
+	// A unique violation fails the whole batch.
+	batch.Reset()
+	if err := batch.Put([]byte("harry"), []byte("potter")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	duplicated := newBackupStudent(0, 1991)
+	duplicated.Name = "student-100"
+	if err := batch.Collection(students).Put([]byte(duplicated.Name), duplicated); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := batch.Commit(); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := db.Get([]byte("harry")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("nothing should be written: %v", err)
+	}
+}
+
+func TestBatchEncodeAndReplay(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	batch := db.NewBatch()
+	hermione := testStudent{
+		Name:  "hermione",
+		Email: "hermione@hogwarts.edu",
+		House: "Gryffindor",
+		Year:  1991,
+	}
+
+	batch.Put([]byte("hedwig"), []byte("owl"))
+	batch.Put([]byte("crookshanks"), nil)
+	batch.Collection(students).Put([]byte(hermione.Name), hermione)
+	batch.Delete([]byte("scabbers"))
+	batch.DeleteRange([]byte("a"), nil)
+
+	other := db.NewBatch()
+	other.Put([]byte("fawkes"), []byte("phoenix"))
+	if err := batch.Merge(other); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	if batch.Len() != 6 || other.Len() != 1 || batch.Size() != len(batch.Encode()) {
+		t.Errorf("unexpected batches: %d, %d, size %d", batch.Len(), other.Len(), batch.Size())
+	}
+
+	data := batch.Encode()
+	replayed, err := db.DecodeBatch(data)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	if !meta.Equal(replayed.Encode(), data) || replayed.Size() != batch.Size() {
+		t.Errorf("unexpected replayed batch: %+v", replayed)
+	}
+
+	if err := replayed.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	expected := []string{"fawkes=phoenix"}
+	if keys := scanKeys(t, db, false); !meta.Equal(keys, expected) {
+		t.Errorf("unexpected keys: %v, expected %v", keys, expected)
+	}
+
+	var student testStudent
+	if err := students.Get([]byte("hermione"), &student); err != nil || !meta.Equal(student, hermione) {
+		t.Errorf("unexpected student: %+v, %v", student, err)
+	}
+
+	for i := 0; i < len(data); i++ {
+		if _, err := db.DecodeBatch(data[:i]); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("decode data[:%d] got error %v", i, err)
+		}
+	}
+
+	if _, err := db.DecodeBatch(append(data, 0)); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Collections are resolved by names when committed.
+	another := openTestDB(t)
+	defer another.Close()
+
+	unresolved, err := another.DecodeBatch(data)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	if err := unresolved.Commit(); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := unresolved.Merge(batch); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = another.NewBatch().Collection(students).Put([]byte("ron"), hermione)
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,551 @@
+package pinkis
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Bounds of keys of an iterator.
+type IteratorOptions struct {
+	// Iterate keys in [LowerBound, UpperBound), nil means unbounded.
+	LowerBound []byte
+	UpperBound []byte
+	// Iterate keys with prefix only, it is combined with bounds.
+	Prefix []byte
+}
+
+// Iterator iterates keys in order over a snapshot, writes after iterator is made are never
+// observed. Key and Value are valid until the next move of iterator, and must not be modified.
+// An iterator must be closed, and is not safe for concurrent use.
+type Iterator struct {
+	iter engineIterator
+	// Namespace prefix of keys, stripped from keys returned.
+	namespace []byte
+	compare   compareFunc
+	// Bounds of full keys, nil means unbounded.
+	lower []byte
+	upper []byte
+	// Snapshot owned by iterator, released when iterator is closed.
+	snapshot engineSnapshot
+	closed   bool
+}
+
+// Smallest key greater than all keys with prefix, nil if there is not.
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			successor := make([]byte, i+1)
+			copy(successor, prefix)
+			successor[i]++
+			return successor
+		}
+	}
+
+	return nil
+}
+
+func newIterator(iter engineIterator, namespace []byte, options *IteratorOptions) *Iterator {
+	if options == nil {
+		options = &IteratorOptions{}
+	}
+
+	lower := prefixedKey(namespace, options.LowerBound)
+	upper := prefixSuccessor(namespace)
+	if options.UpperBound != nil {
+		upper = prefixedKey(namespace, options.UpperBound)
+	}
+
+	if options.Prefix != nil {
+		start := prefixedKey(namespace, options.Prefix)
+		if bytes.Compare(start, lower) > 0 {
+			lower = start
+		}
+
+		if end := prefixSuccessor(start); end != nil && bytes.Compare(end, upper) < 0 {
+			upper = end
+		}
+	}
+
+	i := &Iterator{
+		iter:      iter,
+		namespace: namespace,
+		compare:   bytes.Compare,
+		lower:     lower,
+		upper:     upper,
+	}
+
+	return i
+}
+
+// Make an iterator over keys of namespace ordered by compare, prefix is not supported since keys
+// with a prefix are not adjacent in any order.
+func newOrderedIterator(iter engineIterator, namespace []byte, compare compareFunc,
+	options *IteratorOptions) (*Iterator, error) {
+	i := &Iterator{
+		iter:      iter,
+		namespace: namespace,
+		compare:   compare,
+	}
+
+	if options == nil {
+		return i, nil
+	}
+
+	if options.Prefix != nil {
+		return nil, WrapError(ErrInvalidOptions, "prefix is not supported with a comparator")
+	}
+
+	if options.LowerBound != nil {
+		i.lower = prefixedKey(namespace, options.LowerBound)
+	}
+
+	if options.UpperBound != nil {
+		i.upper = prefixedKey(namespace, options.UpperBound)
+	}
+
+	return i, nil
+}
+
+// Make an iterator over a new snapshot of DB.
+func (db *DB) NewIterator(options *IteratorOptions) (*Iterator, error) {
+	return db.newIterator(defaultKey(nil), options)
+}
+
+func (db *DB) newIterator(namespace []byte, options *IteratorOptions) (*Iterator, error) {
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+
+	snapshot, err := db.engine.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	i := newIterator(snapshot.Iterator(), namespace, options)
+	i.snapshot = snapshot
+	return i, nil
+}
+
+// Make an iterator over snapshot of transaction, including writes of transaction itself when
+// iterator is made. Iterator must be closed before transaction ends.
+func (tx *Tx) Iterator(options *IteratorOptions) (*Iterator, error) {
+	return tx.iterator(defaultKey(nil), options)
+}
+
+func (tx *Tx) iterator(namespace []byte, options *IteratorOptions) (*Iterator, error) {
+	if err := tx.check(false); err != nil {
+		return nil, err
+	}
+
+	iter := tx.snapshot.Iterator()
+	if tx.writable && (len(tx.writes) > 0 || len(tx.ranges) > 0) {
+		entries, err := tx.pending(namespace)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+
+		iter = newOverlayIterator(iter, entries, tx.ranges)
+	}
+
+	return newIterator(iter, namespace, options), nil
+}
+
+// Whether current position is in bounds.
+func (i *Iterator) Valid() bool {
+	if i.closed || !i.iter.Valid() {
+		return false
+	}
+
+	key := i.iter.Key()
+	return (i.lower == nil || i.compare(key, i.lower) >= 0) &&
+		(i.upper == nil || i.compare(key, i.upper) < 0)
+}
+
+// Move to the first key.
+func (i *Iterator) First() bool {
+	if i.lower == nil {
+		if i.closed {
+			return false
+		}
+
+		i.iter.SeekToFirst()
+		return i.Valid()
+	}
+
+	return i.seek(i.lower)
+}
+
+// Move to the last key.
+func (i *Iterator) Last() bool {
+	if i.closed {
+		return false
+	}
+
+	if i.upper == nil {
+		i.iter.SeekToLast()
+		return i.Valid()
+	}
+
+	i.iter.Seek(i.upper)
+	if i.iter.Valid() {
+		i.iter.Prev()
+
+	} else if i.iter.Error() == nil {
+		i.iter.SeekToLast()
+	}
+
+	return i.Valid()
+}
+
+// Move to the first key >= key.
+func (i *Iterator) Seek(key []byte) bool {
+	target := prefixedKey(i.namespace, key)
+	if i.lower != nil && i.compare(target, i.lower) < 0 {
+		target = i.lower
+	}
+
+	return i.seek(target)
+}
+
+func (i *Iterator) seek(target []byte) bool {
+	if i.closed {
+		return false
+	}
+
+	i.iter.Seek(target)
+	return i.Valid()
+}
+
+// Move to the next key, return whether it is valid.
+func (i *Iterator) Next() bool {
+	if !i.Valid() {
+		return false
+	}
+
+	i.iter.Next()
+	return i.Valid()
+}
+
+// Move to the previous key, return whether it is valid.
+func (i *Iterator) Prev() bool {
+	if !i.Valid() {
+		return false
+	}
+
+	i.iter.Prev()
+	return i.Valid()
+}
+
+// Key at current position.
+func (i *Iterator) Key() []byte {
+	return i.iter.Key()[len(i.namespace):]
+}
+
+// Value at current position.
+func (i *Iterator) Value() []byte {
+	return i.iter.Value()
+}
+
+// Error stops iterator, if any.
+func (i *Iterator) Error() error {
+	if i.closed {
+		return ErrTxClosed
+	}
+
+	return i.iter.Error()
+}
+
+// Close iterator, and release its snapshot.
+func (i *Iterator) Close() error {
+	if i.closed {
+		return ErrTxClosed
+	}
+
+	i.closed = true
+	err := i.iter.Close()
+	if i.snapshot != nil {
+		i.snapshot.Release()
+	}
+
+	return err
+}
+
+// A pending write of transaction.
+type overlayEntry struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+// Pending writes of transaction in namespace, in order of keys.
+func (tx *Tx) pending(namespace []byte) ([]overlayEntry, error) {
+	entries := make([]overlayEntry, 0, len(tx.writes))
+	for _, i := range tx.writes {
+		e := tx.batch.entries[i]
+		if bytes.HasPrefix(e.key, namespace) {
+			value, visible, err := tx.written(e.key, i)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, overlayEntry{
+				key:     e.key,
+				value:   value,
+				deleted: !visible || tx.rangeDeleted(e.key, i, true),
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+	return entries, nil
+}
+
+// Merge pending writes over an iterator, pending writes win on the same key, and pending deletions
+// and range deletions hide keys. Moving forward, base is after current key, moving backward, it is
+// before.
+type overlayIterator struct {
+	base     engineIterator
+	entries  []overlayEntry
+	ranges   rangeTombstones
+	pos      int
+	backward bool
+	fromBase bool
+	valid    bool
+}
+
+func newOverlayIterator(base engineIterator, entries []overlayEntry,
+	ranges rangeTombstones) *overlayIterator {
+	return &overlayIterator{
+		base:    base,
+		entries: entries,
+		ranges:  ranges,
+	}
+}
+
+// Index of the first entry whose key >= key, or > key if after is true.
+func (i *overlayIterator) search(key []byte, after bool) int {
+	return sort.Search(len(i.entries), func(n int) bool {
+		c := bytes.Compare(i.entries[n].key, key)
+		return c > 0 || (c == 0 && !after)
+	})
+}
+
+// Settle on the nearest visible entry of base or pending writes in direction.
+func (i *overlayIterator) find() {
+	step := 1
+	if i.backward {
+		step = -1
+	}
+
+	for {
+		pending := i.pos >= 0 && i.pos < len(i.entries)
+		baseValid := i.base.Valid()
+		if pending && baseValid {
+			c := bytes.Compare(i.entries[i.pos].key, i.base.Key())
+			if c == 0 {
+				// Pending write shadows base.
+				if i.backward {
+					i.base.Prev()
+
+				} else {
+					i.base.Next()
+				}
+
+				continue
+			}
+
+			pending = (c < 0) != i.backward
+		}
+
+		if !pending && !baseValid {
+			i.valid = false
+			return
+		}
+
+		if pending && i.entries[i.pos].deleted {
+			i.pos += step
+			continue
+		}
+
+		if !pending && i.ranges.covers(bytes.Compare, i.base.Key(), 0, maxSequence) {
+			if i.backward {
+				i.base.Prev()
+
+			} else {
+				i.base.Next()
+			}
+
+			continue
+		}
+
+		i.fromBase = !pending
+		i.valid = true
+		return
+	}
+}
+
+func (i *overlayIterator) Valid() bool {
+	return i.valid && i.base.Error() == nil
+}
+
+func (i *overlayIterator) SeekToFirst() {
+	i.backward = false
+	i.base.SeekToFirst()
+	i.pos = 0
+	i.find()
+}
+
+func (i *overlayIterator) SeekToLast() {
+	i.backward = true
+	i.base.SeekToLast()
+	i.pos = len(i.entries) - 1
+	i.find()
+}
+
+func (i *overlayIterator) Seek(key []byte) {
+	i.backward = false
+	i.base.Seek(key)
+	i.pos = i.search(key, false)
+	i.find()
+}
+
+func (i *overlayIterator) Next() {
+	if i.backward {
+		key := append([]byte{}, i.Key()...)
+		if i.fromBase {
+			i.pos = i.search(key, true)
+
+		} else {
+			i.base.Seek(key)
+			if i.base.Valid() && bytes.Equal(i.base.Key(), key) {
+				i.base.Next()
+			}
+		}
+
+		i.backward = false
+	}
+
+	if i.fromBase {
+		i.base.Next()
+
+	} else {
+		i.pos++
+	}
+
+	i.find()
+}
+
+func (i *overlayIterator) Prev() {
+	if !i.backward {
+		key := append([]byte{}, i.Key()...)
+		if i.fromBase {
+			i.pos = i.search(key, false) - 1
+
+		} else {
+			i.base.Seek(key)
+			if i.base.Valid() {
+				i.base.Prev()
+
+			} else {
+				i.base.SeekToLast()
+			}
+		}
+
+		i.backward = true
+	}
+
+	if i.fromBase {
+		i.base.Prev()
+
+	} else {
+		i.pos--
+	}
+
+	i.find()
+}
+
+func (i *overlayIterator) Key() []byte {
+	if i.fromBase {
+		return i.base.Key()
+	}
+
+	return i.entries[i.pos].key
+}
+
+func (i *overlayIterator) Value() []byte {
+	if i.fromBase {
+		return i.base.Value()
+	}
+
+	return i.entries[i.pos].value
+}
+
+func (i *overlayIterator) Error() error {
+	return i.base.Error()
+}
+
+func (i *overlayIterator) Close() error {
+	return i.base.Close()
+}
+
+// Iterate entries materialized in a slice, sorted by compare.
+type sliceIterator struct {
+	entries []overlayEntry
+	compare compareFunc
+	pos     int
+}
+
+func newSliceIterator(entries []overlayEntry, compare compareFunc) *sliceIterator {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return compare(entries[i].key, entries[j].key) < 0
+	})
+
+	return &sliceIterator{
+		entries: entries,
+		compare: compare,
+		pos:     len(entries),
+	}
+}
+
+func (i *sliceIterator) Valid() bool {
+	return i.pos >= 0 && i.pos < len(i.entries)
+}
+
+func (i *sliceIterator) SeekToFirst() {
+	i.pos = 0
+}
+
+func (i *sliceIterator) SeekToLast() {
+	i.pos = len(i.entries) - 1
+}
+
+func (i *sliceIterator) Seek(key []byte) {
+	i.pos = sort.Search(len(i.entries), func(n int) bool {
+		return i.compare(i.entries[n].key, key) >= 0
+	})
+}
+
+func (i *sliceIterator) Next() {
+	i.pos++
+}
+
+func (i *sliceIterator) Prev() {
+	i.pos--
+}
+
+func (i *sliceIterator) Key() []byte {
+	return i.entries[i.pos].key
+}
+
+func (i *sliceIterator) Value() []byte {
+	return i.entries[i.pos].value
+}
+
+func (i *sliceIterator) Error() error {
+	return nil
+}
+
+func (i *sliceIterator) Close() error {
+	return nil
+}
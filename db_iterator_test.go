@@ -0,0 +1,390 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Sorted keys of data in [lower, upper) with prefix.
+func modelKeys(data map[string]string, lower string, upper string, prefix string) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		if key >= lower && (len(upper) <= 0 || key < upper) && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Move iterator randomly, and check it against keys of model.
+func checkIterator(t *testing.T, name string, iter *Iterator, data map[string]string, keys []string,
+	r *rand.Rand) {
+
+	pos := -1
+	for step := 0; step < 300; step++ {
+		var valid bool
+		switch r.Intn(6) {
+		case 0:
+			valid = iter.First()
+			pos = 0
+
+		case 1:
+			valid = iter.Last()
+			pos = len(keys) - 1
+
+		case 2:
+			target := fmt.Sprintf("key-%03d", r.Intn(120))
+			valid = iter.Seek([]byte(target))
+			pos = sort.SearchStrings(keys, target)
+
+		case 3, 4:
+			if pos < 0 || pos >= len(keys) {
+				continue
+			}
+
+			valid = iter.Next()
+			pos++
+
+		case 5:
+			if pos < 0 || pos >= len(keys) {
+				continue
+			}
+
+			valid = iter.Prev()
+			pos--
+		}
+
+		expected := pos >= 0 && pos < len(keys)
+		if valid != expected || iter.Valid() != expected {
+			t.Fatalf("%s: step %d, unexpected valid %v, expected %v at %d", name, step, valid, expected, pos)
+		}
+
+		if !expected {
+			pos = -1
+			continue
+		}
+
+		key := string(iter.Key())
+		if key != keys[pos] || string(iter.Value()) != data[key] {
+			t.Fatalf("%s: step %d, unexpected entry %s=%s, expected %s=%s",
+				name, step, key, iter.Value(), keys[pos], data[keys[pos]])
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		t.Errorf("%s: unexpected error: %v", name, err)
+	}
+}
+
+func testIterator(t *testing.T, name string, db *DB) {
+	defer db.Close()
+
+	r := rand.New(rand.NewSource(35))
+	data := make(map[string]string)
+	var snapshot *Tx
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%03d", r.Intn(100))
+		if r.Intn(4) == 0 {
+			db.Delete([]byte(key))
+			delete(data, key)
+
+		} else {
+			value := fmt.Sprintf("value-%d", i)
+			db.Put([]byte(key), []byte(value))
+			data[key] = value
+		}
+
+		// Keep old versions of keys.
+		if i == 1000 {
+			snapshot, _ = db.Begin(false)
+		}
+	}
+
+	defer snapshot.Rollback()
+	cases := []*IteratorOptions{
+		nil,
+		{LowerBound: []byte("key-020"), UpperBound: []byte("key-070")},
+		{Prefix: []byte("key-05")},
+		{Prefix: []byte("key-0"), LowerBound: []byte("key-055")},
+		{UpperBound: []byte("key-000")},
+	}
+
+	for _, options := range cases {
+		iter, err := db.NewIterator(options)
+		if err != nil {
+			t.Fatalf("%s: new iterator failed: %v", name, err)
+		}
+
+		var lower, upper, prefix string
+		if options != nil {
+			lower, upper, prefix = string(options.LowerBound), string(options.UpperBound), string(options.Prefix)
+		}
+
+		keys := modelKeys(data, lower, upper, prefix)
+		checkIterator(t, fmt.Sprintf("%s %+v", name, options), iter, data, keys, r)
+		if err := iter.Close(); err != nil {
+			t.Errorf("%s: close failed: %v", name, err)
+		}
+
+		if iter.First() {
+			t.Errorf("%s: closed iterator should be invalid", name)
+		}
+	}
+}
+
+func TestIterator(t *testing.T) {
+	testIterator(t, "memory", openTestDB(t))
+	testIterator(t, "lsm", openTestLSM(t, t.TempDir()))
+	testIterator(t, "btree", openTestBTree(t, t.TempDir()))
+}
+
+func testIteratorSnapshot(t *testing.T, name string, db *DB) {
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("old"))
+	}
+
+	iter, _ := db.NewIterator(nil)
+	defer iter.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("new"))
+			db.Delete([]byte(fmt.Sprintf("key-%03d", 99-i)))
+			db.Put([]byte(fmt.Sprintf("key-%03d-x", i)), []byte("new"))
+		}
+	}()
+
+	for round := 0; round < 5; round++ {
+		count := 0
+		for ok := iter.First(); ok; ok = iter.Next() {
+			if string(iter.Value()) != "old" {
+				t.Fatalf("%s: later write is observed at %s", name, iter.Key())
+			}
+
+			count++
+		}
+
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			count--
+		}
+
+		if count != 100-100 {
+			t.Errorf("%s: keys changed in both directions", name)
+		}
+	}
+
+	<-done
+	n := 0
+	for ok := iter.First(); ok; ok = iter.Next() {
+		n++
+	}
+
+	if n != 100 {
+		t.Errorf("%s: unexpected number of keys in snapshot: %d", name, n)
+	}
+}
+
+func TestIteratorSnapshot(t *testing.T) {
+	testIteratorSnapshot(t, "memory", openTestDB(t))
+	testIteratorSnapshot(t, "lsm", openTestLSM(t, t.TempDir()))
+	testIteratorSnapshot(t, "btree", openTestBTree(t, t.TempDir()))
+}
+
+func TestTxIterator(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	for _, name := range []string{"crabbe", "goyle", "malfoy", "parkinson", "zabini"} {
+		db.Put([]byte(name), []byte("slytherin"))
+	}
+
+	err := db.Update(func(tx *Tx) error {
+		tx.Put([]byte("bulstrode"), []byte("slytherin"))
+		tx.Delete([]byte("crabbe"))
+		tx.Put([]byte("malfoy"), []byte("death eater"))
+		tx.Delete([]byte("zabini"))
+
+		iter, err := tx.Iterator(nil)
+		if err != nil {
+			return err
+		}
+
+		defer iter.Close()
+
+		var forward, backward []string
+		for ok := iter.First(); ok; ok = iter.Next() {
+			forward = append(forward, fmt.Sprintf("%s=%s", iter.Key(), iter.Value()))
+		}
+
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			backward = append([]string{fmt.Sprintf("%s=%s", iter.Key(), iter.Value())}, backward...)
+		}
+
+		expected := "bulstrode=slytherin goyle=slytherin malfoy=death eater parkinson=slytherin"
+		if got := strings.Join(forward, " "); got != expected {
+			t.Errorf("unexpected entries forward: %s", got)
+		}
+
+		if got := strings.Join(backward, " "); got != expected {
+			t.Errorf("unexpected entries backward: %s", got)
+		}
+
+		// Change direction in middle of pending writes and base.
+		iter.Seek([]byte("m"))
+		iter.Prev()
+		iter.Next()
+		iter.Next()
+		if string(iter.Key()) != "parkinson" {
+			t.Errorf("unexpected key after changing direction: %s", iter.Key())
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+}
+
+func TestTxIteratorRandom(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	defer db.Close()
+
+	r := rand.New(rand.NewSource(7))
+	data := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%03d", r.Intn(100))
+		db.Put([]byte(key), []byte(key))
+		data[key] = key
+	}
+
+	tx, _ := db.Begin(true)
+	defer tx.Rollback()
+
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key-%03d", r.Intn(100))
+		if r.Intn(2) == 0 {
+			tx.Delete([]byte(key))
+			delete(data, key)
+
+		} else {
+			tx.Put([]byte(key), []byte("pending"))
+			data[key] = "pending"
+		}
+	}
+
+	iter, _ := tx.Iterator(&IteratorOptions{LowerBound: []byte("key-010")})
+	defer iter.Close()
+
+	checkIterator(t, "tx", iter, data, modelKeys(data, "key-010", "", ""), r)
+}
+
+type testWizardName struct {
+	Name string
+	Born int64
+	Wand string
+}
+
+func TestCollectionIterator(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	defer db.Close()
+
+	wizards, _ := db.Collection("wizards", testWizard{})
+	wizards.Put([]byte("harry"), testWizard{Name: "Harry", House: "Gryffindor", Born: 1980})
+	wizards.Put([]byte("luna"), testWizard{Name: "Luna", House: "Ravenclaw", Born: 1981})
+	wizards.Put([]byte("cedric"), testWizard{Name: "Cedric", House: "Hufflepuff", Born: 1977})
+	db.Put([]byte("harry"), []byte("not a wizard in collection"))
+
+	iter, err := wizards.Iterator(&IteratorOptions{LowerBound: []byte("d")})
+	if err != nil {
+		t.Fatalf("new iterator failed: %v", err)
+	}
+
+	defer iter.Close()
+
+	var names []string
+	for ok := iter.First(); ok; ok = iter.Next() {
+		var w testWizard
+		if err := iter.Decode(&w); err != nil {
+			t.Fatalf("decode failed: %v", err)
+		}
+
+		names = append(names, w.Name)
+	}
+
+	if strings.Join(names, ",") != "Harry,Luna" {
+		t.Errorf("unexpected wizards: %v", names)
+	}
+
+	// Decode into another struct by names of fields, with conversion.
+	iter.Last()
+	projection := testWizardName{Wand: "elder"}
+	if err := iter.Decode(&projection); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	if projection != (testWizardName{Name: "Luna", Born: 1981, Wand: "elder"}) {
+		t.Errorf("unexpected projection: %+v", projection)
+	}
+
+	var wrong struct{ House int }
+	if err := iter.Decode(&wrong); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := iter.Decode(projection); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	cases := map[string]string{
+		"abc":         "abd",
+		"ab\xff":      "ac",
+		"\xff\xff":    "",
+		"":            "",
+		"\x01key\xfe": "\x01key\xff",
+	}
+
+	for prefix, expected := range cases {
+		if got := prefixSuccessor([]byte(prefix)); string(got) != expected {
+			t.Errorf("unexpected successor of %q: %q", prefix, got)
+		}
+	}
+}
+
+func TestIteratorEmpty(t *testing.T) {
+	engines := map[string]*DB{
+		"memory": openTestDB(t),
+		"lsm":    openTestLSM(t, t.TempDir()),
+		"btree":  openTestBTree(t, t.TempDir()),
+	}
+
+	for name, db := range engines {
+		iter, err := db.NewIterator(nil)
+		if err != nil {
+			t.Fatalf("%s: new iterator failed: %v", name, err)
+		}
+
+		if iter.First() || iter.Last() || iter.Seek([]byte("voldemort")) || iter.Error() != nil {
+			t.Errorf("%s: iterator of empty database should be invalid: %v", name, iter.Error())
+		}
+
+		iter.Close()
+		db.Close()
+		if _, err := db.NewIterator(nil); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
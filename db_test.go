@@ -0,0 +1,295 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *DB {
+	db, err := Open(Options{})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	return db
+}
+
+func TestDBBasicOperations(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	key := []byte("harry")
+	if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.Put(key, []byte("potter")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value, err := db.Get(key)
+	if err != nil || string(value) != "potter" {
+		t.Errorf("unexpected result: %s, %v", value, err)
+	}
+
+	if has, err := db.Has(key); !has || err != nil {
+		t.Errorf("unexpected result: %v, %v", has, err)
+	}
+
+	if err := db.Delete(key); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if has, err := db.Has(key); has || err != nil {
+		t.Errorf("unexpected result: %v, %v", has, err)
+	}
+}
+
+func TestDBEmptyKeyAndValue(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	if err := db.Put(nil, []byte("nothing")); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := db.Get([]byte{}); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := db.Has(nil); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.Delete(nil); !errors.Is(err, ErrKeyRequired) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.Put([]byte("empty"), nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	value, err := db.Get([]byte("empty"))
+	if err != nil || value == nil || len(value) != 0 {
+		t.Errorf("unexpected result: %#v, %v", value, err)
+	}
+}
+
+func TestDBValueIsolation(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	key := []byte("wand")
+	value := []byte("holly")
+	if err := db.Put(key, value); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	key[0] = 'b'
+	value[0] = 'j'
+
+	got, err := db.Get([]byte("wand"))
+	if err != nil || string(got) != "holly" {
+		t.Fatalf("unexpected result: %s, %v", got, err)
+	}
+
+	got[0] = 'm'
+	again, err := db.Get([]byte("wand"))
+	if err != nil || string(again) != "holly" {
+		t.Errorf("unexpected result: %s, %v", again, err)
+	}
+
+	if has, _ := db.Has([]byte("band")); has {
+		t.Errorf("mutated key should not exist")
+	}
+}
+
+func TestDBClosed(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := db.Get([]byte("key")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.Put([]byte("key"), []byte("value")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDBConcurrentAccess(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := []byte(fmt.Sprintf("w%d-%03d", w, i))
+				if err := db.Put(key, key); err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := []byte(fmt.Sprintf("w%d-%03d", r, i))
+				value, err := db.Get(key)
+				if err == nil && string(value) != string(key) {
+					t.Errorf("unexpected value: %s <=> %s", value, key)
+				}
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("w%d-%03d", w, i))
+			if has, err := db.Has(key); !has || err != nil {
+				t.Errorf("key %s is missing: %v", key, err)
+			}
+		}
+	}
+}
+
+func TestDBPersistence(t *testing.T) {
+	options := Options{
+		Dir: t.TempDir(),
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	db.Put([]byte("harry"), []byte("potter"))
+	db.Put([]byte("ron"), []byte("weasley"))
+	db.Delete([]byte("harry"))
+	wizards, _ := db.Collection("wizards", testWizard{})
+	wizards.Put([]byte("hermione"), testWizard{Name: "Hermione Granger"})
+	if db.Sequence() != 4 {
+		t.Errorf("unexpected sequence: %d", db.Sequence())
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close database failed: %v", err)
+	}
+
+	db, err = Open(options)
+	if err != nil {
+		t.Fatalf("reopen database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	info := db.Recovery()
+	if info.Records != 4 || info.LastSequence != 4 || info.TruncatedBytes != 0 {
+		t.Errorf("unexpected recovery info: %+v", info)
+	}
+
+	if has, _ := db.Has([]byte("harry")); has {
+		t.Errorf("deleted key is recovered")
+	}
+
+	if value, err := db.Get([]byte("ron")); err != nil || string(value) != "weasley" {
+		t.Errorf("unexpected result: %s, %v", value, err)
+	}
+
+	wizards, _ = db.Collection("wizards", testWizard{})
+	var hermione testWizard
+	if err := wizards.Get([]byte("hermione"), &hermione); err != nil || hermione.Name != "Hermione Granger" {
+		t.Errorf("unexpected result: %+v, %v", hermione, err)
+	}
+
+	db.Put([]byte("neville"), []byte("longbottom"))
+	if db.Sequence() != 5 {
+		t.Errorf("unexpected sequence: %d", db.Sequence())
+	}
+}
+
+// Simulate crashes at every byte offset of write-ahead log, every recovered database must contain
+// a prefix of writes.
+func TestDBRecoverFromTornWAL(t *testing.T) {
+	source := t.TempDir()
+	db, err := Open(Options{Dir: source, SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	const count = 8
+	for i := 0; i < count; i++ {
+		db.Put([]byte(fmt.Sprintf("spell-%d", i)), []byte("wingardium leviosa"))
+	}
+
+	db.Close()
+	segment := filepath.Join(walDirName, walSegmentName(1))
+	data, err := os.ReadFile(filepath.Join(source, segment))
+	if err != nil {
+		t.Fatalf("read wal failed: %v", err)
+	}
+
+	for offset := 0; offset <= len(data); offset++ {
+		dir := t.TempDir()
+		os.MkdirAll(filepath.Join(dir, walDirName), 0755)
+		os.WriteFile(filepath.Join(dir, segment), data[:offset], 0644)
+
+		db, err := Open(Options{Dir: dir})
+		if err != nil {
+			t.Fatalf("offset %d: open database failed: %v", offset, err)
+		}
+
+		info := db.Recovery()
+		if int(db.Sequence()) != info.Records {
+			t.Errorf("offset %d: sequence %d, records %d", offset, db.Sequence(), info.Records)
+		}
+
+		for i := 0; i < count; i++ {
+			has, _ := db.Has([]byte(fmt.Sprintf("spell-%d", i)))
+			if has != (i < info.Records) {
+				t.Errorf("offset %d: spell-%d exists=%v, recovered %d", offset, i, has, info.Records)
+			}
+		}
+
+		if offset == len(data) && (info.Records != count || info.TruncatedBytes != 0) {
+			t.Errorf("unexpected recovery of complete wal: %+v", info)
+		}
+
+		db.Close()
+	}
+}
+
+func TestDBRecoverFromCorruptedWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: dir, WALSegmentSize: 16})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	db.Put([]byte("tom"), []byte("riddle"))
+	db.Put([]byte("lord"), []byte("voldemort"))
+	db.Close()
+
+	path := filepath.Join(dir, walDirName, walSegmentName(1))
+	data, _ := os.ReadFile(path)
+	data[walRecordHeaderSize] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	if _, err := Open(Options{Dir: dir}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
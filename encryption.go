@@ -0,0 +1,283 @@
+package pinkis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// KeyProvider supplies master keys to encrypt files at rest. Each file is encrypted by AES-GCM
+// with its own random data key, which is wrapped by a master key and stored in the file along with
+// id of the master key. Keys are rotated by changing the current key id: new files are wrapped by
+// the new key, and old keys must stay available until all files wrapped by them are rewritten.
+type KeyProvider interface {
+	// Id of the master key to wrap new data keys, at most 255 bytes.
+	CurrentKeyID() string
+	// Master key of id, an AES key of 16, 24 or 32 bytes.
+	MasterKey(id string) ([]byte, error)
+}
+
+// StaticKeyProvider provides master keys kept in memory, Current is id of the current key.
+type StaticKeyProvider struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (p *StaticKeyProvider) CurrentKeyID() string {
+	return p.Current
+}
+
+func (p *StaticKeyProvider) MasterKey(id string) ([]byte, error) {
+	key, found := p.Keys[id]
+	if !found {
+		return nil, WrapError(ErrDecryption, "master key '%s' not found", id)
+	}
+
+	return key, nil
+}
+
+// An envelope of data key, stored in the beginning of encrypted files:
+//
+//	magic    uint64, little endian
+//	id size  uint8
+//	key id   [id size]byte
+//	nonce    [12]byte
+//	data key [48]byte, AES-256 key sealed by master key with magic and key id as additional data
+const (
+	envelopeMagic      = uint64(0x70696e6b6973656b)
+	envelopeHeaderSize = 9
+	envelopeMaxKeyID   = 255
+	dataKeySize        = 32
+	cipherNonceSize    = 12
+	cipherTagSize      = 16
+	envelopeKeySize    = cipherNonceSize + dataKeySize + cipherTagSize
+)
+
+// Cipher of an encrypted file, with data key and envelope of it.
+type fileCipher struct {
+	keyID    string
+	key      []byte
+	aead     cipher.AEAD
+	envelope []byte
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Check that current master key of keys is usable, nil keys means no encryption.
+func checkKeyProvider(keys KeyProvider) error {
+	if keys == nil {
+		return nil
+	}
+
+	id := keys.CurrentKeyID()
+	if len(id) > envelopeMaxKeyID {
+		return WrapError(ErrInvalidOptions, "master key id of %d bytes is too long", len(id))
+	}
+
+	master, err := keys.MasterKey(id)
+	if err != nil {
+		return WrapError(ErrInvalidOptions, "master key '%s' unavailable: %s", id, err)
+	}
+
+	if _, err := newAEAD(master); err != nil {
+		return WrapError(ErrInvalidOptions, "invalid master key '%s': %s", id, err)
+	}
+
+	return nil
+}
+
+// Make a cipher of a new file with a random data key, wrapped by current master key of keys.
+func newFileCipher(keys KeyProvider) (*fileCipher, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fileCipher{
+		key:  key,
+		aead: aead,
+	}
+
+	if err := c.wrap(keys); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Wrap data key by current master key of keys, and replace envelope.
+func (c *fileCipher) wrap(keys KeyProvider) error {
+	id := keys.CurrentKeyID()
+	if len(id) > envelopeMaxKeyID {
+		return WrapError(ErrInvalidOptions, "master key id of %d bytes is too long", len(id))
+	}
+
+	master, err := keys.MasterKey(id)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(master)
+	if err != nil {
+		return WrapError(ErrInvalidOptions, "invalid master key '%s': %s", id, err)
+	}
+
+	envelope := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(id)+envelopeKeySize)
+	binary.LittleEndian.PutUint64(envelope, envelopeMagic)
+	envelope[8] = byte(len(id))
+	envelope = append(envelope, id...)
+	nonce := make([]byte, cipherNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	envelope = append(envelope, nonce...)
+	c.envelope = aead.Seal(envelope, nonce, c.key, envelope[:envelopeHeaderSize+len(id)])
+	c.keyID = id
+	return nil
+}
+
+// Size of envelope data starts with, ok is false if data does not start with an envelope.
+// Envelope may be longer than data.
+func envelopeSize(data []byte) (int, bool) {
+	if len(data) < envelopeHeaderSize || binary.LittleEndian.Uint64(data) != envelopeMagic {
+		return 0, false
+	}
+
+	return envelopeHeaderSize + int(data[8]) + envelopeKeySize, true
+}
+
+// Unwrap data key in envelope of file name by master key of keys. All failures, including wrong
+// or missing master keys, are reported as errors wrap ErrDecryption.
+func openEnvelope(envelope []byte, keys KeyProvider, name string) (*fileCipher, error) {
+	size, ok := envelopeSize(envelope)
+	if !ok || len(envelope) < size {
+		return nil, WrapError(ErrDecryption, "invalid key envelope of %s", name)
+	}
+
+	envelope = envelope[:size]
+	idEnd := envelopeHeaderSize + int(envelope[8])
+	id := string(envelope[envelopeHeaderSize:idEnd])
+	if keys == nil {
+		return nil, WrapError(ErrDecryption, "%s is encrypted by master key '%s', but no key provider is given",
+			name, id)
+	}
+
+	master, err := keys.MasterKey(id)
+	if err != nil {
+		return nil, WrapError(ErrDecryption, "master key '%s' of %s unavailable: %s", id, name, err)
+	}
+
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, WrapError(ErrDecryption, "invalid master key '%s' of %s: %s", id, name, err)
+	}
+
+	nonce := envelope[idEnd : idEnd+cipherNonceSize]
+	key, err := aead.Open(nil, nonce, envelope[idEnd+cipherNonceSize:], envelope[:idEnd])
+	if err != nil {
+		return nil, WrapError(ErrDecryption, "data key of %s is not wrapped by given master key '%s'",
+			name, id)
+	}
+
+	c := &fileCipher{
+		keyID:    id,
+		key:      key,
+		envelope: append([]byte{}, envelope...),
+	}
+
+	if c.aead, err = newAEAD(key); err != nil {
+		return nil, WrapError(ErrDecryption, "invalid data key of %s: %s", name, err)
+	}
+
+	return c, nil
+}
+
+// Read envelope in the beginning of file, a nil cipher is returned if file is not encrypted.
+func readEnvelope(file io.ReaderAt, keys KeyProvider, name string) (*fileCipher, error) {
+	header := make([]byte, envelopeHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	size, ok := envelopeSize(header)
+	if !ok {
+		return nil, nil
+	}
+
+	envelope := make([]byte, size)
+	if _, err := file.ReadAt(envelope, 0); err != nil {
+		return nil, WrapError(ErrDecryption, "read key envelope of %s failed: %s", name, err)
+	}
+
+	return openEnvelope(envelope, keys, name)
+}
+
+// Nonce of a counter, which must never repeat for a data key, such as offset in a file.
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, cipherNonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// Append plaintext sealed with nonce of counter to dst.
+func (c *fileCipher) seal(dst []byte, counter uint64, plaintext []byte) []byte {
+	return c.aead.Seal(dst, counterNonce(counter), plaintext, nil)
+}
+
+// Append ciphertext opened with nonce of counter to dst.
+func (c *fileCipher) open(dst []byte, counter uint64, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(dst, counterNonce(counter), ciphertext, nil)
+}
+
+// Pages are rewritten in place, so that they are sealed with random nonces, kept in the end of
+// page after tag. Page header is left in plaintext as additional data, overflow of page is known
+// before it is decrypted.
+const pageCipherOverhead = cipherTagSize + cipherNonceSize
+
+// Seal body of page p, return a new page to write.
+func (c *fileCipher) sealPage(p page) (page, error) {
+	sealed := page(make([]byte, len(p)))
+	copy(sealed, p[:pageHeaderSize])
+	nonce := sealed[len(sealed)-cipherNonceSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	body := p[pageHeaderSize : len(p)-pageCipherOverhead]
+	c.aead.Seal(sealed[pageHeaderSize:pageHeaderSize], nonce, body, sealed[:pageHeaderSize])
+	return sealed, nil
+}
+
+// Open body of page p in place.
+func (c *fileCipher) openPage(p page) error {
+	if len(p) < pageHeaderSize+pageCipherOverhead {
+		return WrapError(ErrCorrupted, "encrypted page %d too short", p.id())
+	}
+
+	nonce := p[len(p)-cipherNonceSize:]
+	ciphertext := p[pageHeaderSize : len(p)-cipherNonceSize]
+	if _, err := c.aead.Open(ciphertext[:0], nonce, ciphertext, p[:pageHeaderSize]); err != nil {
+		return WrapError(ErrDecryption, "page %d cannot be decrypted", p.id())
+	}
+
+	return nil
+}
@@ -0,0 +1,364 @@
+package pinkis
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Key provider of tests, key of each id is derived from id, the first id is the current key.
+func testKeyProvider(ids ...string) *StaticKeyProvider {
+	keys := &StaticKeyProvider{
+		Current: ids[0],
+		Keys:    make(map[string][]byte),
+	}
+
+	for _, id := range ids {
+		key := sha256.Sum256([]byte(id))
+		keys.Keys[id] = key[:]
+	}
+
+	return keys
+}
+
+// Check that no file in dir holds plaintext.
+func testNoPlaintext(t *testing.T, dir string, plaintext string) {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Contains(data, []byte(plaintext)) {
+			t.Errorf("%s holds plaintext '%s'", path, plaintext)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("walk %s failed: %v", dir, err)
+	}
+}
+
+func TestFileCipher(t *testing.T) {
+	keys := testKeyProvider("hogwarts", "durmstrang")
+	c, err := newFileCipher(keys)
+	if err != nil {
+		t.Fatalf("make cipher failed: %v", err)
+	}
+
+	sealed := c.seal(nil, 42, []byte("Gryffindor"))
+	opened, err := openEnvelope(c.envelope, keys, "test")
+	if err != nil || opened.keyID != "hogwarts" {
+		t.Fatalf("open envelope failed: %v", err)
+	}
+
+	if plaintext, err := opened.open(nil, 42, sealed); err != nil || string(plaintext) != "Gryffindor" {
+		t.Errorf("unexpected plaintext: %q, %v", plaintext, err)
+	}
+
+	if _, err := opened.open(nil, 43, sealed); err == nil {
+		t.Errorf("open with nonce of another counter should fail")
+	}
+
+	wrong := &StaticKeyProvider{Current: "hogwarts", Keys: map[string][]byte{"hogwarts": make([]byte, 32)}}
+	for _, other := range []KeyProvider{wrong, testKeyProvider("durmstrang"), nil} {
+		if _, err := openEnvelope(c.envelope, other, "test"); !errors.Is(err, ErrDecryption) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	if _, err := openEnvelope(c.envelope[:20], keys, "test"); !errors.Is(err, ErrDecryption) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Data key is kept when it is wrapped by a new master key.
+	keys.Current = "durmstrang"
+	if err := c.wrap(keys); err != nil {
+		t.Fatalf("wrap data key failed: %v", err)
+	}
+
+	opened, err = openEnvelope(c.envelope, testKeyProvider("durmstrang"), "test")
+	if err != nil || opened.keyID != "durmstrang" {
+		t.Fatalf("open envelope failed: %v", err)
+	}
+
+	if plaintext, err := opened.open(nil, 42, sealed); err != nil || string(plaintext) != "Gryffindor" {
+		t.Errorf("unexpected plaintext: %q, %v", plaintext, err)
+	}
+}
+
+func TestFileCipherPage(t *testing.T) {
+	c, err := newFileCipher(testKeyProvider("hogwarts"))
+	if err != nil {
+		t.Fatalf("make cipher failed: %v", err)
+	}
+
+	p := page(make([]byte, 512))
+	p.setHeader(7, pageFlagLeaf, 0, 0)
+	copy(p[pageHeaderSize:], "Hufflepuff")
+	sealed, err := c.sealPage(p)
+	if err != nil {
+		t.Fatalf("seal page failed: %v", err)
+	}
+
+	if sealed.id() != 7 || bytes.Contains(sealed, []byte("Hufflepuff")) {
+		t.Errorf("unexpected sealed page: %d", sealed.id())
+	}
+
+	again, err := c.sealPage(p)
+	if err != nil || bytes.Equal(again, sealed) {
+		t.Errorf("page should be sealed by random nonces: %v", err)
+	}
+
+	moved := append(page{}, sealed...)
+	moved.setHeader(8, pageFlagLeaf, 0, 0)
+	if err := c.openPage(moved); !errors.Is(err, ErrDecryption) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := c.openPage(sealed); err != nil {
+		t.Fatalf("open page failed: %v", err)
+	}
+
+	if body := len(p) - pageCipherOverhead; !bytes.Equal(sealed[:body], p[:body]) {
+		t.Errorf("unexpected opened page")
+	}
+}
+
+func TestCheckKeyProvider(t *testing.T) {
+	keys := []KeyProvider{
+		&StaticKeyProvider{Current: "hogwarts"},
+		&StaticKeyProvider{Current: "hogwarts", Keys: map[string][]byte{"hogwarts": []byte("alohomora")}},
+	}
+
+	for _, k := range keys {
+		if _, err := Open(Options{Dir: t.TempDir(), KeyProvider: k}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestEncryptedEngines(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			options := Options{
+				Dir:          t.TempDir(),
+				Engine:       engine,
+				SyncPolicy:   SyncNever,
+				MemtableSize: 4 << 10,
+				PageSize:     512,
+				KeyProvider:  testKeyProvider("hogwarts"),
+			}
+
+			db, err := Open(options)
+			if err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			for i := 0; i < 200; i++ {
+				key := []byte(fmt.Sprintf("wizard-%03d", i))
+				if err := db.Put(key, []byte(fmt.Sprintf("Gryffindor %d", i))); err != nil {
+					t.Fatalf("put failed: %v", err)
+				}
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatalf("close failed: %v", err)
+			}
+
+			testNoPlaintext(t, options.Dir, "Gryffindor")
+			testNoPlaintext(t, options.Dir, "wizard-1")
+
+			wrong := &StaticKeyProvider{Current: "hogwarts", Keys: map[string][]byte{"hogwarts": make([]byte, 32)}}
+			for _, keys := range []KeyProvider{wrong, nil} {
+				options.KeyProvider = keys
+				if db, err := Open(options); !errors.Is(err, ErrDecryption) {
+					t.Errorf("unexpected error: %v", err)
+					if err == nil {
+						db.Close()
+					}
+				}
+			}
+
+			options.KeyProvider = testKeyProvider("hogwarts")
+			if db, err = Open(options); err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			defer db.Close()
+
+			for i := 0; i < 200; i++ {
+				value, err := db.Get([]byte(fmt.Sprintf("wizard-%03d", i)))
+				if err != nil || string(value) != fmt.Sprintf("Gryffindor %d", i) {
+					t.Errorf("unexpected value of %d: %q, %v", i, value, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBTreeNotEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestBTree(t, dir)
+	db.Close()
+
+	options := Options{Dir: dir, Engine: EngineBTree, KeyProvider: testKeyProvider("hogwarts")}
+	if _, err := Open(options); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEncryptedWAL(t *testing.T) {
+	dir := t.TempDir()
+	keys := testKeyProvider("hogwarts", "durmstrang")
+	var records []string
+	options := walOptions{
+		dir:        dir,
+		syncPolicy: SyncNever,
+		keys:       keys,
+		replayRecord: func(payload []byte) error {
+			records = append(records, string(payload))
+			return nil
+		},
+	}
+
+	w, _, err := openWAL(options)
+	if err != nil {
+		t.Fatalf("open wal failed: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			keys.Current = "durmstrang"
+		}
+
+		if err := w.Append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	w.Close()
+	if segments := w.Segments(); len(segments) != 2 {
+		t.Errorf("segment should rotate when master key changes: %v", segments)
+	}
+
+	// Tear the last record, it is truncated and never appended again.
+	last := filepath.Join(dir, walSegmentName(2))
+	stat, _ := os.Stat(last)
+	os.Truncate(last, stat.Size()-3)
+
+	w, info, err := openWAL(options)
+	if err != nil {
+		t.Fatalf("open wal failed: %v", err)
+	}
+
+	w.Close()
+	if len(records) != 9 || records[8] != "record-8" || info.TruncatedSegment != walSegmentName(2) {
+		t.Errorf("unexpected records: %v, %+v", records, info)
+	}
+
+	if segments := w.Segments(); len(segments) != 3 {
+		t.Errorf("encrypted wal should start a new segment: %v", segments)
+	}
+
+	options.keys = testKeyProvider("durmstrang")
+	if _, _, err := openWAL(options); !errors.Is(err, ErrDecryption) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	options := testCompactionOptions(t.TempDir(), CompactionLeveled)
+	options.DisableAutoCompaction = true
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	put := func(start int, end int) {
+		for i := start; i < end; i++ {
+			key := []byte(fmt.Sprintf("wizard-%04d", i))
+			if err := db.Put(key, []byte(fmt.Sprintf("Ravenclaw %d", i))); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+		}
+	}
+
+	stale := func(current string) int {
+		v := lsmEngineOf(db).currentVersion()
+		defer v.unref()
+
+		count := 0
+		for _, tables := range v.levels {
+			for _, table := range tables {
+				if table.reader.cipher == nil || table.reader.cipher.keyID != current {
+					count++
+				}
+			}
+		}
+
+		return count
+	}
+
+	// Tables written without encryption are encrypted by compaction.
+	put(0, 500)
+	db.Close()
+
+	keys := testKeyProvider("hogwarts", "durmstrang")
+	options.KeyProvider = keys
+	if db, err = Open(options); err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	if count := stale("hogwarts"); count <= 0 {
+		t.Fatalf("tables should not be encrypted yet")
+	}
+
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	if count := stale("hogwarts"); count != 0 {
+		t.Errorf("%d tables are not encrypted by the current key", count)
+	}
+
+	testNoPlaintext(t, options.Dir, "Ravenclaw")
+
+	// Rotate master key, tables and segments of the old key are rewritten.
+	keys.Current = "durmstrang"
+	put(500, 1000)
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	if count := stale("durmstrang"); count != 0 {
+		t.Errorf("%d tables are not encrypted by the current key", count)
+	}
+
+	db.Close()
+
+	// The old master key is retired.
+	options.KeyProvider = testKeyProvider("durmstrang")
+	if db, err = Open(options); err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("wizard-%04d", i)))
+		if err != nil || string(value) != fmt.Sprintf("Ravenclaw %d", i) {
+			t.Errorf("unexpected value of %d: %q, %v", i, value, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package pinkis
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// EngineType selects storage engine of a database.
+type EngineType int
+
+const (
+	// Keep all data in memory, with an optional write-ahead log for durability.
+	EngineMemory EngineType = iota
+	// Log-structured merge-tree, data outgrowing memory are flushed to sorted tables.
+	EngineLSM
+	// Copy-on-write B+tree in a single paged file, fit for read-heavy workloads.
+	EngineBTree
+)
+
+func (t EngineType) String() string {
+	switch t {
+	case EngineMemory:
+		return "memory"
+
+	case EngineLSM:
+		return "lsm"
+
+	case EngineBTree:
+		return "btree"
+
+	default:
+		return "unknown"
+	}
+}
+
+// Storage engine behind a DB. Keys and values passed to and returned from an engine are owned by
+// the engine, DB is responsible to isolate them from callers.
+type engine interface {
+	// Get value of key, and its frozen typed value if it is put by a collection.
+	Get(key []byte) ([]byte, interface{}, error)
+	// Call fn with value and frozen typed value of key, they are valid only until fn returns.
+	View(key []byte, fn func(value []byte, object interface{}) error) error
+	// Take a snapshot of all applied batches, reads of it never observe batches applied later.
+	// Old versions visible to a snapshot are kept until it is released.
+	Snapshot() (engineSnapshot, error)
+	// Apply all entries of batch atomically, readers never observe a partially applied batch.
+	// Sequence number of batch is assigned by caller and must be increasing.
+	Apply(batch *writeBatch) error
+	// Make all applied batches persistent.
+	Flush() error
+	// Compact data of keys in [start, end], nil means unbounded.
+	CompactRange(start []byte, end []byte) error
+	// Sequence number of the last applied batch.
+	LastSequence() uint64
+	// What is recovered when engine is opened.
+	Recovery() RecoveryInfo
+	// Scan all files of engine with checksums verified, and add corrupted ranges to report.
+	Verify(report *VerifyReport) error
+	// Make an openable copy of engine in a new directory at a consistent sequence number, which
+	// is returned.
+	Checkpoint(dir string) (uint64, error)
+	Close() error
+}
+
+// A consistent read-only view of engine, it must be released, and is not safe for concurrent use.
+type engineSnapshot interface {
+	// Sequence number of the last batch visible in snapshot.
+	Sequence() uint64
+	// Same as engine.View, at the snapshot.
+	View(key []byte, fn func(value []byte, object interface{}) error) error
+	// Iterate all visible keys, iterator must be closed before snapshot is released.
+	Iterator() engineIterator
+	Release()
+}
+
+// Open engine of options, blocks of tables are cached in cache, which may be nil, and compressed by
+// compressors of compression.
+func openEngine(options Options, cache *blockCache, compression *compressionPolicy) (engine, error) {
+	switch options.Engine {
+	case EngineMemory:
+		return openMemoryEngine(options)
+
+	case EngineLSM:
+		return openLSMEngine(options, cache, compression)
+
+	case EngineBTree:
+		return openBTreeEngine(options)
+
+	default:
+		return nil, WrapError(ErrInvalidOptions, "unknown engine type %d", options.Engine)
+	}
+}
+
+const walDirName = "wal"
+
+// Make directory of database, or check that it exists if database is read-only.
+func makeEngineDir(options Options) error {
+	if options.ReadOnly {
+		_, err := os.Stat(options.Dir)
+		return err
+	}
+
+	return os.MkdirAll(options.Dir, 0755)
+}
+
+// Open write-ahead log of an engine, replay all logged batches with apply.
+func openEngineWAL(options Options, apply func(batch *writeBatch) error) (*writeAheadLog, RecoveryInfo, error) {
+	walOptions := walOptions{
+		dir:         filepath.Join(options.Dir, walDirName),
+		segmentSize: options.WALSegmentSize,
+		syncPolicy:  options.SyncPolicy,
+		syncPeriod:  options.SyncPeriod,
+		keys:        options.KeyProvider,
+		readOnly:    options.ReadOnly,
+		replayRecord: func(payload []byte) error {
+			batch, err := decodeBatch(payload)
+			if err != nil {
+				return err
+			}
+
+			return apply(batch)
+		},
+	}
+
+	return openWAL(walOptions)
+}
@@ -0,0 +1,25 @@
+package pinkis
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEngineType(t *testing.T) {
+	names := map[EngineType]string{
+		EngineMemory:   "memory",
+		EngineLSM:      "lsm",
+		EngineBTree:    "btree",
+		EngineType(42): "unknown",
+	}
+
+	for engineType, name := range names {
+		if engineType.String() != name {
+			t.Errorf("unexpected name: %s <=> %s", engineType, name)
+		}
+	}
+
+	if _, err := Open(Options{Engine: EngineType(42)}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/flily/pinkis/meta"
+)
+
+var (
+	ErrPinkisError = errors.New("pinkis error")
+	ErrNotFound    = NewError("key not found")
+	ErrKeyRequired = NewError("key required")
+	ErrClosed      = NewError("database closed")
+	ErrReadOnly    = NewError("database is read-only")
+
+	ErrCorrupted      = NewError("data corrupted")
+	ErrDecryption     = NewError("decryption failed")
+	ErrInvalidName    = NewError("invalid name")
+	ErrInvalidOptions = NewError("invalid options")
+	ErrTypeMismatch   = NewError("type mismatch")
+
+	ErrTxClosed      = NewError("transaction closed")
+	ErrTxNotWritable = NewError("transaction not writable")
+	ErrTxManaged     = NewError("transaction managed by Update or View")
+	ErrConflict      = NewError("transaction conflict")
+
+	ErrBucketExists   = NewError("bucket already exists")
+	ErrBucketNotFound = NewError("bucket not found")
+
+	ErrUniqueViolation = NewError("unique index violated")
+
+	ErrBackupMismatch = NewError("backup does not follow database")
+
+	ErrWatchLagged      = NewError("watcher lagged behind")
+	ErrHistoryTruncated = NewError("history truncated")
+)
+
+// Make a new error based on ErrPinkisError.
+func NewError(format string, args ...interface{}) error {
+	return meta.MetaError{
+		Base:    ErrPinkisError,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Make a new error wraps base, errors.Is(err, base) is true.
+func WrapError(base error, format string, args ...interface{}) error {
+	return &meta.MetaError{
+		Base:    base,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
@@ -0,0 +1,43 @@
+package pinkis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func TestNewError(t *testing.T) {
+	err := NewError("hello, %s", "world")
+
+	message := "hello, world"
+	if err.Error() != message {
+		t.Errorf("error message: %s", err)
+	}
+
+	if !errors.Is(err, ErrPinkisError) {
+		t.Errorf("err (%v) is not ErrPinkisError (%v)", err, ErrPinkisError)
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	err := WrapError(ErrNotFound, "key '%s' not found", "lumos")
+
+	message := "key 'lumos' not found"
+	if err.Error() != message {
+		t.Errorf("error message: %s", err)
+	}
+
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err (%v) is not ErrNotFound (%v)", err, ErrNotFound)
+	}
+
+	if !errors.Is(err, ErrPinkisError) {
+		t.Errorf("err (%v) is not ErrPinkisError (%v)", err, ErrPinkisError)
+	}
+
+	var metaError *meta.MetaError
+	if !errors.As(err, &metaError) {
+		t.Errorf("err (%v) is not a MetaError", err)
+	}
+}
@@ -0,0 +1,628 @@
+package pinkis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Index of a collection over one or more fields of values. Indexes are declared by struct tags of
+// the registered type, `pinkis:"index"` or `pinkis:"unique"` for an index of a single field named
+// by the field, and `pinkis:"index:name"` or `pinkis:"unique:name"` for composite indexes, whose
+// fields are in order of the struct. Indexes are maintained on every Put and Delete.
+type Index struct {
+	Name   string
+	Fields []string
+	// No two values have the same indexed fields.
+	Unique bool
+}
+
+func (i Index) equal(other Index) bool {
+	return i.Name == other.Name && i.Unique == other.Unique &&
+		strings.Join(i.Fields, "\x00") == strings.Join(other.Fields, "\x00")
+}
+
+// UniqueError is returned when a value violates a unique index, it wraps ErrUniqueViolation.
+type UniqueError struct {
+	Collection string
+	Index      string
+	// Key of value written, and key of the existing value with the same indexed fields.
+	Key      []byte
+	Existing []byte
+}
+
+func (e *UniqueError) Error() string {
+	return fmt.Sprintf("%v: index '%s' of collection '%s', key '%s' conflicts with '%s'",
+		ErrUniqueViolation, e.Index, e.Collection, e.Key, e.Existing)
+}
+
+func (e *UniqueError) Unwrap() error {
+	return ErrUniqueViolation
+}
+
+// Entries of an index are stored in index namespace, ordered by encoded fields:
+//
+//	key    0x04 collection, index, encoded fields, primary key for non-unique indexes only
+//	value  primary key
+//
+// Definitions of indexes are stored in meta namespace, so that an index is rebuilt when its
+// definition changes:
+//
+//	key    0x00 "index/" collection, index name
+//	value  unique byte, fields, each as length uvarint and name
+type collectionIndex struct {
+	Index
+	prefix []byte
+}
+
+var indexDefinitionPrefix = []byte("\x00index/")
+
+func indexDefinitionKey(collection string, name string) []byte {
+	prefix := namespacePrefix(namespaceMeta, collection)[1:]
+	key := prefixedKey(indexDefinitionPrefix, prefix)
+	return append(key, name...)
+}
+
+func (i Index) encode() []byte {
+	data := []byte{0}
+	if i.Unique {
+		data[0] = 1
+	}
+
+	for _, field := range i.Fields {
+		data = appendLengthPrefixed(data, []byte(field))
+	}
+
+	return data
+}
+
+func decodeIndex(name string, data []byte) (Index, error) {
+	index := Index{Name: name}
+	if len(data) <= 0 {
+		return index, WrapError(ErrCorrupted, "invalid definition of index '%s'", name)
+	}
+
+	index.Unique = data[0] != 0
+	data = data[1:]
+	for len(data) > 0 {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length > uint64(len(data)-n) {
+			return index, WrapError(ErrCorrupted, "invalid definition of index '%s'", name)
+		}
+
+		index.Fields = append(index.Fields, string(data[n:n+int(length)]))
+		data = data[n+int(length):]
+	}
+
+	return index, nil
+}
+
+func newCollectionIndex(collection string, index Index) *collectionIndex {
+	prefix := namespacePrefix(namespaceIndex, collection)
+	prefix = appendLengthPrefixed(prefix, []byte(index.Name))
+	return &collectionIndex{
+		Index:  index,
+		prefix: prefix,
+	}
+}
+
+// Key of index entry of value with primary key.
+func (i *collectionIndex) entryKey(value reflect.Value, key []byte) ([]byte, error) {
+	entry := append([]byte{}, i.prefix...)
+	for _, field := range i.Fields {
+		v, err := meta.GetField(value.Interface(), field)
+		if err != nil {
+			return nil, err
+		}
+
+		entry = appendIndexValue(entry, reflect.ValueOf(v))
+	}
+
+	if !i.Unique {
+		entry = append(entry, key...)
+	}
+
+	return entry, nil
+}
+
+func indexable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+
+	default:
+		return false
+	}
+}
+
+const (
+	indexTagFalse  byte = 0x01
+	indexTagTrue   byte = 0x02
+	indexTagNumber byte = 0x03
+	indexTagBytes  byte = 0x04
+)
+
+// Append a value in an encoding whose bytewise order is the order of values, and no encoding is a
+// prefix of another. Bytes are terminated by 0x00 0x01, with 0x00 escaped as 0x00 0xff.
+func appendIndexValue(buffer []byte, value reflect.Value) []byte {
+	var u [8]byte
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			return append(buffer, indexTagTrue)
+		}
+
+		return append(buffer, indexTagFalse)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		binary.BigEndian.PutUint64(u[:], uint64(value.Int())^(1<<63))
+		return append(append(buffer, indexTagNumber), u[:]...)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		binary.BigEndian.PutUint64(u[:], value.Uint())
+		return append(append(buffer, indexTagNumber), u[:]...)
+
+	case reflect.Float32, reflect.Float64:
+		bits := math.Float64bits(value.Float())
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+
+		} else {
+			bits |= 1 << 63
+		}
+
+		binary.BigEndian.PutUint64(u[:], bits)
+		return append(append(buffer, indexTagNumber), u[:]...)
+
+	default:
+		var data []byte
+		if value.Kind() == reflect.String {
+			data = []byte(value.String())
+
+		} else {
+			data = value.Bytes()
+		}
+
+		buffer = append(buffer, indexTagBytes)
+		for _, c := range data {
+			if c == 0 {
+				buffer = append(buffer, 0, 0xff)
+
+			} else {
+				buffer = append(buffer, c)
+			}
+		}
+
+		return append(buffer, 0, 1)
+	}
+}
+
+// Parse indexes declared by struct tags of t.
+func parseIndexTags(t reflect.Type) ([]Index, error) {
+	var indexes []Index
+	find := func(name string) *Index {
+		for i := range indexes {
+			if indexes[i].Name == name {
+				return &indexes[i]
+			}
+		}
+
+		indexes = append(indexes, Index{Name: name})
+		return &indexes[len(indexes)-1]
+	}
+
+	for n := 0; n < t.NumField(); n++ {
+		field := t.Field(n)
+		tag, found := field.Tag.Lookup("pinkis")
+		if !found {
+			continue
+		}
+
+		for _, option := range strings.Split(tag, ",") {
+			kind, name := option, field.Name
+			if colon := strings.IndexByte(option, ':'); colon >= 0 {
+				kind, name = option[:colon], option[colon+1:]
+			}
+
+			switch kind {
+			case "expires":
+				// Expiry is not an index, see parseExpiresTag.
+
+			case "index", "unique":
+				index := find(name)
+				if len(index.Fields) > 0 && index.Unique != (kind == "unique") {
+					return nil, WrapError(ErrInvalidOptions,
+						"fields of index '%s' of %s disagree on uniqueness", name, t)
+				}
+
+				index.Unique = kind == "unique"
+				index.Fields = append(index.Fields, field.Name)
+
+			default:
+				return nil, WrapError(ErrInvalidOptions, "unknown tag '%s' of field %s.%s",
+					option, t, field.Name)
+			}
+		}
+	}
+
+	return indexes, nil
+}
+
+func checkIndex(t reflect.Type, index Index) error {
+	if len(index.Name) <= 0 {
+		return WrapError(ErrInvalidName, "index name required")
+	}
+
+	if len(index.Fields) <= 0 {
+		return WrapError(ErrInvalidOptions, "index '%s' requires fields", index.Name)
+	}
+
+	for _, name := range index.Fields {
+		field, found := t.FieldByName(name)
+		if !found || !meta.IsExportedName(name) {
+			return WrapError(ErrInvalidOptions, "index '%s' requires exported field '%s' of %s",
+				index.Name, name, t)
+		}
+
+		if !indexable(field.Type) {
+			return WrapError(ErrTypeMismatch, "field '%s' of index '%s' can not be indexed, type %s",
+				name, index.Name, field.Type)
+		}
+	}
+
+	return nil
+}
+
+// Declared indexes of collection.
+func (c *Collection) Indexes() []Index {
+	c.indexLock.RLock()
+	defer c.indexLock.RUnlock()
+
+	indexes := make([]Index, len(c.indexes))
+	for i, index := range c.indexes {
+		indexes[i] = index.Index
+	}
+
+	return indexes
+}
+
+func (c *Collection) indexList() []*collectionIndex {
+	c.indexLock.RLock()
+	defer c.indexLock.RUnlock()
+
+	return c.indexes
+}
+
+func (c *Collection) findIndex(name string) *collectionIndex {
+	for _, index := range c.indexList() {
+		if index.Name == name {
+			return index
+		}
+	}
+
+	return nil
+}
+
+// Declare an index of fields programmatically, existing values are indexed. Indexes not declared
+// by struct tags are dropped when collection is got in a new process, and rebuilt when declared
+// again. Indexes should be declared before values are written concurrently.
+func (c *Collection) CreateIndex(name string, unique bool, fields ...string) error {
+	index := Index{
+		Name:   name,
+		Fields: append([]string{}, fields...),
+		Unique: unique,
+	}
+
+	if err := checkIndex(c.valueType, index); err != nil {
+		return err
+	}
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	for _, declared := range c.indexes {
+		if declared.Name != name {
+			continue
+		}
+
+		if !declared.equal(index) {
+			return WrapError(ErrInvalidOptions, "index '%s' of collection '%s' is declared differently",
+				name, c.name)
+		}
+
+		return nil
+	}
+
+	ci := newCollectionIndex(c.name, index)
+	err := c.db.updateRetry(func(tx *Tx) error {
+		return c.ensureIndex(tx, ci)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	indexes := make([]*collectionIndex, len(c.indexes), len(c.indexes)+1)
+	copy(indexes, c.indexes)
+	c.indexes = append(indexes, ci)
+	return nil
+}
+
+// Set up indexes declared by tags when collection is got, drop indexes no longer declared.
+func (c *Collection) setupIndexes() error {
+	indexes, err := parseIndexTags(c.valueType)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if err := checkIndex(c.valueType, index); err != nil {
+			return err
+		}
+
+		c.indexes = append(c.indexes, newCollectionIndex(c.name, index))
+	}
+
+	return c.db.updateRetry(func(tx *Tx) error {
+		stored, err := c.storedIndexes(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, index := range stored {
+			if ci := c.findIndexLocked(index.Name); ci == nil {
+				if err := c.dropIndex(tx, index.Name); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, ci := range c.indexes {
+			if err := c.ensureIndex(tx, ci); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (c *Collection) findIndexLocked(name string) *collectionIndex {
+	for _, index := range c.indexes {
+		if index.Name == name {
+			return index
+		}
+	}
+
+	return nil
+}
+
+func (c *Collection) storedIndexes(tx *Tx) ([]Index, error) {
+	namespace := indexDefinitionKey(c.name, "")
+	iter, err := tx.iterator(namespace, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []Index
+	for ok := iter.First(); ok && err == nil; ok = iter.Next() {
+		var index Index
+		index, err = decodeIndex(string(iter.Key()), iter.Value())
+		indexes = append(indexes, index)
+	}
+
+	if err == nil {
+		err = iter.Error()
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	return indexes, err
+}
+
+// Delete all entries and definition of an index.
+func (c *Collection) dropIndex(tx *Tx, name string) error {
+	ci := newCollectionIndex(c.name, Index{Name: name})
+	iter, err := tx.iterator(ci.prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	for ok := iter.First(); ok; ok = iter.Next() {
+		keys = append(keys, prefixedKey(ci.prefix, iter.Key()))
+	}
+
+	err = iter.Error()
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return err
+	}
+
+	keys = append(keys, indexDefinitionKey(c.name, name))
+	for _, key := range keys {
+		k := key
+		if err := tx.write(k, func(batch *writeBatch) { batch.Delete(k) }); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Build an index from all values if its definition is not stored as it is.
+func (c *Collection) ensureIndex(tx *Tx, ci *collectionIndex) error {
+	key := indexDefinitionKey(c.name, ci.Name)
+	var stored Index
+	err := tx.view(key, func(value []byte, object interface{}) error {
+		var err error
+		stored, err = decodeIndex(ci.Name, value)
+		return err
+	})
+
+	if err == nil && stored.equal(ci.Index) {
+		return nil
+
+	} else if err == nil {
+		if err := c.dropIndex(tx, ci.Name); err != nil {
+			return err
+		}
+
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	type entry struct {
+		index []byte
+		key   []byte
+	}
+
+	iter, err := tx.iterator(c.prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	var entries []entry
+	for ok := iter.First(); ok && err == nil; ok = iter.Next() {
+		var value reflect.Value
+		value, err = c.decode(iter.Value())
+		if err == nil {
+			e := entry{key: append([]byte{}, iter.Key()...)}
+			e.index, err = ci.entryKey(value, e.key)
+			entries = append(entries, e)
+		}
+	}
+
+	if err == nil {
+		err = iter.Error()
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return bytes.Compare(entries[i].index, entries[j].index) < 0 })
+	for n, e := range entries {
+		if n > 0 && bytes.Equal(entries[n-1].index, e.index) {
+			return &UniqueError{Collection: c.name, Index: ci.Name, Key: e.key, Existing: entries[n-1].key}
+		}
+
+		if err := tx.write(e.index, func(batch *writeBatch) { batch.Put(e.index, e.key) }); err != nil {
+			return err
+		}
+	}
+
+	definition := ci.encode()
+	return tx.write(key, func(batch *writeBatch) { batch.Put(key, definition) })
+}
+
+// Update index entries in transaction for value of key, value is invalid if key is deleted. All
+// unique indexes are checked before anything is written.
+func (c *Collection) updateIndexes(tx *Tx, key []byte, value reflect.Value, expires int64) error {
+	indexes := c.indexList()
+	if len(indexes) <= 0 {
+		return nil
+	}
+
+	var old reflect.Value
+	err := tx.view(c.key(key), func(data []byte, object interface{}) error {
+		var err error
+		old, err = c.load(data, object)
+		return err
+	})
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	type change struct {
+		remove []byte
+		add    []byte
+	}
+
+	changes := make([]change, 0, len(indexes))
+	for _, index := range indexes {
+		ch := change{}
+		if old.IsValid() {
+			if ch.remove, err = index.entryKey(old, key); err != nil {
+				return err
+			}
+		}
+
+		if value.IsValid() {
+			if ch.add, err = index.entryKey(value, key); err != nil {
+				return err
+			}
+		}
+
+		// Entries are written again to follow expiry of value, if collection may expire.
+		if bytes.Equal(ch.remove, ch.add) {
+			if !c.expiring() {
+				continue
+			}
+
+			ch.remove = nil
+		}
+
+		if ch.add != nil && index.Unique {
+			existing, err := tx.get(ch.add)
+			if err == nil && !bytes.Equal(existing, key) {
+				return &UniqueError{Collection: c.name, Index: index.Name, Key: key, Existing: existing}
+
+			} else if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+
+		changes = append(changes, ch)
+	}
+
+	primary := append([]byte{}, key...)
+	for _, ch := range changes {
+		remove, add := ch.remove, ch.add
+		if remove != nil {
+			if err := tx.write(remove, func(batch *writeBatch) { batch.Delete(remove) }); err != nil {
+				return err
+			}
+		}
+
+		if add != nil {
+			err := tx.write(add, func(batch *writeBatch) {
+				if expires > 0 {
+					putExpiring(batch, add, primary, nil, expires)
+
+				} else {
+					batch.Put(add, primary)
+				}
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
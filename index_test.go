@@ -0,0 +1,362 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+type testStudent struct {
+	Name  string `pinkis:"index"`
+	Email string `pinkis:"unique"`
+	House string `pinkis:"index:house_year"`
+	Year  int    `pinkis:"index:house_year"`
+	Wand  string
+}
+
+func TestParseIndexTags(t *testing.T) {
+	indexes, err := parseIndexTags(reflect.TypeOf(testStudent{}))
+	if err != nil {
+		t.Fatalf("parse tags failed: %v", err)
+	}
+
+	expected := []Index{
+		{Name: "Name", Fields: []string{"Name"}},
+		{Name: "Email", Fields: []string{"Email"}, Unique: true},
+		{Name: "house_year", Fields: []string{"House", "Year"}},
+	}
+
+	if !meta.Equal(indexes, expected) {
+		t.Errorf("unexpected indexes: %+v <=> %+v", indexes, expected)
+	}
+
+	type unknownTag struct {
+		Name string `pinkis:"primary"`
+	}
+
+	if _, err := parseIndexTags(reflect.TypeOf(unknownTag{})); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	type disagree struct {
+		Name  string `pinkis:"index:name"`
+		House string `pinkis:"unique:name"`
+	}
+
+	if _, err := parseIndexTags(reflect.TypeOf(disagree{})); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	type unindexable struct {
+		Courses []string `pinkis:"index"`
+	}
+
+	db := openTestDB(t)
+	defer db.Close()
+
+	if _, err := db.Collection("courses", unindexable{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	type unexported struct {
+		name string `pinkis:"index"`
+	}
+
+	if _, err := db.Collection("unexported", unexported{}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIndexValueOrder(t *testing.T) {
+	values := []interface{}{
+		math.MinInt64, -1000, -1, 0, 1, 255, 256, math.MaxInt64,
+	}
+
+	floats := []interface{}{
+		math.Inf(-1), -1e10, -1.5, -0.5, 0.0, 0.5, 1.5, 1e10, math.Inf(1),
+	}
+
+	strings := []interface{}{
+		"", "\x00", "\x00\x00", "\x00a", "a", "a\x00", "a\x00b", "ab", "b",
+	}
+
+	for _, group := range [][]interface{}{values, floats, strings, {false, true}} {
+		for i := 1; i < len(group); i++ {
+			a := appendIndexValue(nil, reflect.ValueOf(group[i-1]))
+			b := appendIndexValue(nil, reflect.ValueOf(group[i]))
+			if bytes.Compare(a, b) >= 0 {
+				t.Errorf("encoding of %#v should be less than %#v: %v <=> %v", group[i-1], group[i], a, b)
+			}
+
+			if bytes.HasPrefix(b, a) {
+				t.Errorf("encoding of %#v should not be a prefix of %#v", group[i-1], group[i])
+			}
+		}
+	}
+}
+
+// Primary keys in index, in order of index entries.
+func indexedKeys(t *testing.T, db *DB, c *Collection, name string) []string {
+	index := c.findIndex(name)
+	if index == nil {
+		t.Fatalf("index '%s' not found", name)
+	}
+
+	var keys []string
+	err := db.View(func(tx *Tx) error {
+		iter, err := tx.iterator(index.prefix, nil)
+		if err != nil {
+			return err
+		}
+		defer iter.Close()
+
+		for ok := iter.First(); ok; ok = iter.Next() {
+			keys = append(keys, string(iter.Value()))
+		}
+
+		return iter.Error()
+	})
+
+	if err != nil {
+		t.Fatalf("read index failed: %v", err)
+	}
+
+	return keys
+}
+
+func TestIndexMaintained(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	if names := fmt.Sprint(students.Indexes()); names != "[{Name [Name] false} {Email [Email] true} {house_year [House Year] false}]" {
+		t.Errorf("unexpected indexes: %s", names)
+	}
+
+	values := map[string]testStudent{
+		"harry":    {Name: "Harry Potter", Email: "harry@hogwarts", House: "Gryffindor", Year: 5},
+		"hermione": {Name: "Hermione Granger", Email: "hermione@hogwarts", House: "Gryffindor", Year: 5},
+		"draco":    {Name: "Draco Malfoy", Email: "draco@hogwarts", House: "Slytherin", Year: 5},
+		"ginny":    {Name: "Ginny Weasley", Email: "ginny@hogwarts", House: "Gryffindor", Year: 4},
+	}
+
+	for key, value := range values {
+		if err := students.Put([]byte(key), value); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if keys := fmt.Sprint(indexedKeys(t, db, students, "Name")); keys != "[draco ginny harry hermione]" {
+		t.Errorf("unexpected index: %s", keys)
+	}
+
+	if keys := fmt.Sprint(indexedKeys(t, db, students, "house_year")); keys != "[ginny harry hermione draco]" {
+		t.Errorf("unexpected index: %s", keys)
+	}
+
+	// Old entries are replaced when indexed fields change.
+	draco := values["draco"]
+	draco.Name = "Albus Dumbledore"
+	if err := students.Put([]byte("draco"), draco); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := students.Delete([]byte("ginny")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if keys := fmt.Sprint(indexedKeys(t, db, students, "Name")); keys != "[draco harry hermione]" {
+		t.Errorf("unexpected index: %s", keys)
+	}
+
+	if keys := fmt.Sprint(indexedKeys(t, db, students, "Email")); keys != "[draco harry hermione]" {
+		t.Errorf("unexpected index: %s", keys)
+	}
+}
+
+func TestIndexUnique(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	harry := testStudent{Name: "Harry Potter", Email: "harry@hogwarts"}
+	if err := students.Put([]byte("harry"), harry); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	// Put the same value again is not a violation.
+	if err := students.Put([]byte("harry"), harry); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	err = students.Put([]byte("impostor"), testStudent{Name: "Barty Crouch", Email: "harry@hogwarts"})
+	var uniqueErr *UniqueError
+	if !errors.As(err, &uniqueErr) || !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if uniqueErr.Index != "Email" || string(uniqueErr.Key) != "impostor" || string(uniqueErr.Existing) != "harry" {
+		t.Errorf("unexpected error: %+v", uniqueErr)
+	}
+
+	if has, _ := students.Has([]byte("impostor")); has {
+		t.Errorf("violating value should not be written")
+	}
+
+	// Violation within the same transaction.
+	err = db.Update(func(tx *Tx) error {
+		c := tx.Collection(students)
+		if err := c.Put([]byte("ron"), testStudent{Name: "Ron Weasley", Email: "ron@hogwarts"}); err != nil {
+			return err
+		}
+
+		err := c.Put([]byte("scabbers"), testStudent{Name: "Peter Pettigrew", Email: "ron@hogwarts"})
+		if !errors.Is(err, ErrUniqueViolation) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		// Released when owner changes.
+		if err := c.Put([]byte("harry"), testStudent{Name: "Harry Potter", Email: "potter@hogwarts"}); err != nil {
+			return err
+		}
+
+		return c.Put([]byte("james"), testStudent{Name: "James Potter", Email: "harry@hogwarts"})
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if keys := fmt.Sprint(indexedKeys(t, db, students, "Email")); keys != "[james harry ron]" {
+		t.Errorf("unexpected index: %s", keys)
+	}
+
+	// Concurrent writers of the same unique value conflict.
+	tx1, _ := db.Begin(true)
+	tx2, _ := db.Begin(true)
+	tx1.Collection(students).Put([]byte("fred"), testStudent{Email: "twins@hogwarts"})
+	tx2.Collection(students).Put([]byte("george"), testStudent{Email: "twins@hogwarts"})
+	if err := tx1.Commit(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := tx2.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateIndex(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	wizards, err := db.Collection("wizards", testWizard{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	names := []string{"Luna Lovegood", "Neville Longbottom", "Cedric Diggory", "Cho Chang"}
+	for i, name := range names {
+		value := testWizard{Name: name, Born: 1981 - i%2, House: "Hogwarts"}
+		if err := wizards.Put([]byte(fmt.Sprintf("wizard-%d", i)), value); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if err := wizards.CreateIndex("house", true, "House"); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := wizards.CreateIndex("courses", false, "Courses"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := wizards.CreateIndex("born", false, "Born", "Name"); err != nil {
+		t.Fatalf("create index failed: %v", err)
+	}
+
+	if err := wizards.CreateIndex("born", false, "Born", "Name"); err != nil {
+		t.Errorf("declare the same index again should succeed: %v", err)
+	}
+
+	if err := wizards.CreateIndex("born", false, "Born"); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	keys := indexedKeys(t, db, wizards, "born")
+	if fmt.Sprint(keys) != "[wizard-3 wizard-1 wizard-2 wizard-0]" {
+		t.Errorf("unexpected index: %v", keys)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	db, err = Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatalf("reopen database failed: %v", err)
+	}
+	defer db.Close()
+
+	// Undeclared indexes are dropped.
+	wizards, err = db.Collection("wizards", testWizard{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	n := 0
+	db.View(func(tx *Tx) error {
+		iter, _ := tx.iterator([]byte{namespaceIndex}, nil)
+		defer iter.Close()
+		for ok := iter.First(); ok; ok = iter.Next() {
+			n++
+		}
+
+		stored, _ := wizards.storedIndexes(tx)
+		n += len(stored)
+		return nil
+	})
+
+	if n != 0 {
+		t.Errorf("undeclared index should be dropped, %d keys left", n)
+	}
+
+	if err := wizards.CreateIndex("born", false, "Born"); err != nil {
+		t.Fatalf("create index failed: %v", err)
+	}
+
+	keys = indexedKeys(t, db, wizards, "born")
+	sort.Strings(keys[:2])
+	sort.Strings(keys[2:])
+	if fmt.Sprint(keys) != "[wizard-1 wizard-3 wizard-0 wizard-2]" {
+		t.Errorf("unexpected index: %v", keys)
+	}
+}
+
+func TestIndexDefinition(t *testing.T) {
+	index := Index{Name: "house_year", Fields: []string{"House", "Year"}, Unique: true}
+	got, err := decodeIndex(index.Name, index.encode())
+	if err != nil || !got.equal(index) {
+		t.Errorf("unexpected index: %+v, %v", got, err)
+	}
+
+	if _, err := decodeIndex("broken", nil); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Internal keys are user keys with a trailer of sequence number and kind. Entries of the same
+// user key are ordered by sequence number descending, so the newest version comes first.
+const (
+	internalTrailerSize = 8
+	maxSequence         = uint64(1)<<56 - 1
+
+	// Kind used in lookup keys, must be the largest kind, so that seeking a lookup key finds the
+	// newest entry of a user key whose sequence number <= the lookup sequence.
+	kindSeek = kindMerge
+)
+
+func packTrailer(seq uint64, kind entryKind) uint64 {
+	return seq<<8 | uint64(kind)
+}
+
+func makeInternalKey(key []byte, seq uint64, kind entryKind) []byte {
+	ikey := make([]byte, len(key)+internalTrailerSize)
+	copy(ikey, key)
+	binary.LittleEndian.PutUint64(ikey[len(key):], packTrailer(seq, kind))
+	return ikey
+}
+
+// Make a key to find the newest entry of key visible at sequence number seq.
+func makeLookupKey(key []byte, seq uint64) []byte {
+	return makeInternalKey(key, seq, kindSeek)
+}
+
+type parsedInternalKey struct {
+	key  []byte
+	seq  uint64
+	kind entryKind
+}
+
+func (k parsedInternalKey) String() string {
+	return fmt.Sprintf("%q@%d:%s", k.key, k.seq, k.kind)
+}
+
+func parseInternalKey(ikey []byte) (parsedInternalKey, error) {
+	if len(ikey) < internalTrailerSize {
+		return parsedInternalKey{}, WrapError(ErrCorrupted, "internal key too short, %d bytes", len(ikey))
+	}
+
+	n := len(ikey) - internalTrailerSize
+	trailer := binary.LittleEndian.Uint64(ikey[n:])
+	parsed := parsedInternalKey{
+		key:  ikey[:n:n],
+		seq:  trailer >> 8,
+		kind: entryKind(trailer & 0xff),
+	}
+
+	return parsed, nil
+}
+
+// User key part of an internal key, ikey must be a valid internal key.
+func internalUserKey(ikey []byte) []byte {
+	n := len(ikey) - internalTrailerSize
+	return ikey[:n:n]
+}
+
+func internalTrailer(ikey []byte) uint64 {
+	return binary.LittleEndian.Uint64(ikey[len(ikey)-internalTrailerSize:])
+}
+
+// Make a comparator of internal keys based on a comparator of user keys.
+func internalCompare(compare compareFunc) compareFunc {
+	return func(a []byte, b []byte) int {
+		if r := compare(internalUserKey(a), internalUserKey(b)); r != 0 {
+			return r
+		}
+
+		ta, tb := internalTrailer(a), internalTrailer(b)
+		if ta > tb {
+			return -1
+
+		} else if ta < tb {
+			return 1
+		}
+
+		return 0
+	}
+}
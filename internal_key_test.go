@@ -0,0 +1,54 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"testing"
+)
+
+func TestInternalKey(t *testing.T) {
+	ikey := makeInternalKey([]byte("sirius"), 42, kindPut)
+	parsed, err := parseInternalKey(ikey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(parsed.key, []byte("sirius")) || parsed.seq != 42 || parsed.kind != kindPut {
+		t.Errorf("unexpected parsed key: %s", parsed)
+	}
+
+	if !bytes.Equal(internalUserKey(ikey), []byte("sirius")) {
+		t.Errorf("unexpected user key: %q", internalUserKey(ikey))
+	}
+
+	if _, err := parseInternalKey([]byte("short")); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInternalKeyOrder(t *testing.T) {
+	keys := [][]byte{
+		makeInternalKey([]byte("b"), 1, kindPut),
+		makeInternalKey([]byte("a"), 1, kindPut),
+		makeInternalKey([]byte("a"), 3, kindDelete),
+		makeInternalKey([]byte("ab"), 2, kindPut),
+		makeInternalKey([]byte("a"), 2, kindPut),
+	}
+
+	compare := internalCompare(bytewiseCompare)
+	sort.Slice(keys, func(i, j int) bool { return compare(keys[i], keys[j]) < 0 })
+
+	expected := []string{`"a"@3:delete`, `"a"@2:put`, `"a"@1:put`, `"ab"@2:put`, `"b"@1:put`}
+	for i, ikey := range keys {
+		parsed, _ := parseInternalKey(ikey)
+		if parsed.String() != expected[i] {
+			t.Errorf("keys[%d] = %s <=> %s", i, parsed, expected[i])
+		}
+	}
+
+	lookup := makeLookupKey([]byte("a"), 2)
+	if compare(lookup, keys[1]) >= 0 || compare(lookup, keys[0]) <= 0 {
+		t.Errorf("lookup key should be at the newest visible version")
+	}
+}
@@ -0,0 +1,475 @@
+package pinkis
+
+import (
+	"sync"
+)
+
+// Iterator over internal entries in order of internal keys. Key and Value are valid until the
+// next move of iterator.
+type internalIterator interface {
+	Valid() bool
+	SeekToFirst()
+	SeekToLast()
+	// Move to the first entry whose key >= key.
+	Seek(key []byte)
+	Next()
+	Prev()
+	Key() []byte
+	Value() []byte
+	Error() error
+	Close() error
+}
+
+// An iterator without any entry, or stopped by an error.
+type emptyIterator struct {
+	err error
+}
+
+func (i *emptyIterator) Valid() bool     { return false }
+func (i *emptyIterator) SeekToFirst()    {}
+func (i *emptyIterator) SeekToLast()     {}
+func (i *emptyIterator) Seek(key []byte) {}
+func (i *emptyIterator) Next()           {}
+func (i *emptyIterator) Prev()           {}
+func (i *emptyIterator) Key() []byte     { return nil }
+func (i *emptyIterator) Value() []byte   { return nil }
+func (i *emptyIterator) Error() error    { return i.err }
+func (i *emptyIterator) Close() error    { return i.err }
+
+// Iterator over the newest visible entries of a snapshot in order of keys, deleted keys are
+// skipped. Key and Value are valid until the next move of iterator.
+type engineIterator interface {
+	Valid() bool
+	SeekToFirst()
+	SeekToLast()
+	// Move to the first entry whose key >= key.
+	Seek(key []byte)
+	Next()
+	Prev()
+	Key() []byte
+	Value() []byte
+	Error() error
+	Close() error
+}
+
+// An engine iterator tells expiry of the current entry, so that it is kept by backups.
+type expiringIterator interface {
+	// Expiry of the current entry in unix nanoseconds, 0 if it never expires.
+	Expires() int64
+}
+
+// Iterate newest entries of user keys whose sequence numbers <= seq, over an iterator of
+// internal entries, entries expired at now are taken as deletes. Moving forward, internal iterator
+// is at the current entry, or at the last entry folded if operands are merged. Moving backward, it
+// is before all entries of current key, and current entry is saved.
+type versionIterator struct {
+	iter         internalIterator
+	compare      compareFunc
+	tombstones   rangeTombstones
+	seq          uint64
+	now          int64
+	backward     bool
+	valid        bool
+	savedKey     []byte
+	savedValue   []byte
+	savedExpires int64
+	// Operands are folded into saved value of current entry, moving forward.
+	merged bool
+	err    error
+}
+
+func newVersionIterator(iter internalIterator, compare compareFunc, seq uint64, now int64) *versionIterator {
+	i := &versionIterator{
+		iter:    iter,
+		compare: compare,
+		seq:     seq,
+		now:     now,
+	}
+
+	return i
+}
+
+func (i *versionIterator) parse() (parsedInternalKey, bool) {
+	parsed, err := parseInternalKey(i.iter.Key())
+	if err != nil {
+		i.err = err
+		return parsed, false
+	}
+
+	return parsed, true
+}
+
+// Whether current entry is a delete, expired, or covered by a range tombstone.
+func (i *versionIterator) deleted(parsed parsedInternalKey) bool {
+	switch parsed.kind {
+	case kindDelete:
+		return true
+
+	case kindPutExpiring:
+		if expiredAt(i.iter.Value(), i.now) {
+			return true
+		}
+	}
+
+	return i.covered(parsed)
+}
+
+func (i *versionIterator) covered(parsed parsedInternalKey) bool {
+	return i.tombstones.covers(i.compare, parsed.key, parsed.seq, i.seq)
+}
+
+func (i *versionIterator) stop() {
+	i.valid = false
+	i.merged = false
+	i.savedKey = i.savedKey[:0]
+	i.savedValue = i.savedValue[:0]
+	if err := i.iter.Error(); err != nil && i.err == nil {
+		i.err = err
+	}
+}
+
+// Find the first visible put from current entry, skip keys <= savedKey if skipping.
+func (i *versionIterator) findNext(skipping bool) {
+	i.merged = false
+	for ; i.iter.Valid(); i.iter.Next() {
+		parsed, ok := i.parse()
+		if !ok {
+			break
+		}
+
+		if parsed.seq > i.seq {
+			continue
+		}
+
+		if skipping && i.compare(parsed.key, i.savedKey) <= 0 {
+			continue
+		}
+
+		if !i.deleted(parsed) && (parsed.kind != kindMerge || i.merge(parsed)) {
+			i.valid = true
+			i.savedKey = i.savedKey[:0]
+			return
+		}
+
+		if i.err != nil {
+			break
+		}
+
+		i.savedKey = append(i.savedKey[:0], parsed.key...)
+		skipping = true
+	}
+
+	i.stop()
+}
+
+// Fold operands of the current key from the current entry, which is the newest operand visible,
+// onto the older value, and save the value merged. Internal iterator is left at the last entry of
+// key folded. Return false if key is deleted, since an expired value absorbs operands, or on errors.
+func (i *versionIterator) merge(parsed parsedInternalKey) bool {
+	key := append([]byte{}, parsed.key...)
+	last := append([]byte{}, i.iter.Key()...)
+	operands := [][]byte{append([]byte{}, i.iter.Value()...)}
+	for {
+		i.iter.Next()
+		if !i.iter.Valid() {
+			break
+		}
+
+		older, ok := i.parse()
+		if !ok {
+			return false
+		}
+
+		if i.compare(older.key, key) != 0 {
+			break
+		}
+
+		if i.covered(older) {
+			return i.fold(kindDelete, nil, operands)
+		}
+
+		if older.kind != kindMerge {
+			return i.fold(older.kind, i.iter.Value(), operands)
+		}
+
+		operands = append(operands, append([]byte{}, i.iter.Value()...))
+		last = append(last[:0], i.iter.Key()...)
+	}
+
+	if err := i.iter.Error(); err != nil {
+		i.err = err
+		return false
+	}
+
+	// Moved past all entries of key, back to the last operand.
+	i.iter.Seek(last)
+	return i.fold(kindDelete, nil, operands)
+}
+
+// Fold operands, newest first, onto an older entry as the current entry.
+func (i *versionIterator) fold(kind entryKind, value []byte, operands [][]byte) bool {
+	for l, r := 0, len(operands)-1; l < r; l, r = l+1, r-1 {
+		operands[l], operands[r] = operands[r], operands[l]
+	}
+
+	kind, value, ok, err := mergeEntry(kind, value, operands, i.now)
+	if err != nil {
+		i.err = err
+	}
+
+	if !ok {
+		return false
+	}
+
+	i.savedExpires = expiryOf(kind, value)
+	value, _ = visibleValue(kind, value, i.now)
+	i.savedValue = append(i.savedValue[:0], value...)
+	i.merged = true
+	return true
+}
+
+// Find the newest visible entry of the previous key which is not deleted, moving backward.
+// Operands are folded one by one onto the older entry saved.
+func (i *versionIterator) findPrev() {
+	deleted := true
+	// Key of an expired value, which absorbs operands merged onto it.
+	var expired []byte
+	for ; i.iter.Valid(); i.iter.Prev() {
+		parsed, ok := i.parse()
+		if !ok {
+			break
+		}
+
+		if parsed.seq > i.seq {
+			continue
+		}
+
+		// A put is found for a later key, and this is an entry of the previous key.
+		if !deleted && i.compare(parsed.key, i.savedKey) < 0 {
+			break
+		}
+
+		absent := deleted
+		deleted = i.deleted(parsed)
+		if parsed.kind == kindMerge && !deleted && absent {
+			deleted = len(expired) > 0 && i.compare(parsed.key, expired) == 0
+		}
+
+		if deleted {
+			if parsed.kind == kindPutExpiring && !i.covered(parsed) {
+				expired = append(expired[:0], parsed.key...)
+
+			} else if parsed.kind != kindMerge || i.covered(parsed) {
+				expired = expired[:0]
+			}
+
+			i.savedKey = i.savedKey[:0]
+			i.savedValue = i.savedValue[:0]
+
+		} else if parsed.kind == kindMerge {
+			var existing []byte
+			if !absent {
+				existing = i.savedValue
+
+			} else {
+				i.savedExpires = 0
+			}
+
+			merged, err := foldOperands(existing, [][]byte{i.iter.Value()})
+			if err != nil {
+				i.err = err
+				break
+			}
+
+			i.savedKey = append(i.savedKey[:0], parsed.key...)
+			i.savedValue = append(i.savedValue[:0], merged...)
+
+		} else {
+			value, _ := visibleValue(parsed.kind, i.iter.Value(), i.now)
+			i.savedKey = append(i.savedKey[:0], parsed.key...)
+			i.savedValue = append(i.savedValue[:0], value...)
+			i.savedExpires = expiryOf(parsed.kind, i.iter.Value())
+		}
+	}
+
+	if i.err != nil || deleted {
+		i.stop()
+		i.backward = false
+		return
+	}
+
+	i.valid = true
+}
+
+func (i *versionIterator) Valid() bool {
+	return i.err == nil && i.valid
+}
+
+func (i *versionIterator) SeekToFirst() {
+	i.backward = false
+	i.iter.SeekToFirst()
+	i.findNext(false)
+}
+
+func (i *versionIterator) SeekToLast() {
+	i.backward = true
+	i.iter.SeekToLast()
+	i.findPrev()
+}
+
+func (i *versionIterator) Seek(key []byte) {
+	i.backward = false
+	i.iter.Seek(makeLookupKey(key, i.seq))
+	i.findNext(false)
+}
+
+func (i *versionIterator) Next() {
+	if i.backward {
+		// Internal iterator is before current key, which is saved to skip.
+		i.backward = false
+		if i.iter.Valid() {
+			i.iter.Next()
+
+		} else {
+			i.iter.SeekToFirst()
+		}
+
+	} else {
+		i.savedKey = append(i.savedKey[:0], internalUserKey(i.iter.Key())...)
+		i.iter.Next()
+	}
+
+	i.findNext(true)
+}
+
+func (i *versionIterator) Prev() {
+	if !i.backward {
+		// Move internal iterator before all entries of current key.
+		i.savedKey = append(i.savedKey[:0], internalUserKey(i.iter.Key())...)
+		for {
+			i.iter.Prev()
+			if !i.iter.Valid() {
+				i.stop()
+				return
+			}
+
+			if i.compare(internalUserKey(i.iter.Key()), i.savedKey) < 0 {
+				break
+			}
+		}
+
+		i.backward = true
+	}
+
+	i.findPrev()
+}
+
+func (i *versionIterator) Key() []byte {
+	if i.backward {
+		return i.savedKey
+	}
+
+	return internalUserKey(i.iter.Key())
+}
+
+func (i *versionIterator) Value() []byte {
+	if i.backward || i.merged {
+		return i.savedValue
+	}
+
+	kind := kindPut
+	if parsed, ok := i.parse(); ok {
+		kind = parsed.kind
+	}
+
+	value, _ := visibleValue(kind, i.iter.Value(), i.now)
+	return value
+}
+
+func (i *versionIterator) Expires() int64 {
+	if i.backward || i.merged {
+		return i.savedExpires
+	}
+
+	parsed, ok := i.parse()
+	if !ok {
+		return 0
+	}
+
+	return expiryOf(parsed.kind, i.iter.Value())
+}
+
+func (i *versionIterator) Error() error {
+	return i.err
+}
+
+func (i *versionIterator) Close() error {
+	err := i.iter.Close()
+	if i.err != nil {
+		err = i.err
+	}
+
+	return err
+}
+
+// An iterator reads under a read lock, for sorted runs modified by writers concurrently.
+type lockedIterator struct {
+	internalIterator
+	lock *sync.RWMutex
+}
+
+func (i *lockedIterator) Valid() bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.internalIterator.Valid()
+}
+
+func (i *lockedIterator) SeekToFirst() {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	i.internalIterator.SeekToFirst()
+}
+
+func (i *lockedIterator) SeekToLast() {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	i.internalIterator.SeekToLast()
+}
+
+func (i *lockedIterator) Seek(key []byte) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	i.internalIterator.Seek(key)
+}
+
+func (i *lockedIterator) Next() {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	i.internalIterator.Next()
+}
+
+func (i *lockedIterator) Prev() {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	i.internalIterator.Prev()
+}
+
+func (i *lockedIterator) Key() []byte {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.internalIterator.Key()
+}
+
+func (i *lockedIterator) Value() []byte {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	return i.internalIterator.Value()
+}
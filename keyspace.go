@@ -0,0 +1,56 @@
+package pinkis
+
+import (
+	"encoding/binary"
+)
+
+// All keys stored in engine are prefixed with a namespace byte, so that keys of different
+// namespaces never collide.
+const (
+	namespaceMeta       byte = 0x00
+	namespaceDefault    byte = 0x01
+	namespaceCollection byte = 0x02
+	namespaceBucket     byte = 0x03
+	namespaceIndex      byte = 0x04
+	namespaceExpiry     byte = 0x05
+	namespaceChange     byte = 0x06
+)
+
+func namespacePrefix(namespace byte, name string) []byte {
+	prefix := make([]byte, 1+binary.MaxVarintLen64+len(name))
+	prefix[0] = namespace
+	n := binary.PutUvarint(prefix[1:], uint64(len(name)))
+	n += copy(prefix[1+n:], name)
+	return prefix[:1+n]
+}
+
+// Split key prefixed by namespacePrefix into name and the rest, ok is false if key is malformed.
+func splitNamespacePrefix(key []byte) (string, []byte, bool) {
+	length, n := binary.Uvarint(key[1:])
+	if n <= 0 || length > uint64(len(key)-1-n) {
+		return "", nil, false
+	}
+
+	end := 1 + n + int(length)
+	return string(key[1+n : end]), key[end:], true
+}
+
+// Make a new key of prefix + key, the result never shares memory with arguments.
+func prefixedKey(prefix []byte, key []byte) []byte {
+	result := make([]byte, len(prefix)+len(key))
+	copy(result, prefix)
+	copy(result[len(prefix):], key)
+	return result
+}
+
+func defaultKey(key []byte) []byte {
+	return prefixedKey([]byte{namespaceDefault}, key)
+}
+
+// Prefix of keys in bucket of id, ids are fixed length so that no prefix covers another.
+func bucketPrefix(id uint64) []byte {
+	prefix := make([]byte, 9)
+	prefix[0] = namespaceBucket
+	binary.BigEndian.PutUint64(prefix[1:], id)
+	return prefix
+}
@@ -0,0 +1,37 @@
+package pinkis
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNamespacePrefix(t *testing.T) {
+	prefix := namespacePrefix(namespaceCollection, "wizards")
+	expected := append([]byte{namespaceCollection, 7}, "wizards"...)
+	if !bytes.Equal(prefix, expected) {
+		t.Errorf("unexpected prefix: %v <=> %v", prefix, expected)
+	}
+
+	// name "a" with key "bc" and name "ab" with key "c" must be different.
+	a := prefixedKey(namespacePrefix(namespaceCollection, "a"), []byte("bc"))
+	b := prefixedKey(namespacePrefix(namespaceCollection, "ab"), []byte("c"))
+	if bytes.Equal(a, b) {
+		t.Errorf("keys of different collections collide: %v", a)
+	}
+}
+
+func TestPrefixedKeyIsIsolated(t *testing.T) {
+	prefix := []byte{namespaceDefault}
+	key := []byte("key")
+	result := prefixedKey(prefix, key)
+	key[0] = 'K'
+	prefix[0] = namespaceMeta
+
+	if !bytes.Equal(result, []byte("\x01key")) {
+		t.Errorf("unexpected key: %q", result)
+	}
+
+	if !bytes.Equal(defaultKey([]byte("key")), result) {
+		t.Errorf("unexpected default key: %q", defaultKey([]byte("key")))
+	}
+}
@@ -0,0 +1,703 @@
+package pinkis
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const lsmDefaultMemtableSize = 4 << 20
+
+// A log-structured merge-tree engine. Writes go to write-ahead log and memtable, a full memtable
+// is sealed as immutable and flushed into a level 0 table in background. Reads look up memtable,
+// immutable memtable and tables from the newest to the oldest. Tables are merged by compactions,
+// see compaction.go.
+type lsmEngine struct {
+	options  Options
+	dir      string
+	compare  compareFunc
+	recovery RecoveryInfo
+	limiter  *rateLimiter
+	cache    *blockCache
+	filter   *filterPolicy
+	// Compressors of data blocks of tables, shared with DB to set compressors of buckets.
+	compression *compressionPolicy
+
+	// writeLock serializes writers and flushes.
+	writeLock sync.Mutex
+	wal       *writeAheadLog
+	sequence  uint64
+	closed    bool
+
+	// lock protects memtables, current version and compaction states. flushCond is signaled
+	// when a flush finished, compactionCond is signaled when a compaction finished. imm is
+	// cleared along with installing its table, flushing is cleared when the flush finished.
+	lock           sync.RWMutex
+	flushCond      *sync.Cond
+	compactionCond *sync.Cond
+	mem            *memtable
+	imm            *memtable
+	flushing       bool
+	current        *lsmVersion
+	bgErr          error
+	compactions    compactionState
+	snapshots      *snapshotList
+
+	// manifestLock serializes changes of manifest and version.
+	manifestLock sync.Mutex
+	manifest     *manifest
+}
+
+func openLSMEngine(options Options, cache *blockCache, compression *compressionPolicy) (*lsmEngine, error) {
+	if len(options.Dir) <= 0 {
+		return nil, WrapError(ErrInvalidOptions, "lsm engine requires a directory")
+	}
+
+	if err := makeEngineDir(options); err != nil {
+		return nil, err
+	}
+
+	e := &lsmEngine{
+		options:     options,
+		dir:         options.Dir,
+		compare:     bytewiseCompare,
+		limiter:     newRateLimiter(options.CompactionRateLimit),
+		cache:       cache,
+		filter:      newFilterPolicy(options),
+		compression: compression,
+		snapshots:   newSnapshotList(),
+	}
+
+	e.flushCond = sync.NewCond(&e.lock)
+	e.compactionCond = sync.NewCond(&e.lock)
+	e.compactions.busy = make(map[uint64]bool)
+	e.mem = newMemtable(e.compare)
+	if err := e.load(); err != nil {
+		if e.current != nil {
+			e.current.unref()
+		}
+
+		return nil, err
+	}
+
+	e.maybeScheduleCompaction()
+	return e, nil
+}
+
+func (e *lsmEngine) tableOptions() tableOptions {
+	return tableOptions{
+		blockSize:     e.options.BlockSize,
+		filter:        e.filter,
+		compression:   e.compression,
+		cache:         e.cache,
+		keys:          e.options.KeyProvider,
+		skipChecksums: e.options.DisableChecksums,
+	}
+}
+
+func (e *lsmEngine) load() error {
+	m, err := loadManifest(e.dir, e.options.KeyProvider)
+	if err != nil {
+		return err
+	}
+
+	if m == nil {
+		m = &manifest{nextFileNumber: 1}
+	}
+
+	e.manifest = m
+	e.sequence = m.lastSequence
+	tables := make([]*liveTable, 0, len(m.tables))
+	for _, t := range m.tables {
+		path := e.tablePath(t.number)
+		reader, err := openTable(path, t.number, e.compare, e.tableOptions())
+		if err != nil {
+			for _, opened := range tables {
+				opened.reader.Close()
+			}
+
+			return err
+		}
+
+		tables = append(tables, newLiveTable(t, reader, path))
+	}
+
+	e.current = newVersion(e.compare, tables)
+	e.current.tombstones = m.tombstones
+	if !e.options.ReadOnly {
+		if err := e.removeObsoleteFiles(); err != nil {
+			return err
+		}
+	}
+
+	wal, info, err := openEngineWAL(e.options, e.replay)
+	if err != nil {
+		return err
+	}
+
+	info.LastSequence = e.sequence
+	e.wal = wal
+	e.recovery = info
+	return nil
+}
+
+// Replay a logged batch, skip it if it is already flushed into tables.
+func (e *lsmEngine) replay(batch *writeBatch) error {
+	if batch.LastSequence() <= e.manifest.lastSequence {
+		return nil
+	}
+
+	e.mem.Apply(batch)
+	e.sequence = batch.LastSequence()
+	return nil
+}
+
+func (e *lsmEngine) tablePath(number uint64) string {
+	return filepath.Join(e.dir, tableFileName(number))
+}
+
+// Remove tables not in manifest, which are left by an interrupted flush or compaction.
+func (e *lsmEngine) removeObsoleteFiles() error {
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return err
+	}
+
+	live := make(map[uint64]bool)
+	for _, t := range e.current.tables() {
+		live[t.meta.number] = true
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		obsolete := name == manifestFileName+".tmp"
+		if strings.HasSuffix(name, tableSuffix) {
+			number, err := strconv.ParseUint(strings.TrimSuffix(name, tableSuffix), 10, 64)
+			obsolete = err == nil && !live[number]
+		}
+
+		if obsolete {
+			if err := os.Remove(filepath.Join(e.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Get current version with a reference, caller must unref it.
+func (e *lsmEngine) currentVersion() *lsmVersion {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	e.current.ref()
+	return e.current
+}
+
+func (e *lsmEngine) Get(key []byte) ([]byte, interface{}, error) {
+	return e.get(key, maxSequence)
+}
+
+// Find the newest version of key whose sequence number <= seq.
+func (e *lsmEngine) get(key []byte, seq uint64) ([]byte, interface{}, error) {
+	e.lock.RLock()
+	if e.closed {
+		e.lock.RUnlock()
+		return nil, nil, ErrClosed
+	}
+
+	result, found := e.mem.Get(key, seq)
+	if !found && e.imm != nil {
+		result, found = e.imm.Get(key, seq)
+	}
+
+	version := e.current
+	version.ref()
+	tombstones := e.tombstones(version)
+	e.lock.RUnlock()
+	defer version.unref()
+
+	if !found {
+		var err error
+		result, found, err = version.get(key, seq)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !found || tombstones.covers(e.compare, key, result.seq, seq) {
+		return nil, nil, ErrNotFound
+	}
+
+	if result.kind == kindMerge {
+		return e.getMerged(key, seq)
+	}
+
+	value, visible := result.visible(nowOf(e.options.clock()))
+	if !visible {
+		return nil, nil, ErrNotFound
+	}
+
+	return value, result.object, nil
+}
+
+// Find value of key whose newest version is an operand, by folding operands with an iterator.
+func (e *lsmEngine) getMerged(key []byte, seq uint64) ([]byte, interface{}, error) {
+	iter := e.iterator(seq)
+	iter.Seek(key)
+	var value []byte
+	err := ErrNotFound
+	if iter.Valid() && e.compare(iter.Key(), key) == 0 {
+		value, err = append([]byte{}, iter.Value()...), nil
+	}
+
+	if errIter := iter.Error(); errIter != nil {
+		err = errIter
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return value, nil, nil
+}
+
+// Values are never modified once applied, they are valid after lock is released.
+func (e *lsmEngine) View(key []byte, fn func(value []byte, object interface{}) error) error {
+	value, object, err := e.Get(key)
+	if err != nil {
+		return err
+	}
+
+	return fn(value, object)
+}
+
+func (e *lsmEngine) view(key []byte, seq uint64, fn func(value []byte, object interface{}) error) error {
+	value, object, err := e.get(key, seq)
+	if err != nil {
+		return err
+	}
+
+	return fn(value, object)
+}
+
+// Versions visible to snapshots are kept by compactions until snapshots are released.
+func (e *lsmEngine) Snapshot() (engineSnapshot, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.closed {
+		return nil, ErrClosed
+	}
+
+	s := newSequenceSnapshot(e.snapshots, e.sequence, e.view)
+	s.iterator = e.iterator
+	return s, nil
+}
+
+func (e *lsmEngine) iterator(seq uint64) engineIterator {
+	e.lock.RLock()
+	closed := e.closed
+	e.lock.RUnlock()
+	if closed {
+		return &emptyIterator{err: ErrClosed}
+	}
+
+	iter, tombstones := e.newInternalIterator()
+	result := newVersionIterator(iter, e.compare, seq, nowOf(e.options.clock()))
+	result.tombstones = tombstones
+	return result
+}
+
+// Range tombstones of memtables and version, caller must hold lock.
+func (e *lsmEngine) tombstones(version *lsmVersion) rangeTombstones {
+	var tombstones rangeTombstones
+	tombstones = append(tombstones, e.mem.rangeDels...)
+	if e.imm != nil {
+		tombstones = append(tombstones, e.imm.rangeDels...)
+	}
+
+	return append(tombstones, version.tombstones...)
+}
+
+func (e *lsmEngine) Apply(batch *writeBatch) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	if err := e.makeRoomForWrite(false); err != nil {
+		return err
+	}
+
+	if err := e.wal.Append(batch.Encode()); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	e.mem.Apply(batch)
+	e.sequence = batch.LastSequence()
+	e.lock.Unlock()
+	return nil
+}
+
+func (e *lsmEngine) memtableSize() int {
+	if e.options.MemtableSize <= 0 {
+		return lsmDefaultMemtableSize
+	}
+
+	return e.options.MemtableSize
+}
+
+// Seal memtable and start flushing it if it is full, or force is true. Wait if the previous
+// immutable memtable is still being flushed. Caller must hold writeLock.
+func (e *lsmEngine) makeRoomForWrite(force bool) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for {
+		if e.bgErr != nil {
+			return e.bgErr
+		}
+
+		if e.mem.Len() <= 0 || (!force && e.mem.Size() < e.memtableSize()) {
+			return nil
+		}
+
+		if e.flushing {
+			e.flushCond.Wait()
+			continue
+		}
+
+		segment, err := e.wal.Rotate()
+		if err != nil {
+			return err
+		}
+
+		e.mem.logSegment = segment
+		e.imm = e.mem
+		e.flushing = true
+		e.mem = newMemtable(e.compare)
+		go e.flushMemtable(e.imm)
+		return nil
+	}
+}
+
+// Wait until no memtable is being flushed, return error of background flush. Caller must hold
+// lock.
+func (e *lsmEngine) waitForFlush() error {
+	for e.flushing && e.bgErr == nil {
+		e.flushCond.Wait()
+	}
+
+	return e.bgErr
+}
+
+func (e *lsmEngine) newTableNumber() uint64 {
+	e.manifestLock.Lock()
+	defer e.manifestLock.Unlock()
+
+	number := e.manifest.nextFileNumber
+	e.manifest.nextFileNumber++
+	return number
+}
+
+// Record edit in manifest and install a new version. All added tables are dropped if manifest
+// can not be saved.
+func (e *lsmEngine) logAndApply(edit *versionEdit) error {
+	e.manifestLock.Lock()
+	defer e.manifestLock.Unlock()
+
+	next := &manifest{
+		nextFileNumber: e.manifest.nextFileNumber,
+		lastSequence:   e.manifest.lastSequence,
+	}
+
+	if edit.lastSequence > next.lastSequence {
+		next.lastSequence = edit.lastSequence
+	}
+
+	for _, t := range e.manifest.tables {
+		if !edit.deleted[t.number] {
+			next.tables = append(next.tables, t)
+		}
+	}
+
+	for _, t := range edit.added {
+		next.tables = append(next.tables, t.meta)
+	}
+
+	next.tombstones = e.manifest.tombstones.apply(edit)
+
+	if err := saveManifest(e.dir, next, e.options.KeyProvider); err != nil {
+		for _, t := range edit.added {
+			t.markObsolete()
+			t.ref()
+			t.unref()
+		}
+
+		return err
+	}
+
+	e.manifest = next
+	e.lock.Lock()
+	old := e.current
+	e.current = old.apply(edit)
+	// Entries of a flushed memtable must not be seen in both memtable and its table.
+	if edit.flushed != nil && e.imm == edit.flushed {
+		e.imm = nil
+	}
+
+	e.lock.Unlock()
+	old.unref()
+	return nil
+}
+
+func (e *lsmEngine) flushMemtable(imm *memtable) {
+	err := e.flush(imm)
+
+	e.lock.Lock()
+	if err != nil {
+		e.bgErr = err
+	}
+
+	e.flushing = false
+	e.flushCond.Broadcast()
+	e.lock.Unlock()
+
+	if err == nil {
+		e.maybeScheduleCompaction()
+	}
+}
+
+// Write memtable into a level 0 table, record it in manifest, and remove write-ahead log
+// segments covered by it.
+func (e *lsmEngine) flush(imm *memtable) error {
+	edit := &versionEdit{
+		lastSequence: imm.maxSeq,
+		tombstones:   imm.rangeDels,
+		flushed:      imm,
+	}
+
+	// A memtable of range tombstones only makes no table.
+	if imm.list.Len() > 0 {
+		output, err := e.newOutputTable(0)
+		if err != nil {
+			return err
+		}
+
+		iter := imm.Iterator()
+		for iter.SeekToFirst(); iter.Valid() && err == nil; iter.Next() {
+			err = output.Add(iter.Key(), iter.Value())
+		}
+
+		var table *liveTable
+		if err == nil {
+			table, err = output.Finish()
+		}
+
+		if err != nil {
+			output.Abandon()
+			return err
+		}
+
+		edit.added = []*liveTable{table}
+	}
+
+	if err := e.logAndApply(edit); err != nil {
+		return err
+	}
+
+	return e.wal.RemoveBefore(imm.logSegment)
+}
+
+// Flush memtable into a table, and wait until it is done.
+func (e *lsmEngine) Flush() error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	return e.flushAndWait()
+}
+
+// Caller must hold writeLock.
+func (e *lsmEngine) flushAndWait() error {
+	if err := e.makeRoomForWrite(true); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	err := e.waitForFlush()
+	e.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return e.wal.Sync()
+}
+
+func (e *lsmEngine) LastSequence() uint64 {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.sequence
+}
+
+func (e *lsmEngine) Recovery() RecoveryInfo {
+	return e.recovery
+}
+
+// Number of live tables.
+func (e *lsmEngine) TableCount() int {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.current.tableCount()
+}
+
+// Flush memtable, and link all live tables into dir along with a manifest of them. Writes are
+// blocked until memtable is flushed, tables are kept by the current version until they are linked.
+func (e *lsmEngine) Checkpoint(dir string) (uint64, error) {
+	e.writeLock.Lock()
+	if e.closed {
+		e.writeLock.Unlock()
+		return 0, ErrClosed
+	}
+
+	if err := e.flushAndWait(); err != nil {
+		e.writeLock.Unlock()
+		return 0, err
+	}
+
+	// Manifest and version are changed together by logAndApply.
+	e.manifestLock.Lock()
+	m := *e.manifest
+	v := e.currentVersion()
+	e.manifestLock.Unlock()
+	seq := e.LastSequence()
+	e.writeLock.Unlock()
+	defer v.unref()
+
+	// Memtable is empty, all batches are in tables.
+	m.lastSequence = seq
+	for _, t := range v.tables() {
+		if err := linkFile(t.path, filepath.Join(dir, filepath.Base(t.path))); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := saveManifest(dir, &m, e.options.KeyProvider); err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+// Verify manifest, all live tables and write-ahead log. Tables are kept by the current version
+// until they are scanned.
+func (e *lsmEngine) Verify(report *VerifyReport) error {
+	e.lock.RLock()
+	if e.closed {
+		e.lock.RUnlock()
+		return ErrClosed
+	}
+
+	version := e.current
+	version.ref()
+	e.lock.RUnlock()
+	defer version.unref()
+
+	if err := verifyManifest(e.dir, e.options.KeyProvider, report); err != nil {
+		return err
+	}
+
+	for _, t := range version.tables() {
+		report.Files++
+		verifyTable(t.reader, tableFileName(t.meta.number), report, nil)
+	}
+
+	return verifyWAL(filepath.Join(e.dir, walDirName), e.options.KeyProvider, report, nil)
+}
+
+// Make an iterator over all entries of memtables and tables, along with range tombstones of them.
+func (e *lsmEngine) newInternalIterator() (internalIterator, rangeTombstones) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	mem := &lockedIterator{
+		internalIterator: e.mem.Iterator(),
+		lock:             &e.lock,
+	}
+
+	iterators := []internalIterator{mem}
+	if e.imm != nil {
+		iterators = append(iterators, e.imm.Iterator())
+	}
+
+	version := e.current
+	version.ref()
+	for _, t := range version.tables() {
+		iterators = append(iterators, t.reader.Iterator())
+	}
+
+	iterators = append(iterators, &versionReleaser{version: version})
+	return newMergingIterator(internalCompare(e.compare), iterators), e.tombstones(version)
+}
+
+// An empty iterator releases a version when it is closed.
+type versionReleaser struct {
+	emptyIterator
+	version *lsmVersion
+}
+
+func (r *versionReleaser) Close() error {
+	if r.version != nil {
+		r.version.unref()
+		r.version = nil
+	}
+
+	return nil
+}
+
+// Close engine after the running flush and compactions are done, data in memtable are recovered
+// from write-ahead log when engine is opened again.
+func (e *lsmEngine) Close() error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	if e.closed {
+		return ErrClosed
+	}
+
+	e.lock.Lock()
+	flushErr := e.waitForFlush()
+	e.closed = true
+	atomic.StoreInt32(&e.compactions.stopping, 1)
+	for e.compactions.running > 0 {
+		e.compactionCond.Wait()
+	}
+
+	current := e.current
+	e.lock.Unlock()
+
+	err := e.wal.Close()
+	current.unref()
+	if err == nil && flushErr != nil {
+		err = flushErr
+	}
+
+	return err
+}
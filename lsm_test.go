@@ -0,0 +1,251 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func openTestLSM(t *testing.T, dir string) *DB {
+	options := Options{
+		Dir:          dir,
+		Engine:       EngineLSM,
+		SyncPolicy:   SyncNever,
+		MemtableSize: 4 << 10,
+		BlockSize:    512,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open lsm database failed: %v", err)
+	}
+
+	return db
+}
+
+func lsmEngineOf(db *DB) *lsmEngine {
+	return db.engine.(*lsmEngine)
+}
+
+func TestLSMRequiresDir(t *testing.T) {
+	if _, err := Open(Options{Engine: EngineLSM}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLSMFlushAndRead(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestLSM(t, dir)
+
+	const count = 2000
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := db.Put(key, []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	for i := 0; i < count; i += 3 {
+		db.Delete([]byte(fmt.Sprintf("key-%05d", i)))
+	}
+
+	for i := 0; i < count; i += 5 {
+		db.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte("overwritten"))
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if n := lsmEngineOf(db).TableCount(); n < 2 {
+		t.Errorf("memtable should be flushed into several tables, got %d", n)
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < count; i++ {
+			key := []byte(fmt.Sprintf("key-%05d", i))
+			value, err := db.Get(key)
+			switch {
+			case i%5 == 0:
+				if err != nil || string(value) != "overwritten" {
+					t.Errorf("unexpected result of %s: %s, %v", key, value, err)
+				}
+
+			case i%3 == 0:
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("unexpected result of %s: %s, %v", key, value, err)
+				}
+
+			default:
+				if err != nil || string(value) != fmt.Sprintf("value-%d", i) {
+					t.Errorf("unexpected result of %s: %s, %v", key, value, err)
+				}
+			}
+		}
+	}
+
+	check(db)
+	sequence := db.Sequence()
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	db = openTestLSM(t, dir)
+	defer db.Close()
+
+	if db.Sequence() != sequence {
+		t.Errorf("unexpected sequence: %d <=> %d", db.Sequence(), sequence)
+	}
+
+	check(db)
+}
+
+func TestLSMRecoverMemtableFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestLSM(t, dir)
+	for i := 0; i < 500; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+	}
+
+	tables := lsmEngineOf(db).TableCount()
+	sequence := db.Sequence()
+	db.Close()
+
+	db = openTestLSM(t, dir)
+	defer db.Close()
+
+	// A running flush is finished by Close, there may be one more table.
+	if lsmEngineOf(db).TableCount() < tables || db.Sequence() != sequence {
+		t.Errorf("unexpected state: tables %d <=> %d, sequence %d <=> %d",
+			lsmEngineOf(db).TableCount(), tables, db.Sequence(), sequence)
+	}
+
+	info := db.Recovery()
+	if info.LastSequence != sequence || info.Records <= 0 {
+		t.Errorf("unexpected recovery info: %+v", info)
+	}
+
+	for i := 0; i < 500; i++ {
+		if has, _ := db.Has([]byte(fmt.Sprintf("key-%03d", i))); !has {
+			t.Errorf("key-%03d is lost", i)
+		}
+	}
+
+	segments := lsmEngineOf(db).wal.Segments()
+	if len(segments) > lsmEngineOf(db).TableCount()+1 {
+		t.Errorf("flushed wal segments are not removed: %v", segments)
+	}
+}
+
+func TestLSMRemoveObsoleteTables(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestLSM(t, dir)
+	db.Put([]byte("key"), []byte("value"))
+	db.Flush()
+	db.Close()
+
+	obsolete := filepath.Join(dir, tableFileName(100))
+	os.WriteFile(obsolete, []byte("left by an interrupted flush"), 0644)
+
+	db = openTestLSM(t, dir)
+	defer db.Close()
+
+	if _, err := os.Stat(obsolete); !os.IsNotExist(err) {
+		t.Errorf("obsolete table is not removed: %v", err)
+	}
+
+	if value, err := db.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("unexpected result: %s, %v", value, err)
+	}
+}
+
+func TestLSMTypedValues(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	defer db.Close()
+
+	wizards, _ := db.Collection("wizards", testWizard{})
+	albus := testWizard{
+		Name:    "Albus Dumbledore",
+		House:   "Gryffindor",
+		Born:    1881,
+		Courses: []string{"Transfiguration"},
+	}
+
+	if err := wizards.Put([]byte("albus"), &albus); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	albus.Courses[0] = "Defence Against the Dark Arts"
+	expected := testWizard{
+		Name:    "Albus Dumbledore",
+		House:   "Gryffindor",
+		Born:    1881,
+		Courses: []string{"Transfiguration"},
+	}
+
+	var got testWizard
+	if err := wizards.Get([]byte("albus"), &got); err != nil || !meta.Equal(got, expected) {
+		t.Errorf("unexpected result from memtable: %#v, %v", got, err)
+	}
+
+	db.Flush()
+	got = testWizard{}
+	if err := wizards.Get([]byte("albus"), &got); err != nil || !meta.Equal(got, expected) {
+		t.Errorf("unexpected result from table: %#v, %v", got, err)
+	}
+}
+
+func TestLSMConcurrentAccess(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				key := []byte(fmt.Sprintf("w%d-%03d", w, i))
+				if err := db.Put(key, key); err != nil {
+					t.Errorf("put failed: %v", err)
+					return
+				}
+
+				value, err := db.Get(key)
+				if err != nil || string(value) != string(key) {
+					t.Errorf("unexpected result of %s: %s, %v", key, value, err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+}
+
+func TestLSMClosed(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	engine := lsmEngineOf(db)
+	db.Close()
+
+	if _, _, err := engine.Get([]byte("key")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := engine.Apply(putBatch("key", "value")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := engine.Flush(); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := engine.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
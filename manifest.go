@@ -0,0 +1,239 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+)
+
+// Manifest records live tables of an LSM engine. It is rewritten as a whole into a temporary
+// file and renamed, so that a manifest is either the old one or the new one after a crash. An
+// encrypted manifest starts with key envelope, followed by a record sealed as a WAL record.
+// Manifests of version 1 have no range tombstones.
+const (
+	manifestFileName = "MANIFEST"
+	manifestVersion  = 2
+)
+
+type manifest struct {
+	nextFileNumber uint64
+	// All entries whose sequence number <= lastSequence are in tables.
+	lastSequence uint64
+	tables       []*tableMeta
+	tombstones   rangeTombstones
+}
+
+func appendUvarint(buffer []byte, v uint64) []byte {
+	var u [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(u[:], v)
+	return append(buffer, u[:n]...)
+}
+
+func appendVarint(buffer []byte, v int64) []byte {
+	var u [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(u[:], v)
+	return append(buffer, u[:n]...)
+}
+
+func appendLengthPrefixed(buffer []byte, data []byte) []byte {
+	buffer = appendUvarint(buffer, uint64(len(data)))
+	return append(buffer, data...)
+}
+
+// Encode manifest as:
+//
+//	version          uvarint
+//	next file number uvarint
+//	last sequence    uvarint
+//	table count      uvarint
+//	tables           [level, number, size uvarint, smallest, largest length prefixed] * count
+//	tombstone count  uvarint
+//	tombstones       [start, end length prefixed, seq uvarint] * count
+func (m *manifest) Encode() []byte {
+	buffer := make([]byte, 0, 64+len(m.tables)*64)
+	buffer = appendUvarint(buffer, manifestVersion)
+	buffer = appendUvarint(buffer, m.nextFileNumber)
+	buffer = appendUvarint(buffer, m.lastSequence)
+	buffer = appendUvarint(buffer, uint64(len(m.tables)))
+	for _, t := range m.tables {
+		buffer = appendUvarint(buffer, uint64(t.level))
+		buffer = appendUvarint(buffer, t.number)
+		buffer = appendUvarint(buffer, t.size)
+		buffer = appendLengthPrefixed(buffer, t.smallest)
+		buffer = appendLengthPrefixed(buffer, t.largest)
+	}
+
+	buffer = appendUvarint(buffer, uint64(len(m.tombstones)))
+	for _, t := range m.tombstones {
+		buffer = appendLengthPrefixed(buffer, t.start)
+		buffer = appendLengthPrefixed(buffer, t.end)
+		buffer = appendUvarint(buffer, t.seq)
+	}
+
+	return buffer
+}
+
+// Read uvarints from data in order, ok is false if any of them is invalid.
+type uvarintReader struct {
+	data []byte
+	ok   bool
+}
+
+func (r *uvarintReader) Uvarint() uint64 {
+	if !r.ok {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.ok = false
+		return 0
+	}
+
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *uvarintReader) Bytes() []byte {
+	if !r.ok {
+		return nil
+	}
+
+	data, rest, ok := readLengthPrefixed(r.data)
+	if !ok {
+		r.ok = false
+		return nil
+	}
+
+	r.data = rest
+	return append([]byte{}, data...)
+}
+
+func decodeManifest(data []byte) (*manifest, error) {
+	r := &uvarintReader{data: data, ok: true}
+	version := r.Uvarint()
+	if r.ok && version != 1 && version != manifestVersion {
+		return nil, WrapError(ErrCorrupted, "unsupported manifest version %d", version)
+	}
+
+	m := &manifest{
+		nextFileNumber: r.Uvarint(),
+		lastSequence:   r.Uvarint(),
+	}
+
+	count := r.Uvarint()
+	if count > uint64(len(r.data)) {
+		return nil, WrapError(ErrCorrupted, "invalid manifest table count %d", count)
+	}
+
+	for i := uint64(0); i < count && r.ok; i++ {
+		t := &tableMeta{
+			level:    int(r.Uvarint()),
+			number:   r.Uvarint(),
+			size:     r.Uvarint(),
+			smallest: r.Bytes(),
+			largest:  r.Bytes(),
+		}
+
+		m.tables = append(m.tables, t)
+	}
+
+	if version > 1 {
+		count = r.Uvarint()
+		if count > uint64(len(r.data)) {
+			return nil, WrapError(ErrCorrupted, "invalid manifest tombstone count %d", count)
+		}
+
+		for i := uint64(0); i < count && r.ok; i++ {
+			t := rangeTombstone{
+				start: r.Bytes(),
+				end:   r.Bytes(),
+				seq:   r.Uvarint(),
+			}
+
+			m.tombstones = append(m.tombstones, t)
+		}
+	}
+
+	if !r.ok || len(r.data) > 0 {
+		return nil, WrapError(ErrCorrupted, "invalid manifest")
+	}
+
+	return m, nil
+}
+
+// Load manifest in dir, return nil without error if there is no manifest. keys is required if
+// manifest is encrypted.
+func loadManifest(dir string, keys KeyProvider) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+
+	} else if err != nil {
+		return nil, err
+	}
+
+	var c *fileCipher
+	offset, encrypted := envelopeSize(data)
+	if encrypted {
+		if c, err = openEnvelope(data, keys, manifestFileName); err != nil {
+			return nil, err
+		}
+	}
+
+	payload, size, ok := decodeWALRecord(data[offset:])
+	if !ok || offset+size != len(data) {
+		return nil, WrapError(ErrCorrupted, "manifest checksum mismatch")
+	}
+
+	if c != nil {
+		if payload, err = c.open(nil, uint64(offset), payload); err != nil {
+			return nil, WrapError(ErrDecryption, "%s cannot be decrypted", manifestFileName)
+		}
+	}
+
+	return decodeManifest(payload)
+}
+
+// Save manifest atomically, in a checksummed record the same as write-ahead log. Manifest is
+// encrypted by a new data key if keys is not nil.
+func saveManifest(dir string, m *manifest, keys KeyProvider) error {
+	var envelope []byte
+	payload := m.Encode()
+	if keys != nil {
+		c, err := newFileCipher(keys)
+		if err != nil {
+			return err
+		}
+
+		envelope = c.envelope
+		payload = c.seal(nil, uint64(len(envelope)), payload)
+	}
+
+	path := filepath.Join(dir, manifestFileName)
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(envelope, encodeWALRecord(payload)...))
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	if err := os.Rename(temp, path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
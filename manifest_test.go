@@ -0,0 +1,96 @@
+package pinkis
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func TestManifestSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	if m, err := loadManifest(dir, nil); m != nil || err != nil {
+		t.Errorf("unexpected result: %v, %v", m, err)
+	}
+
+	m := &manifest{
+		nextFileNumber: 8,
+		lastSequence:   1998,
+		tables: []*tableMeta{
+			{level: 0, number: 5, size: 4096, smallest: []byte("a"), largest: []byte("m")},
+			{level: 1, number: 7, size: 8192, smallest: []byte("n"), largest: []byte("z")},
+		},
+		tombstones: rangeTombstones{
+			{start: []byte("dudley"), end: []byte("petunia"), seq: 1991},
+		},
+	}
+
+	if err := saveManifest(dir, m, nil); err != nil {
+		t.Fatalf("save manifest failed: %v", err)
+	}
+
+	got, err := loadManifest(dir, nil)
+	if err != nil {
+		t.Fatalf("load manifest failed: %v", err)
+	}
+
+	if got.nextFileNumber != 8 || got.lastSequence != 1998 || len(got.tables) != 2 ||
+		!meta.Equal(got.tombstones, m.tombstones) {
+		t.Fatalf("unexpected manifest: %+v", got)
+	}
+
+	for i, table := range got.tables {
+		expected := m.tables[i]
+		if table.level != expected.level || table.number != expected.number ||
+			table.size != expected.size || string(table.smallest) != string(expected.smallest) ||
+			string(table.largest) != string(expected.largest) {
+			t.Errorf("tables[%d] = %+v <=> %+v", i, table, expected)
+		}
+	}
+}
+
+func TestManifestVersion1(t *testing.T) {
+	m := &manifest{
+		nextFileNumber: 3,
+		lastSequence:   1991,
+		tables: []*tableMeta{
+			{level: 0, number: 2, size: 4096, smallest: []byte("harry"), largest: []byte("ron")},
+		},
+	}
+
+	// Manifests of version 1 end after tables, without range tombstones.
+	data := m.Encode()
+	data[0] = 1
+	got, err := decodeManifest(data[:len(data)-1])
+	if err != nil || got.lastSequence != 1991 || len(got.tables) != 1 || len(got.tombstones) != 0 {
+		t.Errorf("unexpected manifest: %+v, %v", got, err)
+	}
+
+	if _, err := decodeManifest(data); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCorruptedManifest(t *testing.T) {
+	dir := t.TempDir()
+	saveManifest(dir, &manifest{nextFileNumber: 1}, nil)
+
+	path := filepath.Join(dir, manifestFileName)
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	if _, err := loadManifest(dir, nil); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := decodeManifest([]byte{manifestVersion, 1, 1, 5}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := decodeManifest([]byte{42}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,407 @@
+package pinkis
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// An engine keeps all data in an ordered memtable in memory. If a directory is given, all batches
+// are logged in write-ahead log and replayed when engine is opened. Overwritten and deleted
+// versions are kept only while a snapshot may read them.
+type memoryEngine struct {
+	// writeLock serializes writers and checkpoints.
+	writeLock sync.Mutex
+	lock      sync.RWMutex
+	mem       *memtable
+	wal       *writeAheadLog
+	sequence  uint64
+	recovery  RecoveryInfo
+	snapshots *snapshotList
+	// User keys with more than one version.
+	versioned map[string]bool
+	clock     Clock
+}
+
+func newMemoryEngine() *memoryEngine {
+	e := &memoryEngine{
+		mem:       newMemtable(bytewiseCompare),
+		snapshots: newSnapshotList(),
+		versioned: make(map[string]bool),
+		clock:     systemClock{},
+	}
+
+	return e
+}
+
+func openMemoryEngine(options Options) (*memoryEngine, error) {
+	e := newMemoryEngine()
+	e.clock = options.clock()
+	if len(options.Dir) <= 0 {
+		return e, nil
+	}
+
+	wal, info, err := openEngineWAL(options, e.apply)
+	if err != nil {
+		return nil, err
+	}
+
+	info.LastSequence = e.sequence
+	e.wal = wal
+	e.recovery = info
+	return e, nil
+}
+
+func (e *memoryEngine) get(key []byte, seq uint64) ([]byte, interface{}, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.mem == nil {
+		return nil, nil, ErrClosed
+	}
+
+	result, found := e.mem.Get(key, seq)
+	if !found {
+		return nil, nil, ErrNotFound
+	}
+
+	value, visible := result.visible(nowOf(e.clock))
+	if !visible {
+		return nil, nil, ErrNotFound
+	}
+
+	return value, result.object, nil
+}
+
+func (e *memoryEngine) Get(key []byte) ([]byte, interface{}, error) {
+	return e.get(key, maxSequence)
+}
+
+// Remove versions of key invisible to all readers, which read at sequence numbers in readers,
+// in descending order. Caller must hold lock.
+func (e *memoryEngine) collect(key []byte, readers []uint64) {
+	var kept []parsedInternalKey
+	var obsolete [][]byte
+	newer := uint64(maxSequence) + 1
+	j := 0
+	node := e.mem.list.Seek(makeLookupKey(key, maxSequence))
+	for ; node != nil; node = node.Next() {
+		parsed, _ := parseInternalKey(node.key)
+		if bytewiseCompare(parsed.key, key) != 0 {
+			break
+		}
+
+		// A version is visible to readers in [seq, seq of newer version).
+		for j < len(readers) && readers[j] >= newer {
+			j++
+		}
+
+		if j < len(readers) && readers[j] >= parsed.seq {
+			kept = append(kept, parsed)
+
+		} else {
+			obsolete = append(obsolete, node.key)
+		}
+
+		newer = parsed.seq
+	}
+
+	// Tombstones older than all kept puts hide nothing.
+	for len(kept) > 0 && kept[len(kept)-1].kind == kindDelete {
+		last := kept[len(kept)-1]
+		obsolete = append(obsolete, makeInternalKey(last.key, last.seq, last.kind))
+		kept = kept[:len(kept)-1]
+	}
+
+	for _, ikey := range obsolete {
+		e.mem.list.Remove(ikey)
+	}
+
+	if len(kept) > 1 {
+		e.versioned[string(key)] = true
+
+	} else {
+		delete(e.versioned, string(key))
+	}
+}
+
+// Fold operands of batch onto values of keys, before any entry is applied, so that nothing is
+// applied if any fails. Operands absorbed by expired values are left as they are, and skipped when
+// applied. Caller must hold lock.
+func (e *memoryEngine) fold(batch *writeBatch) ([]batchEntry, error) {
+	entries := batch.entries
+	copied := false
+	now := nowOf(e.clock)
+	latest := make(map[string]int)
+	var ranges rangeTombstones
+	for i, entry := range batch.entries {
+		if entry.kind == kindDeleteRange {
+			ranges = append(ranges, rangeTombstone{start: entry.key, end: entry.value, seq: uint64(i) + 1})
+			continue
+		}
+
+		if entry.kind != kindMerge {
+			latest[string(entry.key)] = i
+			continue
+		}
+
+		kind, value := kindDelete, []byte(nil)
+		seq := uint64(0)
+		if j, written := latest[string(entry.key)]; written {
+			kind, value = entries[j].kind, entries[j].value
+			seq = uint64(j) + 1
+
+		} else if result, found := e.mem.Get(entry.key, maxSequence); found {
+			kind, value = result.kind, result.value
+		}
+
+		if ranges.covers(bytewiseCompare, entry.key, seq, maxSequence) {
+			kind, value = kindDelete, nil
+		}
+
+		merged, mergedValue, ok, err := mergeEntry(kind, value, [][]byte{entry.value}, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if !copied {
+			entries = append([]batchEntry{}, batch.entries...)
+			copied = true
+		}
+
+		entries[i] = batchEntry{kind: merged, key: entry.key, value: mergedValue}
+		latest[string(entry.key)] = i
+	}
+
+	return entries, nil
+}
+
+// Fold and apply batch, for batches replayed from write-ahead log.
+func (e *memoryEngine) apply(batch *writeBatch) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.mem == nil {
+		return ErrClosed
+	}
+
+	entries, err := e.fold(batch)
+	if err != nil {
+		return err
+	}
+
+	e.applyEntries(batch, entries)
+	return nil
+}
+
+// Apply entries of batch folded, caller must hold lock.
+func (e *memoryEngine) applyEntries(batch *writeBatch, entries []batchEntry) {
+	// Range tombstones are applied as deletes of keys in range.
+	var touched [][]byte
+	for i, entry := range entries {
+		seq := batch.seq + uint64(i)
+		switch entry.kind {
+		case kindDeleteRange:
+			touched = append(touched, e.mem.DeleteKeys(seq, entry.key, entry.value)...)
+
+		case kindMerge:
+
+		default:
+			e.mem.Add(seq, entry.kind, entry.key, entry.value, entry.object)
+			touched = append(touched, entry.key)
+		}
+	}
+
+	e.sequence = batch.LastSequence()
+	readers := e.snapshots.sequences(e.sequence)
+	for _, key := range touched {
+		e.collect(key, readers)
+	}
+}
+
+// Values are never modified once applied, they are valid after lock is released.
+func (e *memoryEngine) View(key []byte, fn func(value []byte, object interface{}) error) error {
+	value, object, err := e.Get(key)
+	if err != nil {
+		return err
+	}
+
+	return fn(value, object)
+}
+
+func (e *memoryEngine) view(key []byte, seq uint64, fn func(value []byte, object interface{}) error) error {
+	value, object, err := e.get(key, seq)
+	if err != nil {
+		return err
+	}
+
+	return fn(value, object)
+}
+
+func (e *memoryEngine) Snapshot() (engineSnapshot, error) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.mem == nil {
+		return nil, ErrClosed
+	}
+
+	s := newSequenceSnapshot(e.snapshots, e.sequence, e.view)
+	s.iterator = e.iterator
+	s.release = e.release
+	return s, nil
+}
+
+func (e *memoryEngine) iterator(seq uint64) engineIterator {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.mem == nil {
+		return &emptyIterator{err: ErrClosed}
+	}
+
+	iter := &lockedIterator{
+		internalIterator: e.mem.Iterator(),
+		lock:             &e.lock,
+	}
+
+	return newVersionIterator(iter, bytewiseCompare, seq, nowOf(e.clock))
+}
+
+// Collect versions kept for released snapshots.
+func (e *memoryEngine) release() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.mem == nil {
+		return
+	}
+
+	readers := e.snapshots.sequences(e.sequence)
+	for key := range e.versioned {
+		e.collect([]byte(key), readers)
+	}
+}
+
+func (e *memoryEngine) Apply(batch *writeBatch) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	// Memtable is changed by writers only, which are serialized by write lock.
+	e.lock.RLock()
+	closed := e.mem == nil
+	var entries []batchEntry
+	var err error
+	if !closed {
+		entries, err = e.fold(batch)
+	}
+
+	e.lock.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if e.wal != nil {
+		if err := e.wal.Append(batch.Encode()); err != nil {
+			return err
+		}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.mem == nil {
+		return ErrClosed
+	}
+
+	e.applyEntries(batch, entries)
+	return nil
+}
+
+func (e *memoryEngine) Flush() error {
+	if e.wal == nil {
+		return nil
+	}
+
+	return e.wal.Sync()
+}
+
+// Nothing to compact in memory.
+func (e *memoryEngine) CompactRange(start []byte, end []byte) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.mem == nil {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+func (e *memoryEngine) LastSequence() uint64 {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.sequence
+}
+
+func (e *memoryEngine) Recovery() RecoveryInfo {
+	return e.recovery
+}
+
+// Verify write-ahead log, nothing to verify if engine is in memory only.
+func (e *memoryEngine) Verify(report *VerifyReport) error {
+	e.lock.RLock()
+	closed := e.mem == nil
+	e.lock.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	if e.wal == nil {
+		return nil
+	}
+
+	return verifyWAL(e.wal.options.dir, e.wal.options.keys, report, nil)
+}
+
+// Copy write-ahead log into dir, writes are blocked until it is copied. An engine in memory only
+// has no checkpoint.
+func (e *memoryEngine) Checkpoint(dir string) (uint64, error) {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	if e.wal == nil {
+		return 0, WrapError(ErrInvalidOptions, "checkpoint requires a database in a directory")
+	}
+
+	seq := e.LastSequence()
+	if err := e.wal.CopyTo(filepath.Join(dir, walDirName)); err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+func (e *memoryEngine) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.mem == nil {
+		return ErrClosed
+	}
+
+	e.mem = nil
+	if e.wal != nil {
+		return e.wal.Close()
+	}
+
+	return nil
+}
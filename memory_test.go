@@ -0,0 +1,80 @@
+package pinkis
+
+import (
+	"errors"
+	"testing"
+)
+
+func putBatch(key string, value string) *writeBatch {
+	batch := &writeBatch{}
+	batch.Put([]byte(key), []byte(value))
+	return batch
+}
+
+func deleteBatch(key string) *writeBatch {
+	batch := &writeBatch{}
+	batch.Delete([]byte(key))
+	return batch
+}
+
+func TestMemoryEngine(t *testing.T) {
+	e := newMemoryEngine()
+
+	batch := putBatch("ron", "weasley")
+	batch.seq = 1
+	if err := e.Apply(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value, _, err := e.Get([]byte("ron"))
+	if err != nil || string(value) != "weasley" {
+		t.Errorf("unexpected result: %s, %v", value, err)
+	}
+
+	batch = deleteBatch("ron")
+	batch.seq = 2
+	if err := e.Apply(batch); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, _, err := e.Get([]byte("ron")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, _, err := e.Get([]byte("ron")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := e.Apply(putBatch("ron", "")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := e.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMemoryEngineApplyBatch(t *testing.T) {
+	e := newMemoryEngine()
+	defer e.Close()
+
+	batch := &writeBatch{}
+	batch.Put([]byte("fred"), []byte("weasley"))
+	batch.Put([]byte("george"), []byte("weasley"))
+	batch.Delete([]byte("fred"))
+	if err := e.Apply(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, err := e.Get([]byte("fred")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if value, _, err := e.Get([]byte("george")); err != nil || string(value) != "weasley" {
+		t.Errorf("unexpected result: %s, %v", value, err)
+	}
+}
@@ -0,0 +1,181 @@
+package pinkis
+
+// Result of looking up a user key in a sorted run.
+type lookupResult struct {
+	seq    uint64
+	kind   entryKind
+	value  []byte
+	object interface{}
+}
+
+// Sorted run in memory, keyed by internal keys. A memtable is NOT safe for concurrent use, writers
+// must be serialized against readers. Objects of entries are decoded from their values by
+// Collection.encode and never handed out, so mutation by callers never reaches the sorted run.
+type memtable struct {
+	list    *skiplist
+	compare compareFunc
+	maxSeq  uint64
+	// Range tombstones applied, they are kept in manifest when memtable is flushed.
+	rangeDels rangeTombstones
+	rangeSize int
+
+	// Id of the first write-ahead log segment NOT covered by this memtable.
+	logSegment uint64
+}
+
+func newMemtable(compare compareFunc) *memtable {
+	m := &memtable{
+		list:    newSkiplist(internalCompare(compare)),
+		compare: compare,
+	}
+
+	return m
+}
+
+func (m *memtable) Add(seq uint64, kind entryKind, key []byte, value []byte, object interface{}) {
+	m.list.Put(makeInternalKey(key, seq, kind), value, object)
+	if seq > m.maxSeq {
+		m.maxSeq = seq
+	}
+}
+
+func (m *memtable) Apply(batch *writeBatch) {
+	for i, entry := range batch.entries {
+		seq := batch.seq + uint64(i)
+		if entry.kind == kindDeleteRange {
+			m.AddRange(seq, entry.key, entry.value)
+			continue
+		}
+
+		m.Add(seq, entry.kind, entry.key, entry.value, entry.object)
+	}
+
+	// An empty batch takes a sequence number as well.
+	if last := batch.LastSequence(); last > m.maxSeq {
+		m.maxSeq = last
+	}
+}
+
+// Add a range tombstone deleting keys in [start, end) older than seq.
+func (m *memtable) AddRange(seq uint64, start []byte, end []byte) {
+	m.rangeDels = append(m.rangeDels, rangeTombstone{start: start, end: end, seq: seq})
+	m.rangeSize += len(start) + len(end) + internalTrailerSize
+	if seq > m.maxSeq {
+		m.maxSeq = seq
+	}
+}
+
+// Delete keys in [start, end) whose newest versions are not deletes, by deletes at seq. Return
+// keys deleted.
+func (m *memtable) DeleteKeys(seq uint64, start []byte, end []byte) [][]byte {
+	var keys [][]byte
+	var last []byte
+	for node := m.list.Seek(makeLookupKey(start, maxSequence)); node != nil; node = node.Next() {
+		parsed, _ := parseInternalKey(node.key)
+		if m.compare(parsed.key, end) >= 0 {
+			break
+		}
+
+		// The first entry of a user key is its newest version.
+		if last != nil && m.compare(parsed.key, last) == 0 {
+			continue
+		}
+
+		last = parsed.key
+		if parsed.kind != kindDelete {
+			keys = append(keys, parsed.key)
+		}
+	}
+
+	for _, key := range keys {
+		m.Add(seq, kindDelete, key, nil, nil)
+	}
+
+	if seq > m.maxSeq {
+		m.maxSeq = seq
+	}
+
+	return keys
+}
+
+// Find the newest entry of key whose sequence number <= seq.
+func (m *memtable) Get(key []byte, seq uint64) (lookupResult, bool) {
+	node := m.list.Seek(makeLookupKey(key, seq))
+	if node == nil || m.compare(internalUserKey(node.key), key) != 0 {
+		return lookupResult{}, false
+	}
+
+	parsed, _ := parseInternalKey(node.key)
+	result := lookupResult{
+		seq:    parsed.seq,
+		kind:   parsed.kind,
+		value:  node.value,
+		object: node.object,
+	}
+
+	return result, true
+}
+
+// Approximate memory used by memtable.
+func (m *memtable) Size() int {
+	return m.list.Size() + m.list.Len()*internalTrailerSize + m.rangeSize
+}
+
+// Number of entries and range tombstones.
+func (m *memtable) Len() int {
+	return m.list.Len() + len(m.rangeDels)
+}
+
+func (m *memtable) Iterator() *memtableIterator {
+	return &memtableIterator{list: m.list}
+}
+
+type memtableIterator struct {
+	list *skiplist
+	node *skipNode
+}
+
+func (i *memtableIterator) Valid() bool {
+	return i.node != nil
+}
+
+func (i *memtableIterator) SeekToFirst() {
+	i.node = i.list.First()
+}
+
+func (i *memtableIterator) SeekToLast() {
+	i.node = i.list.Last()
+}
+
+func (i *memtableIterator) Seek(key []byte) {
+	i.node = i.list.Seek(key)
+}
+
+func (i *memtableIterator) Next() {
+	i.node = i.node.Next()
+}
+
+func (i *memtableIterator) Prev() {
+	i.node = i.list.Before(i.node.key)
+}
+
+func (i *memtableIterator) Key() []byte {
+	return i.node.key
+}
+
+func (i *memtableIterator) Value() []byte {
+	return i.node.value
+}
+
+// Frozen typed value of current entry, nil if it is not put by a collection.
+func (i *memtableIterator) Object() interface{} {
+	return i.node.object
+}
+
+func (i *memtableIterator) Error() error {
+	return nil
+}
+
+func (i *memtableIterator) Close() error {
+	return nil
+}
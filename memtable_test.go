@@ -0,0 +1,122 @@
+package pinkis
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func TestMemtableVersions(t *testing.T) {
+	m := newMemtable(bytewiseCompare)
+	m.Add(1, kindPut, []byte("snape"), []byte("potions"), nil)
+	m.Add(2, kindPut, []byte("snape"), []byte("defence"), nil)
+	m.Add(3, kindDelete, []byte("snape"), nil, nil)
+	m.Add(4, kindPut, []byte("lupin"), []byte("defence"), nil)
+
+	cases := []struct {
+		key   string
+		seq   uint64
+		found bool
+		kind  entryKind
+		value string
+	}{
+		{"snape", 0, false, kindPut, ""},
+		{"snape", 1, true, kindPut, "potions"},
+		{"snape", 2, true, kindPut, "defence"},
+		{"snape", 3, true, kindDelete, ""},
+		{"snape", maxSequence, true, kindDelete, ""},
+		{"lupin", 3, false, kindPut, ""},
+		{"lupin", 4, true, kindPut, "defence"},
+		{"quirrell", maxSequence, false, kindPut, ""},
+	}
+
+	for _, c := range cases {
+		result, found := m.Get([]byte(c.key), c.seq)
+		if found != c.found {
+			t.Errorf("Get(%s, %d) found=%v, expected %v", c.key, c.seq, found, c.found)
+			continue
+		}
+
+		if found && (result.kind != c.kind || string(result.value) != c.value) {
+			t.Errorf("Get(%s, %d) = %s:%s, expected %s:%s",
+				c.key, c.seq, result.kind, result.value, c.kind, c.value)
+		}
+	}
+
+	if m.maxSeq != 4 || m.Len() != 4 {
+		t.Errorf("unexpected memtable: maxSeq=%d, len=%d", m.maxSeq, m.Len())
+	}
+}
+
+func TestMemtableIterator(t *testing.T) {
+	m := newMemtable(bytewiseCompare)
+	batch := &writeBatch{seq: 10}
+	for i := 0; i < 10; i++ {
+		batch.Put([]byte(fmt.Sprintf("key-%d", 9-i)), []byte("value"))
+	}
+
+	m.Apply(batch)
+
+	iter := m.Iterator()
+	count := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		parsed, _ := parseInternalKey(iter.Key())
+		expected := fmt.Sprintf("key-%d", count)
+		if string(parsed.key) != expected || parsed.seq != uint64(19-count) {
+			t.Errorf("unexpected entry: %s, expected %s", parsed, expected)
+		}
+
+		count++
+	}
+
+	if count != 10 || iter.Error() != nil || iter.Close() != nil {
+		t.Errorf("unexpected iteration: %d, %v", count, iter.Error())
+	}
+
+	iter.Seek(makeLookupKey([]byte("key-5"), maxSequence))
+	if !iter.Valid() || string(internalUserKey(iter.Key())) != "key-5" {
+		t.Errorf("unexpected seek result")
+	}
+}
+
+func TestMemtableFrozenObject(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	wizards, err := db.Collection("wizards", testWizard{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	m := newMemtable(bytewiseCompare)
+	wizard := testWizard{
+		Name:    "Minerva McGonagall",
+		Courses: []string{"Transfiguration"},
+	}
+
+	data, object, err := wizards.encode(wizard)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	batch := &writeBatch{seq: 1}
+	batch.PutObject([]byte("minerva"), data, object)
+
+	m.Apply(batch)
+	wizard.Courses[0] = "Divination"
+
+	result, found := m.Get([]byte("minerva"), maxSequence)
+	if !found {
+		t.Fatalf("object not found")
+	}
+
+	expected := testWizard{
+		Name:    "Minerva McGonagall",
+		Courses: []string{"Transfiguration"},
+	}
+
+	if !meta.Equal(result.object, expected) {
+		t.Errorf("unexpected object: %#v <=> %#v", result.object, expected)
+	}
+}
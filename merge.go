@@ -0,0 +1,552 @@
+package pinkis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// MergeOperator folds operands merged into a key onto its value, so that counters and lists are
+// updated without reading them. Operands are stored with name of operator as they are merged, and
+// folded when key is read, by compactions, or by engines applying them. Any run of operands may be
+// folded onto the value before it at any time, so Merge must be deterministic, and folding operands
+// one by one must give the same value as folding them at once.
+type MergeOperator interface {
+	// Name of operator stored with operands, it identifies operator after database is opened again.
+	Name() string
+	// Fold operands, oldest first, onto existing value, which is nil if key does not exist.
+	// Neither existing value nor operands may be kept or modified.
+	Merge(existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// Built-in merge operators, registered by default.
+var (
+	// Add operands to value, both are int64 encoded by EncodeInt64. A key not existing is 0.
+	Int64Add MergeOperator = int64Add{}
+	// Append operands as items to value, which is a list decoded by DecodeList.
+	ListAppend MergeOperator = listAppend{}
+)
+
+var mergeOperators = struct {
+	lock   sync.RWMutex
+	byName map[string]MergeOperator
+}{
+	byName: make(map[string]MergeOperator),
+}
+
+func init() {
+	for _, op := range []MergeOperator{Int64Add, ListAppend} {
+		mergeOperators.byName[op.Name()] = op
+	}
+}
+
+// RegisterMergeOperator makes op available to fold operands stored by name of it, name must be
+// unique. Operators must be registered before a database holding operands of them is opened.
+func RegisterMergeOperator(op MergeOperator) error {
+	mergeOperators.lock.Lock()
+	defer mergeOperators.lock.Unlock()
+
+	if len(op.Name()) <= 0 {
+		return WrapError(ErrInvalidName, "merge operator name required")
+	}
+
+	if _, found := mergeOperators.byName[op.Name()]; found {
+		return WrapError(ErrInvalidOptions, "merge operator '%s' is registered", op.Name())
+	}
+
+	mergeOperators.byName[op.Name()] = op
+	return nil
+}
+
+// Check that op is registered, so that operands of it can be folded by engines.
+func checkMergeOperator(op MergeOperator) error {
+	if op == nil {
+		return nil
+	}
+
+	if _, found := mergeOperatorOfName(op.Name()); !found {
+		return WrapError(ErrInvalidOptions, "merge operator '%s' is not registered", op.Name())
+	}
+
+	return nil
+}
+
+func mergeOperatorOfName(name string) (MergeOperator, bool) {
+	mergeOperators.lock.RLock()
+	defer mergeOperators.lock.RUnlock()
+
+	op, found := mergeOperators.byName[name]
+	return op, found
+}
+
+// Value of an entry of kindMerge, operand prefixed by name of op. Operand is checked by folding it
+// onto nothing, so that a malformed operand is never stored.
+func mergeOperand(op MergeOperator, operand []byte) ([]byte, error) {
+	if op == nil {
+		return nil, WrapError(ErrInvalidOptions, "no merge operator")
+	}
+
+	if _, err := op.Merge(nil, [][]byte{operand}); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 0, binary.MaxVarintLen64+len(op.Name())+len(operand))
+	buffer = appendLengthPrefixed(buffer, []byte(op.Name()))
+	return append(buffer, operand...), nil
+}
+
+// Fold values of entries of kindMerge, oldest first, onto existing value. Each run of operands of
+// the same operator is folded at once.
+func foldOperands(existing []byte, operands [][]byte) ([]byte, error) {
+	value := existing
+	for i := 0; i < len(operands); {
+		name, first, ok := readLengthPrefixed(operands[i])
+		if !ok {
+			return nil, WrapError(ErrCorrupted, "invalid merge operand")
+		}
+
+		run := [][]byte{first}
+		j := i + 1
+		for ; j < len(operands); j++ {
+			other, operand, ok := readLengthPrefixed(operands[j])
+			if !ok {
+				return nil, WrapError(ErrCorrupted, "invalid merge operand")
+			}
+
+			if !bytes.Equal(other, name) {
+				break
+			}
+
+			run = append(run, operand)
+		}
+
+		op, found := mergeOperatorOfName(string(name))
+		if !found {
+			return nil, WrapError(ErrInvalidOptions, "merge operator '%s' is not registered", name)
+		}
+
+		var err error
+		if value, err = op.Merge(value, run); err != nil {
+			return nil, err
+		}
+
+		i = j
+	}
+
+	return value, nil
+}
+
+// Fold operands, oldest first, onto an entry of key visible at now. Return the entry folded, which
+// expires with the entry folded onto, or false if the entry is expired. An expired value absorbs
+// operands merged onto it until it is deleted, however operands are folded.
+func mergeEntry(kind entryKind, value []byte, operands [][]byte, now int64) (entryKind, []byte, bool, error) {
+	existing, visible := visibleValue(kind, value, now)
+	if !visible && kind == kindPutExpiring {
+		return kind, nil, false, nil
+	}
+
+	merged, err := foldOperands(existing, operands)
+	if err != nil {
+		return kind, nil, false, err
+	}
+
+	if expires := expiryOf(kind, value); visible && expires != 0 {
+		return kindPutExpiring, expiringValue(merged, expires), true, nil
+	}
+
+	return kindPut, merged, true, nil
+}
+
+type int64Add struct{}
+
+func (int64Add) Name() string {
+	return "int64-add"
+}
+
+func (int64Add) Merge(existing []byte, operands [][]byte) ([]byte, error) {
+	sum := int64(0)
+	if len(existing) > 0 {
+		v, err := DecodeInt64(existing)
+		if err != nil {
+			return nil, err
+		}
+
+		sum = v
+	}
+
+	for _, operand := range operands {
+		v, err := DecodeInt64(operand)
+		if err != nil {
+			return nil, err
+		}
+
+		sum += v
+	}
+
+	return EncodeInt64(sum), nil
+}
+
+// Encode v as an operand or a value of Int64Add, 8 bytes in big endian.
+func EncodeInt64(v int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(v))
+	return data
+}
+
+// Decode an int64 encoded by EncodeInt64.
+func DecodeInt64(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, WrapError(ErrTypeMismatch, "int64 requires 8 bytes, but %d", len(data))
+	}
+
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+type listAppend struct{}
+
+func (listAppend) Name() string {
+	return "list-append"
+}
+
+func (listAppend) Merge(existing []byte, operands [][]byte) ([]byte, error) {
+	if _, err := DecodeList(existing); err != nil {
+		return nil, err
+	}
+
+	size := len(existing)
+	for _, operand := range operands {
+		size += lengthPrefixedSize(operand)
+	}
+
+	result := append(make([]byte, 0, size), existing...)
+	for _, operand := range operands {
+		result = appendLengthPrefixed(result, operand)
+	}
+
+	return result, nil
+}
+
+// Decode items of a list built by ListAppend, items refer to data.
+func DecodeList(data []byte) ([][]byte, error) {
+	var items [][]byte
+	for rest := data; len(rest) > 0; {
+		item, next, ok := readLengthPrefixed(rest)
+		if !ok {
+			return nil, WrapError(ErrTypeMismatch, "invalid item %d of list", len(items))
+		}
+
+		items = append(items, item)
+		rest = next
+	}
+
+	return items, nil
+}
+
+// FieldCombiner combines values of a field in existing value and in an operand, into value of the
+// field merged. Both values are of type of the field, result is converted to it.
+type FieldCombiner func(existing interface{}, operand interface{}) (interface{}, error)
+
+// Combiners of fields for FieldMergeOperator.
+var (
+	// The greater one of values of a bool, number, string or []byte field.
+	MaxField FieldCombiner = maxField
+	// Sum of values of a number field.
+	SumField FieldCombiner = sumField
+)
+
+func maxField(existing interface{}, operand interface{}) (interface{}, error) {
+	a, b := reflect.ValueOf(existing), reflect.ValueOf(operand)
+	if !indexable(a.Type()) || a.Type() != b.Type() {
+		return nil, WrapError(ErrTypeMismatch, "can not compare %s and %s", a.Type(), b.Type())
+	}
+
+	if bytes.Compare(appendIndexValue(nil, a), appendIndexValue(nil, b)) >= 0 {
+		return existing, nil
+	}
+
+	return operand, nil
+}
+
+func sumField(existing interface{}, operand interface{}) (interface{}, error) {
+	a, b := reflect.ValueOf(existing), reflect.ValueOf(operand)
+	if a.Type() == b.Type() {
+		switch a.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return a.Int() + b.Int(), nil
+
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return a.Uint() + b.Uint(), nil
+
+		case reflect.Float32, reflect.Float64:
+			return a.Float() + b.Float(), nil
+		}
+	}
+
+	return nil, WrapError(ErrTypeMismatch, "can not add %s and %s", a.Type(), b.Type())
+}
+
+// FieldMergeOperator merges typed values of a struct type field by field. The value merged is the
+// newest operand, with fields of combiners combined from existing value and all operands.
+type FieldMergeOperator struct {
+	name      string
+	valueType reflect.Type
+	codec     Codec
+	combiners map[string]FieldCombiner
+}
+
+// Make a merge operator of name for typed values of the same struct type as prototype, encoded by
+// codec, which must be codec of database, DefaultCodec if nil. Fields of combiners must be
+// exported, combiners are checked by combining zero values of fields. Operator must be registered
+// by RegisterMergeOperator before it is used.
+func NewFieldMergeOperator(name string, prototype interface{}, codec Codec,
+	combiners map[string]FieldCombiner) (*FieldMergeOperator, error) {
+	if !meta.IsStruct(prototype) {
+		return nil, WrapError(ErrTypeMismatch, "merge operator '%s' requires a struct type, but %T",
+			name, prototype)
+	}
+
+	if codec == nil {
+		codec = DefaultCodec
+	}
+
+	valueType := meta.InstanceOf(prototype).Type()
+	for field, combine := range combiners {
+		f, found := valueType.FieldByName(field)
+		if !found || !meta.IsExportedName(field) {
+			return nil, WrapError(ErrInvalidOptions, "no exported field '%s' in %s", field, valueType)
+		}
+
+		zero := reflect.Zero(f.Type).Interface()
+		result, err := combine(zero, zero)
+		if err != nil {
+			return nil, err
+		}
+
+		if !reflect.ValueOf(result).CanConvert(f.Type) {
+			return nil, WrapError(ErrTypeMismatch, "field '%s' requires type %s, but %T",
+				field, f.Type, result)
+		}
+	}
+
+	op := &FieldMergeOperator{
+		name:      name,
+		valueType: valueType,
+		codec:     codec,
+		combiners: combiners,
+	}
+
+	return op, nil
+}
+
+func (o *FieldMergeOperator) Name() string {
+	return o.name
+}
+
+// Type of values merged.
+func (o *FieldMergeOperator) Type() reflect.Type {
+	return o.valueType
+}
+
+func (o *FieldMergeOperator) decode(data []byte) (interface{}, error) {
+	pointer := meta.NewPointerOf(o.valueType)
+	if err := o.codec.Unmarshal(data, pointer.Interface()); err != nil {
+		return nil, err
+	}
+
+	return pointer.Interface(), nil
+}
+
+func (o *FieldMergeOperator) Merge(existing []byte, operands [][]byte) ([]byte, error) {
+	var merged interface{}
+	if len(existing) > 0 {
+		var err error
+		if merged, err = o.decode(existing); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, operand := range operands {
+		value, err := o.decode(operand)
+		if err != nil {
+			return nil, err
+		}
+
+		if merged != nil {
+			if err := o.combine(merged, value); err != nil {
+				return nil, err
+			}
+		}
+
+		merged = value
+	}
+
+	if merged == nil {
+		return existing, nil
+	}
+
+	return o.codec.Marshal(reflect.ValueOf(merged).Elem().Interface())
+}
+
+// Set fields of combiners of operand to values combined from existing value, both are pointers.
+func (o *FieldMergeOperator) combine(existing interface{}, operand interface{}) error {
+	for field, combine := range o.combiners {
+		a, err := meta.GetField(existing, field)
+		if err != nil {
+			return err
+		}
+
+		b, err := meta.GetField(operand, field)
+		if err != nil {
+			return err
+		}
+
+		result, err := combine(a, b)
+		if err != nil {
+			return err
+		}
+
+		if _, err := meta.SetField(operand, field, result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) merge(key []byte, op MergeOperator, operand []byte) error {
+	value, err := mergeOperand(op, operand)
+	if err != nil {
+		return err
+	}
+
+	batch := &writeBatch{}
+	batch.Merge(key, value)
+	return db.write(batch)
+}
+
+// Merge operand into key by Options.MergeOperator without reading it, operand is copied. Operands
+// are folded onto value of key when it is read.
+func (db *DB) Merge(key []byte, operand []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return db.merge(defaultKey(key), db.options.MergeOperator, operand)
+}
+
+// Merge operand into key by Options.MergeOperator in transaction, operand is copied. Merged key is
+// written by transaction, the same as a put.
+func (tx *Tx) Merge(key []byte, operand []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	value, err := mergeOperand(tx.db.options.MergeOperator, operand)
+	if err != nil {
+		return err
+	}
+
+	k := defaultKey(key)
+	return tx.write(k, func(batch *writeBatch) { batch.Merge(k, value) })
+}
+
+// Set operator of Merge of collection, op must be registered. An operator of typed values which
+// tells its type, such as FieldMergeOperator, must be of type of collection.
+func (c *Collection) SetMergeOperator(op MergeOperator) error {
+	if err := checkMergeOperator(op); err != nil {
+		return err
+	}
+
+	if typed, ok := op.(interface{ Type() reflect.Type }); ok && typed.Type() != c.valueType {
+		return WrapError(ErrTypeMismatch, "collection '%s' is type %s, but merge operator '%s' is %s",
+			c.name, c.valueType, op.Name(), typed.Type())
+	}
+
+	c.mergeLock.Lock()
+	defer c.mergeLock.Unlock()
+
+	c.merger = op
+	return nil
+}
+
+func (c *Collection) mergeOperator() MergeOperator {
+	c.mergeLock.RLock()
+	defer c.mergeLock.RUnlock()
+
+	return c.merger
+}
+
+// Whether operands are folded when they are merged, so that indexes and expiry are updated.
+func (c *Collection) foldsOnMerge() bool {
+	return len(c.indexList()) > 0 || c.expiring()
+}
+
+// Merge operand into key of collection by operator of collection, operand must be the registered
+// struct or a pointer to it. Operands are folded onto value of key when it is read, or at once in
+// a transaction if collection is indexed or values expire.
+func (c *Collection) Merge(key []byte, operand interface{}) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if c.foldsOnMerge() {
+		return c.db.updateRetry(func(tx *Tx) error {
+			return tx.Collection(c).Merge(key, operand)
+		})
+	}
+
+	data, _, err := c.encode(operand)
+	if err != nil {
+		return err
+	}
+
+	return c.db.merge(c.key(key), c.mergeOperator(), data)
+}
+
+// Merge operand into key of collection in transaction, see Collection.Merge.
+func (t *TxCollection) Merge(key []byte, operand interface{}) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	data, _, err := t.c.encode(operand)
+	if err != nil {
+		return err
+	}
+
+	value, err := mergeOperand(t.c.mergeOperator(), data)
+	if err != nil {
+		return err
+	}
+
+	k := t.c.key(key)
+	if !t.c.foldsOnMerge() {
+		return t.tx.write(k, func(batch *writeBatch) { batch.Merge(k, value) })
+	}
+
+	var existing []byte
+	err = t.tx.view(k, func(view []byte, object interface{}) error {
+		existing = append([]byte{}, view...)
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	merged, err := foldOperands(existing, [][]byte{value})
+	if err != nil {
+		return err
+	}
+
+	object, err := t.c.decode(merged)
+	if err != nil {
+		return err
+	}
+
+	return t.put(key, merged, object.Interface())
+}
@@ -0,0 +1,792 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+type testScore struct {
+	House  string
+	Points int
+	Best   int
+	Note   string
+	secret int
+}
+
+func TestMergeOperators(t *testing.T) {
+	sum, err := Int64Add.Merge(nil, [][]byte{EncodeInt64(10), EncodeInt64(-3)})
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	if n, err := DecodeInt64(sum); n != 7 || err != nil {
+		t.Errorf("unexpected sum: %d, %v", n, err)
+	}
+
+	if _, err := Int64Add.Merge(nil, [][]byte{[]byte("sirius")}); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	list, err := ListAppend.Merge(nil, [][]byte{[]byte("harry"), []byte("ron")})
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	list, err = ListAppend.Merge(list, [][]byte{[]byte("hermione")})
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	items, err := DecodeList(list)
+	expected := [][]byte{[]byte("harry"), []byte("ron"), []byte("hermione")}
+	if err != nil || !meta.Equal(items, expected) {
+		t.Errorf("unexpected list: %q, %v", items, err)
+	}
+
+	if _, err := DecodeList([]byte{0x10, 'h'}); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := RegisterMergeOperator(Int64Add); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := mergeOperand(nil, EncodeInt64(1)); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := foldOperands(nil, [][]byte{{5, 'd', 'o', 'b', 'b', 'y'}}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFieldMergeOperator(t *testing.T) {
+	combiners := map[string]FieldCombiner{"Points": SumField, "Best": MaxField}
+	op, err := NewFieldMergeOperator("test-score", testScore{}, nil, combiners)
+	if err != nil {
+		t.Fatalf("make operator failed: %v", err)
+	}
+
+	var operands [][]byte
+	for i, points := range []int{10, 50, 20} {
+		operand, err := DefaultCodec.Marshal(testScore{
+			House:  "gryffindor",
+			Points: points,
+			Best:   points,
+			Note:   fmt.Sprintf("round %d", i),
+			secret: points,
+		})
+		if err != nil {
+			t.Fatalf("encode failed: %v", err)
+		}
+
+		operands = append(operands, operand)
+	}
+
+	merged, err := op.Merge(nil, operands)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	var score testScore
+	if err := DefaultCodec.Unmarshal(merged, &score); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	expected := testScore{House: "gryffindor", Points: 80, Best: 50, Note: "round 2"}
+	if score != expected {
+		t.Errorf("unexpected score: %+v <=> %+v", score, expected)
+	}
+
+	cases := []struct {
+		prototype interface{}
+		combiners map[string]FieldCombiner
+		err       error
+	}{
+		{0, nil, ErrTypeMismatch},
+		{testScore{}, map[string]FieldCombiner{"Wand": MaxField}, ErrInvalidOptions},
+		{testScore{}, map[string]FieldCombiner{"secret": SumField}, ErrInvalidOptions},
+		{testScore{}, map[string]FieldCombiner{"House": SumField}, ErrTypeMismatch},
+	}
+
+	for _, c := range cases {
+		if _, err := NewFieldMergeOperator("test-invalid", c.prototype, nil, c.combiners); !errors.Is(err, c.err) {
+			t.Errorf("unexpected error of %T %v: %v", c.prototype, c.combiners, err)
+		}
+	}
+}
+
+func getInt64(t *testing.T, db *DB, key string) int64 {
+	value, err := db.Get([]byte(key))
+	if err != nil {
+		t.Fatalf("get '%s' failed: %v", key, err)
+	}
+
+	n, err := DecodeInt64(value)
+	if err != nil {
+		t.Fatalf("decode '%s' failed: %v", key, err)
+	}
+
+	return n
+}
+
+func testMerge(t *testing.T, engine EngineType) {
+	options := Options{
+		Engine:        engine,
+		SyncPolicy:    SyncNever,
+		MergeOperator: Int64Add,
+	}
+
+	if engine != EngineMemory {
+		options.Dir = t.TempDir()
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer func() { db.Close() }()
+
+	if err := db.Put([]byte("gryffindor"), EncodeInt64(100)); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	snapshot, err := db.Begin(false)
+	if err != nil {
+		t.Fatalf("begin failed: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		for _, house := range []string{"gryffindor", "slytherin"} {
+			if err := db.Merge([]byte(house), EncodeInt64(10)); err != nil {
+				t.Fatalf("merge failed: %v", err)
+			}
+		}
+
+		if i == 2 {
+			if err := db.Flush(); err != nil {
+				t.Fatalf("flush failed: %v", err)
+			}
+		}
+	}
+
+	if n := getInt64(t, db, "gryffindor"); n != 150 {
+		t.Errorf("unexpected gryffindor: %d", n)
+	}
+
+	if n := getInt64(t, db, "slytherin"); n != 50 {
+		t.Errorf("unexpected slytherin: %d", n)
+	}
+
+	value, err := snapshot.Get([]byte("gryffindor"))
+	if n, _ := DecodeInt64(value); err != nil || n != 100 {
+		t.Errorf("unexpected snapshot value: %d, %v", n, err)
+	}
+
+	if _, err := snapshot.Get([]byte("slytherin")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := snapshot.Rollback(); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+
+	if err := db.Delete([]byte("slytherin")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if err := db.Merge([]byte("slytherin"), EncodeInt64(1)); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	if n := getInt64(t, db, "slytherin"); n != 1 {
+		t.Errorf("unexpected slytherin: %d", n)
+	}
+
+	if err := db.Merge([]byte("ravenclaw"), []byte("luna")); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"gryffindor=" + string(EncodeInt64(150)),
+		"slytherin=" + string(EncodeInt64(1)),
+	}
+
+	if keys := scanKeys(t, db, false); !meta.Equal(keys, expected) {
+		t.Errorf("unexpected keys: %q <=> %q", keys, expected)
+	}
+
+	reversed := []string{expected[1], expected[0]}
+	if keys := scanKeys(t, db, true); !meta.Equal(keys, reversed) {
+		t.Errorf("unexpected keys: %q <=> %q", keys, reversed)
+	}
+
+	if engine == EngineMemory {
+		return
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if db, err = Open(options); err != nil {
+		t.Fatalf("reopen database failed: %v", err)
+	}
+
+	if n := getInt64(t, db, "gryffindor"); n != 150 {
+		t.Errorf("unexpected gryffindor after reopen: %d", n)
+	}
+
+	if n := getInt64(t, db, "slytherin"); n != 1 {
+		t.Errorf("unexpected slytherin after reopen: %d", n)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			testMerge(t, engine)
+		})
+	}
+
+	db := openTestDB(t)
+	defer db.Close()
+
+	if err := db.Merge([]byte("harry"), EncodeInt64(1)); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMergeIteratorMixed(t *testing.T) {
+	db, err := Open(Options{
+		Dir:           t.TempDir(),
+		Engine:        EngineLSM,
+		SyncPolicy:    SyncNever,
+		MergeOperator: ListAppend,
+	})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	steps := []func() error{
+		func() error { return db.Put([]byte("a"), []byte("arthur")) },
+		func() error { return db.Merge([]byte("b"), []byte("bill")) },
+		func() error { return db.Merge([]byte("b"), []byte("bob")) },
+		func() error { return db.Merge([]byte("c"), []byte("charlie")) },
+		func() error { return db.Delete([]byte("c")) },
+		func() error { return db.Merge([]byte("d"), []byte("dobby")) },
+		func() error { return db.DeleteRange([]byte("d"), []byte("e")) },
+		func() error { return db.Merge([]byte("d"), []byte("draco")) },
+		func() error { return db.Put([]byte("e"), []byte("ernie")) },
+	}
+
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d failed: %v", i, err)
+		}
+
+		if i%3 == 2 {
+			if err := db.Flush(); err != nil {
+				t.Fatalf("flush failed: %v", err)
+			}
+		}
+	}
+
+	list := func(items ...string) string {
+		var operands [][]byte
+		for _, item := range items {
+			operands = append(operands, []byte(item))
+		}
+
+		value, _ := ListAppend.Merge(nil, operands)
+		return string(value)
+	}
+
+	expected := []string{"a=arthur", "b=" + list("bill", "bob"), "d=" + list("draco"), "e=ernie"}
+	if keys := scanKeys(t, db, false); !meta.Equal(keys, expected) {
+		t.Errorf("unexpected keys: %q <=> %q", keys, expected)
+	}
+
+	reversed := []string{expected[3], expected[2], expected[1], expected[0]}
+	if keys := scanKeys(t, db, true); !meta.Equal(keys, reversed) {
+		t.Errorf("unexpected keys: %q <=> %q", keys, reversed)
+	}
+}
+
+func TestMergeCompaction(t *testing.T) {
+	options := testCompactionOptions(t.TempDir(), CompactionLeveled)
+	options.MergeOperator = Int64Add
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	houses := []string{"gryffindor", "hufflepuff", "ravenclaw", "slytherin"}
+	for i := 0; i < 50; i++ {
+		for _, house := range houses {
+			if err := db.Merge([]byte(house), EncodeInt64(int64(i))); err != nil {
+				t.Fatalf("merge failed: %v", err)
+			}
+		}
+
+		if i%10 == 9 {
+			if err := db.Flush(); err != nil {
+				t.Fatalf("flush failed: %v", err)
+			}
+		}
+	}
+
+	snapshot, err := db.Begin(false)
+	if err != nil {
+		t.Fatalf("begin failed: %v", err)
+	}
+
+	for _, house := range houses {
+		if err := db.Merge([]byte(house), EncodeInt64(1000)); err != nil {
+			t.Fatalf("merge failed: %v", err)
+		}
+	}
+
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	for _, house := range houses {
+		if n := getInt64(t, db, house); n != 2225 {
+			t.Errorf("unexpected %s: %d", house, n)
+		}
+
+		value, err := snapshot.Get([]byte(house))
+		if n, _ := DecodeInt64(value); err != nil || n != 1225 {
+			t.Errorf("unexpected snapshot %s: %d, %v", house, n, err)
+		}
+	}
+
+	if err := snapshot.Rollback(); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+
+	// Operands under the snapshot are folded, the one above it is kept.
+	if n := countTableEntries(t, lsmEngineOf(db)); n != 2*len(houses) {
+		t.Errorf("unexpected entries after compaction: %d", n)
+	}
+}
+
+// A flushed memtable is dropped along with installing its table, before the flush finished, so
+// that operands are never read from both of them.
+func TestMergeFlushing(t *testing.T) {
+	options := testCompactionOptions(t.TempDir(), CompactionLeveled)
+	options.DisableAutoCompaction = true
+	options.MergeOperator = Int64Add
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if err := db.Put([]byte("vault"), EncodeInt64(45)); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.Merge([]byte("vault"), EncodeInt64(4)); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	e := lsmEngineOf(db)
+	e.writeLock.Lock()
+	e.lock.Lock()
+	segment, err := e.wal.Rotate()
+	if err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+
+	imm := e.mem
+	imm.logSegment = segment
+	e.imm, e.flushing, e.mem = imm, true, newMemtable(e.compare)
+	e.lock.Unlock()
+
+	err = e.flush(imm)
+	n := getInt64(t, db, "vault")
+
+	e.lock.Lock()
+	e.flushing = false
+	e.flushCond.Broadcast()
+	e.lock.Unlock()
+	e.writeLock.Unlock()
+
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	if n != 49 {
+		t.Errorf("unexpected value while flushing: %d", n)
+	}
+}
+
+// Apply random puts, deletes and merges of a few keys, flushed in background, and check values
+// read against a model after each write. A counter merged by each write is read concurrently, it
+// must be in range of merges finished before reading and merges started after reading.
+func testMergeModel(t *testing.T, options Options, seed int64) {
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	counter := []byte("points")
+	started, merged := int64(0), int64(0)
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				result <- nil
+				return
+
+			default:
+			}
+
+			before := atomic.LoadInt64(&merged)
+			value, err := db.Get(counter)
+			after := atomic.LoadInt64(&started)
+			n, errDecode := DecodeInt64(value)
+			if errors.Is(err, ErrNotFound) {
+				n, err, errDecode = 0, nil, nil
+			}
+
+			if err != nil || errDecode != nil || n < before || n > after {
+				result <- fmt.Errorf("counter %d out of [%d, %d]: %v, %v", n, before, after, err, errDecode)
+				return
+			}
+		}
+	}()
+
+	r := rand.New(rand.NewSource(seed))
+	keys := []string{"crabbe", "goyle", "malfoy", "zabini"}
+	model := make(map[string]int64)
+	for i := 0; i < 1000; i++ {
+		key := keys[r.Intn(len(keys))]
+		n := int64(r.Intn(100))
+		switch op := r.Intn(40); {
+		case op < 8:
+			err = db.Put([]byte(key), EncodeInt64(n))
+			model[key] = n
+
+		case op < 12:
+			err = db.Delete([]byte(key))
+			delete(model, key)
+
+		case op < 14:
+			err = db.Flush()
+
+		default:
+			err = db.Merge([]byte(key), EncodeInt64(n))
+			model[key] += n
+		}
+
+		if err == nil {
+			atomic.AddInt64(&started, 1)
+			err = db.Merge(counter, EncodeInt64(1))
+			atomic.AddInt64(&merged, 1)
+		}
+
+		if err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+
+		for _, key := range keys {
+			value, err := db.Get([]byte(key))
+			expected, exists := model[key]
+			if !exists {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("unexpected '%s' after write %d: %v, %v", key, i, value, err)
+				}
+
+				continue
+			}
+
+			if n, errDecode := DecodeInt64(value); err != nil || errDecode != nil || n != expected {
+				t.Fatalf("unexpected '%s' after write %d: %d <=> %d, %v", key, i, n, expected, err)
+			}
+		}
+	}
+
+	close(done)
+	if err := <-result; err != nil {
+		t.Errorf("unexpected counter: %v", err)
+	}
+}
+
+func TestMergeModel(t *testing.T) {
+	for _, strategy := range []CompactionStrategy{CompactionLeveled, CompactionSizeTiered} {
+		for seed := int64(1); seed <= 5; seed++ {
+			t.Run(fmt.Sprintf("%s/%d", strategy, seed), func(t *testing.T) {
+				options := testCompactionOptions(t.TempDir(), strategy)
+				options.MemtableSize = 1 << 10
+				options.MergeOperator = Int64Add
+				testMergeModel(t, options, seed)
+			})
+		}
+	}
+}
+
+func TestMergeExpiring(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			clock := newTestClock()
+			options := Options{
+				Engine:        engine,
+				SyncPolicy:    SyncNever,
+				Clock:         clock,
+				ReapPeriod:    -1,
+				MergeOperator: Int64Add,
+			}
+
+			if engine != EngineMemory {
+				options.Dir = t.TempDir()
+			}
+
+			db, err := Open(options)
+			if err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			defer db.Close()
+
+			key := []byte("polyjuice")
+			if err := db.PutWithTTL(key, EncodeInt64(1), time.Hour); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+
+			if err := db.Merge(key, EncodeInt64(2)); err != nil {
+				t.Fatalf("merge failed: %v", err)
+			}
+
+			if n := getInt64(t, db, string(key)); n != 3 {
+				t.Errorf("unexpected value: %d", n)
+			}
+
+			clock.Advance(2 * time.Hour)
+			if err := db.Merge(key, EncodeInt64(4)); err != nil {
+				t.Fatalf("merge failed: %v", err)
+			}
+
+			if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if err := db.Delete(key); err != nil {
+				t.Fatalf("delete failed: %v", err)
+			}
+
+			if err := db.Merge(key, EncodeInt64(8)); err != nil {
+				t.Fatalf("merge failed: %v", err)
+			}
+
+			if n := getInt64(t, db, string(key)); n != 8 {
+				t.Errorf("unexpected value: %d", n)
+			}
+		})
+	}
+}
+
+func TestTxMerge(t *testing.T) {
+	db, err := Open(Options{MergeOperator: Int64Add})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if err := db.Put([]byte("hagrid"), EncodeInt64(1)); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		for _, key := range []string{"hagrid", "hagrid", "lupin", "moody"} {
+			if err := tx.Merge([]byte(key), EncodeInt64(2)); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.DeleteRange([]byte("lupin"), []byte("lupio")); err != nil {
+			return err
+		}
+
+		if err := tx.Merge([]byte("lupin"), EncodeInt64(5)); err != nil {
+			return err
+		}
+
+		if err := tx.Put([]byte("moody"), EncodeInt64(10)); err != nil {
+			return err
+		}
+
+		if err := tx.Merge([]byte("moody"), EncodeInt64(3)); err != nil {
+			return err
+		}
+
+		expected := map[string]int64{"hagrid": 5, "lupin": 5, "moody": 13}
+		for key, count := range expected {
+			value, err := tx.Get([]byte(key))
+			if n, _ := DecodeInt64(value); err != nil || n != count {
+				t.Errorf("unexpected %s in tx: %d, %v", key, n, err)
+			}
+		}
+
+		iter, err := tx.Iterator(nil)
+		if err != nil {
+			return err
+		}
+
+		defer iter.Close()
+
+		for ok := iter.First(); ok; ok = iter.Next() {
+			n, _ := DecodeInt64(iter.Value())
+			if n != expected[string(iter.Key())] {
+				t.Errorf("unexpected %s in iterator: %d", iter.Key(), n)
+			}
+
+			delete(expected, string(iter.Key()))
+		}
+
+		if len(expected) > 0 {
+			t.Errorf("keys not iterated: %v", expected)
+		}
+
+		return iter.Error()
+	})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	expected := map[string]int64{"hagrid": 5, "lupin": 5, "moody": 13}
+	for key, count := range expected {
+		if n := getInt64(t, db, key); n != count {
+			t.Errorf("unexpected %s: %d", key, n)
+		}
+	}
+}
+
+// Operators of collections registered once, as the registry is global to all tests.
+var testScoreOperator, testYearOperator MergeOperator
+
+func init() {
+	var err error
+	testScoreOperator, err = NewFieldMergeOperator("test-collection-score", testScore{}, nil,
+		map[string]FieldCombiner{"Points": SumField, "Best": MaxField})
+	if err != nil {
+		panic(err)
+	}
+
+	testYearOperator, err = NewFieldMergeOperator("test-collection-year", testStudent{}, nil,
+		map[string]FieldCombiner{"Year": MaxField})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, op := range []MergeOperator{testScoreOperator, testYearOperator} {
+		if err := RegisterMergeOperator(op); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestCollectionMerge(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	scores, err := db.Collection("scores", testScore{})
+	if err != nil {
+		t.Fatalf("open collection failed: %v", err)
+	}
+
+	unregistered, err := NewFieldMergeOperator("test-collection-unregistered", testScore{}, nil,
+		map[string]FieldCombiner{"Points": SumField})
+	if err != nil {
+		t.Fatalf("make operator failed: %v", err)
+	}
+
+	if err := scores.SetMergeOperator(unregistered); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	op := testScoreOperator
+	if err := scores.Merge([]byte("gryffindor"), testScore{Points: 1}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := scores.SetMergeOperator(op); err != nil {
+		t.Fatalf("set operator failed: %v", err)
+	}
+
+	for _, points := range []int{10, 50, 20} {
+		score := testScore{House: "gryffindor", Points: points, Best: points}
+		if err := scores.Merge([]byte("gryffindor"), score); err != nil {
+			t.Fatalf("merge failed: %v", err)
+		}
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		return tx.Collection(scores).Merge([]byte("gryffindor"), testScore{House: "gryffindor", Points: 5})
+	})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	var score testScore
+	if err := scores.Get([]byte("gryffindor"), &score); err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+
+	expected := testScore{House: "gryffindor", Points: 85, Best: 50}
+	if score != expected {
+		t.Errorf("unexpected score: %+v <=> %+v", score, expected)
+	}
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("open collection failed: %v", err)
+	}
+
+	if err := students.SetMergeOperator(op); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := students.SetMergeOperator(testYearOperator); err != nil {
+		t.Fatalf("set operator failed: %v", err)
+	}
+
+	for _, year := range []int{3, 1, 2} {
+		student := testStudent{Name: "Neville", Email: "neville@hogwarts.edu", House: "gryffindor", Year: year}
+		if err := students.Merge([]byte("neville"), student); err != nil {
+			t.Fatalf("merge failed: %v", err)
+		}
+	}
+
+	var found []testStudent
+	if err := students.Find(Where("Year").Eq(3)).All(&found); err != nil {
+		t.Fatalf("find failed: %v", err)
+	}
+
+	if len(found) != 1 || found[0].Name != "Neville" {
+		t.Errorf("unexpected students: %+v", found)
+	}
+
+	if n, err := students.Find(Where("Year").Eq(2)).Count(); n != 0 || err != nil {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,155 @@
+package pinkis
+
+// Merge several sorted iterators into one. If iterators have entries of the same key, the one from
+// the iterator with smaller index comes first.
+type mergingIterator struct {
+	compare   compareFunc
+	iterators []internalIterator
+	current   internalIterator
+	// Moving backward, all iterators except current are before current key.
+	backward bool
+	err      error
+}
+
+func newMergingIterator(compare compareFunc, iterators []internalIterator) *mergingIterator {
+	return &mergingIterator{
+		compare:   compare,
+		iterators: iterators,
+	}
+}
+
+func (m *mergingIterator) checkError(iter internalIterator) {
+	if err := iter.Error(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *mergingIterator) findSmallest() {
+	m.current = nil
+	for _, iter := range m.iterators {
+		if !iter.Valid() {
+			m.checkError(iter)
+			continue
+		}
+
+		if m.current == nil || m.compare(iter.Key(), m.current.Key()) < 0 {
+			m.current = iter
+		}
+	}
+}
+
+func (m *mergingIterator) findLargest() {
+	m.current = nil
+	for i := len(m.iterators) - 1; i >= 0; i-- {
+		iter := m.iterators[i]
+		if !iter.Valid() {
+			m.checkError(iter)
+			continue
+		}
+
+		if m.current == nil || m.compare(iter.Key(), m.current.Key()) > 0 {
+			m.current = iter
+		}
+	}
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.err == nil && m.current != nil
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, iter := range m.iterators {
+		iter.SeekToFirst()
+	}
+
+	m.backward = false
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, iter := range m.iterators {
+		iter.SeekToLast()
+	}
+
+	m.backward = true
+	m.findLargest()
+}
+
+func (m *mergingIterator) Seek(key []byte) {
+	for _, iter := range m.iterators {
+		iter.Seek(key)
+	}
+
+	m.backward = false
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Next() {
+	// Move other iterators after current key when direction changes.
+	if m.backward {
+		key := m.current.Key()
+		for _, iter := range m.iterators {
+			if iter == m.current {
+				continue
+			}
+
+			iter.Seek(key)
+			if iter.Valid() && m.compare(iter.Key(), key) == 0 {
+				iter.Next()
+			}
+		}
+
+		m.backward = false
+	}
+
+	m.current.Next()
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Prev() {
+	// Move other iterators before current key when direction changes.
+	if !m.backward {
+		key := m.current.Key()
+		for _, iter := range m.iterators {
+			if iter == m.current {
+				continue
+			}
+
+			iter.Seek(key)
+			if iter.Valid() {
+				iter.Prev()
+
+			} else {
+				iter.SeekToLast()
+			}
+		}
+
+		m.backward = true
+	}
+
+	m.current.Prev()
+	m.findLargest()
+}
+
+func (m *mergingIterator) Key() []byte {
+	return m.current.Key()
+}
+
+func (m *mergingIterator) Value() []byte {
+	return m.current.Value()
+}
+
+func (m *mergingIterator) Error() error {
+	return m.err
+}
+
+func (m *mergingIterator) Close() error {
+	err := m.err
+	for _, iter := range m.iterators {
+		if errClose := iter.Close(); err == nil {
+			err = errClose
+		}
+	}
+
+	return err
+}
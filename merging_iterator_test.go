@@ -0,0 +1,86 @@
+package pinkis
+
+import (
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Make a memtable of key and value pairs, all entries are put with sequence number seq.
+func memtableOf(seq uint64, entries ...string) *memtable {
+	m := newMemtable(bytewiseCompare)
+	for i := 0; i+1 < len(entries); i += 2 {
+		m.Add(seq, kindPut, []byte(entries[i]), []byte(entries[i+1]), nil)
+	}
+
+	return m
+}
+
+func TestMergingIterator(t *testing.T) {
+	iter := newMergingIterator(internalCompare(bytewiseCompare), []internalIterator{
+		memtableOf(3, "b", "3", "d", "3").Iterator(),
+		memtableOf(2, "a", "2", "b", "2", "e", "2").Iterator(),
+		memtableOf(4).Iterator(),
+		memtableOf(1, "c", "1", "d", "1").Iterator(),
+	})
+
+	defer iter.Close()
+
+	var result []string
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		result = append(result, string(internalUserKey(iter.Key()))+string(iter.Value()))
+	}
+
+	expected := []string{"a2", "b3", "b2", "c1", "d3", "d1", "e2"}
+	if ok, err := meta.ArrayEqualInfo(expected, result); !ok {
+		t.Errorf("unexpected merged entries: %v", err)
+	}
+
+	result = result[:0]
+	for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+		result = append([]string{string(internalUserKey(iter.Key())) + string(iter.Value())}, result...)
+	}
+
+	if ok, err := meta.ArrayEqualInfo(expected, result); !ok {
+		t.Errorf("unexpected merged entries backward: %v", err)
+	}
+
+	iter.Seek(makeLookupKey([]byte("c"), maxSequence))
+	if !iter.Valid() || string(internalUserKey(iter.Key())) != "c" {
+		t.Errorf("seek to wrong entry")
+	}
+
+	// Change direction.
+	moves := []struct {
+		next  bool
+		entry string
+	}{{false, "b2"}, {false, "b3"}, {true, "b2"}, {true, "c1"}, {true, "d3"}, {false, "c1"}}
+	for _, move := range moves {
+		if move.next {
+			iter.Next()
+
+		} else {
+			iter.Prev()
+		}
+
+		if entry := string(internalUserKey(iter.Key())) + string(iter.Value()); entry != move.entry {
+			t.Errorf("unexpected entry %s, expected %s", entry, move.entry)
+		}
+	}
+}
+
+func TestMergingIteratorError(t *testing.T) {
+	iter := newMergingIterator(internalCompare(bytewiseCompare), []internalIterator{
+		memtableOf(1, "a", "1").Iterator(),
+		&emptyIterator{err: ErrCorrupted},
+	})
+
+	iter.SeekToFirst()
+	if iter.Valid() || iter.Error() != ErrCorrupted {
+		t.Errorf("error of a child iterator should stop merging iterator")
+	}
+
+	if err := iter.Close(); err != ErrCorrupted {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -153,3 +153,43 @@ func Equal(a interface{}, b interface{}) bool {
 	vb := reflect.ValueOf(b)
 	return ValueEqual(va, vb)
 }
+
+func diffForValue(paths []string, path string, a reflect.Value, b reflect.Value) []string {
+	if a.IsValid() && b.IsValid() && a.Type() == b.Type() {
+		switch a.Kind() {
+		case reflect.Interface, reflect.Ptr:
+			if !a.IsNil() && !b.IsNil() {
+				return diffForValue(paths, path, a.Elem(), b.Elem())
+			}
+
+		case reflect.Struct:
+			return diffForStruct(paths, path, a, b)
+		}
+	}
+
+	if !equalForValue(a, b) {
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+func diffForStruct(paths []string, path string, a reflect.Value, b reflect.Value) []string {
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if len(path) > 0 {
+			name = path + "." + name
+		}
+
+		paths = diffForValue(paths, name, a.Field(i), b.Field(i))
+	}
+
+	return paths
+}
+
+// Paths of fields that differ between a and b, walked the same way as Equal.
+// Fields of nested structs are joined by dots like "Wand.Core", other values are compared as a
+// whole, and the path of a and b themselves is "". Nil if a equals to b.
+func DiffFields(a interface{}, b interface{}) []string {
+	return diffForValue(nil, "", reflect.ValueOf(a), reflect.ValueOf(b))
+}
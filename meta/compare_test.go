@@ -111,3 +111,42 @@ func TestValueEqualOnStructWithPrivateField(t *testing.T) {
 		t.Errorf("unexpected result: %+v != %+v", a, c)
 	}
 }
+
+func TestDiffFields(t *testing.T) {
+	type wand struct {
+		Wood string
+		Core string
+	}
+
+	type wizard struct {
+		Name    string
+		Wand    *wand
+		Pets    []string
+		age     int
+		Friends map[string]int
+	}
+
+	a := wizard{Name: "harry", Wand: &wand{"holly", "phoenix"}, Pets: []string{"hedwig"}, age: 11}
+	b := wizard{Name: "harry", Wand: &wand{"holly", "phoenix"}, Pets: []string{"hedwig"}, age: 11}
+	if paths := DiffFields(a, b); paths != nil {
+		t.Errorf("unexpected paths: %v", paths)
+	}
+
+	b.Wand = &wand{"holly", "thestral"}
+	b.Pets = append(b.Pets, "pigwidgeon")
+	b.age = 17
+	expected := []string{"Wand.Core", "Pets", "age"}
+	if paths := DiffFields(a, b); !Equal(paths, expected) {
+		t.Errorf("unexpected paths: %v <=> %v", paths, expected)
+	}
+
+	b = a
+	b.Wand = nil
+	if paths := DiffFields(&a, &b); !Equal(paths, []string{"Wand"}) {
+		t.Errorf("unexpected paths: %v", paths)
+	}
+
+	if paths := DiffFields(1, "harry"); !Equal(paths, []string{""}) {
+		t.Errorf("unexpected paths: %v", paths)
+	}
+}
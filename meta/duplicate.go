@@ -12,6 +12,11 @@ func MakeUnsafeRef(data reflect.Value) reflect.Value {
 
 	switch data.Kind() {
 	case reflect.Ptr:
+		if data.IsNil() {
+			result = reflect.Zero(data.Type())
+			break
+		}
+
 		instance := data.Elem()
 		instancePointer := unsafe.Pointer(instance.UnsafeAddr())
 		unsafePointer := reflect.NewAt(instance.Type(), instancePointer)
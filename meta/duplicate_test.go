@@ -195,6 +195,27 @@ func TestDuplicateForSimpleStructWithPrivatePointerVariable(t *testing.T) {
 	}
 }
 
+func TestDuplicateForSimpleStructWithPrivateNilPointer(t *testing.T) {
+	type testStruct struct {
+		Name   string
+		spouse *testStruct
+	}
+
+	data := testStruct{
+		Name: "Luna Lovegood",
+	}
+
+	got, err := Duplicate(data)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if !Equal(data, got.(testStruct)) || got.(testStruct).spouse != nil {
+		t.Errorf("unexpected result: %#v (%s) <=> %#v (%s)",
+			got, reflect.TypeOf(got), data, reflect.TypeOf(data))
+	}
+}
+
 func TestDuplicateForSimpleStructWithPrivatePointerLiteral(t *testing.T) {
 	type testStruct struct {
 		Name   string
@@ -0,0 +1,88 @@
+package pinkis
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+const (
+	mmapMinSize  = 1 << 20
+	mmapMaxStep  = 1 << 30
+	mmapMaxBytes = 1 << 40
+)
+
+// A read-only memory mapped region of file. A region is referenced by transactions reading it,
+// and unmapped when the last reference is released, so that remapping never invalidates slices
+// held by running transactions.
+type mmapRegion struct {
+	data []byte
+	refs int32
+}
+
+func newMmapRegion(file *os.File, size int) (*mmapRegion, error) {
+	data, err := mmapFile(file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mmapRegion{
+		data: data,
+		refs: 1,
+	}
+
+	return r, nil
+}
+
+func (r *mmapRegion) ref() {
+	if r != nil {
+		atomic.AddInt32(&r.refs, 1)
+	}
+}
+
+func (r *mmapRegion) unref() {
+	if r == nil || atomic.AddInt32(&r.refs, -1) > 0 {
+		return
+	}
+
+	// Error is ignored, nothing can be done with a region can not be unmapped.
+	_ = munmap(r.data)
+	r.data = nil
+}
+
+// Bytes of region in [offset, offset+size), ok is false if they are not mapped.
+func (r *mmapRegion) slice(offset int64, size int) ([]byte, bool) {
+	if r == nil || offset < 0 || offset+int64(size) > int64(len(r.data)) {
+		return nil, false
+	}
+
+	end := offset + int64(size)
+	return r.data[offset:end:end], true
+}
+
+// Size to map for at least size bytes. It doubles from 1MB up to 1GB, and then grows by 1GB, so
+// that a growing file is remapped only a few times.
+func mmapSize(size int64) (int, error) {
+	if size > mmapMaxBytes {
+		return 0, WrapError(ErrInvalidOptions, "file of %d bytes too large to map", size)
+	}
+
+	if size <= mmapMinSize {
+		return mmapMinSize, nil
+	}
+
+	mapped := int64(mmapMinSize)
+	if size < mmapMaxStep {
+		for mapped < size {
+			mapped *= 2
+		}
+
+	} else {
+		mapped = (size + mmapMaxStep - 1) / mmapMaxStep * mmapMaxStep
+	}
+
+	if int64(int(mapped)) != mapped {
+		return 0, WrapError(ErrInvalidOptions, "file of %d bytes too large to map", size)
+	}
+
+	return int(mapped), nil
+}
@@ -0,0 +1,19 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package pinkis
+
+import (
+	"os"
+)
+
+const mmapSupported = false
+
+// Memory mapping is not supported, pages are read from file.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, NewError("mmap is not supported")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package pinkis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapSize(t *testing.T) {
+	cases := map[int64]int{
+		0:               mmapMinSize,
+		mmapMinSize:     mmapMinSize,
+		mmapMinSize + 1: 2 * mmapMinSize,
+		300 << 20:       512 << 20,
+		mmapMaxStep + 1: 2 * mmapMaxStep,
+	}
+
+	for size, expected := range cases {
+		if mapped, err := mmapSize(size); err != nil || mapped != expected {
+			t.Errorf("unexpected map size of %d: %d, %v", size, mapped, err)
+		}
+	}
+
+	if _, err := mmapSize(mmapMaxBytes + 1); err == nil {
+		t.Errorf("too large file should not be mapped")
+	}
+}
+
+func TestMmapRegion(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported")
+	}
+
+	path := filepath.Join(t.TempDir(), "hogwarts")
+	if err := os.WriteFile(path, []byte("gryffindor"), 0644); err != nil {
+		t.Fatalf("write file failed: %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open file failed: %v", err)
+	}
+
+	defer file.Close()
+
+	r, err := newMmapRegion(file, mmapMinSize)
+	if err != nil {
+		t.Fatalf("map file failed: %v", err)
+	}
+
+	data, ok := r.slice(0, 10)
+	if !ok || string(data) != "gryffindor" {
+		t.Errorf("unexpected mapped data: %q", data)
+	}
+
+	if _, ok := r.slice(mmapMinSize-4, 8); ok {
+		t.Errorf("slice out of region should fail")
+	}
+
+	r.ref()
+	r.unref()
+	if r.data == nil {
+		t.Errorf("region should be mapped while it is referenced")
+	}
+
+	r.unref()
+	if r.data != nil {
+		t.Errorf("region should be unmapped when released")
+	}
+
+	var none *mmapRegion
+	none.ref()
+	none.unref()
+	if _, ok := none.slice(0, 1); ok {
+		t.Errorf("nil region should have nothing mapped")
+	}
+}
@@ -0,0 +1,149 @@
+package pinkis
+
+import (
+	"time"
+)
+
+// Options to open a database.
+type Options struct {
+	// Directory to store data files, database is kept in memory only if Dir is empty.
+	Dir string
+	// Storage engine, EngineMemory by default.
+	Engine EngineType
+	// Open an existing database without writing its files, writes fail with ErrReadOnly.
+	// Compactions and reaper never run, and a torn tail of write-ahead log is ignored.
+	ReadOnly bool
+
+	// Codec of typed values in collections, DefaultCodec is used if nil.
+	Codec Codec
+	// Operator of Merge of keys out of collections, it must be registered by
+	// RegisterMergeOperator. Merge fails if it is nil.
+	MergeOperator MergeOperator
+	// Clock to expire keys, system clock if nil.
+	Clock Clock
+	// Period to delete expired keys in background, 1 minute by default, never if negative.
+	ReapPeriod time.Duration
+	// Maximum number of expired keys deleted in a batch, 1000 by default.
+	ReapBatchSize int
+	// Number of recent changes kept in memory for watchers to resume from, see WatchOptions.From.
+	// Nothing is kept if it is not positive.
+	WatchHistory int
+	// Log changes of keys durably in database, keys of buckets included, see ReadChanges.
+	ChangeLog bool
+	// Number of the newest changes retained in change log, unlimited if not positive.
+	ChangeLogLimit int
+	// Age of changes retained in change log, unlimited if not positive. Change log is trimmed by
+	// reaper, or by TrimChanges.
+	ChangeLogRetention time.Duration
+
+	// When to sync write-ahead log, SyncAlways by default.
+	SyncPolicy SyncPolicy
+	// Period to sync write-ahead log with SyncPeriodically, 100ms by default.
+	SyncPeriod time.Duration
+	// Size of a write-ahead log segment file, 64MB by default.
+	WALSegmentSize int64
+
+	// Size of memtable to be flushed into a sorted table, 4MB by default.
+	MemtableSize int
+	// Size of uncompressed data block in sorted tables, 4KB by default.
+	BlockSize int
+	// Compression of data blocks of sorted tables, SnappyCompression by default. Buckets may be
+	// compressed differently, see BucketOptions. Pages of B+tree engine are never compressed.
+	Compression Compressor
+	// Bytes of blocks of sorted tables and decoded typed values cached in memory, 8MB by default,
+	// nothing is cached if negative.
+	BlockCacheSize int64
+	// Bits per key of bloom filters of sorted tables, 10 by default, no filters if negative.
+	BloomBitsPerKey int
+	// Filter keys by their prefixes instead of whole keys, if not nil.
+	BloomPrefix PrefixExtractor
+	// Size of pages in B+tree engine, a power of 2 in [512, 65536], page size of operating
+	// system by default. It is ignored when an existing file is opened.
+	PageSize int
+	// Read pages of B+tree engine from file instead of memory mapping. Pages are always read from
+	// file on platforms without mmap.
+	DisableMmap bool
+	// Encrypt tables, pages and write-ahead log by master keys of KeyProvider, nothing is
+	// encrypted if nil. Encrypted pages of B+tree engine are always read from file.
+	KeyProvider KeyProvider
+	// Skip verifying checksums of blocks of sorted tables and pages of B+tree engine on read.
+	// Checksums are always written, and always verified by recovery and Verify.
+	DisableChecksums bool
+
+	// How tables of LSM engine are compacted, CompactionLeveled by default.
+	CompactionStrategy CompactionStrategy
+	// Maximum number of compactions running in background, 1 by default.
+	CompactionConcurrency int
+	// Maximum bytes written by compactions per second, unlimited if not positive.
+	CompactionRateLimit int64
+	// Disable background compactions, tables are compacted by CompactRange only.
+	DisableAutoCompaction bool
+	// Number of level 0 tables to trigger a leveled compaction, 4 by default.
+	L0CompactionTrigger int
+	// Maximum size of level 1 in leveled compaction, 10MB by default.
+	LevelBaseSize int64
+	// Size ratio of adjacent levels in leveled compaction, 10 by default.
+	LevelSizeMultiplier int
+	// Size of a table written by compactions, 2MB by default.
+	TableSize int64
+	// Minimum and maximum number of similar sized tables merged by size-tiered compaction, 4 and
+	// 32 by default.
+	SizeTieredMinThreshold int
+	SizeTieredMaxThreshold int
+}
+
+func (o Options) codec() Codec {
+	if o.Codec == nil {
+		return DefaultCodec
+	}
+
+	return o.Codec
+}
+
+func (o Options) clock() Clock {
+	if o.Clock == nil {
+		return systemClock{}
+	}
+
+	return o.Clock
+}
+
+func (o Options) reapPeriod() time.Duration {
+	if o.ReapPeriod == 0 {
+		return time.Minute
+	}
+
+	return o.ReapPeriod
+}
+
+func (o Options) reapBatchSize() int {
+	if o.ReapBatchSize <= 0 {
+		return 1000
+	}
+
+	return o.ReapBatchSize
+}
+
+func (o Options) compression() Compressor {
+	if o.Compression == nil {
+		return SnappyCompression
+	}
+
+	return o.Compression
+}
+
+func (o Options) blockCacheSize() int64 {
+	if o.BlockCacheSize == 0 {
+		return 8 << 20
+	}
+
+	return o.BlockCacheSize
+}
+
+func (o Options) bloomBitsPerKey() int {
+	if o.BloomBitsPerKey == 0 {
+		return 10
+	}
+
+	return o.BloomBitsPerKey
+}
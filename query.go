@@ -0,0 +1,784 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/flily/pinkis/meta"
+)
+
+type queryOp int
+
+const (
+	opEq queryOp = iota
+	opNe
+	opGt
+	opGe
+	opLt
+	opLe
+	opIn
+	opAnd
+	opOr
+)
+
+func (op queryOp) String() string {
+	switch op {
+	case opEq:
+		return "="
+
+	case opNe:
+		return "!="
+
+	case opGt:
+		return ">"
+
+	case opGe:
+		return ">="
+
+	case opLt:
+		return "<"
+
+	case opLe:
+		return "<="
+
+	case opIn:
+		return "in"
+
+	case opAnd:
+		return "and"
+
+	default:
+		return "or"
+	}
+}
+
+// Field of values in collection, to make conditions on it.
+type Field struct {
+	name string
+}
+
+// Condition on fields of values in a collection, made by Where.
+type Condition struct {
+	op       queryOp
+	field    string
+	values   []interface{}
+	children []*Condition
+}
+
+// Make conditions on field of name.
+func Where(name string) *Field {
+	return &Field{name: name}
+}
+
+func (f *Field) condition(op queryOp, values ...interface{}) *Condition {
+	return &Condition{op: op, field: f.name, values: values}
+}
+
+// Field equals value.
+func (f *Field) Eq(value interface{}) *Condition {
+	return f.condition(opEq, value)
+}
+
+// Field does not equal value.
+func (f *Field) Ne(value interface{}) *Condition {
+	return f.condition(opNe, value)
+}
+
+// Field is greater than value.
+func (f *Field) Gt(value interface{}) *Condition {
+	return f.condition(opGt, value)
+}
+
+// Field is greater than or equals value.
+func (f *Field) Ge(value interface{}) *Condition {
+	return f.condition(opGe, value)
+}
+
+// Field is less than value.
+func (f *Field) Lt(value interface{}) *Condition {
+	return f.condition(opLt, value)
+}
+
+// Field is less than or equals value.
+func (f *Field) Le(value interface{}) *Condition {
+	return f.condition(opLe, value)
+}
+
+// Field equals any of values.
+func (f *Field) In(values ...interface{}) *Condition {
+	return f.condition(opIn, values...)
+}
+
+// Both condition and all others are true.
+func (c *Condition) And(others ...*Condition) *Condition {
+	return &Condition{op: opAnd, children: append([]*Condition{c}, others...)}
+}
+
+// Condition or any of others is true.
+func (c *Condition) Or(others ...*Condition) *Condition {
+	return &Condition{op: opOr, children: append([]*Condition{c}, others...)}
+}
+
+func (c *Condition) String() string {
+	switch c.op {
+	case opAnd, opOr:
+		parts := make([]string, len(c.children))
+		for i, child := range c.children {
+			parts[i] = child.String()
+		}
+
+		return "(" + strings.Join(parts, " "+c.op.String()+" ") + ")"
+
+	case opIn:
+		return fmt.Sprintf("%s in %v", c.field, c.values)
+
+	default:
+		return fmt.Sprintf("%s %s %v", c.field, c.op, c.values[0])
+	}
+}
+
+// A condition checked against the registered type, with operands converted to types of fields.
+type compiledCondition struct {
+	*Condition
+	operands []reflect.Value
+	// Encoded operands, in order of index entries, nil if field is not indexable.
+	encoded  [][]byte
+	children []*compiledCondition
+}
+
+// Convert operand to type t without loss, a conversion between numbers, strings or bools only.
+func convertOperand(field string, operand interface{}, t reflect.Type) (reflect.Value, error) {
+	value := reflect.ValueOf(operand)
+	if !value.IsValid() {
+		return value, WrapError(ErrTypeMismatch, "field '%s' can not be compared to nil", field)
+	}
+
+	if value.Type() == t {
+		return value, nil
+	}
+
+	class := func(k reflect.Kind) int {
+		switch k {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+			return 1
+
+		case reflect.String:
+			return 2
+
+		case reflect.Bool:
+			return 3
+
+		default:
+			return 0
+		}
+	}
+
+	kind := value.Kind()
+	if class(kind) == 0 || class(kind) != class(t.Kind()) {
+		return value, WrapError(ErrTypeMismatch, "field '%s' of type %s can not be compared to %T",
+			field, t, operand)
+	}
+
+	converted := value.Convert(t)
+	negative := (class(kind) == 1 && kind >= reflect.Int && kind <= reflect.Int64 && value.Int() < 0) ||
+		((kind == reflect.Float32 || kind == reflect.Float64) && value.Float() < 0)
+	unsigned := t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uintptr
+	if (negative && unsigned) || converted.Convert(value.Type()).Interface() != value.Interface() {
+		return value, WrapError(ErrTypeMismatch, "field '%s' of type %s can not hold %v",
+			field, t, operand)
+	}
+
+	return converted, nil
+}
+
+func (c *Collection) fieldType(name string) (reflect.Type, error) {
+	field, found := c.valueType.FieldByName(name)
+	if !found || !meta.IsExportedName(name) {
+		return nil, WrapError(ErrInvalidOptions, "no exported field '%s' in %s", name, c.valueType)
+	}
+
+	return field.Type, nil
+}
+
+func (c *Collection) compile(condition *Condition) (*compiledCondition, error) {
+	compiled := &compiledCondition{Condition: condition}
+	if condition.op == opAnd || condition.op == opOr {
+		for _, child := range condition.children {
+			if child == nil {
+				return nil, WrapError(ErrInvalidOptions, "nil condition in %s", condition.op)
+			}
+
+			cc, err := c.compile(child)
+			if err != nil {
+				return nil, err
+			}
+
+			compiled.children = append(compiled.children, cc)
+		}
+
+		return compiled, nil
+	}
+
+	t, err := c.fieldType(condition.field)
+	if err != nil {
+		return nil, err
+	}
+
+	ordering := condition.op >= opGt && condition.op <= opLe
+	if ordering && !indexable(t) {
+		return nil, WrapError(ErrTypeMismatch, "field '%s' of type %s is not ordered", condition.field, t)
+	}
+
+	for _, operand := range condition.values {
+		var value reflect.Value
+		if indexable(t) {
+			value, err = convertOperand(condition.field, operand, t)
+
+		} else if value = reflect.ValueOf(operand); !value.IsValid() || value.Type() != t {
+			err = WrapError(ErrTypeMismatch, "field '%s' of type %s can not be compared to %T",
+				condition.field, t, operand)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		compiled.operands = append(compiled.operands, value)
+		if indexable(t) {
+			compiled.encoded = append(compiled.encoded, appendIndexValue(nil, value))
+		}
+	}
+
+	return compiled, nil
+}
+
+// Whether value of struct satisfies condition.
+func (c *compiledCondition) match(value reflect.Value) bool {
+	switch c.op {
+	case opAnd:
+		for _, child := range c.children {
+			if !child.match(value) {
+				return false
+			}
+		}
+
+		return true
+
+	case opOr:
+		for _, child := range c.children {
+			if child.match(value) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	field, err := meta.GetField(value.Interface(), c.field)
+	if err != nil {
+		return false
+	}
+
+	if c.encoded == nil {
+		equal := false
+		for _, operand := range c.operands {
+			equal = equal || meta.Equal(field, operand.Interface())
+		}
+
+		return equal == (c.op != opNe)
+	}
+
+	encoded := appendIndexValue(nil, reflect.ValueOf(field))
+	switch c.op {
+	case opIn:
+		for _, operand := range c.encoded {
+			if bytes.Equal(encoded, operand) {
+				return true
+			}
+		}
+
+		return false
+
+	case opEq:
+		return bytes.Equal(encoded, c.encoded[0])
+
+	case opNe:
+		return !bytes.Equal(encoded, c.encoded[0])
+
+	case opGt:
+		return bytes.Compare(encoded, c.encoded[0]) > 0
+
+	case opGe:
+		return bytes.Compare(encoded, c.encoded[0]) >= 0
+
+	case opLt:
+		return bytes.Compare(encoded, c.encoded[0]) < 0
+
+	default:
+		return bytes.Compare(encoded, c.encoded[0]) <= 0
+	}
+}
+
+// Conditions on fields all of which must be true.
+func (c *compiledCondition) conjuncts() []*compiledCondition {
+	switch c.op {
+	case opAnd:
+		var result []*compiledCondition
+		for _, child := range c.children {
+			result = append(result, child.conjuncts()...)
+		}
+
+		return result
+
+	case opOr:
+		return nil
+
+	default:
+		return []*compiledCondition{c}
+	}
+}
+
+// Plan of a query, how values are found.
+type Plan struct {
+	// Index scanned, or a full scan of collection if empty.
+	Index string
+	// Conditions bounding the index scan.
+	Bounds []string
+	// Values are found in order of OrderBy, without sorting.
+	Ordered bool
+	OrderBy string
+	Limit   int
+}
+
+func (p Plan) String() string {
+	var parts []string
+	if p.Index == "" {
+		parts = append(parts, "full scan")
+
+	} else if len(p.Bounds) > 0 {
+		parts = append(parts, fmt.Sprintf("index %s (%s)", p.Index, strings.Join(p.Bounds, ", ")))
+
+	} else {
+		parts = append(parts, "index "+p.Index)
+	}
+
+	if p.OrderBy != "" {
+		if p.Ordered {
+			parts = append(parts, "ordered by "+p.OrderBy)
+
+		} else {
+			parts = append(parts, "sort by "+p.OrderBy)
+		}
+	}
+
+	if p.Limit > 0 {
+		parts = append(parts, fmt.Sprintf("limit %d", p.Limit))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// A scan chosen for query.
+type queryPlan struct {
+	Plan
+	index *collectionIndex
+	// Entries of index scanned have prefix, and are in [lower, upper) after prefix.
+	prefix []byte
+	lower  []byte
+	upper  []byte
+}
+
+// Query finds values of a collection by conditions.
+type Query struct {
+	c         *Collection
+	tx        *Tx
+	condition *Condition
+	orderBy   string
+	desc      bool
+	limit     int
+}
+
+// Find values satisfying condition, all values if condition is nil.
+func (c *Collection) Find(condition *Condition) *Query {
+	return &Query{c: c, condition: condition}
+}
+
+// Find values satisfying condition in transaction, including writes of transaction itself.
+func (t *TxCollection) Find(condition *Condition) *Query {
+	return &Query{c: t.c, tx: t.tx, condition: condition}
+}
+
+// Order values by field ascending, field must be ordered, a bool, number, string or bytes. Order of
+// values with equal fields is unspecified.
+func (q *Query) OrderBy(field string) *Query {
+	q.orderBy = field
+	q.desc = false
+	return q
+}
+
+// Order values by field descending.
+func (q *Query) OrderByDesc(field string) *Query {
+	q.orderBy = field
+	q.desc = true
+	return q
+}
+
+// Find at most n values, unlimited if n is not positive.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+func (q *Query) compile() (*compiledCondition, error) {
+	if q.orderBy != "" {
+		t, err := q.c.fieldType(q.orderBy)
+		if err != nil {
+			return nil, err
+		}
+
+		if !indexable(t) {
+			return nil, WrapError(ErrTypeMismatch, "field '%s' of type %s is not ordered", q.orderBy, t)
+		}
+	}
+
+	if q.condition == nil {
+		return nil, nil
+	}
+
+	return q.c.compile(q.condition)
+}
+
+// Choose an index matching most conditions, equality on leading fields first, then a range on the
+// next field. An index ordered by OrderBy is used if no index matches.
+func (q *Query) plan(condition *compiledCondition) *queryPlan {
+	var conjuncts []*compiledCondition
+	if condition != nil {
+		conjuncts = condition.conjuncts()
+	}
+
+	best := &queryPlan{}
+	bestScore := 0
+	for _, index := range q.c.indexList() {
+		p, score := q.planIndex(index, conjuncts)
+		if score > bestScore || (score == bestScore && p.Ordered && !best.Ordered) {
+			best, bestScore = p, score
+		}
+	}
+
+	if bestScore <= 0 && !best.Ordered {
+		best = &queryPlan{}
+	}
+
+	best.OrderBy = q.orderBy
+	best.Limit = q.limit
+	if q.orderBy == "" {
+		best.Ordered = false
+	}
+
+	return best
+}
+
+func (q *Query) planIndex(index *collectionIndex, conjuncts []*compiledCondition) (*queryPlan, int) {
+	p := &queryPlan{index: index, prefix: append([]byte{}, index.prefix...)}
+	p.Index = index.Name
+	find := func(field string, ops ...queryOp) []*compiledCondition {
+		var found []*compiledCondition
+		for _, c := range conjuncts {
+			for _, op := range ops {
+				if c.field == field && c.op == op {
+					found = append(found, c)
+				}
+			}
+		}
+
+		return found
+	}
+
+	score := 0
+	eq := 0
+	for eq < len(index.Fields) {
+		conditions := find(index.Fields[eq], opEq)
+		if len(conditions) <= 0 {
+			break
+		}
+
+		p.prefix = append(p.prefix, conditions[0].encoded[0]...)
+		p.Bounds = append(p.Bounds, conditions[0].String())
+		score += 4
+		eq++
+	}
+
+	if eq < len(index.Fields) {
+		field := index.Fields[eq]
+		for _, c := range find(field, opGt, opGe) {
+			lower := c.encoded[0]
+			if c.op == opGt {
+				lower = prefixSuccessor(lower)
+			}
+
+			if p.lower == nil || bytes.Compare(lower, p.lower) > 0 {
+				p.lower = lower
+			}
+
+			p.Bounds = append(p.Bounds, c.String())
+			score = score | 2
+		}
+
+		for _, c := range find(field, opLt, opLe) {
+			upper := c.encoded[0]
+			if c.op == opLe {
+				upper = prefixSuccessor(upper)
+			}
+
+			if p.upper == nil || bytes.Compare(upper, p.upper) < 0 {
+				p.upper = upper
+			}
+
+			p.Bounds = append(p.Bounds, c.String())
+			score = score | 2
+		}
+
+	} else if index.Unique {
+		score += 8
+	}
+
+	for i, field := range index.Fields {
+		if field == q.orderBy && i <= eq {
+			p.Ordered = true
+		}
+	}
+
+	if eq >= len(index.Fields) && index.Unique {
+		p.Ordered = true
+	}
+
+	return p, score
+}
+
+// Explain how values are found.
+func (q *Query) Explain() (Plan, error) {
+	condition, err := q.compile()
+	if err != nil {
+		return Plan{}, err
+	}
+
+	return q.plan(condition).Plan, nil
+}
+
+type queryResult struct {
+	key   []byte
+	value reflect.Value
+	order []byte
+}
+
+// Run query, call fn with each value found in order, until fn returns false or an error.
+func (q *Query) run(fn func(key []byte, value reflect.Value) (bool, error)) error {
+	condition, err := q.compile()
+	if err != nil {
+		return err
+	}
+
+	p := q.plan(condition)
+	if q.tx != nil {
+		return q.execute(q.tx, condition, p, fn)
+	}
+
+	return q.c.db.View(func(tx *Tx) error {
+		return q.execute(tx, condition, p, fn)
+	})
+}
+
+func (q *Query) execute(tx *Tx, condition *compiledCondition, p *queryPlan,
+	fn func(key []byte, value reflect.Value) (bool, error)) error {
+	var results []queryResult
+	count := 0
+	streaming := q.orderBy == "" || p.Ordered
+	visit := func(key []byte, value reflect.Value) (bool, error) {
+		if condition != nil && !condition.match(value) {
+			return true, nil
+		}
+
+		if streaming {
+			count++
+			next, err := fn(key, value)
+			return next && (q.limit <= 0 || count < q.limit), err
+		}
+
+		field, err := meta.GetField(value.Interface(), q.orderBy)
+		if err != nil {
+			return false, err
+		}
+
+		results = append(results, queryResult{
+			key:   append([]byte{}, key...),
+			value: value,
+			order: appendIndexValue(nil, reflect.ValueOf(field)),
+		})
+
+		return true, nil
+	}
+
+	var err error
+	if p.index == nil {
+		err = q.scan(tx, visit)
+
+	} else {
+		err = q.scanIndex(tx, p, visit)
+	}
+
+	if err != nil || streaming {
+		return err
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		c := bytes.Compare(results[i].order, results[j].order)
+		if c == 0 {
+			c = bytes.Compare(results[i].key, results[j].key)
+		}
+
+		return (c < 0) != q.desc
+	})
+
+	for n, result := range results {
+		if q.limit > 0 && n >= q.limit {
+			break
+		}
+
+		if next, err := fn(result.key, result.value); err != nil || !next {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Scan all values in order of keys.
+func (q *Query) scan(tx *Tx, visit func(key []byte, value reflect.Value) (bool, error)) error {
+	iter, err := tx.iterator(q.c.prefix, nil)
+	if err != nil {
+		return err
+	}
+
+	next := true
+	for ok := iter.First(); ok && next && err == nil; ok = iter.Next() {
+		var value reflect.Value
+		if value, err = q.c.decode(iter.Value()); err == nil {
+			next, err = visit(iter.Key(), value)
+		}
+	}
+
+	if err == nil {
+		err = iter.Error()
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// Scan entries of index in bounds of plan, backward if ordered descending.
+func (q *Query) scanIndex(tx *Tx, p *queryPlan, visit func(key []byte, value reflect.Value) (bool, error)) error {
+	options := &IteratorOptions{
+		LowerBound: p.lower,
+		UpperBound: p.upper,
+	}
+
+	iter, err := tx.iterator(p.prefix, options)
+	if err != nil {
+		return err
+	}
+
+	backward := p.Ordered && q.desc
+	move := iter.Next
+	ok := false
+	if backward {
+		move = iter.Prev
+		ok = iter.Last()
+
+	} else {
+		ok = iter.First()
+	}
+
+	next := true
+	for ; ok && next && err == nil; ok = move() {
+		key := iter.Value()
+		var value reflect.Value
+		err = tx.view(q.c.key(key), func(data []byte, object interface{}) error {
+			var err error
+			value, err = q.c.load(data, object)
+			return err
+		})
+
+		// Value may expire after its index entry is read.
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+			continue
+		}
+
+		if err == nil {
+			next, err = visit(key, value)
+		}
+	}
+
+	if err == nil {
+		err = iter.Error()
+	}
+
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
+
+// Call fn with key and value found, value is a pointer to a copy of the registered struct, key is
+// valid during fn only. Stop if fn returns an error.
+func (q *Query) Each(fn func(key []byte, value interface{}) error) error {
+	return q.run(func(key []byte, value reflect.Value) (bool, error) {
+		pointer := meta.NewPointerOf(value.Type())
+		pointer.Elem().Set(value)
+		return true, fn(key, pointer.Interface())
+	})
+}
+
+// Set out, a pointer to a slice of the registered struct, to all values found.
+func (q *Query) All(out interface{}) error {
+	outValue := reflect.ValueOf(out)
+	if outValue.Kind() != reflect.Ptr || outValue.IsNil() || outValue.Elem().Kind() != reflect.Slice ||
+		outValue.Elem().Type().Elem() != q.c.valueType {
+		return WrapError(ErrTypeMismatch, "collection '%s' requires *[]%s to get values, but %T",
+			q.c.name, q.c.valueType, out)
+	}
+
+	values := reflect.MakeSlice(outValue.Elem().Type(), 0, 0)
+	err := q.run(func(key []byte, value reflect.Value) (bool, error) {
+		values = reflect.Append(values, value)
+		return true, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	outValue.Elem().Set(values)
+	return nil
+}
+
+// Count values found.
+func (q *Query) Count() (int, error) {
+	n := 0
+	err := q.run(func(key []byte, value reflect.Value) (bool, error) {
+		n++
+		return true, nil
+	})
+
+	return n, err
+}
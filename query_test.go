@@ -0,0 +1,211 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type testQueryWizard struct {
+	Name    string `pinkis:"unique"`
+	House   string `pinkis:"index:house_year"`
+	Year    int    `pinkis:"index:house_year"`
+	Age     int    `pinkis:"index"`
+	City    string
+	Courses []string
+}
+
+func openQueryCollection(t *testing.T) (*DB, *Collection) {
+	db := openTestDB(t)
+	c, err := db.Collection("wizards", testQueryWizard{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	wizards := []testQueryWizard{
+		{Name: "Harry Potter", House: "Gryffindor", Year: 5, Age: 15, City: "London"},
+		{Name: "Hermione Granger", House: "Gryffindor", Year: 5, Age: 16, City: "London"},
+		{Name: "Ginny Weasley", House: "Gryffindor", Year: 4, Age: 14, City: "Ottery St Catchpole"},
+		{Name: "Draco Malfoy", House: "Slytherin", Year: 5, Age: 15, City: "Wiltshire"},
+		{Name: "Albus Dumbledore", House: "Gryffindor", Year: 7, Age: 115, City: "Godric's Hollow"},
+		{Name: "Viktor Krum", House: "Durmstrang", Year: 7, Age: 18, City: "Oslo"},
+		{Name: "Olympe Maxime", House: "Beauxbatons", Year: 7, Age: 50, City: "Oslo",
+			Courses: []string{"Charms"}},
+		{Name: "Igor Karkaroff", House: "Durmstrang", Year: 7, Age: 60, City: "Oslo"},
+	}
+
+	for i, w := range wizards {
+		if err := c.Put([]byte(fmt.Sprintf("wizard-%02d", i)), w); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	return db, c
+}
+
+func queryNames(t *testing.T, q *Query) []string {
+	var wizards []testQueryWizard
+	if err := q.All(&wizards); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	names := make([]string, len(wizards))
+	for i, w := range wizards {
+		names[i] = w.Name
+	}
+
+	return names
+}
+
+func TestQueryFind(t *testing.T) {
+	db, c := openQueryCollection(t)
+	defer db.Close()
+
+	cases := []struct {
+		query    *Query
+		plan     string
+		expected string
+	}{
+		{
+			query:    c.Find(Where("Age").Gt(18).And(Where("City").Eq("Oslo"))).OrderBy("Name").Limit(50),
+			plan:     "index Age (Age > 18), sort by Name, limit 50",
+			expected: "[Igor Karkaroff Olympe Maxime]",
+		},
+		{
+			query:    c.Find(Where("House").Eq("Gryffindor").And(Where("Year").Ge(5))).OrderBy("Year"),
+			plan:     "index house_year (House = Gryffindor, Year >= 5), ordered by Year",
+			expected: "[Harry Potter Hermione Granger Albus Dumbledore]",
+		},
+		{
+			query:    c.Find(Where("Name").Eq("Viktor Krum")),
+			plan:     "index Name (Name = Viktor Krum)",
+			expected: "[Viktor Krum]",
+		},
+		{
+			query:    c.Find(Where("City").Eq("London").Or(Where("Age").Lt(15))),
+			plan:     "full scan",
+			expected: "[Harry Potter Hermione Granger Ginny Weasley]",
+		},
+		{
+			query:    c.Find(nil).OrderByDesc("Age").Limit(3),
+			plan:     "index Age, ordered by Age, limit 3",
+			expected: "[Albus Dumbledore Igor Karkaroff Olympe Maxime]",
+		},
+		{
+			query:    c.Find(Where("Year").Eq(7)).OrderByDesc("City").Limit(2),
+			plan:     "full scan, sort by City, limit 2",
+			expected: "[Igor Karkaroff Olympe Maxime]",
+		},
+		{
+			query:    c.Find(Where("Age").Ge(15).And(Where("Age").Le(16), Where("House").Ne("Slytherin"))),
+			plan:     "index Age (Age >= 15, Age <= 16)",
+			expected: "[Harry Potter Hermione Granger]",
+		},
+		{
+			query:    c.Find(Where("House").In("Durmstrang", "Beauxbatons")).Limit(2),
+			plan:     "full scan, limit 2",
+			expected: "[Viktor Krum Olympe Maxime]",
+		},
+		{
+			query:    c.Find(Where("Courses").Eq([]string{"Charms"})),
+			plan:     "full scan",
+			expected: "[Olympe Maxime]",
+		},
+		{
+			query:    c.Find(Where("Age").Gt(100.0)),
+			plan:     "index Age (Age > 100)",
+			expected: "[Albus Dumbledore]",
+		},
+	}
+
+	for i, tc := range cases {
+		plan, err := tc.query.Explain()
+		if err != nil {
+			t.Errorf("case %d: explain failed: %v", i, err)
+			continue
+		}
+
+		if plan.String() != tc.plan {
+			t.Errorf("case %d: unexpected plan: %s <=> %s", i, plan, tc.plan)
+		}
+
+		if names := fmt.Sprint(queryNames(t, tc.query)); names != tc.expected {
+			t.Errorf("case %d: unexpected result: %s <=> %s", i, names, tc.expected)
+		}
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	db, c := openQueryCollection(t)
+	defer db.Close()
+
+	cases := []struct {
+		query *Query
+		err   error
+	}{
+		{c.Find(Where("Wand").Eq("holly")), ErrInvalidOptions},
+		{c.Find(Where("Age").Eq("old")), ErrTypeMismatch},
+		{c.Find(Where("Age").Gt(15.5)), ErrTypeMismatch},
+		{c.Find(Where("Courses").Gt([]string{})), ErrTypeMismatch},
+		{c.Find(nil).OrderBy("Courses"), ErrTypeMismatch},
+		{c.Find(Where("Age").Eq(nil)), ErrTypeMismatch},
+	}
+
+	for i, tc := range cases {
+		if _, err := tc.query.Explain(); !errors.Is(err, tc.err) {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		}
+
+		if _, err := tc.query.Count(); !errors.Is(err, tc.err) {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		}
+	}
+
+	var wrong []testWizard
+	if err := c.Find(nil).All(&wrong); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestQueryInTx(t *testing.T) {
+	db, c := openQueryCollection(t)
+	defer db.Close()
+
+	err := db.Update(func(tx *Tx) error {
+		tc := tx.Collection(c)
+		if err := tc.Delete([]byte("wizard-05")); err != nil {
+			return err
+		}
+
+		luna := testQueryWizard{Name: "Luna Lovegood", House: "Ravenclaw", Year: 4, Age: 19, City: "Oslo"}
+		if err := tc.Put([]byte("wizard-99"), luna); err != nil {
+			return err
+		}
+
+		q := tc.Find(Where("City").Eq("Oslo").And(Where("Age").Lt(55))).OrderBy("Age")
+		if names := fmt.Sprint(queryNames(t, q)); names != "[Luna Lovegood Olympe Maxime]" {
+			t.Errorf("unexpected result: %s", names)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	var keys []string
+	err = c.Find(Where("City").Eq("Oslo")).Each(func(key []byte, value interface{}) error {
+		w := value.(*testQueryWizard)
+		keys = append(keys, string(key)+":"+w.Name)
+		return nil
+	})
+
+	if err != nil || fmt.Sprint(keys) != "[wizard-06:Olympe Maxime wizard-07:Igor Karkaroff wizard-99:Luna Lovegood]" {
+		t.Errorf("unexpected result: %v, %v", keys, err)
+	}
+
+	if n, err := c.Find(Where("Year").Eq(7)).Count(); n != 3 || err != nil {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+}
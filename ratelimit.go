@@ -0,0 +1,58 @@
+package pinkis
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket limiting bytes per second, a nil limiter never limits. Burst is one second of
+// rate, so that short bursts are not slowed down.
+type rateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	available float64
+	last      time.Time
+	sleep     func(d time.Duration)
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	r := &rateLimiter{
+		rate:      float64(bytesPerSecond),
+		available: float64(bytesPerSecond),
+		last:      time.Now(),
+		sleep:     time.Sleep,
+	}
+
+	return r
+}
+
+// Take n bytes from bucket, wait until they are available.
+func (r *rateLimiter) Wait(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+
+	r.lock.Lock()
+	now := time.Now()
+	r.available += now.Sub(r.last).Seconds() * r.rate
+	if r.available > r.rate {
+		r.available = r.rate
+	}
+
+	r.last = now
+	r.available -= float64(n)
+	var wait time.Duration
+	if r.available < 0 {
+		wait = time.Duration(-r.available / r.rate * float64(time.Second))
+	}
+
+	r.lock.Unlock()
+
+	if wait > 0 {
+		r.sleep(wait)
+	}
+}
@@ -0,0 +1,31 @@
+package pinkis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(1000)
+	var slept time.Duration
+	r.sleep = func(d time.Duration) { slept += d }
+
+	r.Wait(500)
+	if slept != 0 {
+		t.Errorf("burst within rate should not wait, waited %v", slept)
+	}
+
+	r.Wait(1500)
+	if slept < 900*time.Millisecond || slept > 1100*time.Millisecond {
+		t.Errorf("unexpected wait time: %v", slept)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	if r := newRateLimiter(0); r != nil {
+		t.Errorf("non-positive rate should be unlimited")
+	}
+
+	var r *rateLimiter
+	r.Wait(1 << 30)
+}
@@ -0,0 +1,239 @@
+package pinkis
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+const (
+	skiplistMaxLevel    = 16
+	skiplistBranching   = 4
+	skiplistDefaultSeed = 0x70696e6b6973
+)
+
+type compareFunc func(a []byte, b []byte) int
+
+// Compare keys in lexicographical order.
+func bytewiseCompare(a []byte, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+type skipNode struct {
+	key    []byte
+	value  []byte
+	object interface{}
+	next   []*skipNode
+}
+
+// Next node in the lowest level, nil for the last node.
+func (n *skipNode) Next() *skipNode {
+	return n.next[0]
+}
+
+// An ordered map from key to value. A skiplist is NOT safe for concurrent use, the owner must
+// serialize writers against readers.
+type skiplist struct {
+	head    *skipNode
+	level   int
+	length  int
+	size    int
+	compare compareFunc
+	random  *rand.Rand
+}
+
+func newSkiplist(compare compareFunc) *skiplist {
+	if compare == nil {
+		compare = bytewiseCompare
+	}
+
+	l := &skiplist{
+		head: &skipNode{
+			next: make([]*skipNode, skiplistMaxLevel),
+		},
+		level:   1,
+		compare: compare,
+		random:  rand.New(rand.NewSource(skiplistDefaultSeed)),
+	}
+
+	return l
+}
+
+func (l *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && l.random.Intn(skiplistBranching) == 0 {
+		level++
+	}
+
+	return level
+}
+
+// Find the first node whose key >= key, record the rightmost node before it at each level.
+func (l *skiplist) findGreaterOrEqual(key []byte, prev []*skipNode) *skipNode {
+	node := l.head
+	level := l.level - 1
+	for {
+		next := node.next[level]
+		if next != nil && l.compare(next.key, key) < 0 {
+			node = next
+			continue
+		}
+
+		if prev != nil {
+			prev[level] = node
+		}
+
+		if level == 0 {
+			return next
+		}
+
+		level--
+	}
+}
+
+// Find the last node whose key < key, nil if there is no such node.
+func (l *skiplist) findLessThan(key []byte) *skipNode {
+	node := l.head
+	level := l.level - 1
+	for {
+		next := node.next[level]
+		if next != nil && l.compare(next.key, key) < 0 {
+			node = next
+			continue
+		}
+
+		if level == 0 {
+			break
+		}
+
+		level--
+	}
+
+	if node == l.head {
+		return nil
+	}
+
+	return node
+}
+
+// Find the last node in list, nil if list is empty.
+func (l *skiplist) findLast() *skipNode {
+	node := l.head
+	level := l.level - 1
+	for {
+		next := node.next[level]
+		if next != nil {
+			node = next
+			continue
+		}
+
+		if level == 0 {
+			break
+		}
+
+		level--
+	}
+
+	if node == l.head {
+		return nil
+	}
+
+	return node
+}
+
+// Get node of key, nil if key does not exist.
+func (l *skiplist) Find(key []byte) *skipNode {
+	node := l.findGreaterOrEqual(key, nil)
+	if node != nil && l.compare(node.key, key) == 0 {
+		return node
+	}
+
+	return nil
+}
+
+// Get first node whose key >= key.
+func (l *skiplist) Seek(key []byte) *skipNode {
+	return l.findGreaterOrEqual(key, nil)
+}
+
+func (l *skiplist) First() *skipNode {
+	return l.head.next[0]
+}
+
+func (l *skiplist) Last() *skipNode {
+	return l.findLast()
+}
+
+// Get last node whose key < key.
+func (l *skiplist) Before(key []byte) *skipNode {
+	return l.findLessThan(key)
+}
+
+// Put key, value and an optional object into list, return true if an existing key is replaced.
+func (l *skiplist) Put(key []byte, value []byte, object interface{}) bool {
+	prev := make([]*skipNode, skiplistMaxLevel)
+	node := l.findGreaterOrEqual(key, prev)
+	if node != nil && l.compare(node.key, key) == 0 {
+		l.size += len(value) - len(node.value)
+		node.value = value
+		node.object = object
+		return true
+	}
+
+	level := l.randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			prev[i] = l.head
+		}
+
+		l.level = level
+	}
+
+	node = &skipNode{
+		key:    key,
+		value:  value,
+		object: object,
+		next:   make([]*skipNode, level),
+	}
+
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+
+	l.length++
+	l.size += len(key) + len(value)
+	return false
+}
+
+// Remove key from list, return true if key exists.
+func (l *skiplist) Remove(key []byte) bool {
+	prev := make([]*skipNode, skiplistMaxLevel)
+	node := l.findGreaterOrEqual(key, prev)
+	if node == nil || l.compare(node.key, key) != 0 {
+		return false
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		if prev[i].next[i] == node {
+			prev[i].next[i] = node.next[i]
+		}
+	}
+
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+
+	l.length--
+	l.size -= len(node.key) + len(node.value)
+	return true
+}
+
+// Number of keys in list.
+func (l *skiplist) Len() int {
+	return l.length
+}
+
+// Approximate memory used by keys and values.
+func (l *skiplist) Size() int {
+	return l.size
+}
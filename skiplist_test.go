@@ -0,0 +1,139 @@
+package pinkis
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestSkiplistPutAndFind(t *testing.T) {
+	l := newSkiplist(nil)
+
+	if l.Put([]byte("harry"), []byte("gryffindor"), nil) {
+		t.Errorf("put new key should not replace")
+	}
+
+	if !l.Put([]byte("harry"), []byte("potter"), nil) {
+		t.Errorf("put existing key should replace")
+	}
+
+	l.Put([]byte("draco"), []byte("slytherin"), nil)
+
+	if l.Len() != 2 {
+		t.Errorf("unexpected length: %d", l.Len())
+	}
+
+	node := l.Find([]byte("harry"))
+	if node == nil || string(node.value) != "potter" {
+		t.Errorf("unexpected node: %v", node)
+	}
+
+	if node := l.Find([]byte("hermione")); node != nil {
+		t.Errorf("unexpected node: %v", node)
+	}
+
+	size := len("harry") + len("potter") + len("draco") + len("slytherin")
+	if l.Size() != size {
+		t.Errorf("unexpected size: %d <=> %d", l.Size(), size)
+	}
+}
+
+func TestSkiplistOrder(t *testing.T) {
+	l := newSkiplist(bytewiseCompare)
+	keys := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", (i*7919)%1000)
+		keys = append(keys, key)
+		l.Put([]byte(key), []byte(key), nil)
+	}
+
+	sort.Strings(keys)
+	i := 0
+	for node := l.First(); node != nil; node = node.Next() {
+		if string(node.key) != keys[i] {
+			t.Fatalf("keys[%d] = %s <=> %s", i, node.key, keys[i])
+		}
+
+		i++
+	}
+
+	if i != len(keys) {
+		t.Errorf("unexpected count: %d", i)
+	}
+
+	last := l.Last()
+	if last == nil || string(last.key) != keys[len(keys)-1] {
+		t.Errorf("unexpected last: %v", last)
+	}
+}
+
+func TestSkiplistSeek(t *testing.T) {
+	l := newSkiplist(nil)
+	for _, key := range []string{"b", "d", "f"} {
+		l.Put([]byte(key), nil, nil)
+	}
+
+	cases := []struct {
+		key    string
+		seek   string
+		before string
+	}{
+		{"a", "b", ""},
+		{"b", "b", ""},
+		{"c", "d", "b"},
+		{"f", "f", "d"},
+		{"g", "", "f"},
+	}
+
+	for _, c := range cases {
+		seek := l.Seek([]byte(c.key))
+		if (seek == nil && c.seek != "") || (seek != nil && string(seek.key) != c.seek) {
+			t.Errorf("Seek(%s) got %v, expected %s", c.key, seek, c.seek)
+		}
+
+		before := l.Before([]byte(c.key))
+		if (before == nil && c.before != "") || (before != nil && string(before.key) != c.before) {
+			t.Errorf("Before(%s) got %v, expected %s", c.key, before, c.before)
+		}
+	}
+}
+
+func TestSkiplistRemove(t *testing.T) {
+	l := newSkiplist(nil)
+	for i := 0; i < 100; i++ {
+		l.Put([]byte(fmt.Sprintf("%03d", i)), []byte("v"), nil)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		if !l.Remove([]byte(fmt.Sprintf("%03d", i))) {
+			t.Errorf("remove %03d failed", i)
+		}
+	}
+
+	if l.Remove([]byte("000")) {
+		t.Errorf("remove a removed key should be false")
+	}
+
+	if l.Len() != 50 {
+		t.Errorf("unexpected length: %d", l.Len())
+	}
+
+	for i := 0; i < 100; i++ {
+		node := l.Find([]byte(fmt.Sprintf("%03d", i)))
+		if (i%2 == 0) != (node == nil) {
+			t.Errorf("unexpected node for %03d: %v", i, node)
+		}
+	}
+
+	if l.Size() != 50*4 {
+		t.Errorf("unexpected size: %d", l.Size())
+	}
+
+	for i := 1; i < 100; i += 2 {
+		l.Remove([]byte(fmt.Sprintf("%03d", i)))
+	}
+
+	if l.First() != nil || l.Last() != nil || l.level != 1 {
+		t.Errorf("list should be empty")
+	}
+}
@@ -0,0 +1,176 @@
+package pinkis
+
+import (
+	"encoding/binary"
+)
+
+// Snappy block format, a uvarint of decompressed length followed by elements, each starts with a
+// tag byte whose lowest 2 bits are type of element:
+//
+//	literal  00, length-1 in upper 6 bits if less than 60, otherwise 60-63 for 1-4 bytes of
+//	         length-1 following tag, little endian, then literal bytes
+//	copy 1   01, length-4 in 3 bits, upper 3 bits of 11-bit offset, then lower 8 bits of offset
+//	copy 2   10, length-1 in upper 6 bits, then 2 bytes offset, little endian
+//	copy 4   11, length-1 in upper 6 bits, then 4 bytes offset, little endian
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+	// Copies farther than 64KB are never made, but they are read.
+	snappyWindow = 1<<16 - 1
+)
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Type() byte {
+	return 1
+}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(dst []byte, src []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(src)))
+	position := 0
+	for _, s := range lzParse(src, snappyWindow, 1, nil) {
+		dst = snappyLiteral(dst, src[position:position+s.literals])
+		dst = snappyCopy(dst, s.offset, s.length)
+		position += s.literals + s.length
+	}
+
+	return snappyLiteral(dst, src[position:])
+}
+
+func snappyLiteral(dst []byte, literal []byte) []byte {
+	n := len(literal) - 1
+	switch {
+	case len(literal) <= 0:
+		return dst
+
+	case n < 60:
+		dst = append(dst, byte(n<<2)|snappyTagLiteral)
+
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+
+	return append(dst, literal...)
+}
+
+// Append copies of length, split into copies of at most 64 bytes, none shorter than 4 bytes.
+func snappyCopy(dst []byte, offset int, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+func (snappyCompressor) Decompress(dst []byte, src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > uint64(len(src))*255 {
+		return nil, WrapError(ErrCorrupted, "invalid snappy length")
+	}
+
+	base := len(dst)
+	dst = append(dst, make([]byte, length)...)
+	out := dst[base:]
+	d := 0
+	for s := n; s < len(src); {
+		tag := src[s]
+		var offset, size int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			size = int(tag >> 2)
+			s++
+			if size >= 60 {
+				extra := size - 59
+				if s+extra > len(src) {
+					return nil, WrapError(ErrCorrupted, "truncated snappy literal")
+				}
+
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[s+i])
+				}
+
+				s += extra
+			}
+
+			size++
+			if size > len(src)-s || size > len(out)-d {
+				return nil, WrapError(ErrCorrupted, "snappy literal of %d bytes overflows", size)
+			}
+
+			copy(out[d:], src[s:s+size])
+			s += size
+			d += size
+			continue
+
+		case snappyTagCopy1:
+			if s+2 > len(src) {
+				return nil, WrapError(ErrCorrupted, "truncated snappy copy")
+			}
+
+			size = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+
+		case snappyTagCopy2:
+			if s+3 > len(src) {
+				return nil, WrapError(ErrCorrupted, "truncated snappy copy")
+			}
+
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+
+		case snappyTagCopy4:
+			if s+5 > len(src) {
+				return nil, WrapError(ErrCorrupted, "truncated snappy copy")
+			}
+
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+
+		if offset <= 0 || offset > d || size > len(out)-d {
+			return nil, WrapError(ErrCorrupted, "invalid snappy copy of %d bytes at %d", size, offset)
+		}
+
+		// Copies may overlap bytes they produce, byte by byte is required.
+		for i := 0; i < size; i++ {
+			out[d+i] = out[d-offset+i]
+		}
+
+		d += size
+	}
+
+	if d != len(out) {
+		return nil, WrapError(ErrCorrupted, "snappy decompressed %d bytes, but %d", d, len(out))
+	}
+
+	return dst, nil
+}
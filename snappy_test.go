@@ -0,0 +1,65 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSnappyFormat(t *testing.T) {
+	cases := []struct {
+		compressed []byte
+		expected   string
+	}{
+		// Literal "abcd", then copy 1 of 6 bytes at offset 4.
+		{[]byte{10, 3 << 2, 'a', 'b', 'c', 'd', 2<<2 | snappyTagCopy1, 4}, "abcdabcdab"},
+		// Literal "ab", then copy 2 of 5 bytes at offset 2.
+		{[]byte{7, 1 << 2, 'a', 'b', 4<<2 | snappyTagCopy2, 2, 0}, "abababa"},
+		// Literal "xyz", then copy 4 of 3 bytes at offset 3.
+		{[]byte{6, 2 << 2, 'x', 'y', 'z', 2<<2 | snappyTagCopy4, 3, 0, 0, 0}, "xyzxyz"},
+		// Literal with length in a following byte.
+		{append([]byte{61, 60 << 2, 60}, bytes.Repeat([]byte{'h'}, 61)...), string(bytes.Repeat([]byte{'h'}, 61))},
+	}
+
+	for i, c := range cases {
+		got, err := SnappyCompression.Decompress(nil, c.compressed)
+		if err != nil || string(got) != c.expected {
+			t.Errorf("case %d: unexpected result: %q, %v", i, got, err)
+		}
+	}
+
+	corrupted := [][]byte{
+		{},
+		// Length mismatch.
+		{5, 1 << 2, 'a', 'b'},
+		// Offset out of output.
+		{6, 1 << 2, 'a', 'b', 0<<2 | snappyTagCopy1, 3},
+		// Zero offset.
+		{6, 1 << 2, 'a', 'b', 0<<2 | snappyTagCopy1, 0},
+		// Truncated literal.
+		{4, 3 << 2, 'a', 'b'},
+		// Truncated copy.
+		{8, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyTagCopy2, 4},
+	}
+
+	for i, data := range corrupted {
+		if _, err := SnappyCompression.Decompress(nil, data); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestSnappyLongCopies(t *testing.T) {
+	data := append([]byte("0123456789"), bytes.Repeat([]byte("0123456789"), 500)...)
+	data = append(data, make([]byte, 70000)...)
+	data = append(data, []byte("0123456789")...)
+	compressed := SnappyCompression.Compress(nil, data)
+	if len(compressed) > len(data)/20 {
+		t.Errorf("poor compression: %d => %d", len(data), len(compressed))
+	}
+
+	got, err := SnappyCompression.Decompress(nil, compressed)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("round trip failed: %v", err)
+	}
+}
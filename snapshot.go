@@ -0,0 +1,140 @@
+package pinkis
+
+import (
+	"sort"
+	"sync"
+)
+
+// Sequence numbers of live snapshots, with counts of snapshots at each of them. Old versions
+// visible at the oldest live snapshot must be kept.
+type snapshotList struct {
+	lock   sync.Mutex
+	counts map[uint64]int
+}
+
+func newSnapshotList() *snapshotList {
+	l := &snapshotList{
+		counts: make(map[uint64]int),
+	}
+
+	return l
+}
+
+func (l *snapshotList) add(seq uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.counts[seq]++
+}
+
+func (l *snapshotList) remove(seq uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.counts[seq]--
+	if l.counts[seq] <= 0 {
+		delete(l.counts, seq)
+	}
+}
+
+// Number of live snapshots.
+func (l *snapshotList) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n := 0
+	for _, count := range l.counts {
+		n += count
+	}
+
+	return n
+}
+
+// Sequence number of the oldest live snapshot, or latest if there is none or all snapshots are
+// newer than it.
+func (l *snapshotList) oldest(latest uint64) uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	oldest := latest
+	for seq := range l.counts {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+
+	return oldest
+}
+
+// Distinct sequence numbers of live snapshots and latest, in descending order.
+func (l *snapshotList) sequences(latest uint64) []uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	result := make([]uint64, 0, len(l.counts)+1)
+	result = append(result, latest)
+	for seq := range l.counts {
+		if seq != latest {
+			result = append(result, seq)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i] > result[j] })
+	return result
+}
+
+// Snapshot of an engine keeping versions of keys by sequence number, it reads the newest versions
+// whose sequence numbers <= seq.
+type sequenceSnapshot struct {
+	seq      uint64
+	list     *snapshotList
+	view     func(key []byte, seq uint64, fn func(value []byte, object interface{}) error) error
+	iterator func(seq uint64) engineIterator
+	release  func()
+	released bool
+}
+
+func newSequenceSnapshot(list *snapshotList, seq uint64,
+	view func(key []byte, seq uint64, fn func(value []byte, object interface{}) error) error) *sequenceSnapshot {
+
+	list.add(seq)
+	s := &sequenceSnapshot{
+		seq:  seq,
+		list: list,
+		view: view,
+	}
+
+	return s
+}
+
+func (s *sequenceSnapshot) Sequence() uint64 {
+	return s.seq
+}
+
+func (s *sequenceSnapshot) View(key []byte, fn func(value []byte, object interface{}) error) error {
+	if s.released {
+		return ErrTxClosed
+	}
+
+	return s.view(key, s.seq, fn)
+}
+
+func (s *sequenceSnapshot) Iterator() engineIterator {
+	if s.released {
+		return &emptyIterator{err: ErrTxClosed}
+	}
+
+	return s.iterator(s.seq)
+}
+
+func (s *sequenceSnapshot) Release() {
+	if s.released {
+		return
+	}
+
+	s.released = true
+	s.list.remove(s.seq)
+	if s.release != nil {
+		s.release()
+	}
+}
@@ -0,0 +1,99 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSnapshotList(t *testing.T) {
+	l := newSnapshotList()
+	if l.oldest(10) != 10 {
+		t.Errorf("latest should be the oldest without snapshots")
+	}
+
+	l.add(5)
+	l.add(3)
+	l.add(3)
+	l.remove(3)
+	if l.oldest(10) != 3 || l.Len() != 2 {
+		t.Errorf("unexpected oldest snapshot: %d, %d snapshots", l.oldest(10), l.Len())
+	}
+
+	l.remove(3)
+	if l.oldest(4) != 4 {
+		t.Errorf("unexpected oldest snapshot: %d", l.oldest(4))
+	}
+}
+
+// Old versions are kept for snapshots, and collected when snapshots are released.
+func TestMemoryEngineSnapshot(t *testing.T) {
+	e := newMemoryEngine()
+	defer e.Close()
+
+	apply := func(seq uint64, batch *writeBatch) {
+		batch.seq = seq
+		if err := e.Apply(batch); err != nil {
+			t.Fatalf("apply failed: %v", err)
+		}
+	}
+
+	apply(1, putBatch("hedwig", "owl"))
+	apply(2, putBatch("hedwig", "snowy owl"))
+	if e.mem.Len() != 1 {
+		t.Errorf("overwritten version should be collected, %d versions", e.mem.Len())
+	}
+
+	s, _ := e.Snapshot()
+	for i := 3; i < 10; i++ {
+		apply(uint64(i), putBatch("hedwig", fmt.Sprint(i)))
+	}
+
+	apply(10, deleteBatch("hedwig"))
+	err := s.View([]byte("hedwig"), func(value []byte, object interface{}) error {
+		if string(value) != "snowy owl" {
+			t.Errorf("unexpected value in snapshot: %s", value)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Errorf("view failed: %v", err)
+	}
+
+	if e.mem.Len() != 2 {
+		t.Errorf("only versions visible to readers should be kept, %d versions", e.mem.Len())
+	}
+
+	s.Release()
+	if e.mem.Len() != 0 || len(e.versioned) != 0 {
+		t.Errorf("all versions should be collected, %d versions", e.mem.Len())
+	}
+
+	if err := s.View([]byte("hedwig"), nil); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLSMSnapshotCompaction(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	defer db.Close()
+
+	db.Put([]byte("dobby"), []byte("house-elf"))
+	tx, _ := db.Begin(false)
+	defer tx.Rollback()
+
+	db.Put([]byte("dobby"), []byte("free elf"))
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	if value, err := tx.Get([]byte("dobby")); err != nil || string(value) != "house-elf" {
+		t.Errorf("version visible to snapshot should survive compaction: %s, %v", value, err)
+	}
+
+	if value, _ := db.Get([]byte("dobby")); string(value) != "free elf" {
+		t.Errorf("unexpected latest value: %s", value)
+	}
+}
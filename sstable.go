@@ -0,0 +1,702 @@
+package pinkis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// Sorted string table, an immutable file of entries sorted by internal keys:
+//
+//	key envelope    optional, see fileCipher
+//	data blocks     [block, trailer] * n
+//	filter block    [filter, trailer], optional, see filterPolicy
+//	metaindex block [block, trailer], name => handle of meta blocks
+//	index block     [block, trailer], last key of data block => handle of data block
+//	footer          metaindex handle, index handle, magic
+//
+// Each block is followed by a trailer of block type and CRC32C of block content and type. Block
+// type is type of Compressor of data blocks, other blocks are never compressed. Keys of a data
+// block are compressed by the same compressor, a block ends early when compressor changes. Blocks
+// of an encrypted table are sealed by data key of table after compressed, with block offset as
+// nonce, checksums are of sealed blocks.
+const (
+	tableSuffix          = ".sst"
+	tableMagic           = uint64(0x70696e6b69737374)
+	tableFooterSize      = 40
+	blockTrailerSize     = 5
+	blockTypeRaw         = byte(0)
+	tableDefaultBlock    = 4 << 10
+	tableMaxBlockHandles = 2 * binary.MaxVarintLen64
+)
+
+func tableFileName(number uint64) string {
+	return fmt.Sprintf("%06d%s", number, tableSuffix)
+}
+
+// Position of a block in table, size excludes trailer.
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func (h blockHandle) Encode() []byte {
+	buffer := make([]byte, tableMaxBlockHandles)
+	n := binary.PutUvarint(buffer, h.offset)
+	n += binary.PutUvarint(buffer[n:], h.size)
+	return buffer[:n]
+}
+
+func decodeBlockHandle(data []byte) (blockHandle, error) {
+	offset, n1 := binary.Uvarint(data)
+	size, n2 := uvarintAt(data, n1)
+	if n1 <= 0 || n2 <= 0 {
+		return blockHandle{}, WrapError(ErrCorrupted, "invalid block handle")
+	}
+
+	return blockHandle{offset: offset, size: size}, nil
+}
+
+func blockChecksum(content []byte, blockType byte) uint32 {
+	crc := crc32.Update(0, crc32cTable, content)
+	return crc32.Update(crc, crc32cTable, []byte{blockType})
+}
+
+// Metadata of a live table.
+type tableMeta struct {
+	level    int
+	number   uint64
+	size     uint64
+	smallest []byte
+	largest  []byte
+}
+
+// Options of tables shared by writers and readers, all optional.
+type tableOptions struct {
+	blockSize int
+	filter    *filterPolicy
+	// Compressors of data blocks, nothing is compressed if nil.
+	compression *compressionPolicy
+	// Index and filter blocks of readers are pinned in cache, data blocks are cached when read.
+	cache *blockCache
+	// Master keys of encrypted tables, new tables are not encrypted if nil.
+	keys KeyProvider
+	// Skip verifying checksums of data blocks on read.
+	skipChecksums bool
+}
+
+type tableWriter struct {
+	file      *os.File
+	compare   compareFunc
+	blockSize int
+	offset    uint64
+	filter    *filterPolicy
+	bloom     *bloomBuilder
+	// Filter key last added, versions of a key, or keys of a prefix, are added once.
+	filterKey []byte
+	// Compressor of the current data block, and buffer of compressed blocks.
+	compression *compressionPolicy
+	compressor  Compressor
+	compressed  []byte
+	// Cipher of an encrypted table, and buffer of sealed blocks.
+	cipher *fileCipher
+	sealed []byte
+
+	data      *blockBuilder
+	index     *blockBuilder
+	lastKey   []byte
+	pending   bool
+	handle    blockHandle
+	entries   int
+	smallest  []byte
+	metaindex map[string]blockHandle
+}
+
+// Make a table writer, compare is the comparator of internal keys. Table is encrypted by a new data
+// key if options has keys.
+func newTableWriter(file *os.File, compare compareFunc, options tableOptions) (*tableWriter, error) {
+	blockSize := options.blockSize
+	if blockSize <= 0 {
+		blockSize = tableDefaultBlock
+	}
+
+	w := &tableWriter{
+		file:        file,
+		compare:     compare,
+		blockSize:   blockSize,
+		compression: options.compression,
+		data:        newBlockBuilder(),
+		index:       newBlockBuilder(),
+		metaindex:   make(map[string]blockHandle),
+	}
+
+	if options.filter != nil {
+		w.filter = options.filter
+		w.bloom = &bloomBuilder{bitsPerKey: options.filter.bitsPerKey}
+	}
+
+	if options.keys != nil {
+		c, err := newFileCipher(options.keys)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := file.Write(c.envelope); err != nil {
+			return nil, err
+		}
+
+		w.cipher = c
+		w.offset = uint64(len(c.envelope))
+	}
+
+	return w, nil
+}
+
+// Add an entry, ikey must be greater than all keys added.
+func (w *tableWriter) Add(ikey []byte, value []byte) error {
+	if w.entries > 0 && w.compare(ikey, w.lastKey) <= 0 {
+		return NewError("table keys out of order")
+	}
+
+	compressor := w.compression.compressor(internalUserKey(ikey))
+	if compressor != w.compressor {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+
+		w.compressor = compressor
+	}
+
+	if w.pending {
+		w.index.Add(w.lastKey, w.handle.Encode())
+		w.pending = false
+	}
+
+	if w.entries <= 0 {
+		w.smallest = append([]byte{}, ikey...)
+	}
+
+	if w.filter != nil {
+		key := w.filter.filterKey(internalUserKey(ikey))
+		if w.entries <= 0 || !bytes.Equal(key, w.filterKey) {
+			w.bloom.Add(key)
+			w.filterKey = append(w.filterKey[:0], key...)
+		}
+	}
+
+	w.data.Add(ikey, value)
+	w.lastKey = append(w.lastKey[:0], ikey...)
+	w.entries++
+
+	if w.data.EstimatedSize() >= w.blockSize {
+		return w.flushBlock()
+	}
+
+	return nil
+}
+
+func (w *tableWriter) flushBlock() error {
+	if w.data.Empty() {
+		return nil
+	}
+
+	blockType, content := compressBlock(w.compressor, w.data.Finish(), w.compressed)
+	handle, err := w.writeBlock(content, blockType)
+	if err != nil {
+		return err
+	}
+
+	if blockType != blockTypeRaw {
+		w.compressed = content[:0]
+	}
+
+	w.data.Reset()
+	w.handle = handle
+	w.pending = true
+	return nil
+}
+
+func (w *tableWriter) writeBlock(content []byte, blockType byte) (blockHandle, error) {
+	if w.cipher != nil {
+		content = w.cipher.seal(w.sealed[:0], w.offset, content)
+		w.sealed = content
+	}
+
+	handle := blockHandle{
+		offset: w.offset,
+		size:   uint64(len(content)),
+	}
+
+	var trailer [blockTrailerSize]byte
+	trailer[0] = blockType
+	binary.LittleEndian.PutUint32(trailer[1:], blockChecksum(content, blockType))
+
+	if _, err := w.file.Write(content); err != nil {
+		return handle, err
+	}
+
+	if _, err := w.file.Write(trailer[:]); err != nil {
+		return handle, err
+	}
+
+	w.offset += uint64(len(content)) + blockTrailerSize
+	return handle, nil
+}
+
+// Number of entries added.
+func (w *tableWriter) Entries() int {
+	return w.entries
+}
+
+// Approximate size of table if it is finished now.
+func (w *tableWriter) EstimatedSize() uint64 {
+	return w.offset + uint64(w.data.EstimatedSize())
+}
+
+// Write index and footer, and sync file. Return metadata of table with number and level unset.
+func (w *tableWriter) Finish() (*tableMeta, error) {
+	if err := w.flushBlock(); err != nil {
+		return nil, err
+	}
+
+	if w.pending {
+		w.index.Add(w.lastKey, w.handle.Encode())
+		w.pending = false
+	}
+
+	if w.filter != nil {
+		handle, err := w.writeBlock(w.bloom.Finish(), blockTypeRaw)
+		if err != nil {
+			return nil, err
+		}
+
+		w.metaindex[w.filter.name()] = handle
+	}
+
+	metaindex := newBlockBuilder()
+	for _, name := range sortedHandleNames(w.metaindex) {
+		metaindex.Add([]byte(name), w.metaindex[name].Encode())
+	}
+
+	metaindexHandle, err := w.writeBlock(metaindex.Finish(), blockTypeRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	indexHandle, err := w.writeBlock(w.index.Finish(), blockTypeRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	var footer [tableFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[0:], metaindexHandle.offset)
+	binary.LittleEndian.PutUint64(footer[8:], metaindexHandle.size)
+	binary.LittleEndian.PutUint64(footer[16:], indexHandle.offset)
+	binary.LittleEndian.PutUint64(footer[24:], indexHandle.size)
+	binary.LittleEndian.PutUint64(footer[32:], tableMagic)
+	if _, err := w.file.Write(footer[:]); err != nil {
+		return nil, err
+	}
+
+	w.offset += tableFooterSize
+	if err := w.file.Sync(); err != nil {
+		return nil, err
+	}
+
+	meta := &tableMeta{
+		size:     w.offset,
+		smallest: w.smallest,
+		largest:  append([]byte{}, w.lastKey...),
+	}
+
+	return meta, nil
+}
+
+func sortedHandleNames(handles map[string]blockHandle) []string {
+	names := make([]string, 0, len(handles))
+	for name := range handles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Reader of a table, safe for concurrent use.
+type tableReader struct {
+	file      *os.File
+	number    uint64
+	size      uint64
+	compare   compareFunc
+	index     *block
+	metaindex map[string]blockHandle
+	cache     *blockCache
+	// Filter of table, nil if table has no filter of policy.
+	policy *filterPolicy
+	filter []byte
+	// Keys of blocks pinned in cache, erased when reader is closed.
+	pinned []string
+	// Cipher of an encrypted table, nil if table is not encrypted.
+	cipher *fileCipher
+	// Checksums of data blocks are not verified, those of index and meta blocks always are.
+	skipChecksums bool
+}
+
+func openTable(path string, number uint64, compare compareFunc, options tableOptions) (*tableReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := newTableReader(file, number, compare, options)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func newTableReader(file *os.File, number uint64, compare compareFunc, options tableOptions) (*tableReader, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := uint64(stat.Size())
+	if size < tableFooterSize {
+		return nil, WrapError(ErrCorrupted, "table %s too short, %d bytes", tableFileName(number), size)
+	}
+
+	var footer [tableFooterSize]byte
+	if _, err := file.ReadAt(footer[:], int64(size-tableFooterSize)); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint64(footer[32:]) != tableMagic {
+		return nil, WrapError(ErrCorrupted, "bad magic number of table %s", tableFileName(number))
+	}
+
+	t := &tableReader{
+		file:          file,
+		number:        number,
+		size:          size,
+		compare:       compare,
+		metaindex:     make(map[string]blockHandle),
+		cache:         options.cache,
+		skipChecksums: options.skipChecksums,
+	}
+
+	if t.cipher, err = readEnvelope(file, options.keys, tableFileName(number)); err != nil {
+		return nil, err
+	}
+
+	metaindexHandle := blockHandle{
+		offset: binary.LittleEndian.Uint64(footer[0:]),
+		size:   binary.LittleEndian.Uint64(footer[8:]),
+	}
+
+	indexHandle := blockHandle{
+		offset: binary.LittleEndian.Uint64(footer[16:]),
+		size:   binary.LittleEndian.Uint64(footer[24:]),
+	}
+
+	if t.index, err = t.readBlock(indexHandle, true); err != nil {
+		return nil, err
+	}
+
+	metaindex, err := t.readBlock(metaindexHandle, true)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := metaindex.Iterator(bytewiseCompare)
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		handle, err := decodeBlockHandle(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+
+		t.metaindex[string(iter.Key())] = handle
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if options.filter != nil {
+		if handle, found := t.metaindex[options.filter.name()]; found {
+			if t.filter, _, err = t.readBlockContent(handle, true); err != nil {
+				return nil, err
+			}
+
+			t.policy = options.filter
+			t.pin(handle, t.filter)
+		}
+	}
+
+	t.pin(indexHandle, t.index)
+	return t, nil
+}
+
+// Pin a block kept by reader in cache, so that cache accounts for it.
+func (t *tableReader) pin(handle blockHandle, value interface{}) {
+	if t.cache == nil {
+		return
+	}
+
+	key := blockCacheKey(t.number, handle.offset)
+	t.cache.Put(key, value, int64(handle.size), true)
+	t.pinned = append(t.pinned, key)
+}
+
+// Read block content, verify its checksum if verify is set and decrypt it.
+func (t *tableReader) readBlockContent(handle blockHandle, verify bool) ([]byte, byte, error) {
+	if handle.offset+handle.size+blockTrailerSize > t.size {
+		return nil, 0, WrapError(ErrCorrupted, "block %d+%d out of table %s",
+			handle.offset, handle.size, tableFileName(t.number))
+	}
+
+	data := make([]byte, handle.size+blockTrailerSize)
+	if _, err := t.file.ReadAt(data, int64(handle.offset)); err != nil {
+		return nil, 0, err
+	}
+
+	content := data[:handle.size]
+	blockType := data[handle.size]
+	checksum := binary.LittleEndian.Uint32(data[handle.size+1:])
+	if verify && checksum != blockChecksum(content, blockType) {
+		return nil, 0, WrapError(ErrCorrupted, "checksum mismatch of block at %s:%d",
+			tableFileName(t.number), handle.offset)
+	}
+
+	if t.cipher != nil {
+		var err error
+		if content, err = t.cipher.open(content[:0], handle.offset, content); err != nil {
+			return nil, 0, WrapError(ErrDecryption, "block at %s:%d cannot be decrypted",
+				tableFileName(t.number), handle.offset)
+		}
+	}
+
+	return content, blockType, nil
+}
+
+func (t *tableReader) readBlock(handle blockHandle, verify bool) (*block, error) {
+	content, blockType, err := t.readBlockContent(handle, verify)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockType != blockTypeRaw {
+		compressor, found := compressorOfType(blockType)
+		if !found {
+			return nil, WrapError(ErrCorrupted, "unknown block type %d in table %s",
+				blockType, tableFileName(t.number))
+		}
+
+		if content, err = compressor.Decompress(nil, content); err != nil {
+			return nil, WrapError(err, "decompress block at %s:%d", tableFileName(t.number), handle.offset)
+		}
+	}
+
+	return newBlock(content)
+}
+
+// Read a data block from cache, or from file and cache it.
+func (t *tableReader) dataBlock(handle blockHandle) (*block, error) {
+	key := blockCacheKey(t.number, handle.offset)
+	if cached, found := t.cache.Get(key); found {
+		return cached.(*block), nil
+	}
+
+	b, err := t.readBlock(handle, !t.skipChecksums)
+	if err != nil {
+		return nil, err
+	}
+
+	t.cache.Put(key, b, int64(len(b.data)), false)
+	return b, nil
+}
+
+// Whether table may contain user key, false only if filter of table excludes it.
+func (t *tableReader) MayContain(key []byte) bool {
+	if t.policy == nil {
+		return true
+	}
+
+	return bloomMayContain(t.filter, t.policy.filterKey(key))
+}
+
+// Find the newest entry of key visible at sequence number seq.
+func (t *tableReader) Get(key []byte, seq uint64) (lookupResult, bool, error) {
+	if !t.MayContain(key) {
+		return lookupResult{}, false, nil
+	}
+
+	iter := t.Iterator()
+	defer iter.Close()
+
+	iter.Seek(makeLookupKey(key, seq))
+	if !iter.Valid() {
+		return lookupResult{}, false, iter.Error()
+	}
+
+	parsed, err := parseInternalKey(iter.Key())
+	if err != nil {
+		return lookupResult{}, false, err
+	}
+
+	if t.compare(internalUserKey(iter.Key()), key) != 0 {
+		return lookupResult{}, false, nil
+	}
+
+	result := lookupResult{
+		seq:   parsed.seq,
+		kind:  parsed.kind,
+		value: iter.Value(),
+	}
+
+	return result, true, nil
+}
+
+func (t *tableReader) Iterator() *tableIterator {
+	return &tableIterator{
+		table: t,
+		index: t.index.Iterator(internalCompare(t.compare)),
+	}
+}
+
+func (t *tableReader) Close() error {
+	for _, key := range t.pinned {
+		t.cache.Erase(key)
+	}
+
+	return t.file.Close()
+}
+
+// Two-level iterator, iterate index block to find data blocks.
+type tableIterator struct {
+	table *tableReader
+	index *blockIterator
+	data  *blockIterator
+	err   error
+}
+
+func (i *tableIterator) loadBlock() bool {
+	i.data = nil
+	if !i.index.Valid() {
+		if err := i.index.Error(); err != nil {
+			i.err = err
+		}
+
+		return false
+	}
+
+	handle, err := decodeBlockHandle(i.index.Value())
+	if err != nil {
+		i.err = err
+		return false
+	}
+
+	block, err := i.table.dataBlock(handle)
+	if err != nil {
+		i.err = err
+		return false
+	}
+
+	i.data = block.Iterator(i.index.compare)
+	return true
+}
+
+// Skip exhausted data blocks forward.
+func (i *tableIterator) skipForward() {
+	for i.err == nil && i.data != nil && !i.data.Valid() {
+		if err := i.data.Error(); err != nil {
+			i.err = err
+			return
+		}
+
+		i.index.Next()
+		if i.loadBlock() {
+			i.data.SeekToFirst()
+		}
+	}
+}
+
+// Skip exhausted data blocks backward.
+func (i *tableIterator) skipBackward() {
+	for i.err == nil && i.data != nil && !i.data.Valid() {
+		if err := i.data.Error(); err != nil {
+			i.err = err
+			return
+		}
+
+		i.index.Prev()
+		if i.loadBlock() {
+			i.data.SeekToLast()
+		}
+	}
+}
+
+func (i *tableIterator) Valid() bool {
+	return i.err == nil && i.data != nil && i.data.Valid()
+}
+
+func (i *tableIterator) SeekToFirst() {
+	i.err = nil
+	i.index.SeekToFirst()
+	if i.loadBlock() {
+		i.data.SeekToFirst()
+	}
+
+	i.skipForward()
+}
+
+func (i *tableIterator) SeekToLast() {
+	i.err = nil
+	i.index.SeekToLast()
+	if i.loadBlock() {
+		i.data.SeekToLast()
+	}
+
+	i.skipBackward()
+}
+
+func (i *tableIterator) Seek(key []byte) {
+	i.err = nil
+	i.index.Seek(key)
+	if i.loadBlock() {
+		i.data.Seek(key)
+	}
+
+	i.skipForward()
+}
+
+func (i *tableIterator) Next() {
+	i.data.Next()
+	i.skipForward()
+}
+
+func (i *tableIterator) Prev() {
+	i.data.Prev()
+	i.skipBackward()
+}
+
+func (i *tableIterator) Key() []byte {
+	return i.data.Key()
+}
+
+func (i *tableIterator) Value() []byte {
+	return i.data.Value()
+}
+
+func (i *tableIterator) Error() error {
+	return i.err
+}
+
+func (i *tableIterator) Close() error {
+	return i.err
+}
@@ -0,0 +1,236 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestTable(t *testing.T, path string, count int, blockSize int) *tableMeta {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create table failed: %v", err)
+	}
+
+	defer file.Close()
+	w, err := newTableWriter(file, internalCompare(bytewiseCompare), tableOptions{blockSize: blockSize})
+	if err != nil {
+		t.Fatalf("make table writer failed: %v", err)
+	}
+
+	for i := 0; i < count; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		kind := kindPut
+		if i%10 == 9 {
+			kind = kindDelete
+		}
+
+		if err := w.Add(makeInternalKey(key, uint64(i+1), kind), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatalf("add entry failed: %v", err)
+		}
+	}
+
+	if w.Entries() != count {
+		t.Errorf("unexpected entries: %d", w.Entries())
+	}
+
+	meta, err := w.Finish()
+	if err != nil {
+		t.Fatalf("finish table failed: %v", err)
+	}
+
+	return meta
+}
+
+func TestTableWriteAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), tableFileName(1))
+	meta := writeTestTable(t, path, 1000, 256)
+
+	if string(internalUserKey(meta.smallest)) != "key-00000" ||
+		string(internalUserKey(meta.largest)) != "key-00999" {
+		t.Errorf("unexpected key range: %q - %q", meta.smallest, meta.largest)
+	}
+
+	stat, _ := os.Stat(path)
+	if uint64(stat.Size()) != meta.size {
+		t.Errorf("unexpected size: %d <=> %d", meta.size, stat.Size())
+	}
+
+	table, err := openTable(path, 1, bytewiseCompare, tableOptions{})
+	if err != nil {
+		t.Fatalf("open table failed: %v", err)
+	}
+
+	defer table.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		result, found, err := table.Get(key, maxSequence)
+		if err != nil || !found {
+			t.Fatalf("get %s failed: %v, %v", key, found, err)
+		}
+
+		if i%10 == 9 {
+			if result.kind != kindDelete {
+				t.Errorf("%s should be deleted", key)
+			}
+
+		} else if string(result.value) != fmt.Sprintf("value-%d", i) {
+			t.Errorf("unexpected value of %s: %s", key, result.value)
+		}
+
+		if _, found, _ := table.Get(key, uint64(i)); found {
+			t.Errorf("%s should not be visible at sequence %d", key, i)
+		}
+	}
+
+	if _, found, err := table.Get([]byte("key-10000"), maxSequence); found || err != nil {
+		t.Errorf("unexpected result: %v, %v", found, err)
+	}
+
+	iter := table.Iterator()
+	count := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		count++
+	}
+
+	if count != 1000 || iter.Error() != nil {
+		t.Errorf("unexpected iteration: %d, %v", count, iter.Error())
+	}
+
+	for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+		count--
+	}
+
+	if count != 0 || iter.Error() != nil {
+		t.Errorf("unexpected backward iteration: %d, %v", count, iter.Error())
+	}
+
+	iter.Seek(makeLookupKey([]byte("key-00500"), maxSequence))
+	if !iter.Valid() || string(internalUserKey(iter.Key())) != "key-00500" {
+		t.Errorf("unexpected seek result: %q", iter.Key())
+	}
+
+	iter.Prev()
+	if !iter.Valid() || string(internalUserKey(iter.Key())) != "key-00499" {
+		t.Errorf("unexpected previous entry: %q", iter.Key())
+	}
+}
+
+func TestTableKeyOrder(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), tableFileName(1)))
+	if err != nil {
+		t.Fatalf("create table failed: %v", err)
+	}
+
+	defer file.Close()
+	w, err := newTableWriter(file, internalCompare(bytewiseCompare), tableOptions{})
+	if err != nil {
+		t.Fatalf("make table writer failed: %v", err)
+	}
+
+	w.Add(makeInternalKey([]byte("b"), 1, kindPut), nil)
+	if err := w.Add(makeInternalKey([]byte("a"), 1, kindPut), nil); err == nil {
+		t.Errorf("keys out of order should be rejected")
+	}
+}
+
+func TestCorruptedTable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, tableFileName(1))
+	writeTestTable(t, path, 100, 128)
+	data, _ := os.ReadFile(path)
+
+	short := filepath.Join(dir, tableFileName(2))
+	os.WriteFile(short, data[:10], 0644)
+	if _, err := openTable(short, 2, bytewiseCompare, tableOptions{}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	badMagic := filepath.Join(dir, tableFileName(3))
+	os.WriteFile(badMagic, data[:len(data)-1], 0644)
+	if _, err := openTable(badMagic, 3, bytewiseCompare, tableOptions{}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	flipped := append([]byte{}, data...)
+	flipped[10] ^= 0xff
+	badBlock := filepath.Join(dir, tableFileName(4))
+	os.WriteFile(badBlock, flipped, 0644)
+	table, err := openTable(badBlock, 4, bytewiseCompare, tableOptions{})
+	if err != nil {
+		t.Fatalf("open table failed: %v", err)
+	}
+
+	defer table.Close()
+	if _, _, err := table.Get([]byte("key-00000"), maxSequence); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTableCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), tableFileName(1))
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create table failed: %v", err)
+	}
+
+	// Keys of bucket 1 are compressed by zstd, others by snappy.
+	compression := newCompressionPolicy(SnappyCompression)
+	compression.set(1, ZstdCompression)
+	w, err := newTableWriter(file, internalCompare(bytewiseCompare), tableOptions{compression: compression})
+	if err != nil {
+		t.Fatalf("make table writer failed: %v", err)
+	}
+
+	var keys [][]byte
+	for _, prefix := range [][]byte{defaultKey(nil), bucketPrefix(1), bucketPrefix(2)} {
+		for i := 0; i < 100; i++ {
+			keys = append(keys, prefixedKey(prefix, []byte(fmt.Sprintf("wizard-%03d", i))))
+		}
+	}
+
+	for i, key := range keys {
+		if err := w.Add(makeInternalKey(key, uint64(i+1), kindPut), []byte("Hogwarts School of Witchcraft")); err != nil {
+			t.Fatalf("add entry failed: %v", err)
+		}
+	}
+
+	if _, err := w.Finish(); err != nil {
+		t.Fatalf("finish table failed: %v", err)
+	}
+
+	file.Close()
+
+	table, err := openTable(path, 1, bytewiseCompare, tableOptions{})
+	if err != nil {
+		t.Fatalf("open table failed: %v", err)
+	}
+
+	defer table.Close()
+
+	types := make(map[byte]int)
+	index := table.index.Iterator(internalCompare(bytewiseCompare))
+	for index.SeekToFirst(); index.Valid(); index.Next() {
+		handle, _ := decodeBlockHandle(index.Value())
+		_, blockType, err := table.readBlockContent(handle, true)
+		if err != nil {
+			t.Fatalf("read block failed: %v", err)
+		}
+
+		types[blockType]++
+	}
+
+	if types[SnappyCompression.Type()] <= 0 || types[ZstdCompression.Type()] <= 0 || types[blockTypeRaw] != 0 {
+		t.Errorf("unexpected block types: %v", types)
+	}
+
+	for _, key := range keys {
+		result, found, err := table.Get(key, maxSequence)
+		if err != nil || !found || string(result.value) != "Hogwarts School of Witchcraft" {
+			t.Errorf("get %q failed: %v, %v", key, found, err)
+		}
+	}
+}
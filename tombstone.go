@@ -0,0 +1,71 @@
+package pinkis
+
+import (
+	"bytes"
+)
+
+// A range tombstone deletes all keys in [start, end) of versions older than it. Engines keeping
+// versions in sorted runs hold range tombstones aside from entries, a version of key is deleted
+// if any range tombstone visible to reader covers it with a greater sequence number. Engines
+// without versions delete keys in range when a range tombstone is applied.
+type rangeTombstone struct {
+	start []byte
+	end   []byte
+	seq   uint64
+}
+
+func (t rangeTombstone) contains(compare compareFunc, key []byte) bool {
+	return compare(t.start, key) <= 0 && compare(key, t.end) < 0
+}
+
+// Whether range contains any of keys, or overlaps any of ranges.
+func (t rangeTombstone) overlapsAny(keys map[string]bool, ranges rangeTombstones) bool {
+	for key := range keys {
+		if t.contains(bytes.Compare, []byte(key)) {
+			return true
+		}
+	}
+
+	for _, r := range ranges {
+		if bytes.Compare(t.start, r.end) < 0 && bytes.Compare(r.start, t.end) < 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+type rangeTombstones []rangeTombstone
+
+// Whether version of key at seq is deleted by any tombstone visible at sequence number readSeq.
+func (l rangeTombstones) covers(compare compareFunc, key []byte, seq uint64, readSeq uint64) bool {
+	for _, t := range l {
+		if t.seq > seq && t.seq <= readSeq && t.contains(compare, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tombstones after edit, retired ones are dropped and added ones are appended.
+func (l rangeTombstones) apply(edit *versionEdit) rangeTombstones {
+	result := make(rangeTombstones, 0, len(l)+len(edit.tombstones))
+	for _, t := range l {
+		if !edit.retired[t.seq] {
+			result = append(result, t)
+		}
+	}
+
+	return append(result, edit.tombstones...)
+}
+
+// Full keys of range [start, end) in namespace, empty end means the end of namespace. Range is
+// empty if start >= end.
+func namespaceRange(namespace []byte, start []byte, end []byte) ([]byte, []byte) {
+	if len(end) <= 0 {
+		return prefixedKey(namespace, start), prefixSuccessor(namespace)
+	}
+
+	return prefixedKey(namespace, start), prefixedKey(namespace, end)
+}
@@ -0,0 +1,354 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func putStudentKeys(t *testing.T, db *DB, n int) {
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("student-%03d", i)
+		if err := db.Put([]byte(key), []byte("hogwarts")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+}
+
+// Keys visible in transaction, in order of keys, or backward.
+func txKeys(t *testing.T, tx *Tx, backward bool) []string {
+	iter, err := tx.Iterator(nil)
+	if err != nil {
+		t.Fatalf("make iterator failed: %v", err)
+	}
+
+	defer iter.Close()
+
+	var keys []string
+	if backward {
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			keys = append([]string{string(iter.Key())}, keys...)
+		}
+
+	} else {
+		for ok := iter.First(); ok; ok = iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+
+	return keys
+}
+
+func TestDeleteRange(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			options := Options{
+				Dir:          t.TempDir(),
+				Engine:       engine,
+				SyncPolicy:   SyncNever,
+				MemtableSize: 4 << 10,
+			}
+
+			db, err := Open(options)
+			if err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			putStudentKeys(t, db, 100)
+			if err := db.Flush(); err != nil {
+				t.Fatalf("flush failed: %v", err)
+			}
+
+			snapshot, err := db.Begin(false)
+			if err != nil {
+				t.Fatalf("begin failed: %v", err)
+			}
+
+			if err := db.DeleteRange([]byte("student-010"), []byte("student-090")); err != nil {
+				t.Fatalf("delete range failed: %v", err)
+			}
+
+			if err := db.Put([]byte("student-050"), []byte("returned")); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+
+			if err := db.DeleteRange([]byte("student-095"), nil); err != nil {
+				t.Fatalf("delete range failed: %v", err)
+			}
+
+			if err := db.DeleteRange([]byte("z"), []byte("a")); !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			check := func(db *DB) {
+				if _, err := db.Get([]byte("student-042")); !errors.Is(err, ErrNotFound) {
+					t.Errorf("student-042 should be deleted: %v", err)
+				}
+
+				if value, err := db.Get([]byte("student-050")); err != nil || string(value) != "returned" {
+					t.Errorf("unexpected student-050: %s, %v", value, err)
+				}
+
+				if value, err := db.Get([]byte("student-090")); err != nil || string(value) != "hogwarts" {
+					t.Errorf("unexpected student-090: %s, %v", value, err)
+				}
+
+				forward, backward := scanKeys(t, db, false), scanKeys(t, db, true)
+				if len(forward) != 16 || len(backward) != 16 || forward[10] != "student-050=returned" {
+					t.Errorf("unexpected keys: %v, backward %v", forward, backward)
+				}
+			}
+
+			check(db)
+
+			// Snapshot taken before still reads deleted keys.
+			if value, err := snapshot.Get([]byte("student-042")); err != nil || string(value) != "hogwarts" {
+				t.Errorf("unexpected student-042 in snapshot: %s, %v", value, err)
+			}
+
+			if keys := txKeys(t, snapshot, true); len(keys) != 100 {
+				t.Errorf("unexpected keys in snapshot: %v", keys)
+			}
+
+			snapshot.Rollback()
+			if err := db.Close(); err != nil {
+				t.Fatalf("close failed: %v", err)
+			}
+
+			// Range tombstones are recovered from write-ahead log or manifest.
+			if db, err = Open(options); err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			defer db.Close()
+
+			check(db)
+			if err := db.Flush(); err != nil {
+				t.Fatalf("flush failed: %v", err)
+			}
+
+			check(db)
+		})
+	}
+}
+
+func TestDeleteRangeCompaction(t *testing.T) {
+	db := openTestCompaction(t, t.TempDir(), CompactionLeveled)
+	defer db.Close()
+
+	putStudentKeys(t, db, 200)
+	e := lsmEngineOf(db)
+	snapshot, err := db.Begin(false)
+	if err != nil {
+		t.Fatalf("begin failed: %v", err)
+	}
+
+	if err := db.DeleteRange([]byte("student-020"), []byte("student-180")); err != nil {
+		t.Fatalf("delete range failed: %v", err)
+	}
+
+	// Tombstone is kept while a snapshot may read keys in range.
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	v := e.currentVersion()
+	if len(v.tombstones) != 1 || countTableEntries(t, e) != 200 {
+		t.Errorf("unexpected version: %d tombstones, %d entries", len(v.tombstones),
+			countTableEntries(t, e))
+	}
+
+	v.unref()
+	if keys := txKeys(t, snapshot, false); len(keys) != 200 {
+		t.Errorf("unexpected keys in snapshot: %d", len(keys))
+	}
+
+	snapshot.Rollback()
+
+	// Covered entries are dropped, and tombstone is retired.
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	v = e.currentVersion()
+	if len(v.tombstones) != 0 || countTableEntries(t, e) != 40 {
+		t.Errorf("unexpected version: %d tombstones, %d entries", len(v.tombstones),
+			countTableEntries(t, e))
+	}
+
+	v.unref()
+	if keys := scanKeys(t, db, false); len(keys) != 40 || keys[20] != "student-180=hogwarts" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
+
+func TestTxDeleteRange(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	putStudentKeys(t, db, 10)
+	err := db.Update(func(tx *Tx) error {
+		if err := tx.Put([]byte("student-003"), []byte("rewritten")); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteRange([]byte("student-002"), []byte("student-008")); err != nil {
+			return err
+		}
+
+		if err := tx.Put([]byte("student-005"), []byte("returned")); err != nil {
+			return err
+		}
+
+		if has, err := tx.Has([]byte("student-003")); err != nil || has {
+			t.Errorf("student-003 should be deleted: %v", err)
+		}
+
+		if value, err := tx.Get([]byte("student-005")); err != nil || string(value) != "returned" {
+			t.Errorf("unexpected student-005: %s, %v", value, err)
+		}
+
+		expected := []string{"student-000", "student-001", "student-005", "student-008", "student-009"}
+		if keys := txKeys(t, tx, false); !meta.Equal(keys, expected) {
+			t.Errorf("unexpected keys: %v", keys)
+		}
+
+		if keys := txKeys(t, tx, true); !meta.Equal(keys, expected) {
+			t.Errorf("unexpected keys backward: %v", keys)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if keys := scanKeys(t, db, false); len(keys) != 5 || keys[2] != "student-005=returned" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	// Ranges conflict with keys and ranges written by others.
+	conflicts := []struct {
+		name  string
+		other func(tx *Tx) error
+		write func(tx *Tx) error
+	}{
+		{
+			name:  "key in range",
+			other: func(tx *Tx) error { return tx.Put([]byte("harry"), []byte("potter")) },
+			write: func(tx *Tx) error { return tx.DeleteRange([]byte("h"), []byte("i")) },
+		},
+		{
+			name:  "range over key",
+			other: func(tx *Tx) error { return tx.DeleteRange([]byte("h"), []byte("i")) },
+			write: func(tx *Tx) error { return tx.Put([]byte("hermione"), []byte("granger")) },
+		},
+		{
+			name:  "overlapping ranges",
+			other: func(tx *Tx) error { return tx.DeleteRange([]byte("d"), []byte("i")) },
+			write: func(tx *Tx) error { return tx.DeleteRange([]byte("h"), nil) },
+		},
+	}
+
+	for _, c := range conflicts {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatalf("begin failed: %v", err)
+		}
+
+		if err := db.Update(c.other); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+
+		if err := c.write(tx); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+
+		if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+	}
+
+	tx, _ := db.Begin(true)
+	db.Update(func(tx *Tx) error { return tx.DeleteRange([]byte("a"), []byte("b")) })
+	tx.DeleteRange([]byte("r"), []byte("s"))
+	if err := tx.Commit(); err != nil {
+		t.Errorf("disjoint ranges should not conflict: %v", err)
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	type testFamiliar struct {
+		Name    string
+		Species string
+		Age     int
+	}
+
+	db := openTestDB(t)
+	defer db.Close()
+
+	students, err := db.Collection("students", testStudent{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	creatures, err := db.Collection("creatures", testFamiliar{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	for i := 0; i < 40; i++ {
+		student := newBackupStudent(i, 1991+i/10)
+		if err := students.Put([]byte(student.Name), student); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+
+		creature := testFamiliar{Name: fmt.Sprintf("creature-%03d", i), Species: "owl", Age: i % 8}
+		if err := creatures.Put([]byte(creature.Name), creature); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if n, err := students.DeleteWhere("Year", 1992, 1994); err != nil || n != 20 {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+
+	if n, err := students.Find(nil).Count(); err != nil || n != 20 {
+		t.Errorf("unexpected count: %d, %v", n, err)
+	}
+
+	if keys := indexedKeys(t, db, students, "house_year"); len(keys) != 20 {
+		t.Errorf("unexpected keys in index: %v", keys)
+	}
+
+	// Runs of matched keys of an unindexed collection are deleted by range deletions.
+	if n, err := creatures.DeleteWhere("Age", 6, nil); err != nil || n != 10 {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+
+	var rest []testFamiliar
+	if err := creatures.Find(nil).All(&rest); err != nil || len(rest) != 30 {
+		t.Errorf("unexpected creatures: %+v, %v", rest, err)
+	}
+
+	for _, creature := range rest {
+		if creature.Age >= 6 {
+			t.Errorf("creature should be deleted: %+v", creature)
+		}
+	}
+
+	if n, err := creatures.DeleteWhere("Age", nil, nil); err != nil || n != 30 {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+
+	if _, err := creatures.DeleteWhere("Wand", 1, 2); err == nil {
+		t.Errorf("unknown field should fail")
+	}
+
+	if _, err := students.DeleteWhere("Year", "1991", nil); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
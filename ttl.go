@@ -0,0 +1,317 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// Clock tells time to expire keys, a fake clock makes expiry deterministic in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func nowOf(clock Clock) int64 {
+	return clock.Now().UnixNano()
+}
+
+// Size of expiry prefixed to values of kindPutExpiring, unix nanoseconds in big endian.
+const expiryHeaderSize = 8
+
+func expiringValue(value []byte, expires int64) []byte {
+	result := make([]byte, expiryHeaderSize+len(value))
+	binary.BigEndian.PutUint64(result, uint64(expires))
+	copy(result[expiryHeaderSize:], value)
+	return result
+}
+
+// Whether value of kindPutExpiring is expired at now. A value too short is never expired, so that
+// it is reported as corrupted when read.
+func expiredAt(value []byte, now int64) bool {
+	if len(value) < expiryHeaderSize {
+		return false
+	}
+
+	return int64(binary.BigEndian.Uint64(value)) <= now
+}
+
+// Value of an entry visible at now, false if it is deleted or expired.
+func visibleValue(kind entryKind, value []byte, now int64) ([]byte, bool) {
+	switch kind {
+	case kindDelete, kindDeleteRange:
+		return nil, false
+
+	case kindPutExpiring:
+		if expiredAt(value, now) {
+			return nil, false
+		}
+
+		if len(value) < expiryHeaderSize {
+			return value, true
+		}
+
+		return value[expiryHeaderSize:], true
+
+	default:
+		return value, true
+	}
+}
+
+// Expiry of an entry in unix nanoseconds, 0 if it never expires.
+func expiryOf(kind entryKind, value []byte) int64 {
+	if kind != kindPutExpiring || len(value) < expiryHeaderSize {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+func (r lookupResult) visible(now int64) ([]byte, bool) {
+	return visibleValue(r.kind, r.value, now)
+}
+
+// Keys expiring are indexed by expiry in expiry namespace, so that the reaper finds expired keys
+// without scanning. An entry may be stale if its key is written again, it is checked by reaper.
+//
+//	key    0x05 expires uint64 big endian, key
+//	value  empty
+func expiryKey(expires int64, key []byte) []byte {
+	result := make([]byte, 1+8+len(key))
+	result[0] = namespaceExpiry
+	binary.BigEndian.PutUint64(result[1:], uint64(expires))
+	copy(result[9:], key)
+	return result
+}
+
+// Put an expiring value and its expiry entry.
+func putExpiring(batch *writeBatch, key []byte, value []byte, object interface{}, expires int64) {
+	batch.PutExpiring(key, value, object, expires)
+	batch.Put(expiryKey(expires, key), []byte{})
+}
+
+func checkTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return WrapError(ErrInvalidOptions, "positive TTL required, but %v", ttl)
+	}
+
+	return nil
+}
+
+func (db *DB) now() int64 {
+	return nowOf(db.options.clock())
+}
+
+// Set value of key, which expires after ttl. An expired key is never read, and it is deleted by
+// the reaper or dropped by compactions later.
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+
+	batch := &writeBatch{}
+	putExpiring(batch, defaultKey(key), value, nil, db.now()+int64(ttl))
+	return db.write(batch)
+}
+
+// Set value of key in transaction, which expires after ttl from now.
+func (tx *Tx) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if err := checkTTL(ttl); err != nil {
+		return err
+	}
+
+	return tx.putExpiring(defaultKey(key), value, nil, tx.db.now()+int64(ttl))
+}
+
+func (tx *Tx) putExpiring(key []byte, value []byte, object interface{}, expires int64) error {
+	valueCopy, err := duplicateBytes(value)
+	if err != nil {
+		return err
+	}
+
+	return tx.write(key, func(batch *writeBatch) { putExpiring(batch, key, valueCopy, object, expires) })
+}
+
+// Name of field of t tagged `pinkis:"expires"`, empty if there is none. The field must be an
+// exported time.Time, values expire at it unless it is zero.
+func parseExpiresTag(t reflect.Type) (string, error) {
+	name := ""
+	for n := 0; n < t.NumField(); n++ {
+		field := t.Field(n)
+		tag, found := field.Tag.Lookup("pinkis")
+		if !found {
+			continue
+		}
+
+		for _, option := range strings.Split(tag, ",") {
+			if option != "expires" {
+				continue
+			}
+
+			if name != "" {
+				return "", WrapError(ErrInvalidOptions, "both %s.%s and %s.%s are tagged expires",
+					t, name, t, field.Name)
+			}
+
+			if !meta.IsExportedName(field.Name) || field.Type != reflect.TypeOf(time.Time{}) {
+				return "", WrapError(ErrTypeMismatch, "expires field %s.%s requires exported time.Time, but %s",
+					t, field.Name, field.Type)
+			}
+
+			name = field.Name
+		}
+	}
+
+	return name, nil
+}
+
+// Whether values of collection may expire.
+func (c *Collection) expiring() bool {
+	return c.expires != "" || c.ttl > 0
+}
+
+// Expiry of value in unix nanoseconds, from its expires field, or default TTL of collection. Zero
+// if value never expires.
+func (c *Collection) expiry(value interface{}) (int64, error) {
+	if c.expires != "" {
+		field, err := meta.GetField(value, c.expires)
+		if err != nil {
+			return 0, err
+		}
+
+		if expires := field.(time.Time); !expires.IsZero() {
+			return expires.UnixNano(), nil
+		}
+	}
+
+	if c.ttl > 0 {
+		return c.db.now() + int64(c.ttl), nil
+	}
+
+	return 0, nil
+}
+
+// Delete expired keys found by expiry entries, at most batch size keys in a transaction. Return
+// number of keys deleted.
+func (db *DB) Reap() (int, error) {
+	total := 0
+	for {
+		n, more, err := db.reap(db.options.reapBatchSize())
+		total += n
+		if err != nil || !more {
+			return total, err
+		}
+	}
+}
+
+// Delete expired keys of at most limit expiry entries, return whether more may be expired.
+func (db *DB) reap(limit int) (int, bool, error) {
+	deleted := 0
+	more := false
+	err := db.updateRetry(func(tx *Tx) error {
+		deleted = 0
+		more = false
+		now := tx.db.now()
+		options := &IteratorOptions{UpperBound: expiryKey(now+1, nil)[1:]}
+		iter, err := tx.iterator([]byte{namespaceExpiry}, options)
+		if err != nil {
+			return err
+		}
+
+		var entries [][]byte
+		for ok := iter.First(); ok; ok = iter.Next() {
+			if len(entries) >= limit {
+				more = true
+				break
+			}
+
+			entries = append(entries, prefixedKey([]byte{namespaceExpiry}, iter.Key()))
+		}
+
+		err = iter.Error()
+		if errClose := iter.Close(); err == nil {
+			err = errClose
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			key := entry[1+8:]
+			exists, err := tx.has(key)
+			if err != nil {
+				return err
+			}
+
+			// Key is written again with a later expiry or without expiry, if it still exists.
+			if !exists {
+				if err := tx.write(key, func(batch *writeBatch) { batch.Delete(key) }); err != nil {
+					return err
+				}
+
+				deleted++
+			}
+
+			e := entry
+			if err := tx.write(e, func(batch *writeBatch) { batch.Delete(e) }); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return deleted, more, err
+}
+
+// Reap expired keys periodically until DB is closed.
+func (db *DB) runReaper(period time.Duration) {
+	defer close(db.reaperDone)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.reaperStop:
+			return
+
+		case <-ticker.C:
+			if _, err := db.Reap(); errors.Is(err, ErrClosed) {
+				return
+			}
+
+			if _, err := db.TrimChanges(); errors.Is(err, ErrClosed) {
+				return
+			}
+		}
+	}
+}
+
+// Stop background reaper and wait for it, it is safe to call more than once.
+func (db *DB) stopReaper() {
+	if db.reaperStop == nil {
+		return
+	}
+
+	db.reaperOnce.Do(func() { close(db.reaperStop) })
+	<-db.reaperDone
+}
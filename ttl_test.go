@@ -0,0 +1,431 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(1997, 6, 26, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func openTestTTL(t *testing.T, engine EngineType, clock Clock) (*DB, Options) {
+	options := Options{
+		Engine:     engine,
+		SyncPolicy: SyncNever,
+		Clock:      clock,
+		ReapPeriod: -1,
+	}
+
+	if engine != EngineMemory {
+		options.Dir = t.TempDir()
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	return db, options
+}
+
+func scanKeys(t *testing.T, db *DB, backward bool) []string {
+	iter, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("make iterator failed: %v", err)
+	}
+
+	defer iter.Close()
+
+	var keys []string
+	if backward {
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			keys = append(keys, string(iter.Key())+"="+string(iter.Value()))
+		}
+
+	} else {
+		for ok := iter.First(); ok; ok = iter.Next() {
+			keys = append(keys, string(iter.Key())+"="+string(iter.Value()))
+		}
+	}
+
+	if err := iter.Error(); err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	return keys
+}
+
+func testTTLExpiry(t *testing.T, engine EngineType) {
+	clock := newTestClock()
+	db, options := openTestTTL(t, engine, clock)
+
+	if err := db.PutWithTTL([]byte("harry"), []byte("potter"), 0); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.PutWithTTL([]byte("dobby"), []byte("elf"), time.Minute); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.PutWithTTL([]byte("hedwig"), []byte("owl"), time.Hour); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.Put([]byte("ron"), []byte("weasley")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if value, err := db.Get([]byte("dobby")); err != nil || string(value) != "elf" {
+		t.Errorf("unexpected value: %s, %v", value, err)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := db.Get([]byte("dobby")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("dobby should expire: %v", err)
+	}
+
+	if found, err := db.Has([]byte("dobby")); found || err != nil {
+		t.Errorf("dobby should expire: %v, %v", found, err)
+	}
+
+	if keys := fmt.Sprint(scanKeys(t, db, false)); keys != "[hedwig=owl ron=weasley]" {
+		t.Errorf("unexpected keys: %s", keys)
+	}
+
+	if keys := fmt.Sprint(scanKeys(t, db, true)); keys != "[ron=weasley hedwig=owl]" {
+		t.Errorf("unexpected keys: %s", keys)
+	}
+
+	err := db.Update(func(tx *Tx) error {
+		if err := tx.PutWithTTL([]byte("fawkes"), []byte("phoenix"), time.Second); err != nil {
+			return err
+		}
+
+		if value, err := tx.Get([]byte("fawkes")); err != nil || string(value) != "phoenix" {
+			t.Errorf("unexpected value in tx: %s, %v", value, err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if engine != EngineMemory {
+		if err := db.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+
+		db, err = Open(options)
+		if err != nil {
+			t.Fatalf("reopen failed: %v", err)
+		}
+	}
+
+	defer db.Close()
+
+	if value, err := db.Get([]byte("fawkes")); err != nil || string(value) != "phoenix" {
+		t.Errorf("unexpected value: %s, %v", value, err)
+	}
+
+	clock.Advance(time.Hour)
+	if keys := fmt.Sprint(scanKeys(t, db, false)); keys != "[ron=weasley]" {
+		t.Errorf("unexpected keys: %s", keys)
+	}
+}
+
+func TestTTLExpiryMemory(t *testing.T) {
+	testTTLExpiry(t, EngineMemory)
+}
+
+func TestTTLExpiryLSM(t *testing.T) {
+	testTTLExpiry(t, EngineLSM)
+}
+
+func TestTTLExpiryBTree(t *testing.T) {
+	testTTLExpiry(t, EngineBTree)
+}
+
+func countExpiryEntries(t *testing.T, db *DB) int {
+	iter, err := db.newIterator([]byte{namespaceExpiry}, nil)
+	if err != nil {
+		t.Fatalf("make iterator failed: %v", err)
+	}
+
+	defer iter.Close()
+
+	n := 0
+	for ok := iter.First(); ok; ok = iter.Next() {
+		n++
+	}
+
+	return n
+}
+
+func TestTTLReap(t *testing.T) {
+	clock := newTestClock()
+	db, _ := openTestTTL(t, EngineMemory, clock)
+	db.options.ReapBatchSize = 2
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("student-%d", i))
+		if err := db.PutWithTTL(key, []byte("hogwarts"), time.Duration(i+1)*time.Minute); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	// Written again without expiry, it is kept by reaper.
+	if err := db.Put([]byte("student-1"), []byte("hogwarts")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if n, err := db.Reap(); n != 0 || err != nil {
+		t.Errorf("nothing should be reaped: %d, %v", n, err)
+	}
+
+	clock.Advance(3 * time.Minute)
+	if n, err := db.Reap(); n != 2 || err != nil {
+		t.Errorf("unexpected reaped: %d, %v", n, err)
+	}
+
+	if n := countExpiryEntries(t, db); n != 2 {
+		t.Errorf("unexpected expiry entries: %d", n)
+	}
+
+	clock.Advance(time.Hour)
+	if n, err := db.Reap(); n != 2 || err != nil {
+		t.Errorf("unexpected reaped: %d, %v", n, err)
+	}
+
+	if n := countExpiryEntries(t, db); n != 0 {
+		t.Errorf("unexpected expiry entries: %d", n)
+	}
+
+	if keys := fmt.Sprint(scanKeys(t, db, false)); keys != "[student-1=hogwarts]" {
+		t.Errorf("unexpected keys: %s", keys)
+	}
+}
+
+func TestTTLBackgroundReaper(t *testing.T) {
+	clock := newTestClock()
+	db, err := Open(Options{Clock: clock, ReapPeriod: time.Millisecond})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	if err := db.PutWithTTL([]byte("dobby"), []byte("elf"), time.Minute); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for countExpiryEntries(t, db) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := countExpiryEntries(t, db); n != 0 {
+		t.Errorf("expired keys should be reaped in background, %d left", n)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+
+	if err := db.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTTLCompaction(t *testing.T) {
+	clock := newTestClock()
+	options := testCompactionOptions(t.TempDir(), CompactionLeveled)
+	options.DisableAutoCompaction = true
+	options.Clock = clock
+	options.ReapPeriod = -1
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("student-%04d", i))
+		if i%10 == 0 {
+			err = db.Put(key, []byte("hogwarts"))
+
+		} else {
+			err = db.PutWithTTL(key, []byte("hogwarts"), time.Minute)
+		}
+
+		if err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	if err := db.CompactRange(nil, nil); err != nil {
+		t.Fatalf("compact range failed: %v", err)
+	}
+
+	e := lsmEngineOf(db)
+	if n := countTableEntries(t, e) - countExpiryEntries(t, db); n != 10 {
+		t.Errorf("expired entries should be dropped, %d entries left", n)
+	}
+
+	if keys := scanKeys(t, db, false); len(keys) != 10 || keys[1] != "student-0010=hogwarts" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
+
+func TestTTLBucket(t *testing.T) {
+	clock := newTestClock()
+	db, _ := openTestTTL(t, EngineMemory, clock)
+	defer db.Close()
+
+	err := db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket("owls", &BucketOptions{TTL: -time.Second}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		b, err := tx.CreateBucket("owls", &BucketOptions{TTL: time.Minute})
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte("hedwig"), []byte("snowy")); err != nil {
+			return err
+		}
+
+		return b.PutWithTTL([]byte("errol"), []byte("great grey"), time.Hour)
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	err = db.View(func(tx *Tx) error {
+		if _, err := tx.Bucket("owls", &BucketOptions{TTL: time.Hour}); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		b, err := tx.Bucket("owls")
+		if err != nil {
+			return err
+		}
+
+		if b.TTL() != time.Minute {
+			t.Errorf("unexpected TTL: %v", b.TTL())
+		}
+
+		if _, err := b.Get([]byte("hedwig")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("hedwig should expire: %v", err)
+		}
+
+		if value, err := b.Get([]byte("errol")); err != nil || string(value) != "great grey" {
+			t.Errorf("unexpected value: %s, %v", value, err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("view failed: %v", err)
+	}
+}
+
+type testPortkey struct {
+	Name    string `pinkis:"index"`
+	Place   string
+	Expires time.Time `pinkis:"expires"`
+}
+
+func TestTTLExpiresTag(t *testing.T) {
+	clock := newTestClock()
+	db, _ := openTestTTL(t, EngineMemory, clock)
+	defer db.Close()
+
+	type wrongExpires struct {
+		Expires int64 `pinkis:"expires"`
+	}
+
+	if _, err := db.Collection("wrong", wrongExpires{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	c, err := db.Collection("portkeys", testPortkey{})
+	if err != nil {
+		t.Fatalf("get collection failed: %v", err)
+	}
+
+	portkeys := []testPortkey{
+		{Name: "boot", Place: "Stoatshead Hill", Expires: clock.Now().Add(time.Minute)},
+		{Name: "cup", Place: "Little Hangleton", Expires: clock.Now().Add(time.Hour)},
+		{Name: "kettle", Place: "Ministry"},
+	}
+
+	for i, p := range portkeys {
+		if err := c.Put([]byte(fmt.Sprintf("portkey-%d", i)), p); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	var p testPortkey
+	if err := c.Get([]byte("portkey-0"), &p); err != nil || p.Place != "Stoatshead Hill" {
+		t.Errorf("unexpected value: %+v, %v", p, err)
+	}
+
+	clock.Advance(time.Minute)
+	if err := c.Get([]byte("portkey-0"), &p); !errors.Is(err, ErrNotFound) {
+		t.Errorf("boot should expire: %v", err)
+	}
+
+	if n, err := c.Find(Where("Name").Eq("boot")).Count(); n != 0 || err != nil {
+		t.Errorf("index entry of boot should expire: %d, %v", n, err)
+	}
+
+	clock.Advance(time.Hour)
+	var names []string
+	err = c.Find(Where("Name").Ge("")).Each(func(key []byte, value interface{}) error {
+		names = append(names, value.(*testPortkey).Name)
+		return nil
+	})
+
+	if err != nil || fmt.Sprint(names) != "[kettle]" {
+		t.Errorf("unexpected portkeys: %v, %v", names, err)
+	}
+
+	if n, err := db.Reap(); n != 4 || err != nil {
+		t.Errorf("values and index entries should be reaped: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,732 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+)
+
+// Tx is a transaction of DB. A transaction reads a snapshot of DB taken when it begins, it never
+// observes writes committed by others later. Writes of a writable transaction are buffered in the
+// transaction, visible to itself only, and applied atomically when it commits. A transaction must
+// be closed by Commit or Rollback, and is not safe for concurrent use.
+//
+// Writable transactions run concurrently. A commit fails with ErrConflict if any key written by
+// the transaction has been written by others since it began, and nothing is applied then.
+type Tx struct {
+	db       *DB
+	writable bool
+	// Managed by Update or View, can not be committed or rolled back manually.
+	managed  bool
+	closed   bool
+	snapshot engineSnapshot
+
+	batch *writeBatch
+	// Index of the latest entry of each key in batch.
+	writes map[string]int
+	// Range deletions in batch, sequence numbers of them are indexes in batch plus one.
+	ranges rangeTombstones
+	// Called in order after transaction commits.
+	committed []func()
+}
+
+// Begin a transaction.
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	snapshot, err := db.engine.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Tx{
+		db:       db,
+		writable: writable,
+		snapshot: snapshot,
+	}
+
+	if writable {
+		tx.batch = &writeBatch{}
+		tx.writes = make(map[string]int)
+		db.conflicts.begin(snapshot.Sequence())
+	}
+
+	return tx, nil
+}
+
+// Run fn in a writable transaction. Transaction commits if fn returns nil, or rolls back if fn
+// returns an error or panics. It returns ErrConflict if commit conflicts with others, caller may
+// retry it.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	return db.managed(true, fn)
+}
+
+// Run fn in a read-only transaction.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	return db.managed(false, fn)
+}
+
+// Run fn in a writable transaction, and retry it on conflicts.
+func (db *DB) updateRetry(fn func(tx *Tx) error) error {
+	for {
+		err := db.Update(fn)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (db *DB) managed(writable bool, fn func(tx *Tx) error) error {
+	tx, err := db.Begin(writable)
+	if err != nil {
+		return err
+	}
+
+	// Rollback on panic as well.
+	defer func() {
+		if !tx.closed {
+			tx.close()
+		}
+	}()
+
+	tx.managed = true
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if !writable {
+		return nil
+	}
+
+	return tx.commit()
+}
+
+// Whether transaction is writable.
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// Sequence number of the last write visible in transaction, excluding its own writes.
+func (tx *Tx) Sequence() uint64 {
+	return tx.readSequence()
+}
+
+func (tx *Tx) readSequence() uint64 {
+	return tx.snapshot.Sequence()
+}
+
+func (tx *Tx) check(write bool) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+
+	if write && !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	return nil
+}
+
+func (tx *Tx) write(key []byte, add func(batch *writeBatch)) error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+
+	// A writable transaction of a read-only database commits nothing.
+	if tx.db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	tx.writes[string(key)] = tx.batch.Len()
+	add(tx.batch)
+	return nil
+}
+
+// Call fn with the latest value of key, written by transaction itself or in snapshot.
+func (tx *Tx) view(key []byte, fn func(value []byte, object interface{}) error) error {
+	if err := tx.check(false); err != nil {
+		return err
+	}
+
+	if tx.writable {
+		i, found := tx.writes[string(key)]
+		if tx.rangeDeleted(key, i, found) {
+			return ErrNotFound
+		}
+
+		if found {
+			e := tx.batch.entries[i]
+			value, visible, err := tx.written(key, i)
+			if err != nil {
+				return err
+			}
+
+			if !visible {
+				return ErrNotFound
+			}
+
+			return fn(value, e.object)
+		}
+	}
+
+	return tx.snapshot.View(key, fn)
+}
+
+// Value of key written at index i in batch. Operands merged are folded onto the value written
+// earlier by transaction, or the value in snapshot.
+func (tx *Tx) written(key []byte, i int) ([]byte, bool, error) {
+	now := tx.db.now()
+	e := tx.batch.entries[i]
+	if e.kind != kindMerge {
+		value, visible := visibleValue(e.kind, e.value, now)
+		return value, visible, nil
+	}
+
+	operands := [][]byte{e.value}
+	for j := i - 1; j >= 0; j-- {
+		older := tx.batch.entries[j]
+		if older.kind == kindDeleteRange {
+			if bytes.Compare(older.key, key) <= 0 && bytes.Compare(key, older.value) < 0 {
+				return tx.fold(kindDelete, nil, operands, now)
+			}
+
+			continue
+		}
+
+		if !bytes.Equal(older.key, key) {
+			continue
+		}
+
+		if older.kind != kindMerge {
+			return tx.fold(older.kind, older.value, operands, now)
+		}
+
+		operands = append(operands, older.value)
+	}
+
+	var value []byte
+	err := tx.snapshot.View(key, func(view []byte, object interface{}) error {
+		value = append([]byte{}, view...)
+		return nil
+	})
+
+	if errors.Is(err, ErrNotFound) {
+		return tx.fold(kindDelete, nil, operands, now)
+
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	return tx.fold(kindPut, value, operands, now)
+}
+
+// Fold operands, newest first, onto an entry.
+func (tx *Tx) fold(kind entryKind, value []byte, operands [][]byte, now int64) ([]byte, bool, error) {
+	reversed := make([][]byte, len(operands))
+	for i, operand := range operands {
+		reversed[len(operands)-1-i] = operand
+	}
+
+	kind, value, ok, err := mergeEntry(kind, value, reversed, now)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	value, visible := visibleValue(kind, value, now)
+	return value, visible, nil
+}
+
+// Whether key is deleted by a range deletion of transaction, after its latest write at index i if
+// written.
+func (tx *Tx) rangeDeleted(key []byte, i int, written bool) bool {
+	seq := uint64(0)
+	if written {
+		seq = uint64(i) + 1
+	}
+
+	return tx.ranges.covers(bytes.Compare, key, seq, maxSequence)
+}
+
+func (tx *Tx) get(key []byte) ([]byte, error) {
+	var value []byte
+	err := tx.view(key, func(view []byte, object interface{}) error {
+		var err error
+		value, err = duplicateBytes(view)
+		return err
+	})
+
+	return value, err
+}
+
+func (tx *Tx) has(key []byte) (bool, error) {
+	err := tx.view(key, func(value []byte, object interface{}) error { return nil })
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Get value of key, including writes of transaction itself. The returned value is a copy owned by
+// caller, later writes never change it.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	return tx.get(defaultKey(key))
+}
+
+// Check whether key exists, including writes of transaction itself.
+func (tx *Tx) Has(key []byte) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+
+	return tx.has(defaultKey(key))
+}
+
+// Set value of key in transaction. Both key and value are copied.
+func (tx *Tx) Put(key []byte, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	valueCopy, err := duplicateBytes(value)
+	if err != nil {
+		return err
+	}
+
+	if valueCopy == nil {
+		valueCopy = []byte{}
+	}
+
+	k := defaultKey(key)
+	return tx.write(k, func(batch *writeBatch) { batch.Put(k, valueCopy) })
+}
+
+// Delete key in transaction.
+func (tx *Tx) Delete(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	k := defaultKey(key)
+	return tx.write(k, func(batch *writeBatch) { batch.Delete(k) })
+}
+
+// Delete all keys in [start, end) of namespace in transaction, empty end means the end of
+// namespace.
+func (tx *Tx) deleteRange(namespace []byte, start []byte, end []byte) error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+
+	if tx.db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := checkRange(start, end); err != nil {
+		return err
+	}
+
+	s, e := namespaceRange(namespace, start, end)
+	if bytes.Compare(s, e) >= 0 {
+		return nil
+	}
+
+	tx.ranges = append(tx.ranges, rangeTombstone{start: s, end: e, seq: uint64(tx.batch.Len()) + 1})
+	tx.batch.DeleteRange(s, e)
+	return nil
+}
+
+// Delete all keys in [start, end) in transaction, empty start or end means unbounded. Keys are
+// deleted by a single range deletion, however many keys are in range.
+func (tx *Tx) DeleteRange(start []byte, end []byte) error {
+	return tx.deleteRange(defaultKey(nil), start, end)
+}
+
+// Apply all writes of transaction atomically, and close it. Transaction is closed even if commit
+// fails, with nothing applied.
+func (tx *Tx) Commit() error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+
+	if tx.managed {
+		return ErrTxManaged
+	}
+
+	return tx.commit()
+}
+
+func (tx *Tx) commit() error {
+	defer tx.close()
+
+	if tx.batch.Len() > 0 {
+		if err := tx.db.commit(tx.batch, tx); err != nil {
+			return err
+		}
+	}
+
+	for _, fn := range tx.committed {
+		fn()
+	}
+
+	return nil
+}
+
+// Discard all writes of transaction, and close it.
+func (tx *Tx) Rollback() error {
+	if err := tx.check(false); err != nil {
+		return err
+	}
+
+	if tx.managed {
+		return ErrTxManaged
+	}
+
+	tx.close()
+	return nil
+}
+
+func (tx *Tx) close() {
+	tx.closed = true
+	tx.batch = nil
+	tx.writes = nil
+	tx.ranges = nil
+	tx.committed = nil
+	seq := tx.readSequence()
+	tx.snapshot.Release()
+	if tx.writable {
+		tx.db.writeLock.Lock()
+		tx.db.conflicts.end(seq)
+		tx.db.writeLock.Unlock()
+	}
+}
+
+// Collection c in transaction.
+func (tx *Tx) Collection(c *Collection) *TxCollection {
+	return &TxCollection{tx: tx, c: c}
+}
+
+// TxCollection reads and writes a collection in a transaction.
+type TxCollection struct {
+	tx *Tx
+	c  *Collection
+}
+
+// Get value of key into out, out must be a pointer to the registered struct. Value is a copy, it
+// never observes later writes.
+func (t *TxCollection) Get(key []byte, out interface{}) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	elem, err := t.c.checkOutput(out)
+	if err != nil {
+		return err
+	}
+
+	return t.tx.view(t.c.key(key), func(data []byte, object interface{}) error {
+		value, err := t.c.load(data, object)
+		if err != nil {
+			return err
+		}
+
+		elem.Set(value)
+		return nil
+	})
+}
+
+// Check whether key exists in collection.
+func (t *TxCollection) Has(key []byte) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+
+	return t.tx.has(t.c.key(key))
+}
+
+// Put value of key in transaction, value is copied, later mutation by caller is not committed.
+func (t *TxCollection) Put(key []byte, value interface{}) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	data, object, err := t.c.encode(value)
+	if err != nil {
+		return err
+	}
+
+	return t.put(key, data, object)
+}
+
+// Put encoded value of key, object is owned by transaction and never mutated.
+func (t *TxCollection) put(key []byte, data []byte, object interface{}) error {
+	expires, err := t.c.expiry(object)
+	if err != nil {
+		return err
+	}
+
+	if err := t.c.updateIndexes(t.tx, key, reflect.ValueOf(object), expires); err != nil {
+		return err
+	}
+
+	k := t.c.key(key)
+	if expires > 0 {
+		return t.tx.write(k, func(batch *writeBatch) { putExpiring(batch, k, data, object, expires) })
+	}
+
+	return t.tx.write(k, func(batch *writeBatch) { batch.PutObject(k, data, object) })
+}
+
+// Delete key from collection in transaction.
+func (t *TxCollection) Delete(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if err := t.c.updateIndexes(t.tx, key, reflect.Value{}, 0); err != nil {
+		return err
+	}
+
+	k := t.c.key(key)
+	return t.tx.write(k, func(batch *writeBatch) { batch.Delete(k) })
+}
+
+// Delete all keys of collection in [start, end) in transaction, empty start or end means
+// unbounded. Keys are deleted one by one if collection is indexed, so that indexes are updated.
+func (t *TxCollection) DeleteRange(start []byte, end []byte) error {
+	if len(t.c.indexList()) <= 0 {
+		return t.tx.deleteRange(t.c.prefix, start, end)
+	}
+
+	if err := checkRange(start, end); err != nil {
+		return err
+	}
+
+	options := &IteratorOptions{}
+	if len(start) > 0 {
+		options.LowerBound = start
+	}
+
+	if len(end) > 0 {
+		options.UpperBound = end
+	}
+
+	iter, err := t.Iterator(options)
+	if err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	for ok := iter.First(); ok; ok = iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+	}
+
+	err = iter.Error()
+	if errClose := iter.Close(); err == nil {
+		err = errClose
+	}
+
+	for _, key := range keys {
+		if err != nil {
+			break
+		}
+
+		err = t.Delete(key)
+	}
+
+	return err
+}
+
+// Delete values whose field is in [lo, hi) in transaction, nil lo or hi means unbounded. Field is
+// read from each value in order of keys, and each run of adjacent keys matched is deleted by
+// DeleteRange. Return number of values deleted.
+func (t *TxCollection) DeleteWhere(field string, lo interface{}, hi interface{}) (int, error) {
+	if _, err := t.c.fieldType(field); err != nil {
+		return 0, err
+	}
+
+	var bounds []*Condition
+	if lo != nil {
+		bounds = append(bounds, Where(field).Ge(lo))
+	}
+
+	if hi != nil {
+		bounds = append(bounds, Where(field).Lt(hi))
+	}
+
+	var condition *compiledCondition
+	if len(bounds) > 0 {
+		var err error
+		condition, err = t.c.compile(bounds[0].And(bounds[1:]...))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Runs of adjacent keys matched, as [first key, successor of the last key).
+	var runs [][2][]byte
+	matching := false
+	n := 0
+	q := &Query{c: t.c, tx: t.tx}
+	err := q.scan(t.tx, func(key []byte, value reflect.Value) (bool, error) {
+		if condition != nil && !condition.match(value) {
+			matching = false
+			return true, nil
+		}
+
+		end := append(append([]byte{}, key...), 0)
+		if matching {
+			runs[len(runs)-1][1] = end
+
+		} else {
+			runs = append(runs, [2][]byte{append([]byte{}, key...), end})
+			matching = true
+		}
+
+		n++
+		return true, nil
+	})
+
+	for _, run := range runs {
+		if err != nil {
+			break
+		}
+
+		err = t.DeleteRange(run[0], run[1])
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Make an iterator over collection in transaction, including writes of transaction itself when
+// iterator is made.
+func (t *TxCollection) Iterator(options *IteratorOptions) (*CollectionIterator, error) {
+	iter, err := t.tx.iterator(t.c.prefix, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CollectionIterator{Iterator: iter, c: t.c}, nil
+}
+
+// Keys written by recent commits, to detect write-write conflicts of writable transactions. Commits
+// are kept only while a running transaction began before them. It is protected by DB.writeLock.
+type conflictTracker struct {
+	running map[uint64]int
+	commits []commitRecord
+}
+
+type commitRecord struct {
+	seq    uint64
+	keys   map[string]bool
+	ranges rangeTombstones
+}
+
+func newConflictTracker() *conflictTracker {
+	t := &conflictTracker{
+		running: make(map[uint64]int),
+	}
+
+	return t
+}
+
+// A writable transaction begins reading at seq.
+func (t *conflictTracker) begin(seq uint64) {
+	t.running[seq]++
+}
+
+func (t *conflictTracker) end(seq uint64) {
+	t.running[seq]--
+	if t.running[seq] <= 0 {
+		delete(t.running, seq)
+	}
+
+	t.prune()
+}
+
+// Drop commits no running transaction began before.
+func (t *conflictTracker) prune() {
+	if len(t.running) <= 0 {
+		t.commits = nil
+		return
+	}
+
+	oldest := uint64(maxSequence)
+	for seq := range t.running {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+
+	i := 0
+	for i < len(t.commits) && t.commits[i].seq <= oldest {
+		i++
+	}
+
+	t.commits = t.commits[i:]
+}
+
+func (t *conflictTracker) record(batch *writeBatch) {
+	if len(t.running) <= 0 {
+		return
+	}
+
+	record := commitRecord{
+		seq:  batch.seq,
+		keys: make(map[string]bool, batch.Len()),
+	}
+
+	for i, e := range batch.entries {
+		if e.kind == kindDeleteRange {
+			r := rangeTombstone{start: e.key, end: e.value, seq: batch.seq + uint64(i)}
+			record.ranges = append(record.ranges, r)
+
+		} else {
+			record.keys[string(e.key)] = true
+		}
+	}
+
+	t.commits = append(t.commits, record)
+}
+
+// Check whether any of keys or ranges is written by commits after seq. Keys in ranges deleted
+// are written as well.
+func (t *conflictTracker) check(seq uint64, keys map[string]int, ranges rangeTombstones) error {
+	for _, commit := range t.commits {
+		if commit.seq <= seq {
+			continue
+		}
+
+		for key := range keys {
+			if commit.keys[key] || commit.ranges.covers(bytes.Compare, []byte(key), 0, maxSequence) {
+				return WrapError(ErrConflict, "key %q is written at sequence %d after %d",
+					key, commit.seq, seq)
+			}
+		}
+
+		for _, r := range ranges {
+			if r.overlapsAny(commit.keys, commit.ranges) {
+				return WrapError(ErrConflict, "range [%q, %q) is written at sequence %d after %d",
+					r.start, r.end, commit.seq, seq)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,360 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTxUpdate(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	db.Put([]byte("ron"), []byte("weasley"))
+	err := db.Update(func(tx *Tx) error {
+		if err := tx.Put([]byte("harry"), []byte("potter")); err != nil {
+			return err
+		}
+
+		if err := tx.Delete([]byte("ron")); err != nil {
+			return err
+		}
+
+		// Read your own writes.
+		if value, err := tx.Get([]byte("harry")); err != nil || string(value) != "potter" {
+			t.Errorf("unexpected value in transaction: %s, %v", value, err)
+		}
+
+		if has, err := tx.Has([]byte("ron")); has || err != nil {
+			t.Errorf("deleted key should not exist in transaction: %v, %v", has, err)
+		}
+
+		// Not visible out of transaction before commit.
+		if _, err := db.Get([]byte("harry")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("uncommitted write should not be visible: %v", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if value, err := db.Get([]byte("harry")); err != nil || string(value) != "potter" {
+		t.Errorf("unexpected value: %s, %v", value, err)
+	}
+
+	if has, _ := db.Has([]byte("ron")); has {
+		t.Errorf("ron should be deleted")
+	}
+
+	if db.Sequence() != 3 {
+		t.Errorf("unexpected sequence: %d", db.Sequence())
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	failure := errors.New("expelled")
+	err := db.Update(func(tx *Tx) error {
+		tx.Put([]byte("draco"), []byte("malfoy"))
+		return failure
+	})
+
+	if err != failure {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("panic should be propagated")
+			}
+		}()
+
+		db.Update(func(tx *Tx) error {
+			tx.Put([]byte("lucius"), []byte("malfoy"))
+			panic("avada kedavra")
+		})
+	}()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatalf("begin failed: %v", err)
+	}
+
+	tx.Put([]byte("narcissa"), []byte("malfoy"))
+	if err := tx.Rollback(); err != nil {
+		t.Errorf("rollback failed: %v", err)
+	}
+
+	if err := tx.Put([]byte("narcissa"), []byte("black")); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, key := range []string{"draco", "lucius", "narcissa"} {
+		if has, _ := db.Has([]byte(key)); has {
+			t.Errorf("%s should be rolled back", key)
+		}
+	}
+
+	if db.Sequence() != 0 {
+		t.Errorf("nothing should be written, sequence %d", db.Sequence())
+	}
+
+	// Writable transaction is released after panic.
+	if err := db.Put([]byte("harry"), []byte("potter")); err != nil {
+		t.Errorf("put failed: %v", err)
+	}
+}
+
+func TestTxManual(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	defer db.Close()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatalf("begin failed: %v", err)
+	}
+
+	value := []byte("granger")
+	tx.Put([]byte("hermione"), value)
+	value[0] = 'G'
+	got, _ := tx.Get([]byte("hermione"))
+	got[1] = 'R'
+	if got, _ := tx.Get([]byte("hermione")); string(got) != "granger" {
+		t.Errorf("value in transaction should be isolated: %s", got)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	if err := tx.Commit(); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if value, err := db.Get([]byte("hermione")); err != nil || string(value) != "granger" {
+		t.Errorf("unexpected value: %s, %v", value, err)
+	}
+}
+
+func TestTxView(t *testing.T) {
+	db := openTestBTree(t, t.TempDir())
+	defer db.Close()
+
+	db.Put([]byte("luna"), []byte("lovegood"))
+	var kept []byte
+	err := db.View(func(tx *Tx) error {
+		if err := tx.Put([]byte("luna"), []byte("scamander")); !errors.Is(err, ErrTxNotWritable) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		if err := tx.Rollback(); !errors.Is(err, ErrTxManaged) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		var err error
+		kept, err = tx.Get([]byte("luna"))
+		return err
+	})
+
+	if err != nil {
+		t.Fatalf("view failed: %v", err)
+	}
+
+	db.Put([]byte("luna"), []byte("scamander"))
+	if string(kept) != "lovegood" {
+		t.Errorf("value read in transaction should not be changed by later writes: %s", kept)
+	}
+}
+
+func TestTxConcurrentUpdates(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	db.Put([]byte("points"), []byte("0"))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; {
+				err := db.Update(func(tx *Tx) error {
+					value, err := tx.Get([]byte("points"))
+					if err != nil {
+						return err
+					}
+
+					var points int
+					fmt.Sscan(string(value), &points)
+					return tx.Put([]byte("points"), []byte(fmt.Sprint(points+10)))
+				})
+
+				if errors.Is(err, ErrConflict) {
+					continue
+
+				} else if err != nil {
+					t.Errorf("update failed: %v", err)
+					return
+				}
+
+				j++
+			}
+		}()
+	}
+
+	wg.Wait()
+	if value, _ := db.Get([]byte("points")); string(value) != "4000" {
+		t.Errorf("unexpected points: %s", value)
+	}
+}
+
+func TestTxClosedDB(t *testing.T) {
+	db := openTestDB(t)
+	db.Close()
+
+	if _, err := db.Begin(true); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := db.View(func(*Tx) error { return nil }); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func testTxSnapshot(t *testing.T, db *DB) {
+	defer db.Close()
+
+	db.Put([]byte("harry"), []byte("potter"))
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatalf("begin failed: %v", err)
+	}
+
+	db.Put([]byte("harry"), []byte("the chosen one"))
+	db.Put([]byte("ginny"), []byte("weasley"))
+	db.Delete([]byte("harry"))
+
+	if value, err := tx.Get([]byte("harry")); err != nil || string(value) != "potter" {
+		t.Errorf("unexpected value in snapshot: %s, %v", value, err)
+	}
+
+	if has, err := tx.Has([]byte("ginny")); has || err != nil {
+		t.Errorf("later write should not be visible in snapshot: %v, %v", has, err)
+	}
+
+	if tx.Sequence() != 1 {
+		t.Errorf("unexpected sequence of snapshot: %d", tx.Sequence())
+	}
+
+	tx.Rollback()
+	if _, err := tx.Get([]byte("harry")); !errors.Is(err, ErrTxClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTxSnapshot(t *testing.T) {
+	testTxSnapshot(t, openTestDB(t))
+	testTxSnapshot(t, openTestLSM(t, t.TempDir()))
+	testTxSnapshot(t, openTestBTree(t, t.TempDir()))
+}
+
+func TestTxConflict(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	tx1, _ := db.Begin(true)
+	tx2, _ := db.Begin(true)
+	tx3, _ := db.Begin(true)
+
+	tx1.Put([]byte("sword"), []byte("neville"))
+	tx2.Put([]byte("sword"), []byte("griphook"))
+	tx3.Put([]byte("cup"), []byte("hufflepuff"))
+	if value, _ := tx3.Get([]byte("sword")); value != nil {
+		t.Errorf("uncommitted write of others should not be visible: %s", value)
+	}
+
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	if err := tx2.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := tx3.Commit(); err != nil {
+		t.Errorf("commit of disjoint keys failed: %v", err)
+	}
+
+	if value, _ := db.Get([]byte("sword")); string(value) != "neville" {
+		t.Errorf("unexpected value: %s", value)
+	}
+
+	// Direct writes conflict with transactions as well.
+	tx, _ := db.Begin(true)
+	tx.Delete([]byte("cup"))
+	db.Put([]byte("cup"), []byte("ravenclaw"))
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if len(db.conflicts.running) != 0 || len(db.conflicts.commits) != 0 {
+		t.Errorf("commits should not be kept without running transactions")
+	}
+}
+
+func TestTxCollection(t *testing.T) {
+	db := openTestLSM(t, t.TempDir())
+	defer db.Close()
+
+	wizards, _ := db.Collection("wizards", testWizard{})
+	harry := testWizard{Name: "Harry", House: "Gryffindor", Courses: []string{"Potions"}}
+	wizards.Put([]byte("harry"), &harry)
+
+	reader, _ := db.Begin(false)
+	defer reader.Rollback()
+
+	err := db.Update(func(tx *Tx) error {
+		c := tx.Collection(wizards)
+		var got testWizard
+		if err := c.Get([]byte("harry"), &got); err != nil {
+			return err
+		}
+
+		got.Courses = append(got.Courses, "Defence Against the Dark Arts")
+		if err := c.Put([]byte("harry"), &got); err != nil {
+			return err
+		}
+
+		// Mutation after put is not committed.
+		got.Courses[0] = "Divination"
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	harry.Courses[0] = "Herbology"
+	var old testWizard
+	if err := reader.Collection(wizards).Get([]byte("harry"), &old); err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+
+	if len(old.Courses) != 1 || old.Courses[0] != "Potions" {
+		t.Errorf("old version should not be changed: %+v", old)
+	}
+
+	var latest testWizard
+	wizards.Get([]byte("harry"), &latest)
+	expected := []string{"Potions", "Defence Against the Dark Arts"}
+	if len(latest.Courses) != 2 || latest.Courses[0] != expected[0] || latest.Courses[1] != expected[1] {
+		t.Errorf("unexpected latest version: %+v", latest)
+	}
+}
@@ -0,0 +1,388 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// VerifyReport reports files scanned by Verify or Check, and all corrupted ranges found in them.
+type VerifyReport struct {
+	Files   int
+	Blocks  int
+	Pages   int
+	Records int
+	// Corrupted ranges in order they are found.
+	Corrupted []CorruptedRange
+}
+
+// CorruptedRange is a range of a file which cannot be read.
+type CorruptedRange struct {
+	// Path of file relative to directory of database.
+	File   string
+	Offset int64
+	Size   int64
+	// Why range cannot be read, it wraps ErrCorrupted or ErrDecryption.
+	Err error
+}
+
+func (r CorruptedRange) String() string {
+	return fmt.Sprintf("%s:%d+%d: %s", r.File, r.Offset, r.Size, r.Err)
+}
+
+func (r *VerifyReport) corrupt(file string, offset int64, size int64, err error) {
+	r.Corrupted = append(r.Corrupted, CorruptedRange{File: file, Offset: offset, Size: size, Err: err})
+}
+
+// Err returns an error wraps ErrCorrupted if any range is corrupted, or nil.
+func (r *VerifyReport) Err() error {
+	if len(r.Corrupted) <= 0 {
+		return nil
+	}
+
+	return WrapError(ErrCorrupted, "%d corrupted ranges, the first at %s", len(r.Corrupted), r.Corrupted[0])
+}
+
+// Visit an entry found by scanning files, seq is 0 if it is unknown. Key and value are valid only
+// until visitor returns.
+type entryVisitor func(seq uint64, kind entryKind, key []byte, value []byte)
+
+// Scan all data blocks of table, name is file of table reported in corrupted ranges. Checksums are
+// always verified, regardless of options of reader.
+func verifyTable(t *tableReader, name string, report *VerifyReport, visit entryVisitor) {
+	compare := internalCompare(t.compare)
+	index := t.index.Iterator(compare)
+	defer index.Close()
+
+	for index.SeekToFirst(); index.Valid(); index.Next() {
+		handle, err := decodeBlockHandle(index.Value())
+		if err != nil {
+			report.corrupt(name, 0, int64(t.size), err)
+			return
+		}
+
+		report.Blocks++
+		offset, size := int64(handle.offset), int64(handle.size+blockTrailerSize)
+		b, err := t.readBlock(handle, true)
+		if err != nil {
+			report.corrupt(name, offset, size, err)
+			continue
+		}
+
+		iter := b.Iterator(compare)
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			parsed, err := parseInternalKey(iter.Key())
+			if err != nil {
+				report.corrupt(name, offset, size, err)
+				break
+			}
+
+			if visit != nil {
+				visit(parsed.seq, parsed.kind, parsed.key, iter.Value())
+			}
+		}
+
+		if err := iter.Error(); err != nil {
+			report.corrupt(name, offset, size, err)
+		}
+
+		iter.Close()
+	}
+
+	if err := index.Error(); err != nil {
+		report.corrupt(name, 0, int64(t.size), err)
+	}
+}
+
+// Open and scan a table file, a table which cannot be opened or decrypted is corrupted as a whole.
+func verifyTableFile(path string, name string, number uint64, keys KeyProvider, report *VerifyReport, visit entryVisitor) error {
+	report.Files++
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	t, err := openTable(path, number, bytewiseCompare, tableOptions{keys: keys})
+	if err != nil {
+		if !errors.Is(err, ErrCorrupted) && !errors.Is(err, ErrDecryption) {
+			return err
+		}
+
+		report.corrupt(name, 0, stat.Size(), err)
+		return nil
+	}
+
+	defer t.Close()
+
+	verifyTable(t, name, report, visit)
+	return nil
+}
+
+// Scan all records of a write-ahead log segment, a segment which cannot be decrypted is corrupted
+// as a whole. After a broken record, scanning resumes from the next valid record. Bytes after the last valid record of the last segment are a torn write of a
+// crash, they are truncated when log is opened, and not reported as corrupted.
+func verifyWALSegment(path string, name string, keys KeyProvider, last bool, report *VerifyReport, visit entryVisitor) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// Segment is removed after its records are flushed.
+		return nil
+
+	} else if err != nil {
+		return err
+	}
+
+	report.Files++
+	var c *fileCipher
+	offset := 0
+	if size, ok := envelopeSize(data); ok {
+		if size > len(data) && last {
+			return nil
+		}
+
+		if c, err = openEnvelope(data, keys, name); err != nil {
+			report.corrupt(name, 0, int64(len(data)), err)
+			return nil
+		}
+
+		offset = size
+	}
+
+	for offset < len(data) {
+		payload, size, ok := decodeWALRecord(data[offset:])
+		if !ok {
+			next := nextWALRecord(data, offset)
+			if next < len(data) || !last {
+				err := WrapError(ErrCorrupted, "broken record at %s:%d", name, offset)
+				report.corrupt(name, int64(offset), int64(next-offset), err)
+			}
+
+			offset = next
+			continue
+		}
+
+		report.Records++
+		if err := verifyWALRecord(c, payload, offset, visit); err != nil {
+			report.corrupt(name, int64(offset), int64(size), WrapError(err, "record at %s:%d", name, offset))
+		}
+
+		offset += size
+	}
+
+	return nil
+}
+
+// Decrypt and decode a record at offset of segment, and visit all entries of its batch.
+func verifyWALRecord(c *fileCipher, payload []byte, offset int, visit entryVisitor) error {
+	if c != nil {
+		var err error
+		if payload, err = c.open(nil, uint64(offset), payload); err != nil {
+			return WrapError(ErrDecryption, "record cannot be decrypted")
+		}
+	}
+
+	batch, err := decodeBatch(payload)
+	if err != nil {
+		return err
+	}
+
+	if visit != nil {
+		for i, e := range batch.entries {
+			visit(batch.seq+uint64(i), e.kind, e.key, e.value)
+		}
+	}
+
+	return nil
+}
+
+// Scan all segments of write-ahead log in walDir.
+func verifyWAL(walDir string, keys KeyProvider, report *VerifyReport, visit entryVisitor) error {
+	segments, err := listWALSegments(walDir)
+	if os.IsNotExist(err) {
+		return nil
+
+	} else if err != nil {
+		return err
+	}
+
+	for i, id := range segments {
+		name := filepath.Join(walDirName, walSegmentName(id))
+		last := i == len(segments)-1
+		path := filepath.Join(walDir, walSegmentName(id))
+		if err := verifyWALSegment(path, name, keys, last, report, visit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Scan the B+tree of meta from root, and freelist of it. If any branch page is corrupted, pages
+// neither reachable nor free are scanned as well, so that leaves under a corrupted branch are
+// still visited. Checksums are always verified.
+func (e *btreeEngine) verifyTree(meta *btreeMeta, report *VerifyReport, visit entryVisitor) {
+	visited := make(map[pgid]bool)
+	read := func(id pgid) page {
+		if id < 2 || id >= meta.pgid || visited[id] {
+			err := WrapError(ErrCorrupted, "invalid page id %d", id)
+			report.corrupt(btreeFileName, int64(id)*int64(e.pageSize), int64(e.pageSize), err)
+			return nil
+		}
+
+		visited[id] = true
+		report.Pages++
+		p, err := e.readPageOf(id, true)
+		if err == nil && id+pgid(p.overflow()) >= meta.pgid {
+			err = WrapError(ErrCorrupted, "overflow of page %d out of file", id)
+		}
+
+		if err == nil && p.flags()&(pageFlagBranch|pageFlagLeaf) != 0 {
+			err = p.validate()
+		}
+
+		if err != nil {
+			report.corrupt(btreeFileName, int64(id)*int64(e.pageSize), int64(e.pageSize), err)
+			return nil
+		}
+
+		for i := pgid(1); i <= pgid(p.overflow()); i++ {
+			visited[id+i] = true
+		}
+
+		return p
+	}
+
+	leaf := func(p page) {
+		for i := 0; i < p.count(); i++ {
+			key, value, err := p.leafElement(i)
+			if err != nil {
+				report.corrupt(btreeFileName, int64(p.id())*int64(e.pageSize), int64(len(p)), err)
+				return
+			}
+
+			if visit != nil {
+				visit(0, p.leafKind(i), key, value)
+			}
+		}
+	}
+
+	lost := false
+	var walk func(id pgid)
+	walk = func(id pgid) {
+		p := read(id)
+		switch {
+		case p == nil:
+			lost = true
+
+		case p.flags() == pageFlagLeaf:
+			leaf(p)
+
+		case p.flags() == pageFlagBranch:
+			for i := 0; i < p.count(); i++ {
+				_, child, err := p.branchElement(i)
+				if err != nil {
+					report.corrupt(btreeFileName, int64(id)*int64(e.pageSize), int64(len(p)), err)
+					lost = true
+					break
+				}
+
+				walk(child)
+			}
+
+		default:
+			err := WrapError(ErrCorrupted, "%s page %d in tree", p.typeName(), id)
+			report.corrupt(btreeFileName, int64(id)*int64(e.pageSize), int64(len(p)), err)
+			lost = true
+		}
+	}
+
+	walk(meta.root)
+	freelist := newBTreeFreelist()
+	p := read(meta.freelist)
+	if p == nil {
+		return
+	}
+
+	if err := freelist.read(p); err != nil {
+		report.corrupt(btreeFileName, int64(meta.freelist)*int64(e.pageSize), int64(len(p)), err)
+		return
+	}
+
+	if !lost {
+		return
+	}
+
+	for _, id := range freelist.ids {
+		visited[id] = true
+	}
+
+	for id := pgid(2); id < meta.pgid; id++ {
+		if visited[id] {
+			continue
+		}
+
+		// Orphans are not reported, they may be overflow of a corrupted page.
+		p, err := e.readPageOf(id, true)
+		if err != nil || p.flags() != pageFlagLeaf || p.validate() != nil {
+			continue
+		}
+
+		report.Pages++
+		for i := pgid(0); i <= pgid(p.overflow()); i++ {
+			visited[id+i] = true
+		}
+
+		leaf(p)
+	}
+}
+
+// Load and check manifest in dir, a manifest which cannot be loaded or decrypted is corrupted as a
+// whole.
+func verifyManifest(dir string, keys KeyProvider, report *VerifyReport) error {
+	stat, err := os.Stat(filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil
+
+	} else if err != nil {
+		return err
+	}
+
+	report.Files++
+	if _, err := loadManifest(dir, keys); err != nil {
+		if !errors.Is(err, ErrCorrupted) && !errors.Is(err, ErrDecryption) {
+			return err
+		}
+
+		report.corrupt(manifestFileName, 0, stat.Size(), err)
+	}
+
+	return nil
+}
+
+// Check both meta pages, a broken one is reported even if the other is valid.
+func (e *btreeEngine) verifyMeta(report *VerifyReport) {
+	buffer := make([]byte, btreeMinPageSize)
+	for i := int64(0); i < 2; i++ {
+		report.Pages++
+		offset := i * int64(e.pageSize)
+		if _, err := e.readMetaAt(buffer, offset); err != nil {
+			report.corrupt(btreeFileName, offset, int64(e.pageSize), err)
+		}
+	}
+}
+
+// Verify checksums of all files of database, and report corrupted ranges. Files are scanned while
+// database is in use, writes are not blocked. A corrupted database is reported as an error wraps
+// ErrCorrupted, along with the report.
+func (db *DB) Verify() (VerifyReport, error) {
+	var report VerifyReport
+	if db.isClosed() {
+		return report, ErrClosed
+	}
+
+	if err := db.engine.Verify(&report); err != nil {
+		return report, err
+	}
+
+	return report, report.Err()
+}
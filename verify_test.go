@@ -0,0 +1,213 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Flip a byte of file at offset.
+func corruptFile(t *testing.T, path string, offset int64) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open %s failed: %v", path, err)
+	}
+
+	defer file.Close()
+
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		t.Fatalf("read %s failed: %v", path, err)
+	}
+
+	b[0] ^= 0xff
+	if _, err := file.WriteAt(b, offset); err != nil {
+		t.Fatalf("write %s failed: %v", path, err)
+	}
+}
+
+// Offset of the first s in file of path.
+func offsetInFile(t *testing.T, path string, s string) int64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s failed: %v", path, err)
+	}
+
+	offset := bytes.Index(data, []byte(s))
+	if offset < 0 {
+		t.Fatalf("'%s' not found in %s", s, path)
+	}
+
+	return int64(offset)
+}
+
+func TestVerifyReport(t *testing.T) {
+	var report VerifyReport
+	if err := report.Err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	report.corrupt("000042.sst", 1024, 512, WrapError(ErrCorrupted, "checksum mismatch"))
+	if err := report.Err(); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if s := report.Corrupted[0].String(); s != "000042.sst:1024+512: checksum mismatch" {
+		t.Errorf("unexpected range: %s", s)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			options := Options{
+				Dir:          t.TempDir(),
+				Engine:       engine,
+				SyncPolicy:   SyncNever,
+				MemtableSize: 4 << 10,
+				PageSize:     512,
+			}
+
+			db, err := Open(options)
+			if err != nil {
+				t.Fatalf("open database failed: %v", err)
+			}
+
+			defer db.Close()
+
+			for i := 0; i < 300; i++ {
+				key := []byte(fmt.Sprintf("wizard-%03d", i))
+				if err := db.Put(key, []byte(fmt.Sprintf("Hufflepuff %d", i))); err != nil {
+					t.Fatalf("put failed: %v", err)
+				}
+			}
+
+			report, err := db.Verify()
+			if err != nil || report.Files <= 0 || len(report.Corrupted) != 0 {
+				t.Fatalf("unexpected report: %+v, %v", report, err)
+			}
+
+			switch engine {
+			case EngineMemory:
+				if report.Records != 300 {
+					t.Errorf("unexpected records: %+v", report)
+				}
+
+			case EngineLSM:
+				if report.Blocks <= 0 || report.Records <= 0 {
+					t.Errorf("unexpected blocks: %+v", report)
+				}
+
+			case EngineBTree:
+				if report.Pages <= 4 {
+					t.Errorf("unexpected pages: %+v", report)
+				}
+			}
+
+			db.Close()
+			if _, err := db.Verify(); !errors.Is(err, ErrClosed) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPageChecksum(t *testing.T) {
+	for _, disableMmap := range []bool{false, true} {
+		dir := t.TempDir()
+		db := openTestBTree(t, dir)
+		if err := db.Put([]byte("harry"), []byte("Gryffindor")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+
+		if db.Close(); !btreeEngineOf(db).checksums {
+			t.Errorf("pages of a new file should end with checksums")
+		}
+
+		path := filepath.Join(dir, btreeFileName)
+		corruptFile(t, path, offsetInFile(t, path, "Gryffindor"))
+
+		// Page of tree may be read when database is opened, or when key is read.
+		options := Options{Dir: dir, Engine: EngineBTree, DisableMmap: disableMmap}
+		db, err := Open(options)
+		if err == nil {
+			_, err = db.Get([]byte("harry"))
+			db.Close()
+		}
+
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		options.DisableChecksums = true
+		if db, err = Open(options); err != nil {
+			t.Fatalf("open database failed: %v", err)
+		}
+
+		if value, err := db.Get([]byte("harry")); err != nil || string(value) == "Gryffindor" {
+			t.Errorf("unexpected value: %q, %v", value, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestTableChecksum(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{
+		Dir:          dir,
+		Engine:       EngineLSM,
+		SyncPolicy:   SyncNever,
+		MemtableSize: 4 << 10,
+		BlockSize:    512,
+		Compression:  NoCompression,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	if err := db.Put([]byte("luna"), []byte("Ravenclaw")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	tables := lsmEngineOf(db).currentVersion()
+	path := tables.tables()[0].path
+	tables.unref()
+	db.Close()
+
+	corruptFile(t, path, offsetInFile(t, path, "Ravenclaw"))
+	if db, err = Open(options); err == nil {
+		_, err = db.Get([]byte("luna"))
+		db.Close()
+	}
+
+	if !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	options.DisableChecksums = true
+	if db, err = Open(options); err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if value, err := db.Get([]byte("luna")); err != nil || string(value) == "Ravenclaw" {
+		t.Errorf("unexpected value: %q, %v", value, err)
+	}
+
+	// Verify always checks checksums.
+	report, err := db.Verify()
+	if !errors.Is(err, ErrCorrupted) || len(report.Corrupted) != 1 || report.Corrupted[0].File != filepath.Base(path) {
+		t.Errorf("unexpected report: %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,242 @@
+package pinkis
+
+import (
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+const lsmNumLevels = 7
+
+// A table in use, with its reader. A table is referenced by versions containing it, its reader is
+// closed when the last reference is released, and its file is removed if it is obsolete.
+type liveTable struct {
+	meta     *tableMeta
+	reader   *tableReader
+	path     string
+	refs     int32
+	obsolete int32
+}
+
+func newLiveTable(meta *tableMeta, reader *tableReader, path string) *liveTable {
+	return &liveTable{
+		meta:   meta,
+		reader: reader,
+		path:   path,
+	}
+}
+
+func (t *liveTable) ref() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+func (t *liveTable) unref() {
+	if atomic.AddInt32(&t.refs, -1) > 0 {
+		return
+	}
+
+	// Errors are ignored, an obsolete file left is removed when engine is opened again.
+	_ = t.reader.Close()
+	if atomic.LoadInt32(&t.obsolete) != 0 {
+		_ = os.Remove(t.path)
+	}
+}
+
+// Mark table as removed from manifest, its file is removed when it is no longer referenced.
+func (t *liveTable) markObsolete() {
+	atomic.StoreInt32(&t.obsolete, 1)
+}
+
+// Range of user keys in table.
+func (t *liveTable) smallestKey() []byte {
+	return internalUserKey(t.meta.smallest)
+}
+
+func (t *liveTable) largestKey() []byte {
+	return internalUserKey(t.meta.largest)
+}
+
+// Whether table may contain user keys in [start, end], nil means unbounded.
+func (t *liveTable) overlaps(compare compareFunc, start []byte, end []byte) bool {
+	if start != nil && compare(t.largestKey(), start) < 0 {
+		return false
+	}
+
+	if end != nil && compare(t.smallestKey(), end) > 0 {
+		return false
+	}
+
+	return true
+}
+
+// An immutable set of live tables organized in levels. Tables in level 0 may overlap and are
+// ordered from the newest to the oldest, tables in other levels are disjoint and ordered by keys.
+type lsmVersion struct {
+	refs    int32
+	compare compareFunc
+	levels  [lsmNumLevels][]*liveTable
+	// Range tombstones flushed and not yet retired by compactions.
+	tombstones rangeTombstones
+}
+
+func newVersion(compare compareFunc, tables []*liveTable) *lsmVersion {
+	v := &lsmVersion{
+		refs:    1,
+		compare: compare,
+	}
+
+	for _, t := range tables {
+		t.ref()
+		v.levels[t.meta.level] = append(v.levels[t.meta.level], t)
+	}
+
+	v.sortLevels()
+	return v
+}
+
+func (v *lsmVersion) sortLevels() {
+	level0 := v.levels[0]
+	sort.Slice(level0, func(i, j int) bool { return level0[i].meta.number > level0[j].meta.number })
+
+	for level := 1; level < lsmNumLevels; level++ {
+		tables := v.levels[level]
+		sort.Slice(tables, func(i, j int) bool {
+			return v.compare(tables[i].smallestKey(), tables[j].smallestKey()) < 0
+		})
+	}
+}
+
+func (v *lsmVersion) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+func (v *lsmVersion) unref() {
+	if atomic.AddInt32(&v.refs, -1) > 0 {
+		return
+	}
+
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			t.unref()
+		}
+	}
+}
+
+// All tables in version.
+func (v *lsmVersion) tables() []*liveTable {
+	var tables []*liveTable
+	for _, level := range v.levels {
+		tables = append(tables, level...)
+	}
+
+	return tables
+}
+
+func (v *lsmVersion) tableCount() int {
+	count := 0
+	for _, level := range v.levels {
+		count += len(level)
+	}
+
+	return count
+}
+
+func (v *lsmVersion) levelSize(level int) uint64 {
+	var size uint64
+	for _, t := range v.levels[level] {
+		size += t.meta.size
+	}
+
+	return size
+}
+
+// Tables in level overlapping user keys [start, end].
+func (v *lsmVersion) overlappingTables(level int, start []byte, end []byte) []*liveTable {
+	var tables []*liveTable
+	for _, t := range v.levels[level] {
+		if t.overlaps(v.compare, start, end) {
+			tables = append(tables, t)
+		}
+	}
+
+	return tables
+}
+
+// Find the newest entry of key visible at sequence number seq. All tables in level 0 are looked
+// up and the newest entry wins, since tables made by size-tiered compaction may hold versions
+// older than tables with smaller numbers.
+func (v *lsmVersion) get(key []byte, seq uint64) (lookupResult, bool, error) {
+	var result lookupResult
+	found := false
+	for _, t := range v.levels[0] {
+		if !t.overlaps(v.compare, key, key) {
+			continue
+		}
+
+		r, ok, err := t.reader.Get(key, seq)
+		if err != nil {
+			return lookupResult{}, false, err
+		}
+
+		if ok && (!found || r.seq > result.seq) {
+			result = r
+			found = true
+		}
+	}
+
+	if found {
+		return result, true, nil
+	}
+
+	for level := 1; level < lsmNumLevels; level++ {
+		tables := v.levels[level]
+		i := sort.Search(len(tables), func(i int) bool {
+			return v.compare(tables[i].largestKey(), key) >= 0
+		})
+
+		if i >= len(tables) || v.compare(tables[i].smallestKey(), key) > 0 {
+			continue
+		}
+
+		r, ok, err := tables[i].reader.Get(key, seq)
+		if err != nil {
+			return lookupResult{}, false, err
+		}
+
+		if ok {
+			return r, true, nil
+		}
+	}
+
+	return lookupResult{}, false, nil
+}
+
+// Changes of tables made by a flush or a compaction.
+type versionEdit struct {
+	added        []*liveTable
+	deleted      map[uint64]bool
+	lastSequence uint64
+	// Range tombstones flushed, and sequence numbers of range tombstones retired.
+	tombstones rangeTombstones
+	retired    map[uint64]bool
+	// Memtable written by a flush, it is dropped when the version is installed.
+	flushed *memtable
+}
+
+// Make a new version by applying edit, tables deleted are marked obsolete.
+func (v *lsmVersion) apply(edit *versionEdit) *lsmVersion {
+	tables := make([]*liveTable, 0, v.tableCount()+len(edit.added))
+	for _, t := range v.tables() {
+		if edit.deleted[t.meta.number] {
+			t.markObsolete()
+			continue
+		}
+
+		tables = append(tables, t)
+	}
+
+	tables = append(tables, edit.added...)
+	next := newVersion(v.compare, tables)
+	next.tombstones = v.tombstones.apply(edit)
+	return next
+}
@@ -0,0 +1,99 @@
+package pinkis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeVersionTable(t *testing.T, dir string, number uint64, level int, entries ...string) *liveTable {
+	path := filepath.Join(dir, tableFileName(number))
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create table failed: %v", err)
+	}
+
+	w, err := newTableWriter(file, internalCompare(bytewiseCompare), tableOptions{})
+	if err != nil {
+		t.Fatalf("make table writer failed: %v", err)
+	}
+
+	for i := 0; i+1 < len(entries); i += 2 {
+		key := makeInternalKey([]byte(entries[i]), number*10+uint64(i), kindPut)
+		if err := w.Add(key, []byte(entries[i+1])); err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+	}
+
+	meta, err := w.Finish()
+	if err != nil {
+		t.Fatalf("finish table failed: %v", err)
+	}
+
+	file.Close()
+	meta.level = level
+	meta.number = number
+	reader, err := openTable(path, number, bytewiseCompare, tableOptions{})
+	if err != nil {
+		t.Fatalf("open table failed: %v", err)
+	}
+
+	return newLiveTable(meta, reader, path)
+}
+
+func TestVersionGet(t *testing.T) {
+	dir := t.TempDir()
+	older := writeVersionTable(t, dir, 1, 0, "harry", "stone", "ron", "rat")
+	newer := writeVersionTable(t, dir, 2, 0, "harry", "chamber")
+	deep := writeVersionTable(t, dir, 3, 1, "hermione", "cat", "neville", "toad")
+
+	v := newVersion(bytewiseCompare, []*liveTable{older, deep, newer})
+	defer v.unref()
+
+	if n := v.tableCount(); n != 3 {
+		t.Errorf("unexpected table count: %d", n)
+	}
+
+	if v.levels[0][0] != newer {
+		t.Errorf("level 0 should be ordered from the newest")
+	}
+
+	cases := map[string]string{
+		"harry":    "chamber",
+		"ron":      "rat",
+		"neville":  "toad",
+		"hermione": "cat",
+	}
+
+	for key, expected := range cases {
+		result, found, err := v.get([]byte(key), maxSequence)
+		if err != nil || !found || string(result.value) != expected {
+			t.Errorf("unexpected result of %s: %s, %v, %v", key, result.value, found, err)
+		}
+	}
+
+	if _, found, _ := v.get([]byte("draco"), maxSequence); found {
+		t.Errorf("draco should not be found")
+	}
+}
+
+func TestVersionObsoleteTable(t *testing.T) {
+	dir := t.TempDir()
+	table := writeVersionTable(t, dir, 1, 0, "harry", "potter")
+	v1 := newVersion(bytewiseCompare, []*liveTable{table})
+	v2 := v1.apply(&versionEdit{deleted: map[uint64]bool{1: true}})
+	defer v2.unref()
+
+	if n := v2.tableCount(); n != 0 {
+		t.Errorf("deleted table should not be in new version, got %d tables", n)
+	}
+
+	if _, err := os.Stat(table.path); err != nil {
+		t.Errorf("table referenced by old version should be kept: %v", err)
+	}
+
+	v1.unref()
+	if _, err := os.Stat(table.path); !os.IsNotExist(err) {
+		t.Errorf("obsolete table should be removed when released: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package pinkis
+
+// Call fn with a read-only view of value of key, without copying it out of storage. With B+tree
+// engine, view is a slice of the memory mapped file. View is valid only in the read transaction,
+// until fn returns, and must not be modified. Use Copy to keep it.
+func (db *DB) GetView(key []byte, fn func(view []byte) error) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return db.view(defaultKey(key), func(value []byte, object interface{}) error {
+		return fn(value)
+	})
+}
+
+// Copy a view into memory owned by caller.
+func Copy(view []byte) ([]byte, error) {
+	return duplicateBytes(view)
+}
@@ -0,0 +1,161 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"unsafe"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func TestGetView(t *testing.T) {
+	engines := map[string]*DB{
+		"memory": openTestDB(t),
+		"lsm":    openTestLSM(t, t.TempDir()),
+		"btree":  openTestBTree(t, t.TempDir()),
+	}
+
+	for name, db := range engines {
+		db.Put([]byte("harry"), []byte("potter"))
+
+		var kept []byte
+		err := db.GetView([]byte("harry"), func(view []byte) error {
+			if string(view) != "potter" {
+				t.Errorf("%s: unexpected view %q", name, view)
+			}
+
+			var err error
+			kept, err = Copy(view)
+			return err
+		})
+
+		if err != nil || !meta.Equal(kept, []byte("potter")) {
+			t.Errorf("%s: unexpected copy %q, %v", name, kept, err)
+		}
+
+		err = db.GetView([]byte("draco"), func(view []byte) error { return nil })
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+
+		stop := errors.New("stop")
+		if err := db.GetView([]byte("harry"), func([]byte) error { return stop }); err != stop {
+			t.Errorf("%s: error of fn should be returned, got %v", name, err)
+		}
+
+		db.Close()
+		if err := db.GetView([]byte("harry"), func([]byte) error { return nil }); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func inRegion(region *mmapRegion, data []byte) bool {
+	start := uintptr(unsafe.Pointer(&region.data[0]))
+	p := uintptr(unsafe.Pointer(&data[0]))
+	return p >= start && p < start+uintptr(len(region.data))
+}
+
+func TestBTreeZeroCopyView(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported")
+	}
+
+	db := openTestBTree(t, t.TempDir())
+	defer db.Close()
+
+	e := btreeEngineOf(db)
+	db.Put([]byte("hermione"), []byte("granger"))
+	err := db.GetView([]byte("hermione"), func(view []byte) error {
+		if !inRegion(e.region, view) {
+			t.Errorf("view should be in mapped region")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Errorf("get view failed: %v", err)
+	}
+
+	value, err := db.Get([]byte("hermione"))
+	if err != nil || inRegion(e.region, value) {
+		t.Errorf("value from Get should be copied out of mapped region: %v", err)
+	}
+}
+
+// A read transaction keeps its region valid after file grows and is remapped.
+func TestBTreeRemap(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported")
+	}
+
+	db := openTestBTree(t, t.TempDir())
+	defer db.Close()
+
+	e := btreeEngineOf(db)
+	db.Put([]byte("ron"), []byte("weasley"))
+	tx := e.beginRead()
+	old := tx.region
+
+	value := make([]byte, 4000)
+	for i := 0; len(e.region.data) <= len(old.data); i++ {
+		if err := db.Put([]byte(fmt.Sprintf("book-%04d", i)), value); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	if old.data == nil {
+		t.Fatalf("region used by a transaction should not be unmapped")
+	}
+
+	got, found, err := tx.get(defaultKey([]byte("ron")))
+	if err != nil || !found || string(got) != "weasley" {
+		t.Errorf("unexpected value in old transaction: %s, %v, %v", got, found, err)
+	}
+
+	e.endRead(tx)
+	if old.data != nil {
+		t.Errorf("old region should be unmapped when the last transaction ends")
+	}
+
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("book-%04d", i))
+		if got, err := db.Get(key); err != nil || len(got) != len(value) {
+			t.Errorf("unexpected value of %s: %d bytes, %v", key, len(got), err)
+		}
+	}
+}
+
+func TestBTreeDisableMmap(t *testing.T) {
+	options := Options{
+		Dir:         t.TempDir(),
+		Engine:      EngineBTree,
+		SyncPolicy:  SyncNever,
+		PageSize:    512,
+		DisableMmap: true,
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if region := btreeEngineOf(db).region; region != nil {
+		t.Errorf("file should not be mapped")
+	}
+
+	for i := 0; i < 500; i++ {
+		db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprint(i)))
+	}
+
+	for i := 0; i < 500; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key-%03d", i)))
+		if err != nil || string(value) != fmt.Sprint(i) {
+			t.Errorf("unexpected value of %d: %s, %v", i, value, err)
+		}
+	}
+}
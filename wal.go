@@ -0,0 +1,630 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when write-ahead log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// Sync after every write, a write returned is durable.
+	SyncAlways SyncPolicy = iota
+	// Sync every Options.SyncPeriod in background, writes in last period may be lost on crash.
+	SyncPeriodically
+	// Never sync explicitly, leave it to operating system.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+
+	case SyncPeriodically:
+		return "periodically"
+
+	case SyncNever:
+		return "never"
+
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	walSuffix             = ".wal"
+	walRecordHeaderSize   = 8
+	walDefaultSegmentSize = 64 << 20
+	walDefaultSyncPeriod  = 100 * time.Millisecond
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum of length and payload, a corrupted length is detected as well.
+func walChecksum(header []byte, payload []byte) uint32 {
+	crc := crc32.Update(0, crc32cTable, header[4:walRecordHeaderSize])
+	return crc32.Update(crc, crc32cTable, payload)
+}
+
+// Encode a WAL record as:
+//
+//	checksum uint32, CRC32C of length and payload, little endian
+//	length   uint32, length of payload, little endian
+//	payload  [length]byte
+func encodeWALRecord(payload []byte) []byte {
+	record := make([]byte, walRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(payload)))
+	copy(record[walRecordHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(record, walChecksum(record, payload))
+	return record
+}
+
+// Decode the first record in data, return payload and size of record. ok is false if data does
+// not start with a complete and valid record.
+func decodeWALRecord(data []byte) ([]byte, int, bool) {
+	if len(data) < walRecordHeaderSize {
+		return nil, 0, false
+	}
+
+	length := binary.LittleEndian.Uint32(data[4:])
+	if uint64(length) > uint64(len(data)-walRecordHeaderSize) {
+		return nil, 0, false
+	}
+
+	size := walRecordHeaderSize + int(length)
+	payload := data[walRecordHeaderSize:size]
+	checksum := binary.LittleEndian.Uint32(data)
+	if checksum != walChecksum(data, payload) {
+		return nil, 0, false
+	}
+
+	return payload, size, true
+}
+
+// Offset of the first valid record in data after offset, or length of data if there is none.
+func nextWALRecord(data []byte, offset int) int {
+	for offset++; offset < len(data); offset++ {
+		if _, _, ok := decodeWALRecord(data[offset:]); ok {
+			return offset
+		}
+	}
+
+	return len(data)
+}
+
+// RecoveryInfo reports what is replayed from write-ahead log when database is opened.
+type RecoveryInfo struct {
+	Segments       int
+	Records        int
+	LastSequence   uint64
+	TruncatedBytes int64
+	// Segment file truncated, empty if nothing is truncated.
+	TruncatedSegment string
+}
+
+type walOptions struct {
+	dir          string
+	segmentSize  int64
+	syncPolicy   SyncPolicy
+	syncPeriod   time.Duration
+	fileMode     os.FileMode
+	replayRecord func(payload []byte) error
+	// Master keys to encrypt new segments, nothing is encrypted if nil.
+	keys KeyProvider
+	// Replay segments only, nothing is appended, created or truncated.
+	readOnly bool
+}
+
+// A segmented write-ahead log. Records are appended to the last segment, a new segment is created
+// when the last one exceeds segment size. An encrypted segment starts with key envelope, payload of
+// each record is sealed by data key of segment, with offset of record as nonce. Encrypted segments
+// are never appended after log is opened again, so that nonce of a torn record is never reused.
+//
+// A record failed to write is cut off from segment, and records after it are appended to a new
+// segment for the same reason. If it can not be cut off, log fails and nothing is appended since.
+type writeAheadLog struct {
+	lock     sync.Mutex
+	options  walOptions
+	segments []uint64
+	file     walFile
+	offset   int64
+	dirty    bool
+	// Cipher of the last segment, nil if it is not encrypted.
+	cipher *fileCipher
+	// Whether a record failed to write into the last segment, and error failing log.
+	torn bool
+	err  error
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// Segment file being appended.
+type walFile interface {
+	Write(data []byte) (int, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+func walSegmentName(id uint64) string {
+	return fmt.Sprintf("%06d%s", id, walSuffix)
+}
+
+func listWALSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, id)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// Open write-ahead log in dir, replay all records and truncate a torn tail in the last segment.
+// A broken record in any other segment is reported as an error wraps ErrCorrupted.
+func openWAL(options walOptions) (*writeAheadLog, RecoveryInfo, error) {
+	var info RecoveryInfo
+	if options.segmentSize <= 0 {
+		options.segmentSize = walDefaultSegmentSize
+	}
+
+	if options.syncPeriod <= 0 {
+		options.syncPeriod = walDefaultSyncPeriod
+	}
+
+	if options.fileMode == 0 {
+		options.fileMode = 0644
+	}
+
+	if !options.readOnly {
+		if err := os.MkdirAll(options.dir, 0755); err != nil {
+			return nil, info, err
+		}
+	}
+
+	segments, err := listWALSegments(options.dir)
+	if options.readOnly && os.IsNotExist(err) {
+		segments, err = nil, nil
+	}
+
+	if err != nil {
+		return nil, info, err
+	}
+
+	w := &writeAheadLog{
+		options:  options,
+		segments: segments,
+	}
+
+	for i, id := range segments {
+		last := i == len(segments)-1
+		if err := w.replaySegment(id, last, &info); err != nil {
+			return nil, info, err
+		}
+	}
+
+	info.Segments = len(segments)
+	if options.readOnly {
+		return w, info, nil
+	}
+
+	if len(segments) <= 0 {
+		err = w.createSegment(1)
+
+	} else if w.cipher != nil || options.keys != nil {
+		err = w.createSegment(segments[len(segments)-1] + 1)
+
+	} else {
+		err = w.openLastSegment()
+	}
+
+	if err != nil {
+		return nil, info, err
+	}
+
+	if options.syncPolicy == SyncPeriodically {
+		w.closing = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncPeriodically()
+	}
+
+	return w, info, nil
+}
+
+func (w *writeAheadLog) segmentPath(id uint64) string {
+	return filepath.Join(w.options.dir, walSegmentName(id))
+}
+
+func (w *writeAheadLog) replaySegment(id uint64, last bool, info *RecoveryInfo) error {
+	path := w.segmentPath(id)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+	w.cipher = nil
+	if size, ok := envelopeSize(data); ok {
+		if size > len(data) && last {
+			return w.truncateSegment(id, path, 0, len(data), info)
+		}
+
+		if w.cipher, err = openEnvelope(data, w.options.keys, walSegmentName(id)); err != nil {
+			return err
+		}
+
+		offset = size
+	}
+
+	for offset < len(data) {
+		payload, size, ok := decodeWALRecord(data[offset:])
+		if !ok {
+			break
+		}
+
+		if w.cipher != nil {
+			if payload, err = w.cipher.open(nil, uint64(offset), payload); err != nil {
+				return WrapError(ErrDecryption, "record at %s:%d cannot be decrypted",
+					walSegmentName(id), offset)
+			}
+		}
+
+		if w.options.replayRecord != nil {
+			if err := w.options.replayRecord(payload); err != nil {
+				return WrapError(ErrCorrupted, "replay record at %s:%d failed: %s",
+					walSegmentName(id), offset, err)
+			}
+		}
+
+		offset += size
+		info.Records++
+	}
+
+	if offset >= len(data) {
+		return nil
+	}
+
+	// Valid records following a broken one are not a torn write.
+	if !last || nextWALRecord(data, offset) < len(data) {
+		return WrapError(ErrCorrupted, "wal segment %s corrupted at offset %d",
+			walSegmentName(id), offset)
+	}
+
+	return w.truncateSegment(id, path, offset, len(data), info)
+}
+
+// Truncate a torn tail of segment id of size at offset, it is only skipped if log is read-only.
+func (w *writeAheadLog) truncateSegment(id uint64, path string, offset int, size int, info *RecoveryInfo) error {
+	if w.options.readOnly {
+		return nil
+	}
+
+	if err := os.Truncate(path, int64(offset)); err != nil {
+		return err
+	}
+
+	info.TruncatedBytes = int64(size - offset)
+	info.TruncatedSegment = walSegmentName(id)
+	return nil
+}
+
+func (w *writeAheadLog) createSegment(id uint64) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL | os.O_APPEND
+	file, err := os.OpenFile(w.segmentPath(id), flag, w.options.fileMode)
+	if err != nil {
+		return err
+	}
+
+	if err := syncDir(w.options.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.offset = 0
+	w.cipher = nil
+	w.torn = false
+	if w.options.keys != nil {
+		if err := w.writeEnvelope(); err != nil {
+			file.Close()
+			w.file = nil
+			return err
+		}
+	}
+
+	if len(w.segments) <= 0 || w.segments[len(w.segments)-1] != id {
+		w.segments = append(w.segments, id)
+	}
+
+	return nil
+}
+
+// Write key envelope of a new data key into the new segment.
+func (w *writeAheadLog) writeEnvelope() error {
+	c, err := newFileCipher(w.options.keys)
+	if err != nil {
+		return err
+	}
+
+	n, err := w.file.Write(c.envelope)
+	w.offset += int64(n)
+	if err != nil {
+		return err
+	}
+
+	w.cipher = c
+	w.dirty = true
+	return nil
+}
+
+func (w *writeAheadLog) openLastSegment() error {
+	id := w.segments[len(w.segments)-1]
+	file, err := os.OpenFile(w.segmentPath(id), os.O_WRONLY|os.O_APPEND, w.options.fileMode)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.offset = stat.Size()
+	return nil
+}
+
+// Finish current segment and start a new one, return id of the new segment.
+func (w *writeAheadLog) rotate() (uint64, error) {
+	if err := w.file.Sync(); err != nil {
+		return 0, err
+	}
+
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+
+	w.dirty = false
+	id := w.segments[len(w.segments)-1] + 1
+	if err := w.createSegment(id); err != nil {
+		w.file = nil
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Finish current segment and start a new one, return id of the new segment.
+func (w *writeAheadLog) Rotate() (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return 0, ErrClosed
+	}
+
+	return w.rotate()
+}
+
+// Remove all segments before segment id, they are no longer needed for recovery.
+func (w *writeAheadLog) RemoveBefore(id uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	removed := 0
+	for removed < len(w.segments)-1 && w.segments[removed] < id {
+		if err := os.Remove(w.segmentPath(w.segments[removed])); err != nil && !os.IsNotExist(err) {
+			w.segments = w.segments[removed:]
+			return err
+		}
+
+		removed++
+	}
+
+	w.segments = w.segments[removed:]
+	if removed > 0 {
+		return syncDir(w.options.dir)
+	}
+
+	return nil
+}
+
+// Append payload as a record, and sync it according to sync policy.
+func (w *writeAheadLog) Append(payload []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return ErrClosed
+
+	} else if w.err != nil {
+		return w.err
+	}
+
+	if (w.offset > 0 && w.offset >= w.options.segmentSize) || w.staleKey() || w.torn {
+		if _, err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if w.cipher != nil {
+		payload = w.cipher.seal(nil, uint64(w.offset), payload)
+	}
+
+	record := encodeWALRecord(payload)
+	if _, err := w.file.Write(record); err != nil {
+		w.torn = true
+		if errTruncate := w.file.Truncate(w.offset); errTruncate != nil {
+			w.err = WrapError(errTruncate, "write-ahead log failed, torn record at %d can not be cut off",
+				w.offset)
+		}
+
+		return err
+	}
+
+	w.offset += int64(len(record))
+
+	w.dirty = true
+	if w.options.syncPolicy == SyncAlways {
+		return w.sync()
+	}
+
+	return nil
+}
+
+// Whether the last segment is not encrypted by the current master key, records are appended to a
+// new segment then, so that old master keys are no longer used once old segments are removed.
+func (w *writeAheadLog) staleKey() bool {
+	keys := w.options.keys
+	return keys != nil && (w.cipher == nil || w.cipher.keyID != keys.CurrentKeyID())
+}
+
+func (w *writeAheadLog) sync() error {
+	if !w.dirty {
+		return nil
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.dirty = false
+	return nil
+}
+
+// Flush written records to stable storage.
+func (w *writeAheadLog) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return ErrClosed
+	}
+
+	return w.sync()
+}
+
+func (w *writeAheadLog) syncPeriodically() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.options.syncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Error is reported again by following Sync or Close.
+			_ = w.Sync()
+
+		case <-w.closing:
+			return
+		}
+	}
+}
+
+// Ids of all segments, the last one is being written.
+func (w *writeAheadLog) Segments() []uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	segments := make([]uint64, len(w.segments))
+	copy(segments, w.segments)
+	return segments
+}
+
+// Sync and close log.
+func (w *writeAheadLog) Close() error {
+	if w.options.readOnly {
+		return nil
+	}
+
+	if w.closing != nil {
+		close(w.closing)
+		<-w.done
+		w.closing = nil
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return ErrClosed
+	}
+
+	err := w.sync()
+	if errClose := w.file.Close(); err == nil {
+		err = errClose
+	}
+
+	w.file = nil
+	return err
+}
+
+// Copy all segments into dir, the last one is copied up to the last record appended.
+func (w *writeAheadLog) CopyTo(dir string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return ErrClosed
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for i, id := range w.segments {
+		size := int64(-1)
+		if i == len(w.segments)-1 {
+			size = w.offset
+		}
+
+		if err := copyFile(w.segmentPath(id), filepath.Join(dir, walSegmentName(id)), size); err != nil {
+			return err
+		}
+	}
+
+	return syncDir(dir)
+}
+
+// Sync directory to make file creation and removal durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if errClose := d.Close(); err == nil {
+		err = errClose
+	}
+
+	return err
+}
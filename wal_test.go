@@ -0,0 +1,390 @@
+package pinkis
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestWAL(t *testing.T, dir string, records *[]string) (*writeAheadLog, RecoveryInfo) {
+	options := walOptions{
+		dir:         dir,
+		segmentSize: 1 << 20,
+		syncPolicy:  SyncNever,
+		replayRecord: func(payload []byte) error {
+			*records = append(*records, string(payload))
+			return nil
+		},
+	}
+
+	w, info, err := openWAL(options)
+	if err != nil {
+		t.Fatalf("open wal failed: %v", err)
+	}
+
+	return w, info
+}
+
+func TestWALRecord(t *testing.T) {
+	record := encodeWALRecord([]byte("expecto patronum"))
+	payload, size, ok := decodeWALRecord(record)
+	if !ok || size != len(record) || string(payload) != "expecto patronum" {
+		t.Errorf("unexpected result: %q, %d, %v", payload, size, ok)
+	}
+
+	for i := 0; i < len(record); i++ {
+		if _, _, ok := decodeWALRecord(record[:i]); ok {
+			t.Errorf("decode torn record[:%d] should fail", i)
+		}
+
+		corrupted := append([]byte{}, record...)
+		corrupted[i] ^= 0x01
+		if _, _, ok := decodeWALRecord(corrupted); ok {
+			t.Errorf("decode record corrupted at %d should fail", i)
+		}
+	}
+}
+
+func TestWALAppendAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	var records []string
+	w, info := openTestWAL(t, dir, &records)
+	if info.Segments != 0 || info.Records != 0 {
+		t.Errorf("unexpected recovery info: %+v", info)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := w.Append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	if err := w.Append([]byte("closed")); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	w, info = openTestWAL(t, dir, &records)
+	defer w.Close()
+
+	if info.Segments != 1 || info.Records != 10 || info.TruncatedBytes != 0 {
+		t.Errorf("unexpected recovery info: %+v", info)
+	}
+
+	for i, record := range records {
+		if record != fmt.Sprintf("record-%d", i) {
+			t.Errorf("records[%d] = %s", i, record)
+		}
+	}
+}
+
+func TestWALSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	options := walOptions{
+		dir:         dir,
+		segmentSize: 64,
+		syncPolicy:  SyncAlways,
+	}
+
+	w, _, err := openWAL(options)
+	if err != nil {
+		t.Fatalf("open wal failed: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := w.Append([]byte(fmt.Sprintf("mischief managed %02d", i))); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+
+	w.Close()
+	segments, _ := listWALSegments(dir)
+	// 27 bytes per record, 3 records per segment.
+	if len(segments) != 7 {
+		t.Errorf("unexpected segments: %v", segments)
+	}
+
+	var records []string
+	options.replayRecord = func(payload []byte) error {
+		records = append(records, string(payload))
+		return nil
+	}
+
+	w, info, err := openWAL(options)
+	if err != nil {
+		t.Fatalf("open wal failed: %v", err)
+	}
+
+	defer w.Close()
+	if info.Segments != 7 || info.Records != 20 || len(records) != 20 {
+		t.Errorf("unexpected recovery info: %+v", info)
+	}
+
+	if len(w.Segments()) != 7 {
+		t.Errorf("unexpected segments: %v", w.Segments())
+	}
+}
+
+// Simulate crashes by truncating the last segment at every byte offset.
+func TestWALTruncateAtEveryOffset(t *testing.T) {
+	source := t.TempDir()
+	var records []string
+	w, _ := openTestWAL(t, source, &records)
+
+	ends := []int{0}
+	for i := 0; i < 5; i++ {
+		payload := []byte(fmt.Sprintf("alohomora-%d", i))
+		if err := w.Append(payload); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+
+		ends = append(ends, ends[len(ends)-1]+walRecordHeaderSize+len(payload))
+	}
+
+	w.Close()
+	data, err := os.ReadFile(filepath.Join(source, walSegmentName(1)))
+	if err != nil {
+		t.Fatalf("read segment failed: %v", err)
+	}
+
+	for offset := 0; offset <= len(data); offset++ {
+		dir := t.TempDir()
+		path := filepath.Join(dir, walSegmentName(1))
+		if err := os.WriteFile(path, data[:offset], 0644); err != nil {
+			t.Fatalf("write segment failed: %v", err)
+		}
+
+		complete := 0
+		for complete+1 < len(ends) && ends[complete+1] <= offset {
+			complete++
+		}
+
+		records = nil
+		w, info := openTestWAL(t, dir, &records)
+		if info.Records != complete || len(records) != complete {
+			t.Errorf("offset %d: recovered %d records, expected %d", offset, info.Records, complete)
+		}
+
+		truncated := int64(offset - ends[complete])
+		if info.TruncatedBytes != truncated {
+			t.Errorf("offset %d: truncated %d bytes, expected %d", offset, info.TruncatedBytes, truncated)
+		}
+
+		if truncated > 0 && info.TruncatedSegment != walSegmentName(1) {
+			t.Errorf("offset %d: unexpected truncated segment %s", offset, info.TruncatedSegment)
+		}
+
+		if err := w.Append([]byte("after crash")); err != nil {
+			t.Errorf("offset %d: append failed: %v", offset, err)
+		}
+
+		w.Close()
+		records = nil
+		w, info = openTestWAL(t, dir, &records)
+		if info.Records != complete+1 || info.TruncatedBytes != 0 {
+			t.Errorf("offset %d: unexpected recovery after append: %+v", offset, info)
+		}
+
+		w.Close()
+	}
+}
+
+func TestWALCorruptedSegment(t *testing.T) {
+	dir := t.TempDir()
+	options := walOptions{
+		dir:         dir,
+		segmentSize: 32,
+		syncPolicy:  SyncNever,
+	}
+
+	w, _, err := openWAL(options)
+	if err != nil {
+		t.Fatalf("open wal failed: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		w.Append([]byte(fmt.Sprintf("obliviate-%d-obliviate", i)))
+	}
+
+	w.Close()
+
+	path := filepath.Join(dir, walSegmentName(1))
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	_, _, err = openWAL(options)
+	if !errors.Is(err, ErrCorrupted) || !errors.Is(err, ErrPinkisError) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestWALCorruptedLastSegment(t *testing.T) {
+	dir := t.TempDir()
+	var records []string
+	w, _ := openTestWAL(t, dir, &records)
+	for i := 0; i < 5; i++ {
+		w.Append([]byte(fmt.Sprintf("expelliarmus-%d", i)))
+	}
+
+	w.Close()
+
+	// A broken record followed by valid records is not a torn write.
+	path := filepath.Join(dir, walSegmentName(1))
+	data, _ := os.ReadFile(path)
+	data[walRecordHeaderSize+2] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	_, _, err := openWAL(walOptions{dir: dir, syncPolicy: SyncNever})
+	if !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if stat, _ := os.Stat(path); stat.Size() != int64(len(data)) {
+		t.Errorf("corrupted segment should not be truncated")
+	}
+}
+
+func TestWALReplayError(t *testing.T) {
+	dir := t.TempDir()
+	var records []string
+	w, _ := openTestWAL(t, dir, &records)
+	w.Append([]byte("crucio"))
+	w.Close()
+
+	options := walOptions{
+		dir: dir,
+		replayRecord: func(payload []byte) error {
+			return errors.New("unforgivable")
+		},
+	}
+
+	if _, _, err := openWAL(options); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// A segment file writes half of the next record and fails.
+type testTornFile struct {
+	walFile
+	torn        bool
+	truncateErr error
+}
+
+func (f *testTornFile) Write(data []byte) (int, error) {
+	if f.torn {
+		f.torn = false
+		n, _ := f.walFile.Write(data[:len(data)/2])
+		return n, errors.New("disk full")
+	}
+
+	return f.walFile.Write(data)
+}
+
+func (f *testTornFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+
+	return f.walFile.Truncate(size)
+}
+
+func TestWALTornAppend(t *testing.T) {
+	for _, truncateErr := range []error{nil, errors.New("read-only file system")} {
+		dir := t.TempDir()
+		var records []string
+		w, _ := openTestWAL(t, dir, &records)
+		if err := w.Append([]byte("alohomora")); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+
+		w.file = &testTornFile{walFile: w.file, torn: true, truncateErr: truncateErr}
+		if err := w.Append([]byte("colloportus")); err == nil {
+			t.Errorf("append should fail")
+		}
+
+		err := w.Append([]byte("lumos"))
+		expected := []string{"alohomora", "lumos"}
+		if truncateErr != nil {
+			if !errors.Is(err, truncateErr) {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			expected = expected[:1]
+
+		} else if err != nil {
+			t.Errorf("append after torn record failed: %v", err)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+
+		records = nil
+		w, info := openTestWAL(t, dir, &records)
+		if fmt.Sprint(records) != fmt.Sprint(expected) {
+			t.Errorf("unexpected records: %q", records)
+		}
+
+		if truncated := info.TruncatedBytes > 0; truncated != (truncateErr != nil) {
+			t.Errorf("unexpected recovery info: %+v", info)
+		}
+
+		w.Close()
+	}
+}
+
+func TestWALSyncPolicy(t *testing.T) {
+	policies := []SyncPolicy{SyncAlways, SyncPeriodically, SyncNever}
+	for _, policy := range policies {
+		dir := t.TempDir()
+		options := walOptions{
+			dir:        dir,
+			syncPolicy: policy,
+			syncPeriod: time.Millisecond,
+		}
+
+		w, _, err := openWAL(options)
+		if err != nil {
+			t.Fatalf("open wal with %s failed: %v", policy, err)
+		}
+
+		if err := w.Append([]byte("lumos")); err != nil {
+			t.Errorf("append with %s failed: %v", policy, err)
+		}
+
+		if policy == SyncAlways && w.dirty {
+			t.Errorf("wal should be synced with %s", policy)
+		}
+
+		if policy == SyncNever && !w.dirty {
+			t.Errorf("wal should not be synced with %s", policy)
+		}
+
+		if policy == SyncPeriodically {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		if err := w.Sync(); err != nil {
+			t.Errorf("sync with %s failed: %v", policy, err)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Errorf("close with %s failed: %v", policy, err)
+		}
+
+		if err := w.Sync(); !errors.Is(err, ErrClosed) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	if SyncPolicy(42).String() != "unknown" {
+		t.Errorf("unexpected name: %s", SyncPolicy(42))
+	}
+}
@@ -0,0 +1,585 @@
+package pinkis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/flily/pinkis/meta"
+)
+
+// ChangeType tells whether a key is put or deleted by a change.
+type ChangeType int
+
+const (
+	ChangePut ChangeType = iota
+	ChangeDelete
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangePut:
+		return "put"
+
+	case ChangeDelete:
+		return "delete"
+
+	default:
+		return "unknown"
+	}
+}
+
+// ChangeEvent is a change of a key delivered to watchers. All writes of a key in a batch make a
+// single change, and keys deleted by a range deletion share its sequence number.
+type ChangeEvent struct {
+	Type ChangeType
+	Key  []byte
+	// Values before and after change, nil if key does not exist.
+	OldValue []byte
+	Value    []byte
+	// Sequence number of the last write of key in the batch.
+	Sequence uint64
+	// Paths of fields changed, see meta.DiffFields. Only changes of collections put over existing
+	// values have it.
+	Fields []string
+	// Why watch stops, it is set in the last event only, which has no change.
+	Err error
+}
+
+// Options of watch.
+type WatchOptions struct {
+	// Deliver changes with sequence numbers >= From, older ones are taken from history kept by
+	// Options.WatchHistory, or watch fails with ErrHistoryTruncated. Zero means changes after
+	// watch begins. To resume, pass Sequence of the last event received plus 1.
+	From uint64
+	// Number of changes waiting to be received, 1024 by default. Writers are never blocked by
+	// watchers, a watcher falling behind more stops with ErrWatchLagged.
+	Buffer int
+}
+
+func (o *WatchOptions) buffer() int {
+	if o == nil || o.Buffer <= 0 {
+		return 1024
+	}
+
+	return o.Buffer
+}
+
+func (o *WatchOptions) from() uint64 {
+	if o == nil {
+		return 0
+	}
+
+	return o.From
+}
+
+// A change of a full key, values are owned by change and never modified.
+type change struct {
+	kind  ChangeType
+	key   []byte
+	old   []byte
+	value []byte
+	seq   uint64
+}
+
+// Only keys of users are watched.
+func watchable(key []byte) bool {
+	if len(key) <= 0 {
+		return false
+	}
+
+	switch key[0] {
+	case namespaceDefault, namespaceCollection, namespaceBucket:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// Watchers of database, and history of recent changes.
+type watchHub struct {
+	lock     sync.Mutex
+	watchers map[*watcher]bool
+	// Recent changes in order of sequence numbers, at most limit ones are kept.
+	history []change
+	limit   int
+	// All changes with sequence numbers >= first are in history.
+	first  uint64
+	closed bool
+}
+
+func newWatchHub(limit int, sequence uint64) *watchHub {
+	return &watchHub{
+		watchers: make(map[*watcher]bool),
+		limit:    limit,
+		first:    sequence + 1,
+	}
+}
+
+// Whether changes are wanted by any watcher or history.
+func (h *watchHub) active() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.limit > 0 || len(h.watchers) > 0
+}
+
+// Whether changes of key are wanted, it is called with lock held.
+func (h *watchHub) wants(key []byte) bool {
+	if !watchable(key) {
+		return false
+	}
+
+	if h.limit > 0 {
+		return true
+	}
+
+	for w := range h.watchers {
+		if bytes.HasPrefix(key, w.prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Publish changes of batches up to sequence number last.
+func (h *watchHub) publish(last uint64, changes []change) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for w := range h.watchers {
+		w.push(changes)
+	}
+
+	if h.limit <= 0 {
+		h.first = last + 1
+		return
+	}
+
+	h.history = append(h.history, changes...)
+	for len(h.history) > h.limit {
+		h.first = h.history[0].seq + 1
+		h.history = h.history[1:]
+		for len(h.history) > 0 && h.history[0].seq < h.first {
+			h.history = h.history[1:]
+		}
+	}
+}
+
+// Changes of batches up to sequence number last are lost, all watchers stop with err.
+func (h *watchHub) fail(last uint64, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for w := range h.watchers {
+		w.stop(err)
+	}
+
+	h.history = nil
+	h.first = last + 1
+}
+
+// Add a watcher at sequence number current, with changes since w.from in history pushed to it.
+func (h *watchHub) add(w *watcher, current uint64) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return ErrClosed
+	}
+
+	// Without history, first is not advanced by writes made while no watcher is active.
+	if h.limit <= 0 {
+		h.first = current + 1
+	}
+
+	if w.from <= 0 {
+		w.from = current + 1
+
+	} else if w.from < h.first {
+		return WrapError(ErrHistoryTruncated, "changes before %d are not kept, but from %d",
+			h.first, w.from)
+	}
+
+	i := sort.Search(len(h.history), func(i int) bool { return h.history[i].seq >= w.from })
+	w.push(h.history[i:])
+	h.watchers[w] = true
+	return nil
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.watchers, w)
+}
+
+// Stop all watchers with ErrClosed, after changes pending are delivered.
+func (h *watchHub) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closed = true
+	for w := range h.watchers {
+		w.stop(ErrClosed)
+	}
+}
+
+// A watcher of keys with prefix, it delivers changes pushed to channel events in its own goroutine.
+type watcher struct {
+	prefix []byte
+	from   uint64
+	limit  int
+	// Make event of change for receiver.
+	event func(c change) (ChangeEvent, error)
+
+	lock    sync.Mutex
+	pending []change
+	err     error
+	signal  chan struct{}
+	events  chan ChangeEvent
+}
+
+func newWatcher(prefix []byte, options *WatchOptions,
+	event func(c change) (ChangeEvent, error)) *watcher {
+	return &watcher{
+		prefix: prefix,
+		from:   options.from(),
+		limit:  options.buffer(),
+		event:  event,
+		signal: make(chan struct{}, 1),
+		events: make(chan ChangeEvent),
+	}
+}
+
+func (w *watcher) notify() {
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Queue changes wanted, all changes of a push are dropped if too many changes are pending.
+func (w *watcher) push(changes []change) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err != nil {
+		return
+	}
+
+	n := len(w.pending)
+	for _, c := range changes {
+		if c.seq >= w.from && bytes.HasPrefix(c.key, w.prefix) {
+			w.pending = append(w.pending, c)
+		}
+	}
+
+	if len(w.pending) > w.limit {
+		w.pending = w.pending[:n]
+		w.err = WrapError(ErrWatchLagged, "more than %d changes are not received", w.limit)
+	}
+
+	if len(w.pending) > 0 || w.err != nil {
+		w.notify()
+	}
+}
+
+// Stop watcher with err after changes pending are delivered.
+func (w *watcher) stop(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+
+	w.notify()
+}
+
+func (w *watcher) send(ctx context.Context, event ChangeEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Deliver changes until ctx is done or watcher stops, then call done and close events.
+func (w *watcher) run(ctx context.Context, done func()) {
+	defer close(w.events)
+	defer done()
+
+	for {
+		w.lock.Lock()
+		pending, err := w.pending, w.err
+		w.pending = nil
+		w.lock.Unlock()
+
+		for _, c := range pending {
+			event, err := w.event(c)
+			if err != nil {
+				w.send(ctx, ChangeEvent{Err: err})
+				return
+			}
+
+			if !w.send(ctx, event) {
+				return
+			}
+		}
+
+		if len(pending) > 0 {
+			continue
+		}
+
+		if err != nil {
+			w.send(ctx, ChangeEvent{Err: err})
+			return
+		}
+
+		select {
+		case <-w.signal:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Start watcher w at the current sequence number, until ctx is done.
+func (db *DB) watch(ctx context.Context, w *watcher) (<-chan ChangeEvent, error) {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	if err := db.watches.add(w, db.sequence); err != nil {
+		return nil, err
+	}
+
+	go w.run(ctx, func() { db.watches.remove(w) })
+	return w.events, nil
+}
+
+// Watch changes of keys with prefix, empty prefix means all keys, until ctx is done. Changes are
+// delivered in order of sequence numbers, channel is closed when watch stops.
+func (db *DB) Watch(ctx context.Context, prefix []byte) (<-chan ChangeEvent, error) {
+	return db.WatchWithOptions(ctx, prefix, nil)
+}
+
+// Same as Watch, with options, which may be nil.
+func (db *DB) WatchWithOptions(ctx context.Context, prefix []byte,
+	options *WatchOptions) (<-chan ChangeEvent, error) {
+	w := newWatcher(defaultKey(prefix), options, func(c change) (ChangeEvent, error) {
+		return changeEvent(c, 1)
+	})
+
+	return db.watch(ctx, w)
+}
+
+// Event of change with strip bytes of namespace removed from key, values are copied.
+func changeEvent(c change, strip int) (ChangeEvent, error) {
+	old, err := duplicateBytes(c.old)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+
+	value, err := duplicateBytes(c.value)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+
+	event := ChangeEvent{
+		Type:     c.kind,
+		Key:      prefixedKey(nil, c.key[strip:]),
+		OldValue: old,
+		Value:    value,
+		Sequence: c.seq,
+	}
+
+	return event, nil
+}
+
+// Watch changes of keys with prefix in collection, same as DB.Watch. Changes of values put over
+// existing ones tell fields changed.
+func (c *Collection) Watch(ctx context.Context, prefix []byte) (<-chan ChangeEvent, error) {
+	return c.WatchWithOptions(ctx, prefix, nil)
+}
+
+// Same as Watch, with options, which may be nil.
+func (c *Collection) WatchWithOptions(ctx context.Context, prefix []byte,
+	options *WatchOptions) (<-chan ChangeEvent, error) {
+	w := newWatcher(c.key(prefix), options, c.changeEvent)
+	return c.db.watch(ctx, w)
+}
+
+func (c *Collection) changeEvent(ch change) (ChangeEvent, error) {
+	event, err := changeEvent(ch, len(c.prefix))
+	if err != nil || event.OldValue == nil || event.Value == nil {
+		return event, err
+	}
+
+	old, err := c.decode(event.OldValue)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+
+	value, err := c.decode(event.Value)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+
+	event.Fields = meta.DiffFields(old.Interface(), value.Interface())
+	return event, nil
+}
+
+// Apply batch to engine, and publish changes of it to watchers, with old values read from a
+// snapshot taken before. It is called with writeLock held.
+func (db *DB) apply(batch *writeBatch) error {
+	if !db.watches.active() {
+		return db.engine.Apply(batch)
+	}
+
+	before, err := db.engine.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	defer before.Release()
+
+	if err := db.engine.Apply(batch); err != nil {
+		return err
+	}
+
+	// Batch is applied, changes failed to be read stop watchers rather than the write.
+	changes, err := db.changesOf(batch, before)
+	if err != nil {
+		db.watches.fail(batch.LastSequence(), err)
+		return nil
+	}
+
+	db.watches.publish(batch.LastSequence(), changes)
+	return nil
+}
+
+// Changes made by batch just applied over snapshot before, in order of sequence numbers.
+func (db *DB) changesOf(batch *writeBatch, before engineSnapshot) ([]change, error) {
+	db.watches.lock.Lock()
+	var keys []string
+	seqs := make(map[string]uint64)
+	touch := func(key []byte, seq uint64) {
+		if _, found := seqs[string(key)]; !found {
+			if !db.watches.wants(key) {
+				return
+			}
+
+			keys = append(keys, string(key))
+		}
+
+		seqs[string(key)] = seq
+	}
+
+	var ranges []batchEntry
+	var rangeSeqs []uint64
+	for i, e := range batch.entries {
+		seq := batch.seq + uint64(i)
+		if e.kind != kindDeleteRange {
+			touch(e.key, seq)
+			continue
+		}
+
+		for _, key := range keys {
+			if key >= string(e.key) && key < string(e.value) {
+				seqs[key] = seq
+			}
+		}
+
+		if watchable(e.key) {
+			ranges = append(ranges, e)
+			rangeSeqs = append(rangeSeqs, seq)
+		}
+	}
+
+	// Keys deleted by ranges are those existing before batch, the latest range deletes them unless
+	// they are written in batch, then sequence numbers are set above.
+	for i := len(ranges) - 1; i >= 0; i-- {
+		iter := before.Iterator()
+		r := ranges[i]
+		for iter.Seek(r.key); iter.Valid() && bytes.Compare(iter.Key(), r.value) < 0; iter.Next() {
+			if _, found := seqs[string(iter.Key())]; !found {
+				touch(iter.Key(), rangeSeqs[i])
+			}
+		}
+
+		err := iter.Error()
+		if errClose := iter.Close(); err == nil {
+			err = errClose
+		}
+
+		if err != nil {
+			db.watches.lock.Unlock()
+			return nil, err
+		}
+	}
+
+	db.watches.lock.Unlock()
+
+	changes := make([]change, 0, len(keys))
+	for _, key := range keys {
+		old, existed, err := viewCopy(before.View, []byte(key))
+		if err != nil {
+			return nil, err
+		}
+
+		value, exists, err := viewCopy(db.engine.View, []byte(key))
+		if err != nil {
+			return nil, err
+		}
+
+		c := change{kind: ChangePut, key: []byte(key), old: old, value: value, seq: seqs[key]}
+		if !exists {
+			c.kind = ChangeDelete
+
+		} else if c.value == nil {
+			c.value = []byte{}
+		}
+
+		if existed && c.old == nil {
+			c.old = []byte{}
+		}
+
+		if existed || exists {
+			changes = append(changes, c)
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].seq < changes[j].seq })
+	return changes, nil
+}
+
+// Copy of value of key by view, and whether key exists.
+func viewCopy(view func(key []byte, fn func(value []byte, object interface{}) error) error,
+	key []byte) ([]byte, bool, error) {
+	var value []byte
+	err := view(key, func(data []byte, object interface{}) error {
+		var err error
+		value, err = duplicateBytes(data)
+		return err
+	})
+
+	if errors.Is(err, ErrNotFound) {
+		return nil, false, nil
+
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
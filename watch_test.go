@@ -0,0 +1,337 @@
+package pinkis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flily/pinkis/meta"
+)
+
+func receiveEvent(t *testing.T, events <-chan ChangeEvent) ChangeEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("events closed")
+		}
+
+		return event
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event received")
+		return ChangeEvent{}
+	}
+}
+
+func describeEvent(event ChangeEvent) string {
+	if event.Err != nil {
+		return event.Err.Error()
+	}
+
+	return fmt.Sprintf("%d %s %s %s->%s", event.Sequence, event.Type, event.Key, event.OldValue, event.Value)
+}
+
+func expectEvents(t *testing.T, events <-chan ChangeEvent, expected ...string) {
+	for _, e := range expected {
+		if event := receiveEvent(t, events); describeEvent(event) != e {
+			t.Errorf("unexpected event: %s <=> %s", describeEvent(event), e)
+		}
+	}
+}
+
+func testWatch(t *testing.T, engine EngineType) {
+	options := Options{Engine: engine, SyncPolicy: SyncNever}
+	if engine != EngineMemory {
+		options.Dir = t.TempDir()
+	}
+
+	db, err := Open(options)
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	if err := db.Put([]byte("gryffindor/harry"), []byte("seeker")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := db.Watch(ctx, []byte("gryffindor/"))
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+
+	if err := db.Put([]byte("gryffindor/harry"), []byte("captain")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.Put([]byte("slytherin/draco"), []byte("seeker")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Put([]byte("gryffindor/ron"), []byte("keeper")); err != nil {
+			return err
+		}
+
+		if err := tx.Put([]byte("gryffindor/ginny"), []byte("chaser")); err != nil {
+			return err
+		}
+
+		if err := tx.Put([]byte("gryffindor/ron"), []byte("prefect")); err != nil {
+			return err
+		}
+
+		return tx.Delete([]byte("gryffindor/neville"))
+	})
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	if err := db.DeleteRange([]byte("gryffindor/"), []byte("gryffindor/r")); err != nil {
+		t.Fatalf("delete range failed: %v", err)
+	}
+
+	if err := db.Delete([]byte("gryffindor/ron")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	expectEvents(t, events,
+		"2 put gryffindor/harry seeker->captain",
+		"5 put gryffindor/ginny ->chaser",
+		"6 put gryffindor/ron ->prefect",
+		"8 delete gryffindor/ginny chaser->",
+		"8 delete gryffindor/harry captain->",
+		"9 delete gryffindor/ron prefect->",
+	)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatch(t *testing.T) {
+	for _, engine := range []EngineType{EngineMemory, EngineLSM, EngineBTree} {
+		t.Run(engine.String(), func(t *testing.T) {
+			testWatch(t, engine)
+		})
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	db, err := Open(Options{WatchHistory: 4})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	for i, name := range []string{"hannah", "ernie", "justin", "susan", "zacharias", "cedric"} {
+		if err := db.Put([]byte(name), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = db.WatchWithOptions(ctx, nil, &WatchOptions{From: 2})
+	if !errors.Is(err, ErrHistoryTruncated) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	events, err := db.WatchWithOptions(ctx, nil, &WatchOptions{From: 4})
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+
+	if err := db.Delete([]byte("cedric")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	expectEvents(t, events,
+		"4 put susan ->3",
+		"5 put zacharias ->4",
+		"6 put cedric ->5",
+		"7 delete cedric 5->",
+	)
+
+	future, err := db.WatchWithOptions(ctx, nil, &WatchOptions{From: 9})
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+
+	for _, name := range []string{"hannah", "ernie"} {
+		if err := db.Delete([]byte(name)); err != nil {
+			t.Fatalf("delete failed: %v", err)
+		}
+	}
+
+	expectEvents(t, future, "9 delete ernie 1->")
+}
+
+func TestWatchResumeUnwatched(t *testing.T) {
+	db, err := Open(Options{})
+	if err != nil {
+		t.Fatalf("open database failed: %v", err)
+	}
+
+	defer db.Close()
+
+	for i, name := range []string{"luna", "padma", "cho", "terry", "michael"} {
+		if err := db.Put([]byte(name), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, from := range []uint64{1, 3, 5} {
+		_, err := db.WatchWithOptions(ctx, nil, &WatchOptions{From: from})
+		if !errors.Is(err, ErrHistoryTruncated) {
+			t.Errorf("unexpected error from %d: %v", from, err)
+		}
+	}
+
+	events, err := db.WatchWithOptions(ctx, nil, &WatchOptions{From: 6})
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+
+	if err := db.Delete([]byte("cho")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	expectEvents(t, events, "6 delete cho 2->")
+}
+
+func TestWatchBackPressure(t *testing.T) {
+	db := openTestDB(t)
+
+	ctx := context.Background()
+	events, err := db.WatchWithOptions(ctx, []byte("weasley/"), &WatchOptions{Buffer: 2})
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+
+	closed, err := db.Watch(ctx, nil)
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+
+	names := []string{"bill", "charlie", "percy", "fred", "george", "ron", "ginny"}
+	for _, name := range names {
+		if err := db.Put([]byte("weasley/"+name), []byte("red")); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	received := 0
+	for event := range events {
+		if event.Err != nil {
+			if !errors.Is(event.Err, ErrWatchLagged) {
+				t.Errorf("unexpected error: %v", event.Err)
+			}
+
+			break
+		}
+
+		if expected := "weasley/" + names[received]; string(event.Key) != expected {
+			t.Errorf("unexpected key: %s <=> %s", event.Key, expected)
+		}
+
+		received++
+	}
+
+	if received <= 0 || received >= len(names) {
+		t.Errorf("unexpected events received: %d", received)
+	}
+
+	if _, ok := <-events; ok {
+		t.Errorf("events not closed")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	var last ChangeEvent
+	count := 0
+	for event := range closed {
+		last = event
+		count++
+	}
+
+	if count != len(names)+1 || !errors.Is(last.Err, ErrClosed) {
+		t.Errorf("unexpected events: %d, %v", count, last.Err)
+	}
+
+	if _, err := db.Watch(ctx, nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCollectionWatch(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	wizards, err := db.Collection("wizards", testWizard{})
+	if err != nil {
+		t.Fatalf("open collection failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := wizards.Watch(ctx, nil)
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+
+	raw, err := db.Watch(ctx, nil)
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+
+	harry := testWizard{Name: "Harry Potter", House: "Gryffindor", Born: 1980}
+	if err := wizards.Put([]byte("harry"), harry); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	harry.Born = 1981
+	harry.Courses = []string{"Defence Against the Dark Arts"}
+	if err := wizards.Put([]byte("harry"), harry); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := db.Put([]byte("harry"), []byte("potter")); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	if err := wizards.Delete([]byte("harry")); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	expected := [][]string{nil, {"Born", "Courses"}, nil}
+	types := []ChangeType{ChangePut, ChangePut, ChangeDelete}
+	for i := range expected {
+		event := receiveEvent(t, events)
+		if string(event.Key) != "harry" || event.Type != types[i] || !meta.Equal(event.Fields, expected[i]) {
+			t.Errorf("unexpected event %d: %s %v", i, describeEvent(event), event.Fields)
+		}
+	}
+
+	if event := receiveEvent(t, raw); describeEvent(event) != "3 put harry ->potter" {
+		t.Errorf("unexpected event: %s", describeEvent(event))
+	}
+
+	cancel()
+	for range events {
+	}
+}
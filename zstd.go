@@ -0,0 +1,1426 @@
+package pinkis
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// Zstandard frame format of RFC 8878. Frames are written in a single segment with content size,
+// without checksum, since blocks of tables are checksummed. Blocks are compressed with Huffman
+// coded literals and sequences of predefined FSE tables, falling back to raw or RLE blocks when
+// they are smaller. All blocks and literal and sequence modes of the format are decoded, except
+// dictionaries. Content checksums are skipped, not verified.
+const (
+	zstdMagic          = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50
+	zstdMaxBlockSize   = 128 << 10
+	// Candidates of each position tried by match finder.
+	zstdSearchDepth = 8
+
+	zstdBlockRaw        = 0
+	zstdBlockRLE        = 1
+	zstdBlockCompressed = 2
+
+	zstdLiteralsRaw        = 0
+	zstdLiteralsRLE        = 1
+	zstdLiteralsCompressed = 2
+	zstdLiteralsTreeless   = 3
+
+	zstdModePredefined = 0
+	zstdModeRLE        = 1
+	zstdModeFSE        = 2
+	zstdModeRepeat     = 3
+
+	huffmanMaxBits = 11
+)
+
+// Baselines and numbers of extra bits of literal length and match length codes.
+var (
+	zstdLiteralsLengthBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+
+	zstdLiteralsLengthBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+
+	zstdMatchLengthBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+
+	zstdMatchLengthBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// Predefined distributions of literal length, offset and match length codes.
+var (
+	zstdLiteralsLengthNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+
+	zstdOffsetNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+
+	zstdMatchLengthNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+)
+
+// Sequence tables are indexed in order of literal length, offset and match length.
+const (
+	zstdLiteralsLength = iota
+	zstdOffset
+	zstdMatchLength
+)
+
+var (
+	zstdMaxLog    = [3]uint{9, 8, 9}
+	zstdMaxSymbol = [3]int{35, 31, 52}
+
+	zstdPredefinedTables = [3]*fseTable{
+		mustFSETable(zstdLiteralsLengthNorm, 6),
+		mustFSETable(zstdOffsetNorm, 5),
+		mustFSETable(zstdMatchLengthNorm, 6),
+	}
+
+	zstdPredefinedEncoders = [3]*fseEncoder{
+		newFSEEncoder(zstdLiteralsLengthNorm, 6),
+		newFSEEncoder(zstdOffsetNorm, 5),
+		newFSEEncoder(zstdMatchLengthNorm, 6),
+	}
+)
+
+// Writer of bitstreams, bits are appended from the lowest bit of each byte.
+type bitWriter struct {
+	out   []byte
+	bits  uint64
+	count uint
+}
+
+// Append the lowest n bits of value, n is at most 32.
+func (w *bitWriter) add(value uint64, n uint) {
+	w.bits |= (value & (1<<n - 1)) << w.count
+	w.count += n
+	for w.count >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.count -= 8
+	}
+}
+
+// Close a backward bitstream, with a bit 1 marking its end.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.count > 0 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits = 0
+		w.count = 0
+	}
+
+	return w.out
+}
+
+// Bits [start, start+n) of data as an integer, lower bits first. Bits out of data are zero, n is
+// at most 56.
+func loadBits(data []byte, start int, n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+
+	shift := uint(0)
+	if start < 0 {
+		if uint(-start) >= n {
+			return 0
+		}
+
+		shift = uint(-start)
+		n -= shift
+		start = 0
+	}
+
+	var value uint64
+	for i := (start + int(n) - 1) / 8; i >= start/8; i-- {
+		value <<= 8
+		if i < len(data) {
+			value |= uint64(data[i])
+		}
+	}
+
+	value = (value >> uint(start%8)) & (1<<n - 1)
+	return value << shift
+}
+
+// Reader of backward bitstreams, from the highest bit below the end mark down to the first bit.
+// Bits read beyond the first bit are zero, and make pos negative.
+type reverseBitReader struct {
+	data []byte
+	pos  int
+}
+
+func newReverseBitReader(data []byte) (*reverseBitReader, error) {
+	if len(data) <= 0 || data[len(data)-1] == 0 {
+		return nil, WrapError(ErrCorrupted, "zstd bitstream without end mark")
+	}
+
+	pos := (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1
+	return &reverseBitReader{data: data, pos: pos}, nil
+}
+
+func (r *reverseBitReader) read(n uint) uint64 {
+	r.pos -= int(n)
+	return loadBits(r.data, r.pos, n)
+}
+
+func (r *reverseBitReader) peek(n uint) uint64 {
+	return loadBits(r.data, r.pos-int(n), n)
+}
+
+// Decoding table of finite state entropy, a state decodes a symbol, and transits to next state
+// of base plus some bits read.
+type fseTable struct {
+	log     uint
+	entries []fseEntry
+}
+
+type fseEntry struct {
+	symbol uint8
+	bits   uint8
+	base   uint16
+}
+
+// Spread symbols of normalized distribution over a table of 2^log states. Symbols of probability
+// -1 take one state each at the end of table.
+func spreadFSE(norm []int16, log uint) ([]uint8, bool) {
+	size := 1 << log
+	table := make([]uint8, size)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			table[high] = uint8(s)
+			high--
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	position := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			table[position] = uint8(s)
+			position = (position + step) & (size - 1)
+			for position > high {
+				position = (position + step) & (size - 1)
+			}
+		}
+	}
+
+	return table, position == 0
+}
+
+func newFSETable(norm []int16, log uint) (*fseTable, error) {
+	symbols, ok := spreadFSE(norm, log)
+	if !ok {
+		return nil, WrapError(ErrCorrupted, "invalid FSE distribution")
+	}
+
+	next := make([]uint16, len(norm))
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+
+		} else {
+			next[s] = uint16(n)
+		}
+	}
+
+	size := 1 << log
+	t := &fseTable{log: log, entries: make([]fseEntry, size)}
+	for i, s := range symbols {
+		state := next[s]
+		next[s]++
+		n := log - uint(bits.Len16(state)-1)
+		t.entries[i] = fseEntry{
+			symbol: s,
+			bits:   uint8(n),
+			base:   uint16(int(state)<<n - size),
+		}
+	}
+
+	return t, nil
+}
+
+func mustFSETable(norm []int16, log uint) *fseTable {
+	t, err := newFSETable(norm, log)
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+// Table of RLE mode, a single symbol without bits.
+func rleFSETable(symbol byte) *fseTable {
+	return &fseTable{entries: []fseEntry{{symbol: symbol}}}
+}
+
+// Read description of a FSE table of at most maxSymbol+1 symbols, return table and bytes read.
+func readFSETable(data []byte, maxLog uint, maxSymbol int) (*fseTable, int, error) {
+	if len(data) <= 0 {
+		return nil, 0, WrapError(ErrCorrupted, "empty FSE table description")
+	}
+
+	log := 5 + uint(loadBits(data, 0, 4))
+	if log > maxLog {
+		return nil, 0, WrapError(ErrCorrupted, "FSE accuracy log %d exceeds %d", log, maxLog)
+	}
+
+	pos := 4
+	remaining := 1 << log
+	var norm []int16
+	for remaining > 0 && len(norm) <= maxSymbol {
+		n := uint(bits.Len(uint(remaining + 1)))
+		value := int(loadBits(data, pos, n))
+		lowerMask := 1<<(n-1) - 1
+		threshold := 1<<n - 1 - (remaining + 1)
+		if value&lowerMask < threshold {
+			value &= lowerMask
+			pos += int(n) - 1
+
+		} else {
+			if value > lowerMask {
+				value -= threshold
+			}
+
+			pos += int(n)
+		}
+
+		probability := value - 1
+		if probability < 0 {
+			remaining += probability
+
+		} else {
+			remaining -= probability
+		}
+
+		norm = append(norm, int16(probability))
+		for repeat := 3; probability == 0 && repeat == 3; {
+			repeat = int(loadBits(data, pos, 2))
+			pos += 2
+			for i := 0; i < repeat && len(norm) <= maxSymbol; i++ {
+				norm = append(norm, 0)
+			}
+		}
+	}
+
+	if remaining != 0 || pos > len(data)*8 {
+		return nil, 0, WrapError(ErrCorrupted, "invalid FSE table description")
+	}
+
+	t, err := newFSETable(norm, log)
+	return t, (pos + 7) / 8, err
+}
+
+// Encoding table of finite state entropy, the reverse of fseTable of the same distribution.
+type fseEncoder struct {
+	log     uint
+	states  []uint16
+	symbols []fseTransform
+}
+
+type fseTransform struct {
+	deltaBits  uint32
+	deltaState int32
+}
+
+func newFSEEncoder(norm []int16, log uint) *fseEncoder {
+	symbols, _ := spreadFSE(norm, log)
+	size := 1 << log
+	cumulative := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			cumulative[s+1] = cumulative[s] + 1
+
+		} else {
+			cumulative[s+1] = cumulative[s] + int(n)
+		}
+	}
+
+	e := &fseEncoder{
+		log:     log,
+		states:  make([]uint16, size),
+		symbols: make([]fseTransform, len(norm)),
+	}
+
+	for i, s := range symbols {
+		e.states[cumulative[s]] = uint16(size + i)
+		cumulative[s]++
+	}
+
+	total := 0
+	for s, n := range norm {
+		switch {
+		case n == 0:
+			e.symbols[s].deltaBits = uint32((log+1)<<16 - uint(size))
+
+		case n == -1 || n == 1:
+			e.symbols[s].deltaBits = uint32(log<<16 - uint(size))
+			e.symbols[s].deltaState = int32(total - 1)
+			total++
+
+		default:
+			maxBits := log - uint(bits.Len16(uint16(n-1))-1)
+			minState := uint(n) << maxBits
+			e.symbols[s].deltaBits = uint32(maxBits<<16 - minState)
+			e.symbols[s].deltaState = int32(total - int(n))
+			total += int(n)
+		}
+	}
+
+	return e
+}
+
+// State of encoding, symbols are encoded in reverse order of decoding.
+type fseState struct {
+	encoder *fseEncoder
+	value   uint32
+}
+
+// Start with the last symbol to decode, no bits are written.
+func (s *fseState) init(encoder *fseEncoder, symbol uint8) {
+	t := encoder.symbols[symbol]
+	n := (t.deltaBits + 1<<15) >> 16
+	value := n<<16 - t.deltaBits
+	s.encoder = encoder
+	s.value = uint32(encoder.states[int32(value>>n)+t.deltaState])
+}
+
+func (s *fseState) encode(w *bitWriter, symbol uint8) {
+	t := s.encoder.symbols[symbol]
+	n := (s.value + t.deltaBits) >> 16
+	w.add(uint64(s.value), uint(n))
+	s.value = uint32(s.encoder.states[int32(s.value>>n)+t.deltaState])
+}
+
+// Write state, the initial state of decoding.
+func (s *fseState) flush(w *bitWriter) {
+	w.add(uint64(s.value), s.encoder.log)
+}
+
+// Decoding table of Huffman codes, indexed by the next maxBits bits. An entry is symbol in lower 8
+// bits, and number of bits of its code in higher 8 bits.
+type huffmanTable struct {
+	maxBits uint
+	entries []uint16
+}
+
+// Build table from weights of all symbols but the last, whose weight is implied.
+func newHuffmanTable(weights []uint8) (*huffmanTable, error) {
+	sum := 0
+	for _, w := range weights {
+		if w > huffmanMaxBits {
+			return nil, WrapError(ErrCorrupted, "invalid Huffman weight %d", w)
+		}
+
+		if w > 0 {
+			sum += 1 << (w - 1)
+		}
+	}
+
+	if sum <= 0 || len(weights) > 255 {
+		return nil, WrapError(ErrCorrupted, "invalid Huffman weights")
+	}
+
+	maxBits := uint(bits.Len(uint(sum)))
+	left := 1<<maxBits - sum
+	if maxBits > huffmanMaxBits || left&(left-1) != 0 {
+		return nil, WrapError(ErrCorrupted, "invalid Huffman weights")
+	}
+
+	weights = append(weights[:len(weights):len(weights)], uint8(bits.Len(uint(left))))
+	var ranks [huffmanMaxBits + 2]int
+	for _, w := range weights {
+		if w > 0 {
+			ranks[maxBits+1-uint(w)]++
+		}
+	}
+
+	// Start of codes of each length, the longest codes first.
+	var starts [huffmanMaxBits + 2]int
+	for n := maxBits; n >= 1; n-- {
+		starts[n-1] = starts[n] + ranks[n]<<(maxBits-n)
+	}
+
+	t := &huffmanTable{maxBits: maxBits, entries: make([]uint16, 1<<maxBits)}
+	for s, w := range weights {
+		if w <= 0 {
+			continue
+		}
+
+		n := maxBits + 1 - uint(w)
+		entry := uint16(s) | uint16(n)<<8
+		for i := 0; i < 1<<(maxBits-n); i++ {
+			t.entries[starts[n]+i] = entry
+		}
+
+		starts[n] += 1 << (maxBits - n)
+	}
+
+	return t, nil
+}
+
+// Read description of a Huffman table, return table and bytes read.
+func readHuffmanTable(data []byte) (*huffmanTable, int, error) {
+	if len(data) <= 0 {
+		return nil, 0, WrapError(ErrCorrupted, "empty Huffman table description")
+	}
+
+	header := int(data[0])
+	var weights []uint8
+	if header >= 128 {
+		count := header - 127
+		size := (count + 1) / 2
+		if 1+size > len(data) {
+			return nil, 0, WrapError(ErrCorrupted, "truncated Huffman weights")
+		}
+
+		for i := 0; i < count; i++ {
+			b := data[1+i/2]
+			if i%2 == 0 {
+				weights = append(weights, b>>4)
+
+			} else {
+				weights = append(weights, b&0x0f)
+			}
+		}
+
+		t, err := newHuffmanTable(weights)
+		return t, 1 + size, err
+	}
+
+	if 1+header > len(data) {
+		return nil, 0, WrapError(ErrCorrupted, "truncated Huffman weights")
+	}
+
+	fse, n, err := readFSETable(data[1:1+header], 6, huffmanMaxBits+1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, err := newReverseBitReader(data[1+n : 1+header])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Two interleaved states, until bitstream is exhausted.
+	states := [2]uint64{r.read(fse.log), r.read(fse.log)}
+	for i := 0; ; i = 1 - i {
+		if len(weights) >= 255 {
+			return nil, 0, WrapError(ErrCorrupted, "too many Huffman weights")
+		}
+
+		e := fse.entries[states[i]]
+		weights = append(weights, e.symbol)
+		states[i] = uint64(e.base) + r.read(uint(e.bits))
+		if r.pos < 0 {
+			weights = append(weights, fse.entries[states[1-i]].symbol)
+			break
+		}
+	}
+
+	t, err := newHuffmanTable(weights)
+	return t, 1 + header, err
+}
+
+// Decode count symbols of a Huffman coded stream, which must be consumed exactly.
+func (t *huffmanTable) decode(dst []byte, stream []byte, count int) ([]byte, error) {
+	r, err := newReverseBitReader(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < count; i++ {
+		entry := t.entries[r.peek(t.maxBits)]
+		r.pos -= int(entry >> 8)
+		dst = append(dst, byte(entry))
+	}
+
+	if r.pos != 0 {
+		return nil, WrapError(ErrCorrupted, "Huffman stream not consumed exactly")
+	}
+
+	return dst, nil
+}
+
+// Huffman codes of literals, codes and lengths of symbols.
+type huffmanEncoder struct {
+	codes   [256]uint16
+	lengths [256]uint8
+	maxBits uint
+	last    int
+}
+
+// Lengths of codes of frequencies, no longer than limit. Symbols of zero frequency have no code.
+func huffmanLengths(freq []int, limit uint) []uint8 {
+	type node struct {
+		weight int
+		parent int
+	}
+
+	for {
+		var leaves []int
+		for s, f := range freq {
+			if f > 0 {
+				leaves = append(leaves, s)
+			}
+		}
+
+		sort.SliceStable(leaves, func(i, j int) bool { return freq[leaves[i]] < freq[leaves[j]] })
+		nodes := make([]node, len(leaves), 2*len(leaves)-1)
+		for i, s := range leaves {
+			nodes[i] = node{weight: freq[s], parent: -1}
+		}
+
+		// Two queues, leaves and internal nodes are both in ascending order of weight.
+		leaf, internal := 0, len(leaves)
+		pick := func() int {
+			if leaf < len(leaves) && (internal >= len(nodes) || nodes[leaf].weight <= nodes[internal].weight) {
+				leaf++
+				return leaf - 1
+			}
+
+			internal++
+			return internal - 1
+		}
+
+		for len(nodes) < cap(nodes) {
+			a, b := pick(), pick()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, parent: -1})
+			nodes[a].parent = len(nodes) - 1
+			nodes[b].parent = len(nodes) - 1
+		}
+
+		lengths := make([]uint8, len(freq))
+		longest := uint(0)
+		for i, s := range leaves {
+			n := uint(0)
+			for p := nodes[i].parent; p >= 0; p = nodes[p].parent {
+				n++
+			}
+
+			lengths[s] = uint8(n)
+			if n > longest {
+				longest = n
+			}
+		}
+
+		if longest <= limit {
+			return lengths
+		}
+
+		// Flatten distribution until codes are short enough.
+		for s, f := range freq {
+			if f > 0 {
+				freq[s] = (f + 1) / 2
+			}
+		}
+	}
+}
+
+// Make Huffman codes of literals. It fails if there are less than 2 distinct symbols, or weights
+// of symbols can not be described directly.
+func newHuffmanEncoder(literals []byte) (*huffmanEncoder, bool) {
+	freq := make([]int, 256)
+	for _, b := range literals {
+		freq[b]++
+	}
+
+	e := &huffmanEncoder{last: -1}
+	distinct := 0
+	for s, f := range freq {
+		if f > 0 {
+			e.last = s
+			distinct++
+		}
+	}
+
+	if distinct < 2 || e.last > 128 {
+		return nil, false
+	}
+
+	lengths := huffmanLengths(freq[:e.last+1], huffmanMaxBits)
+	for s, n := range lengths {
+		e.lengths[s] = n
+		if uint(n) > e.maxBits {
+			e.maxBits = uint(n)
+		}
+	}
+
+	// Canonical codes of decoding table, the longest codes first, then in order of symbols.
+	position := 0
+	for n := e.maxBits; n >= 1; n-- {
+		for s := 0; s <= e.last; s++ {
+			if uint(e.lengths[s]) == n {
+				e.codes[s] = uint16(position >> (e.maxBits - n))
+				position += 1 << (e.maxBits - n)
+			}
+		}
+	}
+
+	return e, true
+}
+
+// Append description of codes, weights of all symbols but the last, 4 bits each.
+func (e *huffmanEncoder) appendTable(dst []byte) []byte {
+	weight := func(s int) byte {
+		if s >= e.last || e.lengths[s] == 0 {
+			return 0
+		}
+
+		return byte(e.maxBits + 1 - uint(e.lengths[s]))
+	}
+
+	dst = append(dst, byte(127+e.last))
+	for s := 0; s < e.last; s += 2 {
+		dst = append(dst, weight(s)<<4|weight(s+1))
+	}
+
+	return dst
+}
+
+// Append a backward stream of literals, the first literal is decoded first.
+func (e *huffmanEncoder) appendStream(dst []byte, literals []byte) []byte {
+	w := bitWriter{out: dst}
+	for i := len(literals) - 1; i >= 0; i-- {
+		w.add(uint64(e.codes[literals[i]]), uint(e.lengths[literals[i]]))
+	}
+
+	return w.close()
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Type() byte {
+	return 2
+}
+
+func (zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (zstdCompressor) Compress(dst []byte, src []byte) []byte {
+	var buffer [8]byte
+	binary.LittleEndian.PutUint32(buffer[:], zstdMagic)
+	dst = append(dst, buffer[:4]...)
+	size := uint64(len(src))
+	switch {
+	case size < 256:
+		dst = append(dst, 0x20, byte(size))
+
+	case size < 1<<16+256:
+		binary.LittleEndian.PutUint16(buffer[:], uint16(size-256))
+		dst = append(dst, 1<<6|0x20)
+		dst = append(dst, buffer[:2]...)
+
+	case size < 1<<32:
+		binary.LittleEndian.PutUint32(buffer[:], uint32(size))
+		dst = append(dst, 2<<6|0x20)
+		dst = append(dst, buffer[:4]...)
+
+	default:
+		binary.LittleEndian.PutUint64(buffer[:], size)
+		dst = append(dst, 3<<6|0x20)
+		dst = append(dst, buffer[:]...)
+	}
+
+	for start := 0; ; start += zstdMaxBlockSize {
+		end := start + zstdMaxBlockSize
+		if end >= len(src) {
+			return appendZstdBlock(dst, src[start:], true)
+		}
+
+		dst = appendZstdBlock(dst, src[start:end], false)
+	}
+}
+
+func appendZstdBlockHeader(dst []byte, blockType int, size int, last bool) []byte {
+	header := uint32(size)<<3 | uint32(blockType)<<1
+	if last {
+		header |= 1
+	}
+
+	return append(dst, byte(header), byte(header>>8), byte(header>>16))
+}
+
+// Append the smallest of raw, RLE and compressed block of src.
+func appendZstdBlock(dst []byte, src []byte, last bool) []byte {
+	if len(src) > 1 && isRepeated(src) {
+		dst = appendZstdBlockHeader(dst, zstdBlockRLE, len(src), last)
+		return append(dst, src[0])
+	}
+
+	start := len(dst)
+	dst = appendZstdBlockHeader(dst, zstdBlockCompressed, 0, last)
+	sequences := lzParse(src, zstdMaxBlockSize, zstdSearchDepth, nil)
+	literals := make([]byte, 0, len(src))
+	position := 0
+	for _, s := range sequences {
+		literals = append(literals, src[position:position+s.literals]...)
+		position += s.literals + s.length
+	}
+
+	literals = append(literals, src[position:]...)
+	dst = appendZstdLiterals(dst, literals)
+	dst = appendZstdSequences(dst, sequences)
+	if size := len(dst) - start - 3; size < len(src) {
+		appendZstdBlockHeader(dst[start:start], zstdBlockCompressed, size, last)
+		return dst
+	}
+
+	dst = appendZstdBlockHeader(dst[:start], zstdBlockRaw, len(src), last)
+	return append(dst, src...)
+}
+
+func isRepeated(data []byte) bool {
+	for _, b := range data {
+		if b != data[0] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Append header of raw or RLE literals of size.
+func appendZstdLiteralsHeader(dst []byte, literalsType byte, size int) []byte {
+	switch {
+	case size < 32:
+		return append(dst, byte(size)<<3|literalsType)
+
+	case size < 1<<12:
+		return append(dst, byte(size&0x0f)<<4|1<<2|literalsType, byte(size>>4))
+
+	default:
+		return append(dst, byte(size&0x0f)<<4|3<<2|literalsType, byte(size>>4), byte(size>>12))
+	}
+}
+
+func appendZstdLiterals(dst []byte, literals []byte) []byte {
+	if len(literals) > 1 && isRepeated(literals) {
+		dst = appendZstdLiteralsHeader(dst, zstdLiteralsRLE, len(literals))
+		return append(dst, literals[0])
+	}
+
+	if compressed, ok := compressZstdLiterals(literals); ok && len(compressed) < len(literals) {
+		return append(dst, compressed...)
+	}
+
+	dst = appendZstdLiteralsHeader(dst, zstdLiteralsRaw, len(literals))
+	return append(dst, literals...)
+}
+
+// Huffman coded literals with header, in a single stream if there are few literals.
+func compressZstdLiterals(literals []byte) ([]byte, bool) {
+	e, ok := newHuffmanEncoder(literals)
+	if !ok {
+		return nil, false
+	}
+
+	payload := e.appendTable(nil)
+	streams := 1
+	if len(literals) < 256 {
+		payload = e.appendStream(payload, literals)
+
+	} else {
+		streams = 4
+		segment := (len(literals) + 3) / 4
+		jump := len(payload)
+		payload = append(payload, make([]byte, 6)...)
+		for i := 0; i < 4; i++ {
+			start := len(payload)
+			end := (i + 1) * segment
+			if end > len(literals) {
+				end = len(literals)
+			}
+
+			payload = e.appendStream(payload, literals[i*segment:end])
+			if i < 3 {
+				binary.LittleEndian.PutUint16(payload[jump+2*i:], uint16(len(payload)-start))
+			}
+		}
+	}
+
+	regenerated, compressed := uint64(len(literals)), uint64(len(payload))
+	var header []byte
+	switch {
+	case streams == 1 && compressed < 1<<10:
+		v := zstdLiteralsCompressed | regenerated<<4 | compressed<<14
+		header = []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+
+	case streams == 1:
+		return nil, false
+
+	case regenerated < 1<<10 && compressed < 1<<10:
+		v := zstdLiteralsCompressed | 1<<2 | regenerated<<4 | compressed<<14
+		header = []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+
+	case regenerated < 1<<14 && compressed < 1<<14:
+		v := zstdLiteralsCompressed | 2<<2 | regenerated<<4 | compressed<<18
+		header = []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+
+	default:
+		v := zstdLiteralsCompressed | 3<<2 | regenerated<<4 | compressed<<22
+		header = []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24), byte(v >> 32)}
+	}
+
+	return append(header, payload...), true
+}
+
+func zstdLiteralsLengthCode(n uint32) uint8 {
+	if n < 16 {
+		return uint8(n)
+	}
+
+	c := len(zstdLiteralsLengthBase) - 1
+	for zstdLiteralsLengthBase[c] > n {
+		c--
+	}
+
+	return uint8(c)
+}
+
+func zstdMatchLengthCode(n uint32) uint8 {
+	if n < 35 {
+		return uint8(n - 3)
+	}
+
+	c := len(zstdMatchLengthBase) - 1
+	for zstdMatchLengthBase[c] > n {
+		c--
+	}
+
+	return uint8(c)
+}
+
+// Append sequences coded by predefined tables. Offsets are never coded as repeated offsets.
+func appendZstdSequences(dst []byte, sequences []lzSequence) []byte {
+	n := len(sequences)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+
+	case n < 0x7f00:
+		dst = append(dst, byte(n>>8)+128, byte(n))
+
+	default:
+		dst = append(dst, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+
+	if n <= 0 {
+		return dst
+	}
+
+	dst = append(dst, zstdModePredefined<<6|zstdModePredefined<<4|zstdModePredefined<<2)
+	type coded struct {
+		codes [3]uint8
+		extra [3]uint32
+	}
+
+	codes := make([]coded, n)
+	for i, s := range sequences {
+		c := &codes[i]
+		c.codes[zstdLiteralsLength] = zstdLiteralsLengthCode(uint32(s.literals))
+		c.extra[zstdLiteralsLength] = uint32(s.literals) - zstdLiteralsLengthBase[c.codes[zstdLiteralsLength]]
+		c.codes[zstdMatchLength] = zstdMatchLengthCode(uint32(s.length))
+		c.extra[zstdMatchLength] = uint32(s.length) - zstdMatchLengthBase[c.codes[zstdMatchLength]]
+		offset := uint32(s.offset + 3)
+		c.codes[zstdOffset] = uint8(bits.Len32(offset) - 1)
+		c.extra[zstdOffset] = offset - 1<<c.codes[zstdOffset]
+	}
+
+	w := bitWriter{out: dst}
+	addExtra := func(c *coded) {
+		w.add(uint64(c.extra[zstdLiteralsLength]), uint(zstdLiteralsLengthBits[c.codes[zstdLiteralsLength]]))
+		w.add(uint64(c.extra[zstdMatchLength]), uint(zstdMatchLengthBits[c.codes[zstdMatchLength]]))
+		w.add(uint64(c.extra[zstdOffset]), uint(c.codes[zstdOffset]))
+	}
+
+	var states [3]fseState
+	for k := range states {
+		states[k].init(zstdPredefinedEncoders[k], codes[n-1].codes[k])
+	}
+
+	addExtra(&codes[n-1])
+	for i := n - 2; i >= 0; i-- {
+		states[zstdOffset].encode(&w, codes[i].codes[zstdOffset])
+		states[zstdMatchLength].encode(&w, codes[i].codes[zstdMatchLength])
+		states[zstdLiteralsLength].encode(&w, codes[i].codes[zstdLiteralsLength])
+		addExtra(&codes[i])
+	}
+
+	states[zstdMatchLength].flush(&w)
+	states[zstdOffset].flush(&w)
+	states[zstdLiteralsLength].flush(&w)
+	return w.close()
+}
+
+// State of decoding a frame, tables and offsets may be repeated by later blocks.
+type zstdDecoder struct {
+	huffman *huffmanTable
+	tables  [3]*fseTable
+	offsets [3]int
+	// Start of output of frame, matches never reach before it.
+	base int
+}
+
+func (zstdCompressor) Decompress(dst []byte, src []byte) ([]byte, error) {
+	for len(src) > 0 {
+		if len(src) < 8 {
+			return nil, WrapError(ErrCorrupted, "truncated zstd frame")
+		}
+
+		magic := binary.LittleEndian.Uint32(src)
+		if magic&0xfffffff0 == zstdSkippableMagic {
+			size := uint64(binary.LittleEndian.Uint32(src[4:]))
+			if size > uint64(len(src)-8) {
+				return nil, WrapError(ErrCorrupted, "truncated zstd skippable frame")
+			}
+
+			src = src[8+size:]
+			continue
+		}
+
+		if magic != zstdMagic {
+			return nil, WrapError(ErrCorrupted, "bad zstd magic number 0x%08x", magic)
+		}
+
+		d := &zstdDecoder{base: len(dst), offsets: [3]int{1, 4, 8}}
+		var n int
+		var err error
+		if dst, n, err = d.decodeFrame(dst, src[4:]); err != nil {
+			return nil, err
+		}
+
+		src = src[4+n:]
+	}
+
+	return dst, nil
+}
+
+// Decode a frame after magic number, return output and bytes read.
+func (d *zstdDecoder) decodeFrame(dst []byte, data []byte) ([]byte, int, error) {
+	descriptor := data[0]
+	if descriptor&0x08 != 0 {
+		return nil, 0, WrapError(ErrCorrupted, "reserved bit of zstd frame header is set")
+	}
+
+	single := descriptor&0x20 != 0
+	pos := 1
+	if !single {
+		pos++
+	}
+
+	dictionarySize := [4]int{0, 1, 2, 4}[descriptor&0x03]
+	sizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if sizeSize == 0 && single {
+		sizeSize = 1
+	}
+
+	if pos+dictionarySize+sizeSize > len(data) {
+		return nil, 0, WrapError(ErrCorrupted, "truncated zstd frame header")
+	}
+
+	if loadBits(data[pos:], 0, uint(8*dictionarySize)) != 0 {
+		return nil, 0, WrapError(ErrCorrupted, "zstd dictionaries are not supported")
+	}
+
+	pos += dictionarySize
+	var contentSize uint64
+	switch sizeSize {
+	case 1:
+		contentSize = uint64(data[pos])
+
+	case 2:
+		contentSize = uint64(binary.LittleEndian.Uint16(data[pos:])) + 256
+
+	case 4:
+		contentSize = uint64(binary.LittleEndian.Uint32(data[pos:]))
+
+	case 8:
+		contentSize = binary.LittleEndian.Uint64(data[pos:])
+	}
+
+	pos += sizeSize
+	for last := false; !last; {
+		if pos+3 > len(data) {
+			return nil, 0, WrapError(ErrCorrupted, "truncated zstd block header")
+		}
+
+		header := int(data[pos]) | int(data[pos+1])<<8 | int(data[pos+2])<<16
+		pos += 3
+		last = header&1 != 0
+		size := header >> 3
+		switch header >> 1 & 0x03 {
+		case zstdBlockRaw:
+			if pos+size > len(data) {
+				return nil, 0, WrapError(ErrCorrupted, "truncated zstd raw block")
+			}
+
+			dst = append(dst, data[pos:pos+size]...)
+			pos += size
+
+		case zstdBlockRLE:
+			if pos+1 > len(data) || size > zstdMaxBlockSize {
+				return nil, 0, WrapError(ErrCorrupted, "invalid zstd RLE block")
+			}
+
+			for i := 0; i < size; i++ {
+				dst = append(dst, data[pos])
+			}
+
+			pos++
+
+		case zstdBlockCompressed:
+			if pos+size > len(data) || size > zstdMaxBlockSize {
+				return nil, 0, WrapError(ErrCorrupted, "invalid zstd compressed block")
+			}
+
+			var err error
+			if dst, err = d.decodeBlock(dst, data[pos:pos+size]); err != nil {
+				return nil, 0, err
+			}
+
+			pos += size
+
+		default:
+			return nil, 0, WrapError(ErrCorrupted, "reserved zstd block type")
+		}
+	}
+
+	if descriptor&0x04 != 0 {
+		pos += 4
+		if pos > len(data) {
+			return nil, 0, WrapError(ErrCorrupted, "truncated zstd checksum")
+		}
+	}
+
+	if sizeSize > 0 && uint64(len(dst)-d.base) != contentSize {
+		return nil, 0, WrapError(ErrCorrupted, "zstd frame decompressed %d bytes, but %d",
+			len(dst)-d.base, contentSize)
+	}
+
+	return dst, pos, nil
+}
+
+func (d *zstdDecoder) decodeBlock(dst []byte, data []byte) ([]byte, error) {
+	literals, n, err := d.decodeLiterals(data)
+	if err != nil {
+		return nil, err
+	}
+
+	start := len(dst)
+	if dst, err = d.decodeSequences(dst, data[n:], literals); err != nil {
+		return nil, err
+	}
+
+	if len(dst)-start > zstdMaxBlockSize {
+		return nil, WrapError(ErrCorrupted, "zstd block decompressed %d bytes", len(dst)-start)
+	}
+
+	return dst, nil
+}
+
+// Decode literals section, return literals and bytes read.
+func (d *zstdDecoder) decodeLiterals(data []byte) ([]byte, int, error) {
+	if len(data) <= 0 {
+		return nil, 0, WrapError(ErrCorrupted, "empty zstd literals section")
+	}
+
+	literalsType := data[0] & 0x03
+	format := data[0] >> 2 & 0x03
+	if literalsType == zstdLiteralsRaw || literalsType == zstdLiteralsRLE {
+		var size, n int
+		switch format {
+		case 1:
+			n = 2
+
+		case 3:
+			n = 3
+
+		default:
+			n = 1
+		}
+
+		if n > len(data) {
+			return nil, 0, WrapError(ErrCorrupted, "truncated zstd literals header")
+		}
+
+		if n == 1 {
+			size = int(data[0] >> 3)
+
+		} else {
+			size = int(loadBits(data, 4, uint(8*n-4)))
+		}
+
+		if literalsType == zstdLiteralsRLE {
+			if n+1 > len(data) || size > zstdMaxBlockSize {
+				return nil, 0, WrapError(ErrCorrupted, "invalid zstd RLE literals")
+			}
+
+			literals := make([]byte, size)
+			for i := range literals {
+				literals[i] = data[n]
+			}
+
+			return literals, n + 1, nil
+		}
+
+		if n+size > len(data) {
+			return nil, 0, WrapError(ErrCorrupted, "truncated zstd raw literals")
+		}
+
+		return data[n : n+size], n + size, nil
+	}
+
+	n, sizeBits, streams := 3, uint(10), 4
+	switch format {
+	case 0:
+		streams = 1
+
+	case 2:
+		n, sizeBits = 4, 14
+
+	case 3:
+		n, sizeBits = 5, 18
+	}
+
+	if n > len(data) {
+		return nil, 0, WrapError(ErrCorrupted, "truncated zstd literals header")
+	}
+
+	regenerated := int(loadBits(data, 4, sizeBits))
+	compressed := int(loadBits(data, 4+int(sizeBits), sizeBits))
+	if n+compressed > len(data) || regenerated > zstdMaxBlockSize {
+		return nil, 0, WrapError(ErrCorrupted, "invalid zstd compressed literals")
+	}
+
+	payload := data[n : n+compressed]
+	if literalsType == zstdLiteralsCompressed {
+		t, size, err := readHuffmanTable(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		d.huffman = t
+		payload = payload[size:]
+
+	} else if d.huffman == nil {
+		return nil, 0, WrapError(ErrCorrupted, "zstd treeless literals without previous table")
+	}
+
+	literals := make([]byte, 0, regenerated)
+	var err error
+	if streams == 1 {
+		literals, err = d.huffman.decode(literals, payload, regenerated)
+		return literals, n + compressed, err
+	}
+
+	if len(payload) < 6 {
+		return nil, 0, WrapError(ErrCorrupted, "truncated zstd jump table")
+	}
+
+	segment := (regenerated + 3) / 4
+	sizes := [4]int{
+		int(binary.LittleEndian.Uint16(payload)),
+		int(binary.LittleEndian.Uint16(payload[2:])),
+		int(binary.LittleEndian.Uint16(payload[4:])),
+	}
+
+	sizes[3] = len(payload) - 6 - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 0 || regenerated < 3*segment {
+		return nil, 0, WrapError(ErrCorrupted, "invalid zstd jump table")
+	}
+
+	payload = payload[6:]
+	for i, size := range sizes {
+		count := segment
+		if i == 3 {
+			count = regenerated - 3*segment
+		}
+
+		if literals, err = d.huffman.decode(literals, payload[:size], count); err != nil {
+			return nil, 0, err
+		}
+
+		payload = payload[size:]
+	}
+
+	return literals, n + compressed, nil
+}
+
+// Decode sequences section, and execute sequences with literals.
+func (d *zstdDecoder) decodeSequences(dst []byte, data []byte, literals []byte) ([]byte, error) {
+	if len(data) <= 0 {
+		return nil, WrapError(ErrCorrupted, "empty zstd sequences section")
+	}
+
+	count, pos := int(data[0]), 1
+	switch {
+	case count == 0:
+		return append(dst, literals...), nil
+
+	case count == 255:
+		if len(data) < 3 {
+			return nil, WrapError(ErrCorrupted, "truncated zstd sequences header")
+		}
+
+		count = int(data[1]) + int(data[2])<<8 + 0x7f00
+		pos = 3
+
+	case count >= 128:
+		if len(data) < 2 {
+			return nil, WrapError(ErrCorrupted, "truncated zstd sequences header")
+		}
+
+		count = (count-128)<<8 + int(data[1])
+		pos = 2
+	}
+
+	if pos >= len(data) || data[pos]&0x03 != 0 {
+		return nil, WrapError(ErrCorrupted, "invalid zstd compression modes")
+	}
+
+	modes := data[pos]
+	pos++
+	for k, shift := range [3]uint{6, 4, 2} {
+		switch modes >> shift & 0x03 {
+		case zstdModePredefined:
+			d.tables[k] = zstdPredefinedTables[k]
+
+		case zstdModeRLE:
+			if pos >= len(data) || int(data[pos]) > zstdMaxSymbol[k] {
+				return nil, WrapError(ErrCorrupted, "invalid zstd RLE sequence symbol")
+			}
+
+			d.tables[k] = rleFSETable(data[pos])
+			pos++
+
+		case zstdModeFSE:
+			t, n, err := readFSETable(data[pos:], zstdMaxLog[k], zstdMaxSymbol[k])
+			if err != nil {
+				return nil, err
+			}
+
+			d.tables[k] = t
+			pos += n
+
+		case zstdModeRepeat:
+			if d.tables[k] == nil {
+				return nil, WrapError(ErrCorrupted, "zstd repeat mode without previous table")
+			}
+		}
+	}
+
+	r, err := newReverseBitReader(data[pos:])
+	if err != nil {
+		return nil, err
+	}
+
+	var states [3]uint64
+	for _, k := range [3]int{zstdLiteralsLength, zstdOffset, zstdMatchLength} {
+		states[k] = r.read(d.tables[k].log)
+	}
+
+	used := 0
+	for i := 0; i < count; i++ {
+		var symbols [3]uint8
+		for k := range symbols {
+			symbols[k] = d.tables[k].entries[states[k]].symbol
+		}
+
+		if symbols[zstdOffset] > 31 {
+			return nil, WrapError(ErrCorrupted, "invalid zstd offset code %d", symbols[zstdOffset])
+		}
+
+		offsetValue := 1<<symbols[zstdOffset] + int(r.read(uint(symbols[zstdOffset])))
+		ml := symbols[zstdMatchLength]
+		matchLength := int(zstdMatchLengthBase[ml]) + int(r.read(uint(zstdMatchLengthBits[ml])))
+		ll := symbols[zstdLiteralsLength]
+		literalsLength := int(zstdLiteralsLengthBase[ll]) + int(r.read(uint(zstdLiteralsLengthBits[ll])))
+		offset := d.offset(offsetValue, literalsLength)
+
+		if i < count-1 {
+			for _, k := range [3]int{zstdLiteralsLength, zstdMatchLength, zstdOffset} {
+				e := d.tables[k].entries[states[k]]
+				states[k] = uint64(e.base) + r.read(uint(e.bits))
+			}
+		}
+
+		if literalsLength > len(literals)-used {
+			return nil, WrapError(ErrCorrupted, "zstd sequence overflows literals")
+		}
+
+		dst = append(dst, literals[used:used+literalsLength]...)
+		used += literalsLength
+		if offset <= 0 || offset > len(dst)-d.base || matchLength > zstdMaxBlockSize {
+			return nil, WrapError(ErrCorrupted, "invalid zstd match of %d bytes at %d", matchLength, offset)
+		}
+
+		// Matches may overlap bytes they produce, byte by byte is required.
+		for j := 0; j < matchLength; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if r.pos != 0 {
+		return nil, WrapError(ErrCorrupted, "zstd sequences not consumed exactly")
+	}
+
+	return append(dst, literals[used:]...), nil
+}
+
+// Resolve offset value of a sequence, values up to 3 repeat recent offsets.
+func (d *zstdDecoder) offset(value int, literalsLength int) int {
+	if value > 3 {
+		d.offsets[2], d.offsets[1], d.offsets[0] = d.offsets[1], d.offsets[0], value-3
+		return d.offsets[0]
+	}
+
+	index := value - 1
+	if literalsLength == 0 {
+		index++
+	}
+
+	switch index {
+	case 0:
+		return d.offsets[0]
+
+	case 1:
+		d.offsets[1], d.offsets[0] = d.offsets[0], d.offsets[1]
+
+	case 2:
+		d.offsets[2], d.offsets[1], d.offsets[0] = d.offsets[1], d.offsets[0], d.offsets[2]
+
+	default:
+		d.offsets[2], d.offsets[1], d.offsets[0] = d.offsets[1], d.offsets[0], d.offsets[0]-1
+	}
+
+	return d.offsets[0]
+}
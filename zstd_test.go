@@ -0,0 +1,127 @@
+package pinkis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Samples of data to compress, from empty to larger than a zstd block.
+func testCompressionSamples() map[string][]byte {
+	random := make([]byte, 20000)
+	rand.New(rand.NewSource(7)).Read(random)
+
+	var text, records bytes.Buffer
+	for i := 0; text.Len() < 300000; i++ {
+		fmt.Fprintf(&text, "Mr. and Mrs. Dursley, of number four, Privet Drive, were proud to say "+
+			"that they were perfectly normal, thank you very much. %d\n", i)
+	}
+
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&records, "wizard-%05d\x00{\"house\":\"%s\",\"born\":%d}", i,
+			[]string{"Gryffindor", "Hufflepuff", "Ravenclaw", "Slytherin"}[i%4], 1900+i%100)
+	}
+
+	return map[string][]byte{
+		"empty":   {},
+		"byte":    {'h'},
+		"short":   []byte("harry"),
+		"repeat":  bytes.Repeat([]byte{'x'}, 200000),
+		"pattern": bytes.Repeat([]byte("abc"), 1000),
+		"random":  random,
+		"binary":  append(append([]byte{}, random[:3000]...), random[:3000]...),
+		"text":    text.Bytes(),
+		"records": records.Bytes(),
+	}
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	for name, data := range testCompressionSamples() {
+		compressed := ZstdCompression.Compress([]byte("prefix"), data)
+		if string(compressed[:6]) != "prefix" {
+			t.Errorf("%s: compressed data should be appended", name)
+		}
+
+		decompressed, err := ZstdCompression.Decompress([]byte("prefix"), compressed[6:])
+		if err != nil {
+			t.Fatalf("%s: decompress failed: %v", name, err)
+		}
+
+		if !bytes.Equal(decompressed[6:], data) || string(decompressed[:6]) != "prefix" {
+			t.Errorf("%s: decompressed data mismatch", name)
+		}
+
+		if name == "text" && len(compressed) > len(data)/10 {
+			t.Errorf("%s: poor compression: %d => %d", name, len(data), len(compressed))
+		}
+	}
+}
+
+func TestZstdCorrupted(t *testing.T) {
+	data := testCompressionSamples()["text"][:10000]
+	compressed := ZstdCompression.Compress(nil, data)
+	for i := 4; i < len(compressed); i += 7 {
+		broken := append([]byte{}, compressed...)
+		broken[i] ^= 0x5a
+		result, err := ZstdCompression.Decompress(nil, broken)
+		if err == nil && bytes.Equal(result, data) {
+			t.Errorf("flipped byte %d should not decompress to the same data", i)
+
+		} else if err != nil && !errors.Is(err, ErrCorrupted) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	for _, n := range []int{0, 3, 8, len(compressed) / 2, len(compressed) - 1} {
+		if _, err := ZstdCompression.Decompress(nil, compressed[:n]); n > 0 && !errors.Is(err, ErrCorrupted) {
+			t.Errorf("truncated at %d: unexpected error: %v", n, err)
+		}
+	}
+}
+
+// Data compressed by one side must be decompressed by the other, if zstd command is available.
+func TestZstdInterop(t *testing.T) {
+	command, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd command not found")
+	}
+
+	dir := t.TempDir()
+	for name, data := range testCompressionSamples() {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path+".zst", ZstdCompression.Compress(nil, data), 0644); err != nil {
+			t.Fatalf("write file failed: %v", err)
+		}
+
+		output, err := exec.Command(command, "-q", "-d", "-c", path+".zst").Output()
+		if err != nil || !bytes.Equal(output, data) {
+			t.Errorf("%s: zstd decompress failed: %v", name, err)
+		}
+
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("write file failed: %v", err)
+		}
+
+		for _, level := range []string{"-1", "-3", "-19", "--ultra", "--fast=3"} {
+			args := []string{"-q", "-c", level, path}
+			if level == "--ultra" {
+				args = []string{"-q", "-c", "--ultra", "-22", "--no-check", path}
+			}
+
+			compressed, err := exec.Command(command, args...).Output()
+			if err != nil {
+				t.Fatalf("zstd compress failed: %v", err)
+			}
+
+			decompressed, err := ZstdCompression.Decompress(nil, compressed)
+			if err != nil || !bytes.Equal(decompressed, data) {
+				t.Errorf("%s of zstd %s: decompress failed: %v", name, level, err)
+			}
+		}
+	}
+}